@@ -0,0 +1,241 @@
+package gallery
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// SmartAlbumsFile holds the smart albums created through the API, inside the cache directory.
+const SmartAlbumsFile = "smart_albums.json"
+
+// Sources of a smart album.
+const (
+	AlbumSourceConfig = "config"
+	AlbumSourceAPI    = "api"
+)
+
+var errConfigAlbum = errors.New("album is defined in the config file")
+
+// albumStore keeps the smart albums of a library: those of the config file, which a reload
+// replaces, and those saved through the API. A config album hides a saved one of the same name.
+type albumStore struct {
+	mu      sync.Mutex
+	cacheFs storage.Storage
+	config  []core.SmartAlbum
+	saved   []core.SmartAlbum
+}
+
+func newAlbumStore(cacheFs storage.Storage) *albumStore {
+	store := &albumStore{cacheFs: cacheFs}
+	if err := readJSONFile(cacheFs, SmartAlbumsFile, &store.saved); err != nil {
+		log.Printf("Failed to read %s: %v", SmartAlbumsFile, err)
+	}
+	return store
+}
+
+func (s *albumStore) setConfig(albums []core.SmartAlbum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = albums
+}
+
+// list returns every album with its source, config albums first.
+func (s *albumStore) list() ([]core.SmartAlbum, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	albums := make([]core.SmartAlbum, 0, len(s.config)+len(s.saved))
+	sources := make([]string, 0, cap(albums))
+	for _, album := range s.config {
+		albums = append(albums, album)
+		sources = append(sources, AlbumSourceConfig)
+	}
+	for _, album := range s.saved {
+		if s.configIndex(album.Name) < 0 {
+			albums = append(albums, album)
+			sources = append(sources, AlbumSourceAPI)
+		}
+	}
+	return albums, sources
+}
+
+func (s *albumStore) configIndex(name string) int {
+	for i, album := range s.config {
+		if album.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *albumStore) savedIndex(name string) int {
+	for i, album := range s.saved {
+		if album.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// put creates or replaces a saved album.
+func (s *albumStore) put(album core.SmartAlbum) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configIndex(album.Name) >= 0 {
+		return errConfigAlbum
+	}
+	saved := append([]core.SmartAlbum(nil), s.saved...)
+	if i := s.savedIndex(album.Name); i >= 0 {
+		saved[i] = album
+	} else {
+		saved = append(saved, album)
+	}
+	return s.persist(saved)
+}
+
+// remove deletes a saved album and reports whether there was one.
+func (s *albumStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configIndex(name) >= 0 {
+		return false, errConfigAlbum
+	}
+	i := s.savedIndex(name)
+	if i < 0 {
+		return false, nil
+	}
+	saved := append(append([]core.SmartAlbum(nil), s.saved[:i]...), s.saved[i+1:]...)
+	return true, s.persist(saved)
+}
+
+func (s *albumStore) persist(saved []core.SmartAlbum) error {
+	if err := writeJSONFile(s.cacheFs, SmartAlbumsFile, saved); err != nil {
+		return err
+	}
+	s.saved = saved
+	return nil
+}
+
+// setConfigAlbums replaces the albums of the config file and re-evaluates all of them.
+func (g *Gallery) setConfigAlbums(albums []core.SmartAlbum) {
+	g.albums.setConfig(albums)
+	g.applySmartAlbums()
+}
+
+// applySmartAlbums hands the current albums to the scanner and has the scan worker rebuild
+// them, so they never change in the middle of a scan.
+func (g *Gallery) applySmartAlbums() {
+	albums, _ := g.albums.list()
+	g.scanner.SetSmartAlbums(albums)
+	select {
+	case g.albumsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// SmartAlbumInfo describes a smart album in the /api/smart-albums listing.
+type SmartAlbumInfo struct {
+	core.SmartAlbum
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+// SmartAlbumRequest is the body of PUT /api/smart-albums/{name}.
+type SmartAlbumRequest struct {
+	Query string `json:"query"`
+	Sort  string `json:"sort"`
+	Limit int    `json:"limit"`
+}
+
+// HandleSmartAlbums godoc
+// @Summary List smart albums
+// @Description Returns the smart albums of the config file and those saved through the API, with the number of matches of the last evaluation
+// @Tags albums
+// @Produce json
+// @Success 200 {array} SmartAlbumInfo
+// @Router /api/smart-albums [get]
+func (g *Gallery) HandleSmartAlbums(c *gin.Context) {
+	albums, sources := g.albums.list()
+	root := g.view(c)
+	result := make([]SmartAlbumInfo, 0, len(albums))
+	for i, album := range albums {
+		info := SmartAlbumInfo{SmartAlbum: album, Source: sources[i]}
+		if node := root.Lookup(album.Name); node != nil && node.IsVirtual() {
+			info.Count = node.MediaCount()
+		}
+		result = append(result, info)
+	}
+	c.JSON(200, result)
+}
+
+// HandlePutSmartAlbum godoc
+// @Summary Create or replace a smart album
+// @Description Saves a smart album in the cache directory and evaluates it; it is then browsable through /api/explore/{name} and /api/media/{name}
+// @Tags albums
+// @Accept json
+// @Produce json
+// @Param name path string true "Album name"
+// @Param album body SmartAlbumRequest true "Query, sort and limit"
+// @Success 200 {object} core.SmartAlbum
+// @Failure 400 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{} "Defined in the config file or named like a directory"
+// @Router /api/smart-albums/{name} [put]
+func (g *Gallery) HandlePutSmartAlbum(c *gin.Context) {
+	var req SmartAlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	album := core.SmartAlbum{Name: c.Param("name"), Query: req.Query, Sort: req.Sort, Limit: req.Limit}
+	if err := album.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if node := g.Root.Lookup(album.Name); node != nil && !node.IsVirtual() {
+		c.JSON(http.StatusConflict, gin.H{"error": "a directory of this name exists"})
+		return
+	}
+	if err := g.albums.put(album); err != nil {
+		g.albumError(c, err)
+		return
+	}
+	g.applySmartAlbums()
+	c.JSON(200, album)
+}
+
+// HandleDeleteSmartAlbum godoc
+// @Summary Delete a smart album
+// @Description Deletes a smart album saved through the API
+// @Tags albums
+// @Param name path string true "Album name"
+// @Success 204
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{} "Defined in the config file"
+// @Router /api/smart-albums/{name} [delete]
+func (g *Gallery) HandleDeleteSmartAlbum(c *gin.Context) {
+	found, err := g.albums.remove(c.Param("name"))
+	if err != nil {
+		g.albumError(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown album"})
+		return
+	}
+	g.applySmartAlbums()
+	c.Status(http.StatusNoContent)
+}
+
+func (g *Gallery) albumError(c *gin.Context, err error) {
+	if errors.Is(err, errConfigAlbum) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
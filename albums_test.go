@@ -0,0 +1,113 @@
+package gallery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func TestSmartAlbums_CRUD(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	cacheFs := storage.NewFs(t.TempDir())
+	l.gallery.albums = newAlbumStore(cacheFs)
+	l.gallery.setConfigAlbums([]core.SmartAlbum{{Name: "everything", Query: ""}})
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPut, "/api/smart-albums/jpgs", `{"query":"name:*.jpg kind:image","sort":"-date"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status %d %s", w.Code, w.Body)
+	}
+	for target, want := range map[string]int{
+		"/api/smart-albums/x":          http.StatusConflict,
+		"/api/smart-albums/everything": http.StatusConflict,
+		"/api/smart-albums/broken":     http.StatusBadRequest,
+	} {
+		body := `{"query":"kind:image"}`
+		if strings.HasSuffix(target, "broken") {
+			body = `{"query":"width>wide"}`
+		}
+		if w := do(http.MethodPut, target, body); w.Code != want {
+			t.Fatalf("PUT %s: expected %d, got %d", target, want, w.Code)
+		}
+	}
+	// No scan worker: apply what the worker would.
+	l.gallery.scanner.ApplyVirtualPaths(l.gallery.Root)
+
+	var explored struct {
+		Images []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/explore/jpgs", "").Body.Bytes(), &explored); err != nil {
+		t.Fatal(err)
+	}
+	if len(explored.Images) != 1 || explored.Images[0].Path != "x/a.jpg" || explored.Images[0].ModTime == 0 {
+		t.Fatalf("expected the album browsable like a directory, got %+v", explored.Images)
+	}
+	var listed []SmartAlbumInfo
+	if err := json.Unmarshal(do(http.MethodGet, "/api/smart-albums", "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Source != AlbumSourceConfig || listed[1].Name != "jpgs" || listed[1].Source != AlbumSourceAPI || listed[1].Count != 1 {
+		t.Fatalf("unexpected listing %+v", listed)
+	}
+	if albums, _ := newAlbumStore(cacheFs).list(); len(albums) != 1 || albums[0].Sort != "-date" {
+		t.Fatalf("expected the album persisted, got %+v", albums)
+	}
+
+	if w := do(http.MethodDelete, "/api/smart-albums/everything", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected config album kept, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/smart-albums/jpgs", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/smart-albums/jpgs", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted album gone, got %d", w.Code)
+	}
+}
+
+func TestSmartAlbums_DuringScan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	l.gallery.albums = newAlbumStore(storage.NewFs(t.TempDir()))
+	l.gallery.setConfigAlbums([]core.SmartAlbum{{Name: "everything", Query: ""}})
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			l.gallery.scanner.Scan(l.gallery.Root)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodPut, "/api/smart-albums/jpgs", strings.NewReader(`{"query":"kind:image"}`)),
+			httptest.NewRequest(http.MethodGet, "/api/smart-albums", nil),
+		} {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: status %d %s", req.Method, req.URL, w.Code, w.Body)
+			}
+		}
+	}
+	<-done
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// runHashPassword reads a password from the first line of stdin and prints the bcrypt hash
+// to put in auth.users[].password.
+func runHashPassword(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 0 {
+		fmt.Fprintln(stderr, "usage: gallery hash-password < password-file")
+		return exitUsage
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Printf("hash-password: %v", err)
+		return exitError
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(stderr, "hash-password: empty password")
+		return exitUsage
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("hash-password: %v", err)
+		return exitError
+	}
+	fmt.Fprintln(stdout, string(hash))
+	return exitOK
+}
+
+// runNewToken prints a random API token and the SHA-256 hash to put in auth.users[].tokens.
+// Only the hash is kept in the config, so the token is shown this one time.
+func runNewToken(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 0 {
+		fmt.Fprintln(stderr, "usage: gallery new-token")
+		return exitUsage
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("new-token: %v", err)
+		return exitError
+	}
+	token := hex.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(token))
+	fmt.Fprintf(stdout, "token: %s\nsha256: %s\n", token, hex.EncodeToString(sum[:]))
+	return exitOK
+}
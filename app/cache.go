@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gallery"
+	"gallery/common/storage"
+	"gallery/core"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+)
+
+const cacheUsage = `usage: gallery cache <command> [flags] [args]
+
+commands:
+  build           scan the library and generate thumbnails, posters, previews and metadata
+  export <file>   write the cache into a portable archive ("-" for stdout)
+  import <file>   merge an archive into the cache ("-" for stdin)
+
+flags: --config, --base, --cache as for "gallery serve", --library to pick a library.
+
+The server must not be running on the same cache directory.
+`
+
+// runCache implements `gallery cache ...` and returns the process exit code.
+func runCache(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, cacheUsage)
+		return exitUsage
+	}
+	fs, lf := newLibraryFlagSet("cache "+args[0], stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, cacheUsage) }
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	conf, err := lf.loadLibrary()
+	if err != nil {
+		log.Printf("cache %s: %v", args[0], err)
+		return exitError
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch args[0] {
+	case "build":
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		report, err := gallery.BuildCache(ctx, *conf)
+		fmt.Fprintf(stdout, "images: %d, videos: %d, thumbnails: %d, posters: %d, previews: %d, failures: %d\n",
+			report.Images, report.Videos, report.Thumbnails, report.Posters, report.Previews, report.Failures)
+		if err != nil {
+			log.Printf("cache build failed: %v", err)
+			return exitError
+		}
+		if report.Failures > 0 {
+			return exitError
+		}
+		return exitOK
+	case "export", "import":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return exitUsage
+		}
+		if err := runCacheArchive(args[0], fs.Arg(0), conf.Cache, stdout); err != nil {
+			log.Printf("cache %s failed: %v", args[0], err)
+			return exitError
+		}
+		return exitOK
+	default:
+		fs.Usage()
+		return exitUsage
+	}
+}
+
+func runCacheArchive(command string, file string, cacheDir string, stdout io.Writer) error {
+	cache := core.NewCacheManager(storage.NewFs(cacheDir), nil)
+	defer cache.Close()
+	if !cache.Persistent() {
+		return fmt.Errorf("cache db unavailable, is a server running on %s?", cacheDir)
+	}
+
+	var stats core.ArchiveStats
+	var err error
+	if command == "export" {
+		if file == "-" {
+			stats, err = cache.Export(stdout)
+		} else {
+			err = storage.WriteFileAtomic(file, func(w io.Writer) error {
+				stats, err = cache.Export(w)
+				return err
+			})
+		}
+	} else {
+		in := io.Reader(os.Stdin)
+		if file != "-" {
+			f, openErr := os.Open(file)
+			if openErr != nil {
+				return openErr
+			}
+			defer f.Close()
+			in = f
+		}
+		stats, err = cache.Import(in)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("cache %s: %d entries, %d files", command, stats.Entries, stats.Files)
+	return nil
+}
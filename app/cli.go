@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gallery"
+	"gallery/config"
+	"io"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Exit codes for scripting.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitProblems = 3 // verify-cache found entries or files to prune
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const usage = `usage: gallery [command] [flags]
+
+commands:
+  serve          run the web server (default when no command is given)
+  scan           scan the library once and update the cache
+  verify-cache   check the cache against the library, exit 3 when something is stale
+  prune-cache    remove cache entries and renditions of media no longer in the library
+  tags import    replace tags from a JSON file mapping paths to tag lists
+  stats          print library statistics from the cache
+  cache          build, export or import the cache, see "gallery cache"
+  config         check the config or print its JSON Schema, see "gallery config"
+  hash-password  read a password from stdin and print its hash for auth.users
+  new-token      print a new API token and the hash for auth.users
+  version        print the version
+
+Run "gallery <command> -h" for the flags of a command. Commands working on one library
+take --library when the config lists several.
+`
+
+var commands = map[string]func(args []string, stdout io.Writer, stderr io.Writer) int{
+	"serve":         runServe,
+	"scan":          runScan,
+	"verify-cache":  runVerifyCache,
+	"prune-cache":   runPruneCache,
+	"tags":          runTags,
+	"stats":         runStats,
+	"cache":         runCache,
+	"config":        runConfig,
+	"hash-password": runHashPassword,
+	"new-token":     runNewToken,
+	"version":       runVersion,
+}
+
+// run dispatches to a command and returns the process exit code.
+// Flags without a command keep the historical behaviour of starting the server.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args, stdout, stderr)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+	return cmd(args[1:], stdout, stderr)
+}
+
+// libraryFlags are shared by every command that works on a library.
+type libraryFlags struct {
+	config  string
+	base    string
+	cache   string
+	library string
+}
+
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *libraryFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	lf := new(libraryFlags)
+	fs.StringVar(&lf.config, "config", "", "config file (default: gallery.yaml, searched upwards)")
+	fs.StringVar(&lf.base, "base", "", "library directory, overrides resource.base")
+	fs.StringVar(&lf.cache, "cache", "", "cache directory, overrides cache")
+	return fs, lf
+}
+
+// newLibraryFlagSet is newFlagSet for commands that work on one library of the config.
+func newLibraryFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *libraryFlags) {
+	fs, lf := newFlagSet(name, stderr)
+	fs.StringVar(&lf.library, "library", "", "library to work on, required when several are configured")
+	return fs, lf
+}
+
+// load reads the config, then applies GALLERY_* environment variables and the flag
+// overrides, in that order, before defaults are filled in.
+func (lf *libraryFlags) load(apply func(conf *config.GalleryConfig)) (*config.GalleryConfig, error) {
+	return lf.loadFile(lf.config, apply)
+}
+
+// loadFile is load with the config read from file ("" searches for gallery.yaml).
+func (lf *libraryFlags) loadFile(file string, apply func(conf *config.GalleryConfig)) (*config.GalleryConfig, error) {
+	conf := new(config.GalleryConfig)
+	if err := loadConfig(conf, file); err != nil {
+		return nil, err
+	}
+	if err := config.ApplyEnv(conf); err != nil {
+		return nil, err
+	}
+	if len(conf.Libraries) > 0 && (lf.base != "" || lf.cache != "") {
+		return nil, errors.New("--base and --cache only apply to a single library, use --library or edit libraries")
+	}
+	return lf.finish(conf, apply)
+}
+
+// loadLibrary is load for commands that work on one library: the library named by --library,
+// or the only one, becomes the resource and cache of the returned config.
+func (lf *libraryFlags) loadLibrary() (*config.GalleryConfig, error) {
+	conf := new(config.GalleryConfig)
+	if err := loadConfig(conf, lf.config); err != nil {
+		return nil, err
+	}
+	if err := config.ApplyEnv(conf); err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	lib, err := conf.Library(lf.library)
+	if err != nil {
+		return nil, err
+	}
+	view := conf.ForLibrary(lib)
+	return lf.finish(&view, nil)
+}
+
+func (lf *libraryFlags) finish(conf *config.GalleryConfig, apply func(conf *config.GalleryConfig)) (*config.GalleryConfig, error) {
+	if lf.base != "" {
+		conf.Resource.Base = lf.base
+	}
+	if lf.cache != "" {
+		conf.Cache = lf.cache
+	}
+	if apply != nil {
+		apply(conf)
+	}
+	if err := conf.Prepare(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// parseLibraryCommand parses args for a command that takes no positional arguments.
+func parseLibraryCommand(name string, args []string, stderr io.Writer, extra func(fs *flag.FlagSet)) (*config.GalleryConfig, int) {
+	fs, lf := newLibraryFlagSet(name, stderr)
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintf(stderr, "%s takes no arguments\n", name)
+		return nil, exitUsage
+	}
+	conf, err := lf.loadLibrary()
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return nil, exitError
+	}
+	return conf, exitOK
+}
+
+func runServe(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs, lf := newFlagSet("serve", stderr)
+	port := fs.Int("port", 0, "listen port, overrides port")
+	noBrowser := fs.Bool("no-browser", false, "do not open a browser on start")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(stderr, "serve takes no arguments")
+		return exitUsage
+	}
+	applyPort := func(conf *config.GalleryConfig) {
+		if *port != 0 {
+			conf.Port = *port
+		}
+	}
+	conf, err := lf.load(applyPort)
+	if err != nil {
+		log.Printf("serve: %v", err)
+		return exitError
+	}
+	watch := func(reloader *gallery.ConfigReloader) {
+		file := lf.config
+		if file == "" {
+			file = locateConfigFile(defaultConfigFile)
+		}
+		if file == "" {
+			return
+		}
+		go watchConfig(context.Background(), file, func() {
+			// Read the located file explicitly: unlike startup, a broken file must not fall back to defaults.
+			next, err := lf.loadFile(file, applyPort)
+			if err == nil {
+				err = reloader.Reload(*next)
+			}
+			if err != nil {
+				log.Printf("Config reload failed, keeping the running config: %v", err)
+			}
+		})
+	}
+	if err := serve(*conf, !*noBrowser, watch); err != nil {
+		log.Printf("serve: %v", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func runScan(args []string, stdout io.Writer, stderr io.Writer) int {
+	var asJSON bool
+	conf, code := parseLibraryCommand("scan", args, stderr, jsonFlag(&asJSON))
+	if conf == nil {
+		return code
+	}
+	stats, err := gallery.ScanLibrary(*conf)
+	if err != nil {
+		log.Printf("scan: %v", err)
+		return exitError
+	}
+	printReport(stdout, stats, asJSON)
+	return exitOK
+}
+
+func runStats(args []string, stdout io.Writer, stderr io.Writer) int {
+	var asJSON bool
+	conf, code := parseLibraryCommand("stats", args, stderr, jsonFlag(&asJSON))
+	if conf == nil {
+		return code
+	}
+	stats, err := gallery.LibraryStats(*conf)
+	if err != nil {
+		log.Printf("stats: %v", err)
+		return exitError
+	}
+	printReport(stdout, stats, asJSON)
+	return exitOK
+}
+
+func runVerifyCache(args []string, stdout io.Writer, stderr io.Writer) int {
+	var asJSON bool
+	conf, code := parseLibraryCommand("verify-cache", args, stderr, jsonFlag(&asJSON))
+	if conf == nil {
+		return code
+	}
+	report, err := gallery.VerifyCache(*conf)
+	if err != nil {
+		log.Printf("verify-cache: %v", err)
+		return exitError
+	}
+	printReport(stdout, report, asJSON)
+	if !report.Clean() {
+		return exitProblems
+	}
+	return exitOK
+}
+
+func runPruneCache(args []string, stdout io.Writer, stderr io.Writer) int {
+	var asJSON bool
+	conf, code := parseLibraryCommand("prune-cache", args, stderr, jsonFlag(&asJSON))
+	if conf == nil {
+		return code
+	}
+	report, err := gallery.PruneCache(*conf)
+	if err != nil {
+		log.Printf("prune-cache: %v", err)
+		return exitError
+	}
+	printReport(stdout, report, asJSON)
+	return exitOK
+}
+
+func runTags(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(stderr, "usage: gallery tags import [flags] <file>")
+		return exitUsage
+	}
+	fs, lf := newLibraryFlagSet("tags import", stderr)
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: gallery tags import [flags] <file>")
+		return exitUsage
+	}
+	data, err := readFile(fs.Arg(0))
+	if err != nil {
+		log.Printf("tags import: %v", err)
+		return exitError
+	}
+	conf, err := lf.loadLibrary()
+	if err != nil {
+		log.Printf("tags import: %v", err)
+		return exitError
+	}
+	n, err := gallery.ImportTags(*conf, data)
+	if err != nil {
+		log.Printf("tags import: %v", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "imported tags of %d paths\n", n)
+	return exitOK
+}
+
+func runVersion(args []string, stdout io.Writer, stderr io.Writer) int {
+	revision := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	line := "gallery " + version
+	if revision != "" {
+		line += " (" + revision + ")"
+	}
+	fmt.Fprintf(stdout, "%s %s %s/%s\n", line, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return exitOK
+}
+
+func jsonFlag(asJSON *bool) func(fs *flag.FlagSet) {
+	return func(fs *flag.FlagSet) {
+		fs.BoolVar(asJSON, "json", false, "print the result as JSON")
+	}
+}
+
+// printReport writes a report struct as JSON or as sorted "key: value" lines.
+func printReport(w io.Writer, report interface{}, asJSON bool) {
+	data, _ := json.Marshal(report)
+	if asJSON {
+		fmt.Fprintln(w, string(data))
+		return
+	}
+	var fields map[string]interface{}
+	_ = json.Unmarshal(data, &fields)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s: %v\n", k, fields[k])
+	}
+}
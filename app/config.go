@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"gallery/config"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+const configUsage = `usage: gallery config <command> [flags]
+
+commands:
+  check    load the config with GALLERY_* overrides, print it with password hashes and
+           token hashes redacted, or every problem found
+  schema   print the JSON Schema of gallery.yaml
+
+flags of check: --config, --base, --cache as for "gallery serve".
+`
+
+// runConfig implements `gallery config ...` and returns the process exit code.
+func runConfig(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, configUsage)
+		return exitUsage
+	}
+	switch args[0] {
+	case "schema":
+		if len(args) != 1 {
+			fmt.Fprint(stderr, configUsage)
+			return exitUsage
+		}
+		_, _ = stdout.Write(config.Schema())
+		return exitOK
+	case "check":
+		fs, lf := newFlagSet("config check", stderr)
+		fs.Usage = func() { fmt.Fprint(stderr, configUsage) }
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		conf, err := lf.load(nil)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		data, _ := yaml.Marshal(redacted(*conf))
+		_, _ = stdout.Write(data)
+		return exitOK
+	default:
+		fmt.Fprint(stderr, configUsage)
+		return exitUsage
+	}
+}
+
+// redactedValue stands in for a secret in the output of `config check`.
+const redactedValue = "<redacted>"
+
+// redacted returns conf with the password hashes and token hashes of the users replaced, so
+// the output of `config check` can be shared.
+func redacted(conf config.GalleryConfig) config.GalleryConfig {
+	users := make([]config.UserConfig, len(conf.Auth.Users))
+	for i, u := range conf.Auth.Users {
+		if u.Password != "" {
+			u.Password = redactedValue
+		}
+		tokens := make([]string, len(u.Tokens))
+		for j := range tokens {
+			tokens[j] = redactedValue
+		}
+		u.Tokens = tokens
+		users[i] = u
+	}
+	conf.Auth.Users = users
+	return conf
+}
@@ -4,62 +4,103 @@ import (
 	"fmt"
 	"gallery"
 	"gallery/config"
+	"io"
 	"log"
-	_ "net/http/pprof"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 
 	"github.com/XGFan/go-utils"
 	"github.com/gin-gonic/gin"
-	"gopkg.in/yaml.v3"
 )
 
+const defaultConfigFile = "gallery.yaml"
+
 var locateAndRead = utils.LocateAndRead
-var unmarshalYAML = yaml.Unmarshal
+var readFile = os.ReadFile
+var stdin io.Reader = os.Stdin
+var parseConfig = config.Parse
 
 func main() {
-	conf := new(config.GalleryConfig)
-	loadConfig(conf)
-	conf.Setup()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func serve(conf config.GalleryConfig, browser bool, watch func(reloader *gallery.ConfigReloader)) error {
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.Default()
 	engine.Use(corsMiddleware())
-	gallery.Init(engine, *conf)
-	openBrowser(fmt.Sprintf("http://localhost:%d/", conf.Port))
-	_ = engine.Run(fmt.Sprintf(":%d", conf.Port))
+	reloader := gallery.Init(engine, conf)
+	if watch != nil {
+		watch(reloader)
+	}
+	if browser {
+		openBrowser(fmt.Sprintf("http://localhost:%d/", conf.Port))
+	}
+	return engine.Run(fmt.Sprintf(":%d", conf.Port))
 }
 
-func loadConfig(conf *config.GalleryConfig) {
-	bytes, err := locateAndRead("gallery.yaml")
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Println("Read gallery.yaml fail, fallback")
+// loadConfig reads name into conf. Without a name it looks for gallery.yaml and keeps the
+// defaults only when there is none; a file that exists must read, parse and hold known keys.
+func loadConfig(conf *config.GalleryConfig, name string) error {
+	var bytes []byte
+	var err error
+	if name != "" {
+		if bytes, err = readFile(name); err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+	} else {
+		name = defaultConfigFile
+		if bytes, err = locateAndRead(defaultConfigFile); err != nil {
+			if os.IsNotExist(err) {
+				log.Println("No gallery.yaml found, using defaults")
+				return nil
+			}
+			return fmt.Errorf("read %s: %w", name, err)
 		}
-		return
 	}
-
-	log.Println("Load config from gallery.yaml")
-	err = unmarshalYAML(bytes, conf)
-	if err != nil {
-		log.Println("Parse gallery.yaml fail, fallback")
+	if err := parseConfig(bytes, conf); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
 	}
-	log.Printf("Load Config: %+v", conf)
+	log.Printf("Load config from %s", name)
+	return nil
 }
 
+// corsMiddleware lets any page read the API, but only pages served by the gallery itself may
+// change anything: requests other than GET, HEAD and OPTIONS from a foreign Origin are refused,
+// so a page opened elsewhere cannot delete or upload through the browser of a user.
 func corsMiddleware() gin.HandlerFunc {
 	return func(context *gin.Context) {
 		context.Writer.Header().Set("Server", "SAIO")
 		context.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		context.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		context.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
-		if context.Request.Method == "OPTIONS" {
+		context.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		context.Writer.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Upload-Offset, Upload-Length, Upload-Expires, Upload-Path")
+		switch context.Request.Method {
+		case http.MethodOptions:
 			context.AbortWithStatus(204)
-			return
+		case http.MethodGet, http.MethodHead:
+		default:
+			if !sameOrigin(context.Request) {
+				context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cross-origin request refused"})
+			}
 		}
 	}
 }
 
+// sameOrigin reports whether r comes from a page of this server, or from a client that sends
+// no Origin at all, such as curl or the native viewer.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
 func browserCommand(goos string, url string) (string, []string, bool) {
 	switch goos {
 	case "linux":
@@ -1,26 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"gallery/config"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func withLoadConfigStubs(t *testing.T, locate func(path string) ([]byte, error), unmarshal func(in []byte, out interface{}) error) {
+func withLoadConfigStubs(t *testing.T, locate func(path string) ([]byte, error), parse func(data []byte, conf *config.GalleryConfig) error) {
 	t.Helper()
 	originalLocateAndRead := locateAndRead
-	originalUnmarshalYAML := unmarshalYAML
+	originalParseConfig := parseConfig
 	locateAndRead = locate
-	unmarshalYAML = unmarshal
+	parseConfig = parse
 	t.Cleanup(func() {
 		locateAndRead = originalLocateAndRead
-		unmarshalYAML = originalUnmarshalYAML
+		parseConfig = originalParseConfig
 	})
 }
 
@@ -33,34 +39,39 @@ func TestLoadConfig_FileMissingFallsBackWithoutMutation(t *testing.T) {
 			}
 			return nil, os.ErrNotExist
 		},
-		func(in []byte, out interface{}) error {
-			t.Fatal("unmarshal should not be called for locate error")
+		func(data []byte, conf *config.GalleryConfig) error {
+			t.Fatal("parse should not be called for locate error")
 			return nil
 		},
 	)
 
-	loadConfig(conf)
+	if err := loadConfig(conf, ""); err != nil {
+		t.Fatalf("expected fallback without error, got %v", err)
+	}
 
 	if conf.Port != 9090 {
 		t.Fatalf("expected config unchanged on fallback, got port=%d", conf.Port)
 	}
 }
 
-func TestLoadConfig_ParseFailureFallsBackWithoutMutation(t *testing.T) {
+func TestLoadConfig_ParseFailureIsAnError(t *testing.T) {
 	conf := &config.GalleryConfig{Port: 7777}
 	withLoadConfigStubs(t,
 		func(path string) ([]byte, error) {
 			return []byte("invalid"), nil
 		},
-		func(in []byte, out interface{}) error {
+		func(data []byte, conf *config.GalleryConfig) error {
 			return errors.New("bad yaml")
 		},
 	)
 
-	loadConfig(conf)
+	err := loadConfig(conf, "")
+	if err == nil || !strings.Contains(err.Error(), "bad yaml") {
+		t.Fatalf("expected parse error, got %v", err)
+	}
 
 	if conf.Port != 7777 {
-		t.Fatalf("expected config unchanged on parse fallback, got port=%d", conf.Port)
+		t.Fatalf("expected config unchanged on parse failure, got port=%d", conf.Port)
 	}
 }
 
@@ -91,7 +102,7 @@ func TestCorsMiddleware_OPTIONSShortCircuitsWithHeaders(t *testing.T) {
 	if got := resp.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST, OPTIONS" {
 		t.Fatalf("expected Access-Control-Allow-Methods header, got %q", got)
 	}
-	if got := resp.Header().Get("Access-Control-Allow-Headers"); got != "Origin, Content-Type" {
+	if got := resp.Header().Get("Access-Control-Allow-Headers"); got != "Origin, Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset" {
 		t.Fatalf("expected Access-Control-Allow-Headers header, got %q", got)
 	}
 }
@@ -119,6 +130,42 @@ func TestCorsMiddleware_NonOPTIONSContinuesToHandler(t *testing.T) {
 	}
 }
 
+func TestCorsMiddleware_RefusesForeignOriginChanges(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(corsMiddleware())
+	r.Any("/api/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		method string
+		origin string
+		want   int
+	}{
+		{http.MethodPost, "http://evil.example", http.StatusForbidden},
+		{http.MethodDelete, "http://evil.example", http.StatusForbidden},
+		{http.MethodPost, "null", http.StatusForbidden},
+		{http.MethodGet, "http://evil.example", http.StatusOK},
+		{http.MethodPost, "http://gallery.lan:8000", http.StatusOK},
+		{http.MethodDelete, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "http://gallery.lan:8000/api/test", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		if resp.Code != tt.want {
+			t.Fatalf("%s from %q: expected %d, got %d", tt.method, tt.origin, tt.want, resp.Code)
+		}
+	}
+}
+
 func TestBrowserCommand_SelectsCommandByOS(t *testing.T) {
 	url := "http://localhost:8080/"
 	tests := []struct {
@@ -173,3 +220,178 @@ func TestBrowserCommand_SelectsCommandByOS(t *testing.T) {
 		})
 	}
 }
+
+func TestRunCache_UsageErrors(t *testing.T) {
+	for _, args := range [][]string{nil, {"unknown"}, {"export"}, {"build", "extra"}} {
+		var stdout, stderr bytes.Buffer
+		if code := runCache(args, &stdout, &stderr); code != exitUsage {
+			t.Fatalf("args %v: expected exit code %d, got %d", args, exitUsage, code)
+		}
+		if stderr.Len() == 0 {
+			t.Fatalf("args %v: expected usage on stderr", args)
+		}
+	}
+}
+
+func TestLoadConfig_ExplicitFileMustLoad(t *testing.T) {
+	conf := &config.GalleryConfig{}
+	if err := loadConfig(conf, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected error for a missing explicit config")
+	}
+}
+
+func TestRun_UnknownCommandIsUsageError(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"frobnicate"}, &stdout, &stderr); code != exitUsage {
+		t.Fatalf("expected exit code %d, got %d", exitUsage, code)
+	}
+	if !strings.Contains(stderr.String(), "verify-cache") {
+		t.Fatalf("expected usage listing commands, got %q", stderr.String())
+	}
+}
+
+func TestRun_VerifyThenPruneCache(t *testing.T) {
+	base, cacheDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "kept.mp4"), []byte("video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kept.mp4.poster.jpg", "gone.mp4.poster.jpg"} {
+		if err := os.WriteFile(filepath.Join(cacheDir, name), []byte("poster"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := filepath.Join(t.TempDir(), "gallery.yaml")
+	if err := os.WriteFile(configFile, []byte("port: 1234\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flags := []string{"--config", configFile, "--base", base, "--cache", cacheDir}
+
+	var stdout, stderr bytes.Buffer
+	if code := run(append([]string{"verify-cache"}, flags...), &stdout, &stderr); code != exitProblems {
+		t.Fatalf("expected verify-cache to report problems, got %d: %s", code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "orphan_renditions: 1") {
+		t.Fatalf("expected one orphan rendition, got %q", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run(append([]string{"prune-cache"}, flags...), &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected prune-cache to succeed, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "gone.mp4.poster.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("expected orphan poster removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "kept.mp4.poster.jpg")); err != nil {
+		t.Fatalf("expected poster of existing video kept: %v", err)
+	}
+
+	stdout.Reset()
+	if code := run(append([]string{"verify-cache"}, flags...), &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected clean cache after prune, got %d: %s", code, stdout.String())
+	}
+}
+
+func TestWatchConfig_ReloadsOnceFileSettles(t *testing.T) {
+	original := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { configPollInterval = original })
+
+	file := filepath.Join(t.TempDir(), "gallery.yaml")
+	if err := os.WriteFile(file, []byte("port: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, file, func() { reloads <- struct{}{} })
+
+	time.Sleep(30 * time.Millisecond)
+	if err := os.WriteFile(file, []byte("port: 22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected reload after the config file changed")
+	}
+	select {
+	case <-reloads:
+		t.Fatal("expected a single reload per change")
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+func TestRunConfigCheck_ReportsEveryProblemAndAppliesEnv(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "gallery.yaml")
+	if err := os.WriteFile(configFile, []byte("prot: 1\nresource:\n  exlude: [a]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"config", "check", "--config", configFile}, &stdout, &stderr); code != exitError {
+		t.Fatalf("expected exit code %d, got %d", exitError, code)
+	}
+	for _, want := range []string{`did you mean "port"`, `did you mean "resource.exclude"`} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Fatalf("expected %q in %q", want, stderr.String())
+		}
+	}
+
+	if err := os.WriteFile(configFile, []byte("port: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GALLERY_PORT", "4321")
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"config", "check", "--config", configFile, "--base", t.TempDir()}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected valid config, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "port: 4321") {
+		t.Fatalf("expected GALLERY_PORT to override the file, got %q", stdout.String())
+	}
+}
+
+func TestRunConfigCheck_RedactsSecrets(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.Repeat("ab", 32)
+	configFile := filepath.Join(t.TempDir(), "gallery.yaml")
+	yaml := "auth:\n  mode: local\n  users:\n" +
+		"    - name: alice\n      password: " + string(hash) + "\n      tokens: [" + token + "]\n"
+	if err := os.WriteFile(configFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"config", "check", "--config", configFile, "--base", t.TempDir()}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected valid config, got %d: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if strings.Contains(out, string(hash)) || strings.Contains(out, token) {
+		t.Fatalf("expected the password and token hashes redacted, got %q", out)
+	}
+	if !strings.Contains(out, "name: alice") || !strings.Contains(out, "password: <redacted>") {
+		t.Fatalf("expected the user printed with a redacted password, got %q", out)
+	}
+}
+
+func TestRunStats_PicksLibrary(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "gallery.yaml")
+	yaml := "cache: " + filepath.Join(dir, "cache") + "\nlibraries:\n" +
+		"  - name: photos\n    base: " + t.TempDir() + "\n" +
+		"  - name: archive\n    base: " + t.TempDir() + "\n"
+	if err := os.WriteFile(configFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"stats", "--config", configFile}, &stdout, &stderr); code != exitError {
+		t.Fatalf("expected a library to be required, got %d", code)
+	}
+	if code := run([]string{"stats", "--config", configFile, "--library", "archive"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected stats of archive, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache", "archive")); err != nil {
+		t.Fatalf("expected the archive cache inside cache: %v", err)
+	}
+}
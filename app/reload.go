@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+)
+
+var configPollInterval = 2 * time.Second
+
+// locateConfigFile returns the file loadConfig reads when no --config is given, or "" if there
+// is none. The search order is that of utils.LocateAndRead.
+func locateConfigFile(name string) string {
+	candidates := []string{name}
+	if wd, err := os.Getwd(); err == nil && wd != "" {
+		candidates = append(candidates, path.Join(wd, name))
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		candidates = append(candidates, path.Join(home, name))
+	}
+	if executable, err := os.Executable(); err == nil {
+		candidates = append(candidates, path.Join(path.Dir(executable), name))
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statStamp(file string) fileStamp {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchConfig calls reload on SIGHUP and whenever file changes. A change is picked up once the
+// file has stayed the same for a whole poll interval, so a half-written file is not loaded.
+func watchConfig(ctx context.Context, file string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	loaded := statStamp(file)
+	seen := loaded
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s", file)
+			loaded = statStamp(file)
+			seen = loaded
+			reload()
+		case <-ticker.C:
+			stamp := statStamp(file)
+			if stamp != seen {
+				seen = stamp
+				continue
+			}
+			if stamp != loaded {
+				loaded = stamp
+				log.Printf("%s changed, reloading", file)
+				reload()
+			}
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package gallery
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"gallery/common/ignore"
+	"gallery/config"
+	"gallery/core"
+)
+
+const (
+	sessionCookie  = "gallery_session"
+	userContextKey = "gallery.user"
+	loginPath      = "/api/auth/login"
+)
+
+// mediaPrefixes are the routes serving files by library path; access to them is checked
+// against the path rules of the user.
+var mediaPrefixes = []string{"/file/", "/thumbnail/", "/video/", "/poster/", "/preview/", "/hls/", "/subtitle/"}
+
+// user is an authenticated account. A nil user stands for everyone when auth is off and
+// may do everything.
+type user struct {
+	name      string
+	admin     bool
+	write     bool
+	libraries []string
+	allow     ignore.Rules
+	deny      ignore.Rules
+}
+
+// newUser compiles the rules of conf; they were checked by config.Validate.
+func newUser(conf config.UserConfig) *user {
+	allow, _ := ignore.CompileAll(conf.Allow, "allow")
+	deny, _ := ignore.CompileAll(conf.Deny, "deny")
+	return &user{
+		name:      conf.Name,
+		admin:     conf.Admin,
+		write:     conf.Admin || conf.Write,
+		libraries: conf.Libraries,
+		allow:     allow,
+		deny:      deny,
+	}
+}
+
+// restricted reports whether the user sees only part of the libraries.
+func (u *user) restricted() bool {
+	return u != nil && !u.admin && (len(u.allow) > 0 || len(u.deny) > 0)
+}
+
+// canRead reports whether the user may see p, a path inside a library. Deny wins; with
+// allow rules only what they match is visible.
+func (u *user) canRead(p string) bool {
+	if !u.restricted() {
+		return true
+	}
+	p = strings.Trim(p, "/")
+	if rule, ok := u.deny.MatchWithParents(p); ok && !rule.Negate {
+		return false
+	}
+	if len(u.allow) == 0 {
+		return true
+	}
+	rule, ok := u.allow.MatchWithParents(p)
+	return ok && !rule.Negate
+}
+
+func (u *user) canLibrary(name string) bool {
+	return u == nil || u.admin || len(u.libraries) == 0 || slices.Contains(u.libraries, name)
+}
+
+func (u *user) canWrite() bool {
+	return u == nil || u.write
+}
+
+func (u *user) isAdmin() bool {
+	return u == nil || u.admin
+}
+
+// currentUser returns the user of the request, nil when auth is off.
+func currentUser(c *gin.Context) *user {
+	if u, ok := c.Get(userContextKey); ok {
+		return u.(*user)
+	}
+	return nil
+}
+
+// view returns the tree as the user of the request may see it.
+func (g *Gallery) view(c *gin.Context) *core.TraverseNode {
+	u := currentUser(c)
+	if !u.restricted() {
+		return g.Root
+	}
+	return g.Root.Prune(u.canRead)
+}
+
+// readable answers 404 for item routes whose *name the user may not see.
+func readable(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).canRead(CleanUrlPath(c.Param("name"))) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		next(c)
+	}
+}
+
+// writable answers 403 to users without write permission, for routes that only read but
+// are part of changing the library.
+func writable(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).canWrite() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "read-only user"})
+			return
+		}
+		next(c)
+	}
+}
+
+// managed guards the routes that add, move or delete files. They need a user with write
+// permission; while auth is off nobody has one, so they answer 403 unless
+// files.allow_anonymous_write opened them.
+func (ls *libraries) managed(next gin.HandlerFunc) gin.HandlerFunc {
+	guarded := writable(next)
+	return func(c *gin.Context) {
+		if !ls.auth.enabled() && !ls.anonymousWrite {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "file management needs auth; set files.allow_anonymous_write to allow it without"})
+			return
+		}
+		guarded(c)
+	}
+}
+
+type session struct {
+	name    string
+	expires time.Time
+}
+
+// authenticator identifies the user of a request by trusted proxy header, API token, basic
+// auth or session cookie. Sessions are kept in memory and end with the process.
+type authenticator struct {
+	mu        sync.Mutex
+	mode      string
+	header    string
+	trusted   []netip.Prefix
+	timeout   time.Duration
+	users     map[string]*user
+	passwords map[string]string // user name -> bcrypt hash
+	tokens    map[string]string // SHA-256 of a token -> user name
+	verified  map[string]string // SHA-256 of basic auth credentials -> user name
+	sessions  map[string]session
+}
+
+func newAuthenticator(conf config.AuthConfig) *authenticator {
+	a := &authenticator{sessions: make(map[string]session)}
+	a.setConfig(conf)
+	return a
+}
+
+// setConfig applies a changed auth config. Sessions of users that are gone or lost their
+// password end; the others stay logged in.
+func (a *authenticator) setConfig(conf config.AuthConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mode = conf.Mode
+	a.header = conf.ProxyHeader
+	a.trusted = a.trusted[:0]
+	for _, proxy := range conf.TrustedProxies {
+		if prefix, err := config.ParsePrefix(proxy); err == nil {
+			a.trusted = append(a.trusted, prefix)
+		}
+	}
+	a.timeout = time.Duration(conf.SessionTimeout) * time.Second
+	a.users = make(map[string]*user, len(conf.Users))
+	a.passwords = make(map[string]string, len(conf.Users))
+	a.tokens = make(map[string]string)
+	a.verified = make(map[string]string)
+	for _, u := range conf.Users {
+		a.users[u.Name] = newUser(u)
+		if u.Password != "" {
+			a.passwords[u.Name] = u.Password
+		}
+		for _, token := range u.Tokens {
+			a.tokens[strings.ToLower(token)] = u.Name
+		}
+	}
+	for id, s := range a.sessions {
+		if _, ok := a.passwords[s.name]; !ok {
+			delete(a.sessions, id)
+		}
+	}
+}
+
+// enabled reports whether requests need a user; a nil authenticator serves everyone.
+func (a *authenticator) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.mode != config.AuthNone
+}
+
+// identify returns the user of the request, or nil.
+func (a *authenticator) identify(c *gin.Context) *user {
+	a.mu.Lock()
+	mode, header := a.mode, a.header
+	a.mu.Unlock()
+	if mode == config.AuthProxy && a.trustedProxy(c) {
+		if name := c.GetHeader(header); name != "" {
+			return a.proxyUser(name)
+		}
+	}
+	if scheme, credentials, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok {
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			return a.tokenUser(credentials)
+		case "basic":
+			if name, password, ok := c.Request.BasicAuth(); ok {
+				return a.login(name, password)
+			}
+			return nil
+		}
+	}
+	if id, err := c.Cookie(sessionCookie); err == nil {
+		return a.sessionUser(id)
+	}
+	return nil
+}
+
+func (a *authenticator) trustedProxy(c *gin.Context) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, prefix := range a.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyUser returns the configured user of that name. Users the proxy authenticated but
+// the config does not list may read everything and change nothing.
+func (a *authenticator) proxyUser(name string) *user {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if u, ok := a.users[name]; ok {
+		return u
+	}
+	return &user{name: name}
+}
+
+// lookup returns the user of a name as identify would: nil for everyone when auth is off,
+// and false when the account is gone.
+func (a *authenticator) lookup(name string) (*user, bool) {
+	if !a.enabled() {
+		return nil, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if u, ok := a.users[name]; ok {
+		return u, true
+	}
+	if a.mode == config.AuthProxy && name != "" {
+		return &user{name: name}, true
+	}
+	return nil, false
+}
+
+func (a *authenticator) tokenUser(token string) *user {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if name, ok := a.tokens[hex.EncodeToString(sum[:])]; ok {
+		return a.users[name]
+	}
+	return nil
+}
+
+// login checks a password. bcrypt is slow on purpose, so credentials already verified
+// are remembered until the config changes; basic auth sends them with every request.
+func (a *authenticator) login(name, password string) *user {
+	sum := sha256.Sum256([]byte(name + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	a.mu.Lock()
+	if verified, ok := a.verified[key]; ok {
+		defer a.mu.Unlock()
+		return a.users[verified]
+	}
+	hash, ok := a.passwords[name]
+	a.mu.Unlock()
+	if !ok {
+		// Spend the same time as for a wrong password, so user names cannot be probed.
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passwords[name] != hash {
+		return nil
+	}
+	a.verified[key] = name
+	return a.users[name]
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gallery"), bcrypt.DefaultCost)
+
+// startSession returns the id of a new session of u.
+func (a *authenticator) startSession(u *user) (string, time.Duration) {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for other, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, other)
+		}
+	}
+	a.sessions[id] = session{name: u.name, expires: now.Add(a.timeout)}
+	return id, a.timeout
+}
+
+func (a *authenticator) sessionUser(id string) *user {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for known, s := range a.sessions {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(id)) == 1 {
+			if time.Now().After(s.expires) {
+				delete(a.sessions, known)
+				return nil
+			}
+			return a.users[s.name]
+		}
+	}
+	return nil
+}
+
+func (a *authenticator) endSession(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, id)
+}
+
+// authorize is the middleware enforcing auth on the API, media and debug routes. The web UI
+// and Swagger stay public, they hold no library data.
+func (ls *libraries) authorize(c *gin.Context) {
+	p := c.Request.URL.Path
+	if !ls.auth.enabled() {
+		// pprof exposes memory and command lines; without accounts only the host may use it.
+		if strings.HasPrefix(p, "/debug/") && !isLoopback(c) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		return
+	}
+	if !strings.HasPrefix(p, "/api/") && !strings.HasPrefix(p, "/debug/") && mediaPrefix(p) == "" {
+		return
+	}
+	u := ls.auth.identify(c)
+	if u == nil {
+		if p == loginPath {
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="gallery"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+		return
+	}
+	c.Set(userContextKey, u)
+	if strings.HasPrefix(p, "/api/auth/") {
+		return
+	}
+	full := c.FullPath()
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !u.canWrite() && !isReadOnlyRoute(full) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "read-only user"})
+			return
+		}
+	}
+	if strings.HasPrefix(p, "/debug/") || strings.HasPrefix(full, "/api/debug/") || strings.HasPrefix(full, "/api/:lib/debug/") {
+		if !u.isAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+		}
+		return
+	}
+	if prefix := mediaPrefix(p); prefix != "" {
+		// Rules match the path as written, so x/../y must not pass as a path below x.
+		if hasParentRef(p) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		l, rest := ls.split(strings.TrimPrefix(p, prefix[:len(prefix)-1]))
+		if !u.canLibrary(l.name) || !u.canRead(rest) {
+			c.AbortWithStatus(http.StatusNotFound)
+		}
+		return
+	}
+	if full == "/api/libraries" {
+		return
+	}
+	lib := c.Param("lib")
+	if lib == "" && len(ls.list) > 0 {
+		lib = ls.list[0].name
+	}
+	if !u.canLibrary(lib) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+	}
+}
+
+func mediaPrefix(p string) string {
+	for _, prefix := range mediaPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func isLoopback(c *gin.Context) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// registerPprof serves the runtime profiles of net/http/pprof, for admins only.
+func registerPprof(s *gin.Engine) {
+	debug := s.Group("/debug/pprof")
+	debug.GET("/", gin.WrapF(pprof.Index))
+	debug.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/profile", gin.WrapF(pprof.Profile))
+	debug.GET("/symbol", gin.WrapF(pprof.Symbol))
+	debug.POST("/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/trace", gin.WrapF(pprof.Trace))
+	debug.GET("/:profile", gin.WrapF(pprof.Index))
+}
+
+// LoginRequest is the body of POST /api/auth/login.
+type LoginRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// AuthInfo describes the user of a request.
+type AuthInfo struct {
+	Mode      string   `json:"mode"`
+	Name      string   `json:"name,omitempty"`
+	Admin     bool     `json:"admin"`
+	Write     bool     `json:"write"`
+	Libraries []string `json:"libraries,omitempty"`
+}
+
+func (ls *libraries) authInfo(u *user) AuthInfo {
+	if !ls.auth.enabled() {
+		return AuthInfo{Mode: config.AuthNone, Admin: true, Write: true}
+	}
+	ls.auth.mu.Lock()
+	mode := ls.auth.mode
+	ls.auth.mu.Unlock()
+	return AuthInfo{Mode: mode, Name: u.name, Admin: u.admin, Write: u.write, Libraries: u.libraries}
+}
+
+// HandleLogin godoc
+// @Summary Log in
+// @Description Checks the password of a local user and starts a session held by an HttpOnly cookie. Sessions are kept in memory and end after auth.session_timeout or a restart
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param login body LoginRequest true "User name and password"
+// @Success 200 {object} AuthInfo
+// @Failure 401 {object} map[string]interface{}
+// @Router /api/auth/login [post]
+func (ls *libraries) HandleLogin(c *gin.Context) {
+	if !ls.auth.enabled() {
+		c.JSON(http.StatusOK, ls.authInfo(nil))
+		return
+	}
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u := ls.auth.login(req.Name, req.Password)
+	if u == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong user name or password"})
+		return
+	}
+	id, timeout := ls.auth.startSession(u)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, id, int(timeout.Seconds()), "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, ls.authInfo(u))
+}
+
+// HandleLogout godoc
+// @Summary Log out
+// @Description Ends the session of the cookie
+// @Tags auth
+// @Success 204
+// @Router /api/auth/logout [post]
+func (ls *libraries) HandleLogout(c *gin.Context) {
+	if id, err := c.Cookie(sessionCookie); err == nil && ls.auth != nil {
+		ls.auth.endSession(id)
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.Status(http.StatusNoContent)
+}
+
+// HandleMe godoc
+// @Summary Current user
+// @Description Returns the auth mode and the user of the request with their permissions
+// @Tags auth
+// @Produce json
+// @Success 200 {object} AuthInfo
+// @Failure 401 {object} map[string]interface{}
+// @Router /api/auth/me [get]
+func (ls *libraries) HandleMe(c *gin.Context) {
+	c.JSON(http.StatusOK, ls.authInfo(currentUser(c)))
+}
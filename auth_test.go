@@ -0,0 +1,179 @@
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"gallery/config"
+	"gallery/core"
+)
+
+func TestAuth_LocalUsersTokensAndRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	writeTestJPEG(t, filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "y", "b.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("guest-token"))
+	walkerSum := sha256.Sum256([]byte("walker-token"))
+	libs := &libraries{auth: newAuthenticator(config.AuthConfig{
+		Mode:           config.AuthLocal,
+		SessionTimeout: 60,
+		Users: []config.UserConfig{
+			{Name: "root", Password: string(hash), Admin: true},
+			{Name: "guest", Tokens: []string{hex.EncodeToString(sum[:])}, Allow: []string{"x/"}},
+			{Name: "walker", Tokens: []string{hex.EncodeToString(walkerSum[:])}, Allow: []string{"x/**"}},
+		},
+	})}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	guest := []string{"Authorization", "Bearer guest-token"}
+
+	for _, target := range []string{"/api/media/", "/file/y/b.jpg", "/api/auth/me"} {
+		if w := do(http.MethodGet, target, ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("GET %s: expected 401 without a user, got %d", target, w.Code)
+		}
+	}
+	if w := do(http.MethodPost, "/api/auth/login", `{"name":"root","password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong password rejected, got %d", w.Code)
+	}
+	w := do(http.MethodPost, "/api/auth/login", `{"name":"root","password":"secret"}`)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected a session cookie, got %d %v", w.Code, cookies)
+	}
+	root := []string{"Cookie", cookies[0].Name + "=" + cookies[0].Value}
+	var me AuthInfo
+	if err := json.Unmarshal(do(http.MethodGet, "/api/auth/me", "", root...).Body.Bytes(), &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Name != "root" || !me.Admin || me.Mode != config.AuthLocal {
+		t.Fatalf("unexpected user %+v", me)
+	}
+	if w := do(http.MethodGet, "/api/auth/me", "", "Authorization", "Basic cm9vdDpzZWNyZXQ="); w.Code != http.StatusOK {
+		t.Fatalf("expected basic auth accepted, got %d", w.Code)
+	}
+
+	// The guest sees x only, in listings and through the file routes alike.
+	var media struct {
+		Images []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/media/", "", guest...).Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Images) != 1 || media.Images[0].Path != "x/a.jpg" {
+		t.Fatalf("expected only x/a.jpg, got %+v", media.Images)
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/media/", "", root...).Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Images) != 2 {
+		t.Fatalf("expected the admin to see everything, got %+v", media.Images)
+	}
+	if w := do(http.MethodGet, "/api/tree", "", guest...); strings.Contains(w.Body.String(), `"y"`) {
+		t.Fatalf("expected y hidden from the tree, got %s", w.Body)
+	}
+	if w := do(http.MethodGet, "/file/y/b.jpg", "", guest...); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a denied file hidden, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/file/x/a.jpg", "", guest...); w.Code != http.StatusOK {
+		t.Fatalf("expected an allowed file served, got %d", w.Code)
+	}
+	// A walker allowed below x must not step out of it with "..".
+	for _, prefix := range mediaPrefixes {
+		target := prefix + "x/../y/b.jpg"
+		if w := do(http.MethodGet, target, "", "Authorization", "Bearer walker-token"); w.Code != http.StatusNotFound {
+			t.Fatalf("GET %s: expected a path stepping out of x refused, got %d", target, w.Code)
+		}
+	}
+
+	if w := do(http.MethodPut, "/api/marks/x/a.jpg", `{"favorite":true}`, guest...); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a read-only user refused, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/marks/x/a.jpg", `{"favorite":true}`, root...); w.Code != http.StatusOK {
+		t.Fatalf("expected the admin to write, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/debug/pprof/", "", guest...); w.Code != http.StatusForbidden {
+		t.Fatalf("expected pprof refused to a non-admin, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/debug/pprof/", "", root...); w.Code != http.StatusOK {
+		t.Fatalf("expected pprof served to an admin, got %d", w.Code)
+	}
+
+	if w := do(http.MethodPost, "/api/auth/logout", "", root...); w.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/auth/me", "", root...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the session ended, got %d", w.Code)
+	}
+}
+
+func TestAuth_ProxyHeaderAndPprofWithoutAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, mode := range []string{config.AuthNone, config.AuthProxy} {
+		libs := &libraries{auth: newAuthenticator(config.AuthConfig{
+			Mode:           mode,
+			ProxyHeader:    "Remote-User",
+			TrustedProxies: []string{"127.0.0.1"},
+			Users:          []config.UserConfig{{Name: "anna", Write: true}},
+		})}
+		libs.add(newTestLibrary(t, "default", "a.jpg"))
+		engine := gin.New()
+		libs.register(engine)
+		do := func(target, remote, name string) int {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.RemoteAddr = remote + ":5000"
+			if name != "" {
+				req.Header.Set("Remote-User", name)
+			}
+			engine.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		if mode == config.AuthNone {
+			if code := do("/api/media/", "192.0.2.1", ""); code != http.StatusOK {
+				t.Fatalf("expected the API open without auth, got %d", code)
+			}
+			if code := do("/debug/pprof/", "192.0.2.1", ""); code != http.StatusForbidden {
+				t.Fatalf("expected pprof refused to other hosts, got %d", code)
+			}
+			if code := do("/debug/pprof/", "127.0.0.1", ""); code != http.StatusOK {
+				t.Fatalf("expected pprof served on loopback, got %d", code)
+			}
+			continue
+		}
+		if code := do("/api/media/", "127.0.0.1", "anna"); code != http.StatusOK {
+			t.Fatalf("expected the proxy user accepted, got %d", code)
+		}
+		if code := do("/api/media/", "192.0.2.1", "anna"); code != http.StatusUnauthorized {
+			t.Fatalf("expected the header ignored from an untrusted host, got %d", code)
+		}
+		if code := do("/debug/pprof/", "127.0.0.1", "anna"); code != http.StatusForbidden {
+			t.Fatalf("expected pprof refused to a non-admin, got %d", code)
+		}
+	}
+}
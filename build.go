@@ -0,0 +1,165 @@
+package gallery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	utils "github.com/XGFan/go-utils"
+
+	"gallery/common/storage"
+	"gallery/config"
+	"gallery/core"
+	"gallery/thumbnail"
+)
+
+// CacheBuildReport summarizes a BuildCache run.
+type CacheBuildReport struct {
+	Images     int `json:"images"`
+	Videos     int `json:"videos"`
+	Thumbnails int `json:"thumbnails"`
+	Posters    int `json:"posters"`
+	Previews   int `json:"previews"`
+	Failures   int `json:"failures"`
+}
+
+// BuildCache scans the library headless and generates up front everything the server would
+// otherwise produce lazily: image sizes and video metadata, thumbnails of album covers and of
+// force_thumbnail paths, posters and hover previews. Existing renditions are kept.
+// It must not run while a server is using the same cache directory.
+func BuildCache(ctx context.Context, conf config.GalleryConfig) (CacheBuildReport, error) {
+	var report CacheBuildReport
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return report, err
+	}
+	defer m.Close()
+	originFs, cacheFs := m.originFs, m.cacheFs
+	scanner, root := m.gallery.scanner, m.gallery.Root
+	cache := scanner.Cache
+	m.restore()
+	scanner.Scan(root)
+
+	images := thumbnailSources(root, conf.Resource.ForceThumbnail)
+	videos := root.Video()
+	report.Images = len(root.Image())
+	report.Videos = len(videos)
+
+	worker := thumbnail.NewImageWorker(originFs, cacheFs)
+	report.Thumbnails, report.Failures = buildEach(ctx, images, func(ctx context.Context, source string) (bool, error) {
+		if cacheFs.Exist(source) {
+			return false, nil
+		}
+		worker.Thumbnail(source)
+		if !cacheFs.Exist(source) {
+			return false, errors.New("thumbnail not written")
+		}
+		return true, nil
+	})
+
+	if scanner.Toolchain.Capabilities().ExtractFrame {
+		sources := make([]string, 0, len(videos))
+		for _, video := range videos {
+			sources = append(sources, video.Path)
+		}
+		posters := newPosterGenerator(originFs, cacheFs, cache.GetVideoMeta)
+		posters.toolchain = scanner.Toolchain
+		posters.strategy = conf.Poster.Strategy
+		posters.sceneThreshold = conf.Poster.SceneThreshold
+		generated, failed := buildEach(ctx, sources, generatedBy(cacheFs, posterCachePath, posters.Generate))
+		report.Posters, report.Failures = generated, report.Failures+failed
+
+		previews := newPreviewGenerator(originFs, cacheFs, cache.GetVideoMeta)
+		previews.toolchain = scanner.Toolchain
+		generated, failed = buildEach(ctx, sources, generatedBy(cacheFs, previewCachePath, previews.Generate))
+		report.Previews, report.Failures = generated, report.Failures+failed
+	} else {
+		log.Printf("ffmpeg unavailable, skipping posters and previews")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	// Scan already persisted sizes and metadata; save again so the backup covers the final state.
+	return report, scanner.Persist(root)
+}
+
+// thumbnailSources lists the images the server serves through /thumbnail/: album covers and
+// images under a force_thumbnail prefix.
+func thumbnailSources(root *core.TraverseNode, forceThumb []string) []string {
+	pm := make(utils.PrefixMatcher)
+	for _, p := range forceThumb {
+		pm.Add(p)
+	}
+	seen := make(map[string]bool)
+	var sources []string
+	add := func(source string) {
+		if source != "" && storage.IsValidPic(source) && !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	for _, album := range root.Album() {
+		add(album.Cover.Path)
+	}
+	if len(forceThumb) > 0 {
+		for _, img := range root.Image() {
+			if pm.Match(img.Path) {
+				add(img.Path)
+			}
+		}
+	}
+	return sources
+}
+
+// generatedBy adapts a queue generator for buildEach, reporting whether it wrote the cache file.
+func generatedBy(cacheFs storage.Storage, cachePath func(string) string, generate func(ctx context.Context, source string) error) func(ctx context.Context, source string) (bool, error) {
+	return func(ctx context.Context, source string) (bool, error) {
+		if cacheFs.Exist(cachePath(source)) {
+			return false, nil
+		}
+		if err := generate(ctx, source); err != nil {
+			return false, err
+		}
+		return cacheFs.Exist(cachePath(source)), nil
+	}
+}
+
+// buildEach runs fn over sources with one worker per CPU and counts generated and failed items.
+func buildEach(ctx context.Context, sources []string, fn func(ctx context.Context, source string) (bool, error)) (int, int) {
+	var mu sync.Mutex
+	generated, failed := 0, 0
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range jobs {
+				start := time.Now()
+				ok, err := fn(ctx, source)
+				mu.Lock()
+				if err != nil {
+					failed++
+					log.Printf("Build failed: %s, err: %v", source, err)
+				} else if ok {
+					generated++
+					log.Printf("Built %s in %s", source, time.Since(start).Truncate(time.Millisecond))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, source := range sources {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- source
+	}
+	close(jobs)
+	wg.Wait()
+	return generated, failed
+}
@@ -0,0 +1,56 @@
+package gallery
+
+import (
+	"context"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gallery/config"
+	"gallery/core"
+)
+
+func writeTestJPEG(t *testing.T, name string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildCache_ThumbnailsCoversAndPersists(t *testing.T) {
+	base, cacheDir := t.TempDir(), t.TempDir()
+	writeTestJPEG(t, filepath.Join(base, "album", "a.jpg"))
+	writeTestJPEG(t, filepath.Join(base, "album", "b.jpg"))
+
+	conf := config.GalleryConfig{Resource: config.ResourceConfig{Base: base}, Cache: cacheDir}
+	report, err := BuildCache(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if report.Images != 2 || report.Thumbnails != 1 || report.Failures != 0 {
+		t.Fatalf("expect only the album cover thumbnailed, got %+v", report)
+	}
+	// Images are sorted after a scan, so the cover is the first by name whichever worker
+	// added it first.
+	if _, err := os.Stat(filepath.Join(cacheDir, "album", "a.jpg")); err != nil {
+		t.Fatalf("expect album/a.jpg as the cover: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, core.CacheDBBackup)); err != nil {
+		t.Fatalf("expect cache persisted: %v", err)
+	}
+
+	report, err = BuildCache(context.Background(), conf)
+	if err != nil || report.Thumbnails != 0 {
+		t.Fatalf("expect existing thumbnail kept, got %+v %v", report, err)
+	}
+}
@@ -0,0 +1,655 @@
+package gallery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// CollectionsFile holds the user-curated collections, inside the cache directory.
+const CollectionsFile = "collections.json"
+
+// Collection is a named, manually ordered selection of images and videos from anywhere in
+// the library.
+type Collection struct {
+	ID          string           `json:"id"`
+	Title       string           `json:"title"`
+	Description string           `json:"description,omitempty"`
+	Cover       string           `json:"cover,omitempty"`
+	Items       []CollectionItem `json:"items"`
+	Created     int64            `json:"created"`
+	Updated     int64            `json:"updated"`
+}
+
+// CollectionItem references a media file by path. Size and ModTime fingerprint the file, so
+// it is found again when it is renamed or moved.
+type CollectionItem struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
+}
+
+func (c Collection) clone() Collection {
+	c.Items = append([]CollectionItem(nil), c.Items...)
+	return c
+}
+
+func (c Collection) paths() []string {
+	paths := make([]string, 0, len(c.Items))
+	for _, item := range c.Items {
+		paths = append(paths, item.Path)
+	}
+	return paths
+}
+
+var errUnknownCollection = errors.New("unknown collection")
+
+// collectionStore keeps the collections of a library. Every change is written through to
+// CollectionsFile; scans never touch it.
+type collectionStore struct {
+	mu          sync.Mutex
+	cacheFs     storage.Storage
+	collections []Collection
+}
+
+func newCollectionStore(cacheFs storage.Storage) *collectionStore {
+	store := &collectionStore{cacheFs: cacheFs}
+	if err := readJSONFile(cacheFs, CollectionsFile, &store.collections); err != nil {
+		log.Printf("Failed to read %s: %v", CollectionsFile, err)
+	}
+	return store
+}
+
+func (s *collectionStore) list() []Collection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Collection, 0, len(s.collections))
+	for _, c := range s.collections {
+		result = append(result, c.clone())
+	}
+	return result
+}
+
+func (s *collectionStore) get(id string) (Collection, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.index(id); i >= 0 {
+		return s.collections[i].clone(), true
+	}
+	return Collection{}, false
+}
+
+func (s *collectionStore) index(id string) int {
+	return slices.IndexFunc(s.collections, func(c Collection) bool { return c.ID == id })
+}
+
+func (s *collectionStore) create(c Collection) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return Collection{}, err
+	}
+	c.ID = hex.EncodeToString(id)
+	c.Created = time.Now().Unix()
+	c.Updated = c.Created
+	collections := append(s.cloneAll(), c)
+	return c, s.persist(collections)
+}
+
+// update applies change to a copy of the collection and saves it unless change fails.
+func (s *collectionStore) update(id string, change func(c *Collection) error) (Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return Collection{}, errUnknownCollection
+	}
+	collections := s.cloneAll()
+	if err := change(&collections[i]); err != nil {
+		return Collection{}, err
+	}
+	collections[i].Updated = time.Now().Unix()
+	return collections[i].clone(), s.persist(collections)
+}
+
+func (s *collectionStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return errUnknownCollection
+	}
+	return s.persist(slices.Delete(s.cloneAll(), i, i+1))
+}
+
+func (s *collectionStore) cloneAll() []Collection {
+	collections := make([]Collection, 0, len(s.collections)+1)
+	for _, c := range s.collections {
+		collections = append(collections, c.clone())
+	}
+	return collections
+}
+
+func (s *collectionStore) persist(collections []Collection) error {
+	if err := writeJSONFile(s.cacheFs, CollectionsFile, collections); err != nil {
+		return err
+	}
+	s.collections = collections
+	return nil
+}
+
+// move points the items at from, or below it when from is a folder, to their new path.
+func (s *collectionStore) move(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rename := func(p string) (string, bool) {
+		if p == from {
+			return to, true
+		}
+		if rest, ok := strings.CutPrefix(p, from+"/"); ok {
+			return path.Join(to, rest), true
+		}
+		return "", false
+	}
+	collections := s.cloneAll()
+	changed := false
+	for ci := range collections {
+		c := &collections[ci]
+		for i, item := range c.Items {
+			if target, ok := rename(item.Path); ok {
+				c.Items[i].Path = target
+				changed = true
+			}
+		}
+		if target, ok := rename(c.Cover); ok {
+			c.Cover = target
+		}
+	}
+	if changed {
+		if err := s.persist(collections); err != nil {
+			log.Printf("Failed to save %s: %v", CollectionsFile, err)
+		}
+	}
+}
+
+// reconcile follows files renamed or moved since they were added. An item missing from the
+// tree is pointed at the file with the same size and modification time, if exactly one
+// file not already in the collection has them.
+func (s *collectionStore) reconcile(root *core.TraverseNode, originFs storage.Storage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	present := make(map[string]bool)
+	byModTime := make(map[int64][]string)
+	for _, img := range root.Image() {
+		present[img.Path] = true
+		byModTime[img.ModTime] = append(byModTime[img.ModTime], img.Path)
+	}
+	for _, vid := range root.Video() {
+		present[vid.Path] = true
+		byModTime[vid.ModTime] = append(byModTime[vid.ModTime], vid.Path)
+	}
+	sizes := make(map[string]int64)
+	sizeOf := func(p string) int64 {
+		if size, ok := sizes[p]; ok {
+			return size
+		}
+		size := int64(-1)
+		if info, err := statFile(originFs, p); err == nil {
+			size = info.Size()
+		}
+		sizes[p] = size
+		return size
+	}
+
+	collections := s.cloneAll()
+	changed := false
+	for ci := range collections {
+		c := &collections[ci]
+		for i, item := range c.Items {
+			if present[item.Path] || item.Size <= 0 || item.ModTime <= 0 {
+				continue
+			}
+			var found []string
+			for _, candidate := range byModTime[item.ModTime] {
+				if !slices.Contains(c.paths(), candidate) && !slices.Contains(found, candidate) && sizeOf(candidate) == item.Size {
+					found = append(found, candidate)
+				}
+			}
+			if len(found) != 1 {
+				continue
+			}
+			log.Printf("Collection %s: %s moved to %s", c.ID, item.Path, found[0])
+			if c.Cover == item.Path {
+				c.Cover = found[0]
+			}
+			c.Items[i].Path = found[0]
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.persist(collections); err != nil {
+			log.Printf("Failed to save %s: %v", CollectionsFile, err)
+		}
+	}
+}
+
+func statFile(fs storage.Storage, name string) (os.FileInfo, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// collectionItem fingerprints the media file at p for a collection.
+func (g *Gallery) collectionItem(p string) (CollectionItem, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if !storage.IsValidPic(p) && !storage.IsValidVideo(p) {
+		return CollectionItem{}, fmt.Errorf("%s is not an image or video", p)
+	}
+	info, err := statFile(g.scanner.OriginFs, p)
+	if err != nil || info.IsDir() {
+		return CollectionItem{}, fmt.Errorf("%s does not exist", p)
+	}
+	return CollectionItem{Path: p, Size: info.Size(), ModTime: info.ModTime().Unix()}, nil
+}
+
+// collectionItems fingerprints paths, leaving out those in skip or repeated.
+func (g *Gallery) collectionItems(paths []string, skip []string) ([]CollectionItem, error) {
+	items := make([]CollectionItem, 0, len(paths))
+	seen := append([]string(nil), skip...)
+	for _, p := range paths {
+		item, err := g.collectionItem(p)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(seen, item.Path) {
+			continue
+		}
+		seen = append(seen, item.Path)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// resolveCollection looks the items up in root, in the collection order. Items that are not
+// in the tree are returned as missing.
+func (g *Gallery) resolveCollection(root *core.TraverseNode, c Collection) (images []core.ImageNode, videos []core.VideoNode, missing []string) {
+	images = make([]core.ImageNode, 0)
+	videos = make([]core.VideoNode, 0)
+	missing = make([]string, 0)
+	for _, item := range c.Items {
+		if img, ok := root.FindImage(item.Path); ok {
+			images = append(images, img)
+		} else if vid, ok := root.FindVideo(item.Path); ok {
+			videos = append(videos, vid)
+		} else {
+			missing = append(missing, item.Path)
+		}
+	}
+	return images, g.fillVideoMetas(videos), missing
+}
+
+// collectionCover returns the chosen cover, or the first item found in root.
+func (g *Gallery) collectionCover(root *core.TraverseNode, c Collection) core.ImageNode {
+	paths := c.paths()
+	if c.Cover != "" {
+		paths = append([]string{c.Cover}, paths...)
+	}
+	for _, p := range paths {
+		if img, ok := root.FindImage(p); ok {
+			return img
+		}
+		if vid, ok := root.FindVideo(p); ok {
+			cover := core.ImageNode{Node: core.Node{Name: vid.Name, Path: vid.Path}, Size: vid.Size}
+			g.fillCoverVideoMeta(&cover)
+			return cover
+		}
+	}
+	return core.EmptyNode
+}
+
+// visibleCollection leaves out the items the user of the request may not see. Collections
+// are shared by all users, so a restricted one sees only part of them.
+func visibleCollection(c *gin.Context, collection Collection) Collection {
+	u := currentUser(c)
+	if !u.restricted() {
+		return collection
+	}
+	visible := collection
+	visible.Items = make([]CollectionItem, 0, len(collection.Items))
+	for _, item := range collection.Items {
+		if u.canRead(item.Path) {
+			visible.Items = append(visible.Items, item)
+		}
+	}
+	if !u.canRead(visible.Cover) {
+		visible.Cover = ""
+	}
+	return visible
+}
+
+// checkReadable rejects paths the user of the request may not see as if they did not exist.
+func checkReadable(c *gin.Context, paths []string) error {
+	u := currentUser(c)
+	for _, p := range paths {
+		if !u.canRead(p) {
+			return fmt.Errorf("%s does not exist", CleanUrlPath(p))
+		}
+	}
+	return nil
+}
+
+// CollectionInfo describes a collection in the /api/collections listing.
+type CollectionInfo struct {
+	ID          string         `json:"id"`
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Cover       core.ImageNode `json:"cover"`
+	Count       int            `json:"count"`
+	Updated     int64          `json:"updated"`
+}
+
+// CollectionDetail is a collection with the items no longer found in the library.
+type CollectionDetail struct {
+	Collection
+	Missing []string `json:"missing"`
+}
+
+// CollectionRequest creates or changes a collection; fields left out of a PATCH are kept.
+// Items lists media paths in the wanted order.
+type CollectionRequest struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Cover       *string   `json:"cover"`
+	Items       *[]string `json:"items"`
+}
+
+// CollectionItemsRequest adds items to a collection, at Position or at the end.
+type CollectionItemsRequest struct {
+	Paths    []string `json:"paths" binding:"required"`
+	Position *int     `json:"position"`
+}
+
+// applyCollectionRequest sets the fields of req on c for the user u.
+func (g *Gallery) applyCollectionRequest(c *Collection, req CollectionRequest, u *user) error {
+	if req.Title != nil {
+		c.Title = strings.TrimSpace(*req.Title)
+	}
+	if req.Description != nil {
+		c.Description = *req.Description
+	}
+	if req.Items != nil {
+		items, err := g.collectionItems(*req.Items, nil)
+		if err != nil {
+			return err
+		}
+		c.Items = keepHidden(c.Items, items, u)
+	}
+	if req.Cover != nil {
+		c.Cover = CleanUrlPath(*req.Cover)
+	}
+	if c.Title == "" {
+		return errors.New("title is required")
+	}
+	if c.Cover != "" && !slices.Contains(c.paths(), c.Cover) {
+		return errors.New("cover must be one of the items")
+	}
+	return nil
+}
+
+// keepHidden lays the new items into the places of the old ones u may see, so a restricted
+// user reorders or removes only what they see; items hidden from them keep their places.
+// New items beyond those places go to the end.
+func keepHidden(old, items []CollectionItem, u *user) []CollectionItem {
+	if !u.restricted() {
+		return items
+	}
+	merged := make([]CollectionItem, 0, len(old)+len(items))
+	next := 0
+	for _, item := range old {
+		if !u.canRead(item.Path) {
+			merged = append(merged, item)
+		} else if next < len(items) {
+			merged = append(merged, items[next])
+			next++
+		}
+	}
+	return append(merged, items[next:]...)
+}
+
+// HandleCollections godoc
+// @Summary List collections
+// @Description Returns the user-curated collections with their cover and item count
+// @Tags collections
+// @Produce json
+// @Success 200 {array} CollectionInfo
+// @Router /api/collections [get]
+func (g *Gallery) HandleCollections(c *gin.Context) {
+	collections := g.collections.list()
+	root := g.view(c)
+	result := make([]CollectionInfo, 0, len(collections))
+	for _, collection := range collections {
+		collection = visibleCollection(c, collection)
+		result = append(result, CollectionInfo{
+			ID:          collection.ID,
+			Title:       collection.Title,
+			Description: collection.Description,
+			Cover:       g.collectionCover(root, collection),
+			Count:       len(collection.Items),
+			Updated:     collection.Updated,
+		})
+	}
+	c.JSON(200, result)
+}
+
+// HandleCreateCollection godoc
+// @Summary Create a collection
+// @Description Creates a collection of images and videos from anywhere in the library, kept in the cache directory
+// @Tags collections
+// @Accept json
+// @Produce json
+// @Param collection body CollectionRequest true "Title, description, cover and ordered item paths"
+// @Success 201 {object} Collection
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/collections [post]
+func (g *Gallery) HandleCreateCollection(c *gin.Context) {
+	var req CollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Items != nil {
+		if err := checkReadable(c, *req.Items); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	collection := Collection{Items: make([]CollectionItem, 0)}
+	if err := g.applyCollectionRequest(&collection, req, currentUser(c)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collection, err := g.collections.create(collection)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, visibleCollection(c, collection))
+}
+
+// HandleCollection godoc
+// @Summary Get a collection
+// @Description Returns a collection with its items in order and the paths no longer found in the library
+// @Tags collections
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Success 200 {object} CollectionDetail
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id} [get]
+func (g *Gallery) HandleCollection(c *gin.Context) {
+	collection, ok := g.collections.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errUnknownCollection.Error()})
+		return
+	}
+	collection = visibleCollection(c, collection)
+	_, _, missing := g.resolveCollection(g.Root, collection)
+	c.JSON(200, CollectionDetail{Collection: collection, Missing: missing})
+}
+
+// HandleUpdateCollection godoc
+// @Summary Change a collection
+// @Description Changes the title, description, cover or items of a collection; items replaces the whole list, which also reorders or removes items; items hidden from a restricted user keep their places
+// @Tags collections
+// @Accept json
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Param collection body CollectionRequest true "Fields to change"
+// @Success 200 {object} Collection
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id} [patch]
+func (g *Gallery) HandleUpdateCollection(c *gin.Context) {
+	var req CollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Items != nil {
+		if err := checkReadable(c, *req.Items); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	collection, err := g.collections.update(c.Param("id"), func(collection *Collection) error {
+		return g.applyCollectionRequest(collection, req, currentUser(c))
+	})
+	g.collectionResult(c, collection, err)
+}
+
+// HandleAddCollectionItems godoc
+// @Summary Add items to a collection
+// @Description Inserts media paths at position (default: the end); paths already in the collection are skipped
+// @Tags collections
+// @Accept json
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Param items body CollectionItemsRequest true "Paths and position"
+// @Success 200 {object} Collection
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id}/items [post]
+func (g *Gallery) HandleAddCollectionItems(c *gin.Context) {
+	var req CollectionItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkReadable(c, req.Paths); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	collection, err := g.collections.update(c.Param("id"), func(collection *Collection) error {
+		items, err := g.collectionItems(req.Paths, collection.paths())
+		if err != nil {
+			return err
+		}
+		position := len(collection.Items)
+		if req.Position != nil {
+			position = min(max(*req.Position, 0), len(collection.Items))
+		}
+		collection.Items = slices.Insert(collection.Items, position, items...)
+		return nil
+	})
+	g.collectionResult(c, collection, err)
+}
+
+// HandleDeleteCollection godoc
+// @Summary Delete a collection
+// @Description Deletes a collection; the media files are not touched
+// @Tags collections
+// @Param id path string true "Collection ID"
+// @Success 204
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id} [delete]
+func (g *Gallery) HandleDeleteCollection(c *gin.Context) {
+	if err := g.collections.remove(c.Param("id")); err != nil {
+		g.collectionResult(c, Collection{}, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// HandleExploreCollection godoc
+// @Summary Explore a collection
+// @Description Returns the items of a collection in the response shape of /api/explore, in the collection order
+// @Tags collections
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Success 200 {object} core.SimpleDirectory
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id}/explore [get]
+func (g *Gallery) HandleExploreCollection(c *gin.Context) {
+	collection, ok := g.collections.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errUnknownCollection.Error()})
+		return
+	}
+	images, videos, _ := g.resolveCollection(g.view(c), collection)
+	c.JSON(200, gin.H{
+		"directories": make([]core.DirNode, 0),
+		"images":      images,
+		"videos":      videos,
+		"others":      make([]core.Node, 0),
+	})
+}
+
+// HandleCollectionMedia godoc
+// @Summary List the media of a collection
+// @Description Returns the items of a collection in the response shape of /api/media, in the collection order
+// @Tags collections
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Success 200 {object} core.MediaResponse
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/collections/{id}/media [get]
+func (g *Gallery) HandleCollectionMedia(c *gin.Context) {
+	collection, ok := g.collections.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errUnknownCollection.Error()})
+		return
+	}
+	images, videos, _ := g.resolveCollection(g.view(c), collection)
+	c.JSON(200, gin.H{
+		"images": images,
+		"videos": videos,
+	})
+}
+
+func (g *Gallery) collectionResult(c *gin.Context, collection Collection, err error) {
+	switch {
+	case errors.Is(err, errUnknownCollection):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(200, visibleCollection(c, collection))
+	}
+}
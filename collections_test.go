@@ -0,0 +1,162 @@
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/config"
+	"gallery/core"
+)
+
+func TestCollections_CRUDAndRename(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	originDir := l.gallery.scanner.OriginFs.GetPath()
+	writeTestJPEG(t, filepath.Join(originDir, "y", "b.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	cacheFs := storage.NewFs(t.TempDir())
+	l.gallery.collections = newCollectionStore(cacheFs)
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/collections", `{"title":"Best","items":["y/b.jpg","/x/a.jpg","y/b.jpg"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d %s", w.Code, w.Body)
+	}
+	var created Collection
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Items) != 2 || created.Items[0].Path != "y/b.jpg" || created.Items[1].Path != "x/a.jpg" {
+		t.Fatalf("expected ordered, deduplicated items, got %+v", created.Items)
+	}
+	for body, want := range map[string]int{
+		`{"items":["x/a.jpg"]}`:                   http.StatusBadRequest,
+		`{"title":"T","items":["x/missing.jpg"]}`: http.StatusBadRequest,
+		`{"title":"T","cover":"y/b.jpg"}`:         http.StatusBadRequest,
+	} {
+		if w := do(http.MethodPost, "/api/collections", body); w.Code != want {
+			t.Fatalf("POST %s: expected %d, got %d", body, want, w.Code)
+		}
+	}
+	base := "/api/collections/" + created.ID
+	if w := do(http.MethodPatch, base, `{"cover":"x/a.jpg","items":["x/a.jpg","y/b.jpg"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d %s", w.Code, w.Body)
+	}
+
+	// Move a.jpg; the next scan follows it by size and modification time.
+	if err := os.MkdirAll(filepath.Join(originDir, "z"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(originDir, "x", "a.jpg"), filepath.Join(originDir, "z", "moved.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	l.gallery.rescan()
+
+	var explored struct {
+		Directories []core.DirNode   `json:"directories"`
+		Images      []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, base+"/explore", "").Body.Bytes(), &explored); err != nil {
+		t.Fatal(err)
+	}
+	if explored.Directories == nil || len(explored.Images) != 2 || explored.Images[0].Path != "z/moved.jpg" || explored.Images[1].Path != "y/b.jpg" {
+		t.Fatalf("expected the moved item in place, got %+v", explored)
+	}
+	var listed []CollectionInfo
+	if err := json.Unmarshal(do(http.MethodGet, "/api/collections", "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Count != 2 || listed[0].Cover.Path != "z/moved.jpg" {
+		t.Fatalf("unexpected listing %+v", listed)
+	}
+	if saved := newCollectionStore(cacheFs).list(); len(saved) != 1 || saved[0].Items[0].Path != "z/moved.jpg" {
+		t.Fatalf("expected the rename persisted, got %+v", saved)
+	}
+
+	if w := do(http.MethodPost, base+"/items", `{"paths":["y/b.jpg","z/moved.jpg"],"position":0}`); w.Code != http.StatusOK {
+		t.Fatalf("POST items: status %d", w.Code)
+	}
+	if err := os.Remove(filepath.Join(originDir, "y", "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	l.gallery.rescan()
+	var detail CollectionDetail
+	if err := json.Unmarshal(do(http.MethodGet, base, "").Body.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Items) != 2 || len(detail.Missing) != 1 || detail.Missing[0] != "y/b.jpg" {
+		t.Fatalf("expected the deleted item reported missing, got %+v", detail)
+	}
+
+	if w := do(http.MethodDelete, base, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", w.Code)
+	}
+	if w := do(http.MethodGet, base+"/media", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted collection gone, got %d", w.Code)
+	}
+}
+
+func TestCollections_RestrictedEditKeepsHiddenItems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	originDir := l.gallery.scanner.OriginFs.GetPath()
+	writeTestJPEG(t, filepath.Join(originDir, "private", "p.jpg"))
+	writeTestJPEG(t, filepath.Join(originDir, "y", "b.jpg"))
+	writeTestJPEG(t, filepath.Join(originDir, "y", "c.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	l.gallery.collections = newCollectionStore(storage.NewFs(t.TempDir()))
+	created, err := l.gallery.collections.create(Collection{Title: "Mixed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.gallery.collections.update(created.ID, func(c *Collection) error {
+		return l.gallery.applyCollectionRequest(c, CollectionRequest{Items: &[]string{"x/a.jpg", "private/p.jpg", "y/b.jpg"}}, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("editor-token"))
+	libs := &libraries{auth: newAuthenticator(config.AuthConfig{
+		Mode: config.AuthLocal,
+		Users: []config.UserConfig{
+			{Name: "editor", Tokens: []string{hex.EncodeToString(sum[:])}, Write: true, Deny: []string{"/private"}},
+		},
+	})}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/api/collections/"+created.ID, strings.NewReader(`{"items":["y/c.jpg","y/b.jpg","x/a.jpg"]}`))
+	req.Header.Set("Authorization", "Bearer editor-token")
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d %s", w.Code, w.Body)
+	}
+	stored, _ := l.gallery.collections.get(created.ID)
+	if got := strings.Join(stored.paths(), ","); got != "y/c.jpg,private/p.jpg,y/b.jpg,x/a.jpg" {
+		t.Fatalf("expected the hidden item kept in place, got %s", got)
+	}
+	var visible Collection
+	if err := json.Unmarshal(w.Body.Bytes(), &visible); err != nil || len(visible.Items) != 3 {
+		t.Fatalf("expected only the visible items returned, got %s", w.Body)
+	}
+}
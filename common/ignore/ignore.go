@@ -0,0 +1,193 @@
+// Package ignore matches library paths against gitignore-style patterns. It backs the
+// exclude and include settings and the per-directory .galleryignore files.
+package ignore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FileName is the per-directory ignore file honoured during scans.
+const FileName = ".galleryignore"
+
+// regexPrefix marks a pattern as a Go regular expression instead of a glob.
+const regexPrefix = "re:"
+
+// Rule is one compiled pattern.
+type Rule struct {
+	Pattern string // as written, including a leading "!"
+	Source  string // where it was read from, such as "exclude[0]" or "a/.galleryignore:3"
+	Negate  bool
+
+	base    string
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// Compile parses pattern, which is relative to the directory base ("" for the library root).
+// The syntax follows gitignore:
+//   - a leading "!" re-includes what an earlier rule excluded;
+//   - a trailing "/" matches directories only;
+//   - a pattern containing another "/" is anchored to base, otherwise it matches a name at any depth;
+//   - "*" and "?" match within one path segment, "[...]" is a character class and "**" spans segments.
+//
+// A pattern starting with "re:" is a regular expression matched against the path relative to base.
+func Compile(pattern, base, source string) (Rule, error) {
+	rule := Rule{Pattern: pattern, Source: source, base: strings.Trim(base, "/")}
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		rule.Negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasPrefix(p, regexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(p, regexPrefix))
+		if err != nil {
+			return rule, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		rule.re = re
+		return rule, nil
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return rule, errors.New("empty pattern")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	body, err := globToRegexp(p)
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if !anchored {
+		body = "(?:.*/)?" + body
+	}
+	rule.re, err = regexp.Compile("^" + body + "$")
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return rule, nil
+}
+
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// Match reports whether the rule matches rel, a path relative to the library root.
+func (r Rule) Match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+// Rules are evaluated in order and the last matching rule wins, as in gitignore.
+type Rules []Rule
+
+// CompileAll compiles patterns relative to the library root; source names each one by its
+// index, such as "exclude[2]".
+func CompileAll(patterns []string, source string) (Rules, error) {
+	rules := make(Rules, 0, len(patterns))
+	var errs []error
+	for i, pattern := range patterns {
+		rule, err := Compile(pattern, "", fmt.Sprintf("%s[%d]", source, i))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// ParseFile compiles the lines of the ignore file found in directory dir. Blank lines and
+// lines starting with "#" are skipped. Invalid lines are reported and left out.
+func ParseFile(data []byte, dir string) (Rules, error) {
+	source := FileName
+	if dir != "" {
+		source = dir + "/" + FileName
+	}
+	var rules Rules
+	var errs []error
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimRight(line, " \t")
+		rule, err := Compile(line, dir, fmt.Sprintf("%s:%d", source, n+1))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", source, n+1, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// Match returns the last rule matching rel. The path is excluded when a rule matched and
+// it is not a negation.
+func (rs Rules) Match(rel string, isDir bool) (Rule, bool) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i].Match(rel, isDir) {
+			return rs[i], true
+		}
+	}
+	return Rule{}, false
+}
+
+// MatchWithParents is Match for a file or, when no rule matches it, for the closest of its
+// parent directories that one does.
+func (rs Rules) MatchWithParents(rel string) (Rule, bool) {
+	isDir := false
+	for p := rel; p != "." && p != ""; p, isDir = path.Dir(p), true {
+		if rule, ok := rs.Match(p, isDir); ok {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
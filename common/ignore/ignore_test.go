@@ -0,0 +1,56 @@
+package ignore
+
+import "testing"
+
+func TestRules_GitignoreSemantics(t *testing.T) {
+	rules, err := CompileAll([]string{"**/node_modules", "*.psd", "/tmp", "raw/", "docs/*.jpg", "!keep.psd", `re:^\d{4}/private/`}, "exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"node_modules", true, true},
+		{"a/b/node_modules", true, true},
+		{"art/cover.psd", false, true},
+		{"art/keep.psd", false, false},
+		{"tmp", true, true},
+		{"a/tmp", true, false},
+		{"a/raw", true, true},
+		{"a/raw", false, false},
+		{"docs/a.jpg", false, true},
+		{"docs/sub/a.jpg", false, false},
+		{"2024/private/x.jpg", false, true},
+		{"photos/2024/private/x.jpg", false, false},
+	}
+	for _, c := range cases {
+		rule, ok := rules.Match(c.path, c.isDir)
+		if got := ok && !rule.Negate; got != c.excluded {
+			t.Errorf("%s (dir=%v): expected excluded=%v, got %v by %q", c.path, c.isDir, c.excluded, got, rule.Pattern)
+		}
+	}
+}
+
+func TestParseFile_RelativeToDirectory(t *testing.T) {
+	rules, err := ParseFile([]byte("# comment\n\n*.tmp\n/cache/\n[oops\n"), "albums")
+	if err == nil {
+		t.Fatal("expected the unterminated class to be reported")
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected the two valid lines, got %d", len(rules))
+	}
+	if rule, ok := rules.Match("albums/x/a.tmp", false); !ok || rule.Source != "albums/.galleryignore:3" {
+		t.Fatalf("expected match from line 3, got %+v %v", rule, ok)
+	}
+	if _, ok := rules.Match("other/a.tmp", false); ok {
+		t.Fatal("expected rules to apply below their directory only")
+	}
+	if _, ok := rules.Match("albums/cache", true); !ok {
+		t.Fatal("expected anchored directory rule to match")
+	}
+	if _, ok := rules.Match("albums/x/cache", true); ok {
+		t.Fatal("expected anchored rule not to match deeper")
+	}
+}
@@ -0,0 +1,560 @@
+// Package query parses and evaluates the filter expressions of smart albums, such as
+//
+//	tag:cat path:2024/** date>=-30d kind:image
+//
+// A term is field, operator and value without spaces in between, or a bare word. Terms next
+// to each other must all match; "or" joins alternatives, "not" or a leading "-" negates, and
+// parentheses group. Values with spaces are written in double quotes.
+package query
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gallery/common/ignore"
+)
+
+// Kinds of Item.
+const (
+	KindImage = "image"
+	KindVideo = "video"
+)
+
+// Item is one image or video as seen by a query.
+type Item struct {
+	Kind        string
+	Path        string
+	Width       int
+	Height      int
+	DurationSec float64
+	Tags        []string
+	Caption     string
+	ModTime     time.Time
+	Favorite    bool
+	Rating      int
+}
+
+// Fields are the names a term can filter on.
+var Fields = []string{"kind", "path", "name", "tag", "caption", "width", "height", "duration", "orientation", "date", "favorite", "rating"}
+
+type predicate func(item *Item, now time.Time) bool
+
+// Query is a parsed expression.
+type Query struct {
+	source string
+	match  predicate
+}
+
+// Parse parses expr. An empty expression matches everything.
+func Parse(expr string) (*Query, error) {
+	p := &parser{src: expr}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	if match == nil {
+		match = func(*Item, time.Time) bool { return true }
+	}
+	return &Query{source: expr, match: match}, nil
+}
+
+// Match reports whether item satisfies the query. Relative dates count back from now.
+func (q *Query) Match(item Item, now time.Time) bool {
+	return q.match(&item, now)
+}
+
+func (q *Query) String() string {
+	return q.source
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes word when it is the next token.
+func (p *parser) keyword(word string) bool {
+	p.skipSpace()
+	end := p.pos + len(word)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], word) {
+		return false
+	}
+	if end < len(p.src) && !unicode.IsSpace(rune(p.src[end])) && p.src[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *parser) parseOr() (predicate, error) {
+	var alternatives []predicate
+	for {
+		match, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if match != nil {
+			alternatives = append(alternatives, match)
+		}
+		if !p.keyword("or") {
+			break
+		}
+		if match == nil {
+			return nil, p.errorf("\"or\" needs a term on both sides")
+		}
+	}
+	switch len(alternatives) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alternatives[0], nil
+	}
+	return func(item *Item, now time.Time) bool {
+		for _, match := range alternatives {
+			if match(item, now) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (p *parser) parseAnd() (predicate, error) {
+	var terms []predicate
+	for {
+		p.skipSpace()
+		if p.eof() || p.src[p.pos] == ')' {
+			break
+		}
+		start := p.pos
+		if p.keyword("or") {
+			p.pos = start
+			break
+		}
+		if p.keyword("and") {
+			if len(terms) == 0 {
+				return nil, p.errorf("\"and\" needs a term on both sides")
+			}
+			continue
+		}
+		match, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, match)
+	}
+	switch len(terms) {
+	case 0:
+		return nil, nil
+	case 1:
+		return terms[0], nil
+	}
+	return func(item *Item, now time.Time) bool {
+		for _, match := range terms {
+			if !match(item, now) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (p *parser) parseUnary() (predicate, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("expected a term")
+	}
+	negate := false
+	if p.keyword("not") {
+		negate = true
+	} else if p.src[p.pos] == '-' && p.pos+1 < len(p.src) && !unicode.IsSpace(rune(p.src[p.pos+1])) {
+		negate = true
+		p.pos++
+	}
+	var match predicate
+	var err error
+	if negate {
+		match, err = p.parseUnary()
+	} else {
+		match, err = p.parsePrimary()
+	}
+	if err != nil || !negate {
+		return match, err
+	}
+	return func(item *Item, now time.Time) bool { return !match(item, now) }, nil
+}
+
+func (p *parser) parsePrimary() (predicate, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("expected a term")
+	}
+	if p.src[p.pos] == '(' {
+		p.pos++
+		match, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.eof() || p.src[p.pos] != ')' {
+			return nil, p.errorf("expected \")\"")
+		}
+		p.pos++
+		if match == nil {
+			return nil, p.errorf("empty parentheses")
+		}
+		return match, nil
+	}
+	if p.src[p.pos] == '"' {
+		text, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		return textTerm(text), nil
+	}
+	start := p.pos
+	for !p.eof() && !unicode.IsSpace(rune(p.src[p.pos])) && !strings.ContainsRune("()", rune(p.src[p.pos])) && p.operator() == "" {
+		p.pos++
+	}
+	word := p.src[start:p.pos]
+	op := p.operator()
+	if op == "" {
+		if word == "" {
+			return nil, p.errorf("unexpected %q", p.src[p.pos:p.pos+1])
+		}
+		return textTerm(word), nil
+	}
+	if word == "" {
+		return nil, p.errorf("expected a field before %q", op)
+	}
+	p.pos += len(op)
+	valuePos := p.pos
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	match, err := compileTerm(strings.ToLower(word), op, value)
+	if err != nil {
+		p.pos = valuePos
+		return nil, p.errorf("%s%s%s: %v", word, op, value, err)
+	}
+	return match, nil
+}
+
+// operator returns the comparison operator at the current position, if any.
+func (p *parser) operator() string {
+	for _, op := range []string{">=", "<=", "!=", ":", "=", ">", "<"} {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *parser) value() (string, error) {
+	if !p.eof() && p.src[p.pos] == '"' {
+		return p.quoted()
+	}
+	start := p.pos
+	for !p.eof() && !unicode.IsSpace(rune(p.src[p.pos])) && p.src[p.pos] != ')' {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a value")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	end := strings.IndexByte(p.src[start+1:], '"')
+	if end < 0 {
+		return "", p.errorf("unterminated quote")
+	}
+	p.pos = start + 1 + end + 1
+	return p.src[start+1 : start+1+end], nil
+}
+
+// textTerm matches a bare word against the name, the caption and the tags.
+func textTerm(text string) predicate {
+	text = strings.ToLower(text)
+	return func(item *Item, _ time.Time) bool {
+		if strings.Contains(strings.ToLower(path.Base(item.Path)), text) || strings.Contains(strings.ToLower(item.Caption), text) {
+			return true
+		}
+		for _, tag := range item.Tags {
+			if strings.EqualFold(tag, text) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var errOperator = errors.New("operator not supported by this field")
+
+func compileTerm(field, op, value string) (predicate, error) {
+	switch field {
+	case "kind", "orientation":
+		value = strings.ToLower(value)
+		allowed := []string{KindImage, KindVideo}
+		get := func(item *Item) string { return item.Kind }
+		if field == "orientation" {
+			allowed = []string{"landscape", "portrait", "square"}
+			get = orientation
+		}
+		if !slices.Contains(allowed, value) {
+			return nil, fmt.Errorf("expected one of %s", strings.Join(allowed, ", "))
+		}
+		return equality(op, func(item *Item) bool { return get(item) == value })
+	case "path":
+		rule, err := ignore.Compile(value, "", "")
+		if err != nil {
+			return nil, err
+		}
+		rules := ignore.Rules{rule}
+		return equality(op, func(item *Item) bool {
+			matched, ok := rules.MatchWithParents(item.Path)
+			return ok && !matched.Negate
+		})
+	case "name", "tag":
+		pattern := strings.ToLower(value)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		if field == "name" {
+			return equality(op, func(item *Item) bool {
+				ok, _ := path.Match(pattern, strings.ToLower(path.Base(item.Path)))
+				return ok
+			})
+		}
+		return equality(op, func(item *Item) bool {
+			for _, tag := range item.Tags {
+				if ok, _ := path.Match(pattern, strings.ToLower(tag)); ok {
+					return true
+				}
+			}
+			return false
+		})
+	case "caption":
+		text := strings.ToLower(value)
+		switch op {
+		case ":":
+			return func(item *Item, _ time.Time) bool { return strings.Contains(strings.ToLower(item.Caption), text) }, nil
+		case "=":
+			return func(item *Item, _ time.Time) bool { return strings.ToLower(item.Caption) == text }, nil
+		case "!=":
+			return func(item *Item, _ time.Time) bool { return !strings.Contains(strings.ToLower(item.Caption), text) }, nil
+		}
+		return nil, errOperator
+	case "favorite":
+		favorite, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("expected true or false")
+		}
+		return equality(op, func(item *Item) bool { return item.Favorite == favorite })
+	case "width", "height", "duration", "rating":
+		n, err := parseNumber(field, value)
+		if err != nil {
+			return nil, err
+		}
+		get := func(item *Item) float64 { return float64(item.Width) }
+		switch field {
+		case "height":
+			get = func(item *Item) float64 { return float64(item.Height) }
+		case "duration":
+			get = func(item *Item) float64 { return item.DurationSec }
+		case "rating":
+			get = func(item *Item) float64 { return float64(item.Rating) }
+		}
+		return compare(op, func(item *Item, _ time.Time) (float64, float64, float64) {
+			return get(item), n, n
+		})
+	case "date":
+		period, err := parseDate(value)
+		if err != nil {
+			return nil, err
+		}
+		match, err := compare(op, func(item *Item, now time.Time) (float64, float64, float64) {
+			start, end := period(now)
+			return float64(item.ModTime.Unix()), float64(start.Unix()), float64(end.Unix())
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Items whose date is unknown match no date term.
+		return func(item *Item, now time.Time) bool {
+			return !item.ModTime.IsZero() && match(item, now)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown field, expected one of %s", strings.Join(Fields, ", "))
+}
+
+func equality(op string, match func(item *Item) bool) (predicate, error) {
+	switch op {
+	case ":", "=":
+		return func(item *Item, _ time.Time) bool { return match(item) }, nil
+	case "!=":
+		return func(item *Item, _ time.Time) bool { return !match(item) }, nil
+	}
+	return nil, errOperator
+}
+
+// compare builds a comparison against the range [start, end) returned by values; a single
+// number has start == end and is compared as such.
+func compare(op string, values func(item *Item, now time.Time) (v, start, end float64)) (predicate, error) {
+	var check func(v, start, end float64) bool
+	switch op {
+	case ":", "=":
+		check = func(v, start, end float64) bool { return v == start || (v >= start && v < end) }
+	case "!=":
+		check = func(v, start, end float64) bool { return !(v == start || (v >= start && v < end)) }
+	case ">":
+		check = func(v, start, end float64) bool { return v > start && v >= end }
+	case ">=":
+		check = func(v, start, end float64) bool { return v >= start }
+	case "<":
+		check = func(v, start, end float64) bool { return v < start }
+	case "<=":
+		check = func(v, start, end float64) bool { return v <= start || v < end }
+	default:
+		return nil, errOperator
+	}
+	return func(item *Item, now time.Time) bool {
+		return check(values(item, now))
+	}, nil
+}
+
+func parseNumber(field, value string) (float64, error) {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n, nil
+	}
+	if field == "duration" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d.Seconds(), nil
+		}
+		return 0, errors.New("expected seconds or a duration such as 1m30s")
+	}
+	return 0, errors.New("expected a number")
+}
+
+// parseDate accepts a year, month or day such as 2024, 2024-05 or 2024-05-17, which stand for
+// the whole period, or an age such as -30d, -12h, -2w, -6m or -1y counted back from now.
+func parseDate(value string) (func(now time.Time) (time.Time, time.Time), error) {
+	if strings.HasPrefix(value, "-") && len(value) > 2 {
+		if n, err := strconv.Atoi(value[1 : len(value)-1]); err == nil && n >= 0 {
+			var back func(now time.Time) time.Time
+			switch value[len(value)-1] {
+			case 'h':
+				back = func(now time.Time) time.Time { return now.Add(-time.Duration(n) * time.Hour) }
+			case 'd':
+				back = func(now time.Time) time.Time { return now.AddDate(0, 0, -n) }
+			case 'w':
+				back = func(now time.Time) time.Time { return now.AddDate(0, 0, -7*n) }
+			case 'm':
+				back = func(now time.Time) time.Time { return now.AddDate(0, -n, 0) }
+			case 'y':
+				back = func(now time.Time) time.Time { return now.AddDate(-n, 0, 0) }
+			}
+			if back != nil {
+				return func(now time.Time) (time.Time, time.Time) {
+					t := back(now)
+					return t, t
+				}, nil
+			}
+		}
+	}
+	layouts := []struct {
+		layout string
+		next   func(t time.Time) time.Time
+	}{
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+		{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	}
+	for _, l := range layouts {
+		if t, err := time.ParseInLocation(l.layout, value, time.Local); err == nil {
+			end := l.next(t)
+			return func(time.Time) (time.Time, time.Time) { return t, end }, nil
+		}
+	}
+	return nil, errors.New("expected a date such as 2024-05-17, 2024-05 or 2024, or an age such as -30d")
+}
+
+func orientation(item *Item) string {
+	switch {
+	case item.Width <= 0 || item.Height <= 0:
+		return ""
+	case item.Width > item.Height:
+		return "landscape"
+	case item.Width < item.Height:
+		return "portrait"
+	}
+	return "square"
+}
+
+// Sorts are the keys results can be ordered by; a leading "-" reverses the order.
+var Sorts = []string{"path", "name", "date", "width", "height", "duration", "rating"}
+
+// Compare returns the order named by sort, such as "name" or "-date". An empty sort orders
+// by path, which also breaks ties.
+func Compare(sort string) (func(a, b Item) int, error) {
+	key, desc := strings.CutPrefix(sort, "-")
+	if key == "" {
+		key = "path"
+	}
+	var byKey func(a, b Item) int
+	switch key {
+	case "path":
+		byKey = func(a, b Item) int { return 0 }
+	case "name":
+		byKey = func(a, b Item) int { return strings.Compare(path.Base(a.Path), path.Base(b.Path)) }
+	case "date":
+		byKey = func(a, b Item) int { return a.ModTime.Compare(b.ModTime) }
+	case "width":
+		byKey = func(a, b Item) int { return a.Width - b.Width }
+	case "height":
+		byKey = func(a, b Item) int { return a.Height - b.Height }
+	case "duration":
+		byKey = func(a, b Item) int { return cmp.Compare(a.DurationSec, b.DurationSec) }
+	case "rating":
+		byKey = func(a, b Item) int { return a.Rating - b.Rating }
+	default:
+		return nil, fmt.Errorf("unknown sort %q, expected one of %s, optionally prefixed with -", sort, strings.Join(Sorts, ", "))
+	}
+	return func(a, b Item) int {
+		c := byKey(a, b)
+		if c == 0 {
+			c = strings.Compare(a.Path, b.Path)
+		}
+		if desc {
+			return -c
+		}
+		return c
+	}, nil
+}
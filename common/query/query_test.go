@@ -0,0 +1,104 @@
+package query
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQuery_Match(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	cat := Item{Kind: KindImage, Path: "2024/trip/cat.jpg", Width: 4000, Height: 3000, Tags: []string{"Cat", "outdoor"}, Caption: "A cat on the beach", ModTime: now.AddDate(0, 0, -3), Favorite: true, Rating: 4}
+	clip := Item{Kind: KindVideo, Path: "2023/clip.mp4", Width: 1080, Height: 1920, DurationSec: 95, ModTime: time.Date(2023, 5, 2, 0, 0, 0, 0, time.Local), Rating: 2}
+	unknown := Item{Kind: KindImage, Path: "misc/old.png", Width: 500, Height: 500}
+
+	cases := []struct {
+		expr string
+		want []string
+	}{
+		{"", []string{"2024/trip/cat.jpg", "2023/clip.mp4", "misc/old.png"}},
+		{"tag:cat path:2024/** date>=-30d", []string{"2024/trip/cat.jpg"}},
+		{"path:trip", []string{"2024/trip/cat.jpg"}},
+		{"kind:video or orientation:square", []string{"2023/clip.mp4", "misc/old.png"}},
+		{"-kind:video", []string{"2024/trip/cat.jpg", "misc/old.png"}},
+		{"not (kind:video or width<1000)", []string{"2024/trip/cat.jpg"}},
+		{"duration>1m30s and duration<=95", []string{"2023/clip.mp4"}},
+		{`caption:"on the beach"`, []string{"2024/trip/cat.jpg"}},
+		{"beach", []string{"2024/trip/cat.jpg"}},
+		{"date:2023-05", []string{"2023/clip.mp4"}},
+		{"date<2024", []string{"2023/clip.mp4"}},
+		{"date>2023", []string{"2024/trip/cat.jpg"}},
+		{"name:*.JPG or name:clip.*", []string{"2024/trip/cat.jpg", "2023/clip.mp4"}},
+		{"tag!=c* and kind:image", []string{"misc/old.png"}},
+		{"favorite:true", []string{"2024/trip/cat.jpg"}},
+		{"favorite:false rating>=1", []string{"2023/clip.mp4"}},
+		{"rating:0", []string{"misc/old.png"}},
+	}
+	for _, c := range cases {
+		q, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		var got []string
+		for _, item := range []Item{cat, clip, unknown} {
+			if q.Match(item, now) {
+				got = append(got, item.Path)
+			}
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%q: expected %v, got %v", c.expr, c.want, got)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, expr := range []string{
+		"color:red",
+		"kind:audio",
+		"width>wide",
+		"favorite:maybe",
+		"favorite>true",
+		"date>=yesterday",
+		"caption>x",
+		"(tag:cat",
+		"tag:cat)",
+		`caption:"open`,
+		"or tag:cat",
+		"tag:",
+		"path:[oops",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	items := []Item{
+		{Path: "b/2.jpg", ModTime: time.Unix(100, 0), Rating: 5},
+		{Path: "a/3.jpg", ModTime: time.Unix(300, 0)},
+		{Path: "c/1.jpg", ModTime: time.Unix(200, 0), Rating: 3},
+	}
+	for sort, want := range map[string][]string{
+		"":        {"a/3.jpg", "b/2.jpg", "c/1.jpg"},
+		"name":    {"c/1.jpg", "b/2.jpg", "a/3.jpg"},
+		"-date":   {"a/3.jpg", "c/1.jpg", "b/2.jpg"},
+		"-rating": {"b/2.jpg", "c/1.jpg", "a/3.jpg"},
+	} {
+		compare, err := Compare(sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.SortFunc(items, compare)
+		var got []string
+		for _, item := range items {
+			got = append(got, item.Path)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("sort %q: expected %v, got %v", sort, want, got)
+		}
+	}
+	if _, err := Compare("size"); err == nil {
+		t.Fatal("expected unknown sort rejected")
+	}
+}
@@ -14,6 +14,7 @@ type Storage interface {
 	OpenOrMkdir(name string) Storage
 	Save(name string, reader io.ReadCloser) error
 	Rename(oldName, newName string) error
+	Remove(name string) error
 	Exist(name string) bool
 	ReadDir(name string) ([]os.FileInfo, error)
 	Open(name string) (http.File, error)
@@ -31,6 +32,7 @@ type FileInf interface {
 
 var picExts = utils.NewSetWithSlice[string]([]string{"png", "jpg", "jpeg", "bmp", "gif"})
 var videoExts = utils.NewSetWithSlice[string]([]string{"mp4", "avi", "mkv", "webm", "flv", "wmv", "ts", "mov", "m4v", "ogv", "ogg"})
+var subtitleExts = utils.NewSetWithSlice[string]([]string{"srt", "ass", "ssa", "vtt"})
 
 func NewFs(str string) Storage {
 	return NewLocalFs(str)
@@ -44,6 +46,10 @@ func IsValidVideo(name string) bool {
 	return true
 }
 
+func IsSubtitle(name string) bool {
+	return subtitleExts.Contains(GetExt(name))
+}
+
 func IsValidPic(name string) bool {
 	ext := GetExt(name)
 	if !(picExts.Contains(ext)) {
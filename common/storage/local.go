@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -17,19 +18,47 @@ func (fs *LocalFs) OpenOrMkdir(name string) Storage {
 	return &LocalFs{SafetyOpenDirectory(fs.Name(), name)}
 }
 
+// Save replaces name atomically, so a crash never leaves a truncated file behind.
 func (fs *LocalFs) Save(name string, reader io.ReadCloser) error {
 	defer reader.Close()
 	fileName := path.Join(fs.Name(), name)
-	fileWriter, e := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
-	if e != nil {
-		return e
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+}
+
+// WriteFileAtomic writes to a temporary file in the same directory, fsyncs it and renames
+// it over fileName. Readers see either the old or the new content, never a partial one.
+func WriteFileAtomic(fileName string, write func(w io.Writer) error) error {
+	dir := path.Dir(fileName)
+	tmp, err := os.CreateTemp(dir, "."+path.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if err = write(tmp); err == nil {
+		err = tmp.Sync()
 	}
-	_, e = io.Copy(fileWriter, reader)
-	if e != nil {
-		return e
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
-	e = fileWriter.Close()
-	return e
+	if err == nil {
+		err = os.Chmod(tmpName, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	// Persist the rename itself; not every platform can sync a directory, so this is best effort.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
 }
 
 func (fs *LocalFs) Exist(name string) bool {
@@ -45,12 +74,23 @@ func (fs *LocalFs) Open(name string) (http.File, error) {
 	return os.Open(fileName)
 }
 
+// Rename moves oldName to newName, creating the directories newName needs.
 func (fs *LocalFs) Rename(oldName, newName string) error {
 	oldFileName := path.Join(fs.Name(), oldName)
 	newFileName := path.Join(fs.Name(), newName)
+	_ = SafetyCreateDirectoryByFileName(newFileName)
 	return os.Rename(oldFileName, newFileName)
 }
 
+// Remove deletes name and everything below it; a missing name is not an error. The root
+// itself cannot be removed.
+func (fs *LocalFs) Remove(name string) error {
+	if strings.Trim(path.Clean("/"+name), "/") == "" {
+		return errors.New("cannot remove the storage root")
+	}
+	return os.RemoveAll(path.Join(fs.Name(), name))
+}
+
 func (fs *LocalFs) Create(name string) (FileInf, error) {
 	target := path.Join(fs.Name(), name)
 	_ = SafetyCreateDirectoryByFileName(target)
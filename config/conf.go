@@ -1,11 +1,24 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"net/netip"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 
-	"github.com/XGFan/go-utils"
+	"golang.org/x/crypto/bcrypt"
+
+	"gallery/common/ignore"
+	"gallery/common/query"
+	"gallery/common/storage"
 )
 
 type Setup interface {
@@ -13,54 +26,431 @@ type Setup interface {
 }
 
 type GalleryConfig struct {
-	Port               int            `yaml:"port"`
-	Resource           ResourceConfig `yaml:"resource"`
-	ThumbnailProcessor string         `yaml:"thumbnail_processor"`
-	Cache              string         `yaml:"cache"`
+	Port               int             `yaml:"port"`
+	Resource           ResourceConfig  `yaml:"resource"`
+	ThumbnailProcessor string          `yaml:"thumbnail_processor"`
+	Cache              string          `yaml:"cache"`
+	Transcode          TranscodeConfig `yaml:"transcode"`
+	Poster             PosterConfig    `yaml:"poster"`
+	Libraries          []LibraryConfig `yaml:"libraries"`
+	Auth               AuthConfig      `yaml:"auth"`
+	Files              FilesConfig     `yaml:"files"`
 }
 
 type ResourceConfig struct {
 	Base           string              `yaml:"base"`
 	Exclude        []string            `yaml:"exclude"`
+	Include        []string            `yaml:"include"`
+	MaxFileSize    string              `yaml:"max_file_size"`
 	ForceThumbnail []string            `yaml:"force_thumbnail"`
 	VirtualPath    map[string][]string `yaml:"virtual_path"`
+	SmartAlbums    []SmartAlbumConfig  `yaml:"smart_albums"`
 	TagBlacklist   []string            `yaml:"tag_blacklist"`
 }
 
+// SmartAlbumConfig is a saved query whose matches are listed as a directory at the root of
+// the library. See package query for the syntax of Query and the accepted Sort values.
+type SmartAlbumConfig struct {
+	Name  string `yaml:"name" json:"name"`
+	Query string `yaml:"query" json:"query"`
+	Sort  string `yaml:"sort" json:"sort"`
+	Limit int    `yaml:"limit" json:"limit"`
+}
+
+// LibraryConfig is one media root of a multi-library server, served under /api/{name}/
+// and /file/{name}/. A library without a cache gets a directory named after it in cache.
+type LibraryConfig struct {
+	Name           string              `yaml:"name" json:"name"`
+	Base           string              `yaml:"base" json:"base"`
+	Cache          string              `yaml:"cache" json:"cache"`
+	Exclude        []string            `yaml:"exclude" json:"exclude"`
+	Include        []string            `yaml:"include" json:"include"`
+	MaxFileSize    string              `yaml:"max_file_size" json:"max_file_size"`
+	ForceThumbnail []string            `yaml:"force_thumbnail" json:"force_thumbnail"`
+	VirtualPath    map[string][]string `yaml:"virtual_path" json:"virtual_path"`
+	SmartAlbums    []SmartAlbumConfig  `yaml:"smart_albums" json:"smart_albums"`
+	TagBlacklist   []string            `yaml:"tag_blacklist" json:"tag_blacklist"`
+}
+
+// DefaultLibrary names the single library described by resource and cache
+// when libraries is not set.
+const DefaultLibrary = "default"
+
+// ReservedLibraryNames are the unprefixed API routes; a library with one of these names
+// would be shadowed by them under /api/.
+var ReservedLibraryNames = []string{"album", "auth", "collections", "debug", "download", "duplicates", "events", "explore", "files", "image", "libraries", "marks", "media", "meta", "playback", "poster", "random", "shares", "similar", "smart-albums", "tag", "trash", "tree", "upload", "uploads"}
+
+var libraryName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// TranscodeConfig tunes on-the-fly HLS transcoding; zero values fall back to defaults.
+type TranscodeConfig struct {
+	MaxConcurrent  int     `yaml:"max_concurrent"`
+	IdleTimeout    int     `yaml:"idle_timeout"`
+	SegmentSeconds float64 `yaml:"segment_seconds"`
+}
+
+// PosterConfig selects how the representative poster frame of a video is picked.
+// Strategy is one of "thumbnail" (default), "scene" or "offset".
+type PosterConfig struct {
+	Strategy       string  `yaml:"strategy"`
+	SceneThreshold float64 `yaml:"scene_threshold"`
+}
+
+// FilesConfig guards uploads, renames, moves and deletes. They need a user with write
+// permission, so with auth off they are refused unless AllowAnonymousWrite is set.
+type FilesConfig struct {
+	AllowAnonymousWrite bool `yaml:"allow_anonymous_write"`
+}
+
+// AuthConfig turns on authentication. Mode is one of AuthModes: "none" (default) serves
+// everyone, "local" requires a login or an API token of one of Users, and "proxy" also trusts
+// the user name a reverse proxy at one of TrustedProxies puts in ProxyHeader.
+type AuthConfig struct {
+	Mode           string       `yaml:"mode"`
+	ProxyHeader    string       `yaml:"proxy_header"`
+	TrustedProxies []string     `yaml:"trusted_proxies"`
+	SessionTimeout int          `yaml:"session_timeout"`
+	Users          []UserConfig `yaml:"users"`
+}
+
+// UserConfig is an account. Password is a bcrypt hash and Tokens are SHA-256 hashes (hex) of
+// API tokens, as printed by the hash-password and new-token commands. Allow and Deny are
+// gitignore-style patterns over paths inside the libraries: deny wins, and with allow set
+// nothing else is visible. Admins see everything.
+type UserConfig struct {
+	Name      string   `yaml:"name" json:"name"`
+	Password  string   `yaml:"password" json:"password"`
+	Tokens    []string `yaml:"tokens" json:"tokens"`
+	Admin     bool     `yaml:"admin" json:"admin"`
+	Write     bool     `yaml:"write" json:"write"`
+	Libraries []string `yaml:"libraries" json:"libraries"`
+	Allow     []string `yaml:"allow" json:"allow"`
+	Deny      []string `yaml:"deny" json:"deny"`
+}
+
+// Modes of AuthConfig.
+const (
+	AuthNone  = "none"
+	AuthLocal = "local"
+	AuthProxy = "proxy"
+)
+
+// AuthModes are the accepted values of auth.mode.
+var AuthModes = []string{AuthNone, AuthLocal, AuthProxy}
+
+// Setup fills in defaults and validates; an invalid config is fatal at startup.
 func (g *GalleryConfig) Setup() {
+	if err := g.Prepare(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Prepare fills in defaults and validates, returning the problems instead of exiting.
+// It is used by the command line and when a config is reloaded while the server runs.
+func (g *GalleryConfig) Prepare() error {
 	var err error
 	if g.Port == 0 {
 		g.Port = 8000
 	}
-	if g.Resource.Base == "" {
-		g.Resource.Base = "."
+	if g.Cache == "" {
+		g.Cache = ".cache"
 	}
-	if !path.IsAbs(g.Resource.Base) {
-		g.Resource.Base, err = filepath.Abs(g.Resource.Base)
-		utils.PanicIfErr(err)
+	if !path.IsAbs(g.Cache) {
+		if g.Cache, err = filepath.Abs(g.Cache); err != nil {
+			return err
+		}
 	}
-	if g.Resource.Exclude != nil {
-		for _, s := range g.Resource.Exclude {
-			if path.IsAbs(s) {
-				log.Fatal("resource.exclude only support relative path")
+	if len(g.Libraries) == 0 {
+		if g.Resource.Base == "" {
+			g.Resource.Base = "."
+		}
+		if !path.IsAbs(g.Resource.Base) {
+			if g.Resource.Base, err = filepath.Abs(g.Resource.Base); err != nil {
+				return err
 			}
 		}
 	}
-	if g.Resource.ForceThumbnail != nil {
-		for _, s := range g.Resource.ForceThumbnail {
-			if path.IsAbs(s) {
-				log.Fatal("resource.force_thumbnail only support relative path")
+	for i := range g.Libraries {
+		lib := &g.Libraries[i]
+		lib.Cache = g.libraryCache(*lib)
+		for _, dir := range []*string{&lib.Base, &lib.Cache} {
+			if *dir != "" && !path.IsAbs(*dir) {
+				if *dir, err = filepath.Abs(*dir); err != nil {
+					return err
+				}
 			}
 		}
 	}
-	if g.Cache == "" {
-		g.Cache = ".cache"
-	}
-	if !path.IsAbs(g.Cache) {
-		g.Cache, err = filepath.Abs(g.Cache)
-		utils.PanicIfErr(err)
+	if g.Poster.Strategy == "" {
+		g.Poster.Strategy = "thumbnail"
 	}
 	if g.ThumbnailProcessor == "" {
 		g.ThumbnailProcessor = "AUTO"
 	}
+	if g.Auth.Mode == "" {
+		g.Auth.Mode = AuthNone
+	}
+	if g.Auth.ProxyHeader == "" {
+		g.Auth.ProxyHeader = "Remote-User"
+	}
+	if len(g.Auth.TrustedProxies) == 0 {
+		g.Auth.TrustedProxies = []string{"127.0.0.1/32", "::1/128"}
+	}
+	if g.Auth.SessionTimeout == 0 {
+		g.Auth.SessionTimeout = 7 * 24 * 3600
+	}
+	return g.Validate()
+}
+
+// Validate checks the settings that cannot be defaulted and reports every problem at once
+// as a *ValidationError.
+func (g *GalleryConfig) Validate() error {
+	var problems ValidationError
+	if g.Port < 0 || g.Port > 65535 {
+		problems.add("port", "must be between 1 and 65535, got %d", g.Port)
+	}
+	if len(g.Libraries) == 0 {
+		validateResource(&problems, "resource.", g.Resource)
+	} else if !reflect.DeepEqual(g.Resource, ResourceConfig{}) {
+		problems.add("resource", "is not used when libraries is set, move it into a library")
+	}
+	seen := make(map[string]bool)
+	for i, lib := range g.Libraries {
+		key := fmt.Sprintf("libraries[%d].", i)
+		switch {
+		case lib.Name == "":
+			problems.add(key+"name", "is required")
+		case !libraryName.MatchString(lib.Name):
+			problems.add(key+"name", "only support letters, digits, - and _, got %q", lib.Name)
+		case slices.Contains(ReservedLibraryNames, lib.Name):
+			problems.add(key+"name", "%q is reserved by an API route", lib.Name)
+		case seen[lib.Name]:
+			problems.add(key+"name", "duplicate library %q", lib.Name)
+		}
+		seen[lib.Name] = true
+		if lib.Base == "" {
+			problems.add(key+"base", "is required")
+		}
+		validateResource(&problems, key, lib.Resource())
+	}
+	if g.Transcode.MaxConcurrent < 0 {
+		problems.add("transcode.max_concurrent", "must not be negative, got %d", g.Transcode.MaxConcurrent)
+	}
+	if g.Transcode.IdleTimeout < 0 {
+		problems.add("transcode.idle_timeout", "must not be negative, got %d", g.Transcode.IdleTimeout)
+	}
+	if g.Transcode.SegmentSeconds < 0 {
+		problems.add("transcode.segment_seconds", "must not be negative, got %g", g.Transcode.SegmentSeconds)
+	}
+	if g.Poster.Strategy != "" && !slices.Contains(PosterStrategies, g.Poster.Strategy) {
+		problems.add("poster.strategy", "only support %s, got %q", strings.Join(PosterStrategies, ", "), g.Poster.Strategy)
+	}
+	if g.Poster.SceneThreshold < 0 || g.Poster.SceneThreshold > 1 {
+		problems.add("poster.scene_threshold", "must be between 0 and 1, got %g", g.Poster.SceneThreshold)
+	}
+	validateAuth(&problems, g.Auth, libraryNames(g.LibraryList()))
+	return problems.err()
+}
+
+func validateAuth(problems *ValidationError, a AuthConfig, libs []string) {
+	if a.Mode != "" && !slices.Contains(AuthModes, a.Mode) {
+		problems.add("auth.mode", "only support %s, got %q", strings.Join(AuthModes, ", "), a.Mode)
+	}
+	if a.Mode == AuthLocal && len(a.Users) == 0 {
+		problems.add("auth.users", "at least one user is required in local mode")
+	}
+	for i, proxy := range a.TrustedProxies {
+		if _, err := ParsePrefix(proxy); err != nil {
+			problems.add(fmt.Sprintf("auth.trusted_proxies[%d]", i), "%v", err)
+		}
+	}
+	if a.SessionTimeout < 0 {
+		problems.add("auth.session_timeout", "must not be negative, got %d", a.SessionTimeout)
+	}
+	seen := make(map[string]bool)
+	for i, u := range a.Users {
+		key := fmt.Sprintf("auth.users[%d].", i)
+		switch {
+		case u.Name == "":
+			problems.add(key+"name", "is required")
+		case seen[u.Name]:
+			problems.add(key+"name", "duplicate user %q", u.Name)
+		}
+		seen[u.Name] = true
+		if u.Password != "" {
+			if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+				problems.add(key+"password", "must be a bcrypt hash, see the hash-password command")
+			}
+		}
+		for j, token := range u.Tokens {
+			if _, err := hex.DecodeString(token); err != nil || len(token) != sha256.Size*2 {
+				problems.add(fmt.Sprintf("%stokens[%d]", key, j), "must be the SHA-256 hash of a token in hex, see the new-token command")
+			}
+		}
+		for j, lib := range u.Libraries {
+			if !slices.Contains(libs, lib) {
+				problems.add(fmt.Sprintf("%slibraries[%d]", key, j), "unknown library %q", lib)
+			}
+		}
+		for _, field := range []string{"allow", "deny"} {
+			patterns := u.Allow
+			if field == "deny" {
+				patterns = u.Deny
+			}
+			for j, pattern := range patterns {
+				if _, err := ignore.Compile(pattern, "", ""); err != nil {
+					problems.add(fmt.Sprintf("%s%s[%d]", key, field, j), "%v", err)
+				}
+			}
+		}
+	}
+}
+
+// ParsePrefix parses a trusted proxy: an address such as 10.0.0.1 or a network such as 10.0.0.0/8.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("expected an IP address or a CIDR network, got %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func validateResource(problems *ValidationError, prefix string, r ResourceConfig) {
+	for _, key := range []string{"exclude", "include"} {
+		patterns := r.Exclude
+		if key == "include" {
+			patterns = r.Include
+		}
+		for i, pattern := range patterns {
+			if _, err := ignore.Compile(pattern, "", ""); err != nil {
+				problems.add(fmt.Sprintf("%s%s[%d]", prefix, key, i), "%v", err)
+			}
+		}
+	}
+	if _, err := ParseSize(r.MaxFileSize); err != nil {
+		problems.add(prefix+"max_file_size", "%v", err)
+	}
+	for i, s := range r.ForceThumbnail {
+		if path.IsAbs(s) {
+			problems.add(fmt.Sprintf("%sforce_thumbnail[%d]", prefix, i), "only support relative path, got %q", s)
+		}
+	}
+	names := make([]string, 0, len(r.VirtualPath))
+	for name := range r.VirtualPath {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i, p := range r.VirtualPath[name] {
+			if path.IsAbs(p) {
+				problems.add(fmt.Sprintf("%svirtual_path.%s[%d]", prefix, name, i), "only support relative path, got %q", p)
+			}
+		}
+	}
+	albums := make(map[string]bool)
+	for i, album := range r.SmartAlbums {
+		key := fmt.Sprintf("%ssmart_albums[%d].", prefix, i)
+		_, isVirtualPath := r.VirtualPath[album.Name]
+		switch {
+		case album.Name == "":
+			problems.add(key+"name", "is required")
+		case strings.Contains(album.Name, "/") || !storage.IsNormalFile(album.Name) || album.Name == "..":
+			problems.add(key+"name", "must be a directory name not starting with ., @ or ~, got %q", album.Name)
+		case albums[album.Name] || isVirtualPath:
+			problems.add(key+"name", "duplicate virtual directory %q", album.Name)
+		}
+		albums[album.Name] = true
+		if _, err := query.Parse(album.Query); err != nil {
+			problems.add(key+"query", "%v", err)
+		}
+		if _, err := query.Compare(album.Sort); err != nil {
+			problems.add(key+"sort", "%v", err)
+		}
+		if album.Limit < 0 {
+			problems.add(key+"limit", "must not be negative, got %d", album.Limit)
+		}
+	}
+}
+
+// Resource returns the library settings in the single-library layout.
+func (l LibraryConfig) Resource() ResourceConfig {
+	return ResourceConfig{
+		Base:           l.Base,
+		Exclude:        l.Exclude,
+		Include:        l.Include,
+		MaxFileSize:    l.MaxFileSize,
+		ForceThumbnail: l.ForceThumbnail,
+		VirtualPath:    l.VirtualPath,
+		SmartAlbums:    l.SmartAlbums,
+		TagBlacklist:   l.TagBlacklist,
+	}
+}
+
+// LibraryList returns the configured libraries, or the single library named DefaultLibrary
+// that resource and cache describe when libraries is not set.
+func (g GalleryConfig) LibraryList() []LibraryConfig {
+	if len(g.Libraries) > 0 {
+		return g.Libraries
+	}
+	return []LibraryConfig{{
+		Name:           DefaultLibrary,
+		Base:           g.Resource.Base,
+		Cache:          g.Cache,
+		Exclude:        g.Resource.Exclude,
+		Include:        g.Resource.Include,
+		MaxFileSize:    g.Resource.MaxFileSize,
+		ForceThumbnail: g.Resource.ForceThumbnail,
+		VirtualPath:    g.Resource.VirtualPath,
+		SmartAlbums:    g.Resource.SmartAlbums,
+		TagBlacklist:   g.Resource.TagBlacklist,
+	}}
+}
+
+// Library finds a library by name; an empty name picks the only library there is.
+func (g GalleryConfig) Library(name string) (LibraryConfig, error) {
+	libs := g.LibraryList()
+	if name == "" {
+		if len(libs) == 1 {
+			return libs[0], nil
+		}
+		return LibraryConfig{}, fmt.Errorf("choose a library: %s", strings.Join(libraryNames(libs), ", "))
+	}
+	for _, lib := range libs {
+		if lib.Name == name {
+			return lib, nil
+		}
+	}
+	return LibraryConfig{}, fmt.Errorf("unknown library %q, configured: %s", name, strings.Join(libraryNames(libs), ", "))
+}
+
+// ForLibrary returns the single-library view of g that serves lib: resource and cache
+// come from lib and libraries is cleared, the shared settings are kept.
+func (g GalleryConfig) ForLibrary(lib LibraryConfig) GalleryConfig {
+	view := g
+	view.Libraries = nil
+	view.Resource = lib.Resource()
+	view.Cache = g.libraryCache(lib)
+	return view
+}
+
+func (g GalleryConfig) libraryCache(lib LibraryConfig) string {
+	if lib.Cache != "" || len(g.Libraries) == 0 {
+		return lib.Cache
+	}
+	parent := g.Cache
+	if parent == "" {
+		parent = ".cache"
+	}
+	return filepath.Join(parent, lib.Name)
+}
+
+func libraryNames(libs []LibraryConfig) []string {
+	names := make([]string, 0, len(libs))
+	for _, lib := range libs {
+		names = append(names, lib.Name)
+	}
+	return names
 }
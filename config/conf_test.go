@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func problemKeys(t *testing.T, err error) []string {
+	t.Helper()
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	keys := make([]string, 0, len(verr.Problems))
+	for _, p := range verr.Problems {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
+
+func TestParse_ReportsUnknownKeysAndTypeErrorsTogether(t *testing.T) {
+	conf := GalleryConfig{Port: 9000}
+	data := []byte("port: abc\nresource:\n  exlude:\n    - tmp\n  force_thumbnail: [a]\nposter:\n  strategy: scene\n  extra: 1\n")
+	err := Parse(data, &conf)
+	want := []string{"resource.exlude", "poster.extra", "port"}
+	if got := problemKeys(t, err); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected problems %v, got %v (%v)", want, got, err)
+	}
+	if conf.Port != 9000 || conf.Poster.Strategy != "" {
+		t.Fatalf("expected config untouched on failure, got %+v", conf)
+	}
+
+	if err := Parse([]byte("port: 1234\nposter:\n  strategy: scene\n"), &conf); err != nil {
+		t.Fatalf("expected valid config, got %v", err)
+	}
+	if conf.Port != 1234 || conf.Poster.Strategy != "scene" {
+		t.Fatalf("expected decoded values, got %+v", conf)
+	}
+}
+
+func TestValidate_ListsEveryProblem(t *testing.T) {
+	conf := GalleryConfig{
+		Port: 70000,
+		Resource: ResourceConfig{
+			Exclude:     []string{"**/ok", "[oops"},
+			MaxFileSize: "huge",
+			VirtualPath: map[string][]string{"all": {"/x"}},
+			SmartAlbums: []SmartAlbumConfig{
+				{Name: "recent", Query: "date>=-30d", Sort: "-date"},
+				{Name: "all", Query: "kind:image"},
+				{Name: "bad", Query: "(tag:cat", Sort: "size", Limit: -1},
+			},
+		},
+		Poster: PosterConfig{Strategy: "random", SceneThreshold: 2},
+	}
+	want := []string{"port", "resource.exclude[1]", "resource.max_file_size", "resource.virtual_path.all[0]",
+		"resource.smart_albums[1].name", "resource.smart_albums[2].query", "resource.smart_albums[2].sort", "resource.smart_albums[2].limit",
+		"poster.strategy", "poster.scene_threshold"}
+	if got := problemKeys(t, conf.Validate()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected problems %v, got %v", want, got)
+	}
+}
+
+func TestApplyEnv_OverridesEveryKind(t *testing.T) {
+	conf := GalleryConfig{Port: 8000, Resource: ResourceConfig{Exclude: []string{"old"}}}
+	err := applyEnv(&conf, []string{
+		"GALLERY_PORT=9001",
+		"GALLERY_RESOURCE_EXCLUDE=a, b,",
+		"GALLERY_RESOURCE_FORCE_THUMBNAIL=[\"c\"]",
+		"GALLERY_RESOURCE_VIRTUAL_PATH={\"all\":[\"a\",\"b\"]}",
+		"GALLERY_POSTER_SCENE_THRESHOLD=0.5",
+		"OTHER=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GalleryConfig{
+		Port: 9001,
+		Resource: ResourceConfig{
+			Exclude:        []string{"a", "b"},
+			ForceThumbnail: []string{"c"},
+			VirtualPath:    map[string][]string{"all": {"a", "b"}},
+		},
+		Poster: PosterConfig{SceneThreshold: 0.5},
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Fatalf("expected %+v, got %+v", want, conf)
+	}
+
+	err = applyEnv(&conf, []string{"GALLERY_PORT=x", "GALLERY_TRANSCODE_SEGMENT_SECONDS=y"})
+	if got := problemKeys(t, err); !reflect.DeepEqual(got, []string{"GALLERY_PORT", "GALLERY_TRANSCODE_SEGMENT_SECONDS"}) {
+		t.Fatalf("expected both variables reported, got %v", got)
+	}
+	if conf.Port != 9001 {
+		t.Fatalf("expected config untouched on failure, got port=%d", conf.Port)
+	}
+}
+
+func TestSchema_PublishedFileIsUpToDate(t *testing.T) {
+	published, err := os.ReadFile("../docs/gallery.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(published, Schema()) {
+		t.Fatal("docs/gallery.schema.json is stale, run go generate ./config")
+	}
+}
+
+func TestLibraries_ValidateAndView(t *testing.T) {
+	conf := GalleryConfig{
+		Cache:    "/var/cache/gallery",
+		Resource: ResourceConfig{Base: "/old"},
+		Libraries: []LibraryConfig{
+			{Name: "photos", Base: "/data/photos", Exclude: []string{"tmp"}},
+			{Name: "photos", Base: "/data/other"},
+			{Name: "tree", Base: "/data/tree"},
+			{Name: "bad name"},
+		},
+	}
+	want := []string{"resource", "libraries[1].name", "libraries[2].name", "libraries[3].name", "libraries[3].base"}
+	if got := problemKeys(t, conf.Validate()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected problems %v, got %v", want, got)
+	}
+
+	lib, err := conf.Library("photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := conf.ForLibrary(lib)
+	if view.Resource.Base != "/data/photos" || view.Cache != "/var/cache/gallery/photos" || view.Libraries != nil {
+		t.Fatalf("unexpected library view %+v", view)
+	}
+	if _, err := conf.Library(""); err == nil {
+		t.Fatal("expected a name to be required with several libraries")
+	}
+
+	single := GalleryConfig{Resource: ResourceConfig{Base: "/data"}, Cache: "/cache"}
+	if lib, err := single.Library(""); err != nil || lib.Name != DefaultLibrary || single.ForLibrary(lib).Cache != "/cache" {
+		t.Fatalf("expected the default library, got %+v, %v", lib, err)
+	}
+}
+
+func TestValidate_Auth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := GalleryConfig{
+		Resource: ResourceConfig{Base: "/data"},
+		Auth: AuthConfig{
+			Mode:           AuthLocal,
+			TrustedProxies: []string{"10.0.0.1", "10.0.0.0/8", "proxy"},
+			Users: []UserConfig{
+				{Name: "anna", Password: string(hash), Tokens: []string{strings.Repeat("ab", 32)}, Allow: []string{"trips/"}},
+				{Name: "anna", Password: "secret", Tokens: []string{"abc"}},
+				{Libraries: []string{"archive"}, Deny: []string{"[oops"}},
+			},
+		},
+	}
+	want := []string{"auth.trusted_proxies[2]", "auth.users[1].name", "auth.users[1].password", "auth.users[1].tokens[0]",
+		"auth.users[2].name", "auth.users[2].libraries[0]", "auth.users[2].deny[0]"}
+	if got := problemKeys(t, conf.Validate()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected problems %v, got %v", want, got)
+	}
+
+	conf = GalleryConfig{Auth: AuthConfig{Mode: "ldap"}}
+	if got := problemKeys(t, conf.Validate()); !reflect.DeepEqual(got, []string{"auth.mode"}) {
+		t.Fatalf("expected the mode rejected, got %v", got)
+	}
+	conf = GalleryConfig{Auth: AuthConfig{Mode: AuthLocal}}
+	if got := problemKeys(t, conf.Validate()); !reflect.DeepEqual(got, []string{"auth.users"}) {
+		t.Fatalf("expected users required, got %v", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"": 0, "1024": 1024, "4GB": 4 << 30, "500 mb": 500 << 20, "1.5G": 3 << 29} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; expected %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseSize("-1GB"); err == nil {
+		t.Error("expected a negative size to be rejected")
+	}
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables that override config keys: the key path is
+// upper-cased with dots replaced by underscores, so resource.base is GALLERY_RESOURCE_BASE
+// and transcode.max_concurrent is GALLERY_TRANSCODE_MAX_CONCURRENT.
+const EnvPrefix = "GALLERY_"
+
+// EnvName returns the environment variable that overrides key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// ApplyEnv overrides conf with every GALLERY_* variable that is set. Lists take a comma
+// separated value or a JSON array, resource.virtual_path takes a JSON object and
+// GALLERY_LIBRARIES a JSON array of libraries. Values that do
+// not parse are reported together as a *ValidationError and leave conf untouched.
+func ApplyEnv(conf *GalleryConfig) error {
+	return applyEnv(conf, os.Environ())
+}
+
+func applyEnv(conf *GalleryConfig, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, EnvPrefix) {
+			env[name] = value
+		}
+	}
+	next := *conf
+	v := reflect.ValueOf(&next).Elem()
+	var problems ValidationError
+	for _, f := range configFields {
+		name := EnvName(f.key)
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+		delete(env, name)
+		if err := setFromEnv(v.FieldByIndex(f.index), raw); err != nil {
+			problems.add(name, "%v", err)
+		}
+	}
+	for name := range env {
+		log.Printf("Ignore unknown environment variable %s", name)
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+	*conf = next
+	return nil
+}
+
+func setFromEnv(v reflect.Value, raw string) error {
+	trimmed := strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(trimmed)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(trimmed)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if strings.HasPrefix(trimmed, "[") || v.Type().Elem().Kind() != reflect.String {
+			return decodeEnvJSON(v, trimmed, "a JSON array")
+		}
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item))
+			}
+		}
+		v.Set(items)
+	case reflect.Map:
+		return decodeEnvJSON(v, trimmed, "a JSON object")
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func decodeEnvJSON(v reflect.Value, raw string, expected string) error {
+	target := reflect.New(v.Type())
+	if err := json.Unmarshal([]byte(raw), target.Interface()); err != nil {
+		return fmt.Errorf("expected %s: %v", expected, err)
+	}
+	v.Set(target.Elem())
+	return nil
+}
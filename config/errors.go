@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is one problem with a config key, named by its YAML path such as
+// "resource.exclude[0]" or by the environment variable it came from.
+type FieldError struct {
+	Key     string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Key == "" {
+		return e.Message
+	}
+	return e.Key + ": " + e.Message
+}
+
+// ValidationError lists every problem found in a config, so that one run reports all typos.
+type ValidationError struct {
+	Problems []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0].Error()
+	}
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("invalid config, %d problems:", len(e.Problems)))
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationError) add(key string, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, FieldError{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns nil when there is nothing to report, keeping callers' err != nil checks honest.
+func (e *ValidationError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// field is a leaf config key: its dotted YAML path and where it lives in GalleryConfig.
+type field struct {
+	key   string
+	index []int
+	typ   reflect.Type
+}
+
+// configFields lists every leaf key, in declaration order. Parse, ApplyEnv and Schema all
+// derive from it, so a new field in GalleryConfig is picked up everywhere.
+var configFields = collectFields(reflect.TypeOf(GalleryConfig{}), "", nil)
+
+func collectFields(t reflect.Type, prefix string, index []int) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := yamlName(f)
+		if name == "" {
+			continue
+		}
+		idx := append(append([]int(nil), index...), i)
+		if f.Type.Kind() == reflect.Struct {
+			fields = append(fields, collectFields(f.Type, prefix+name+".", idx)...)
+			continue
+		}
+		fields = append(fields, field{key: prefix + name, index: idx, typ: f.Type})
+	}
+	return fields
+}
+
+// yamlName returns the key yaml.v3 uses for a struct field, "" for skipped fields.
+func yamlName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// structField finds the field of struct type t that YAML key name maps to.
+func structField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); yamlName(f) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// closestKey suggests the key of t a misspelt name was probably meant to be.
+func closestKey(t reflect.Type, name string) string {
+	best, bestDistance := "", 3
+	for i := 0; i < t.NumField(); i++ {
+		candidate := yamlName(t.Field(i))
+		if candidate == "" {
+			continue
+		}
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
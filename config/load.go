@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Parse decodes a gallery.yaml document into conf. Unlike yaml.Unmarshal it is strict:
+// unknown keys and values of the wrong type are all reported in one *ValidationError,
+// and conf is left untouched when there is any problem.
+func Parse(data []byte, conf *GalleryConfig) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return &ValidationError{Problems: []FieldError{{Message: err.Error()}}}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return &ValidationError{Problems: []FieldError{{Message: fmt.Sprintf("line %d: expected a mapping of config keys", root.Line)}}}
+	}
+
+	var problems ValidationError
+	keyAt := make(map[int]string)
+	checkKeys(root, reflect.TypeOf(GalleryConfig{}), "", keyAt, &problems)
+
+	next := *conf
+	if err := root.Decode(&next); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return &ValidationError{Problems: []FieldError{{Message: err.Error()}}}
+		}
+		for _, msg := range typeErr.Errors {
+			problems.Problems = append(problems.Problems, typeProblem(msg, keyAt))
+		}
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+	*conf = next
+	return nil
+}
+
+// checkKeys reports keys of node that t has no field for and records which key each line
+// holds, so decode errors can be attributed to a key.
+func checkKeys(node *yaml.Node, t reflect.Type, prefix string, keyAt map[int]string, problems *ValidationError) {
+	if node.Kind != yaml.MappingNode || t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		key := prefix + k.Value
+		keyAt[k.Line] = key
+		f, ok := structField(t, k.Value)
+		if !ok {
+			msg := fmt.Sprintf("unknown key at line %d", k.Line)
+			if suggestion := closestKey(t, k.Value); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", prefix+suggestion)
+			}
+			problems.add(key, "%s", msg)
+			continue
+		}
+		if v.Kind == yaml.SequenceNode && f.Type.Kind() == reflect.Slice {
+			for j, item := range v.Content {
+				itemKey := fmt.Sprintf("%s[%d]", key, j)
+				keyAt[item.Line] = itemKey
+				checkKeys(item, f.Type.Elem(), itemKey+".", keyAt, problems)
+			}
+			continue
+		}
+		checkKeys(v, f.Type, key+".", keyAt, problems)
+	}
+}
+
+func typeProblem(msg string, keyAt map[int]string) FieldError {
+	m := typeErrorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return FieldError{Message: msg}
+	}
+	line, _ := strconv.Atoi(m[1])
+	key, ok := keyAt[line]
+	if !ok {
+		return FieldError{Message: msg}
+	}
+	return FieldError{Key: key, Message: m[2] + " at line " + m[1]}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+//go:generate go run schema_gen.go ../docs/gallery.schema.json
+
+// SchemaID is where the generated schema is published in the repository.
+const SchemaID = "https://raw.githubusercontent.com/XGFan/gallery/main/docs/gallery.schema.json"
+
+// PosterStrategies are the accepted values of poster.strategy.
+var PosterStrategies = []string{"thumbnail", "scene", "offset"}
+
+// keyDocs describes every key in the schema, shown by editors on hover and completion.
+var keyDocs = map[string]string{
+	"port":                             "监听端口，默认 8000",
+	"resource":                         "媒体库设置",
+	"resource.base":                    "媒体库目录，默认当前目录",
+	"resource.exclude":                 "扫描时排除的 gitignore 风格模式，! 开头表示重新包含，re: 开头为正则表达式",
+	"resource.include":                 "只列出匹配这些模式的文件，目录仍会遍历",
+	"resource.max_file_size":           "跳过超过此大小的文件，如 2GB、500MB，空表示不限",
+	"resource.force_thumbnail":         "总是输出缩略图而非原图的相对路径前缀",
+	"resource.virtual_path":            "虚拟目录：名称到若干相对路径的映射",
+	"resource.smart_albums":            "智能相册：按查询条件筛选媒体，扫描后重新计算并作为根目录下的目录展示",
+	"resource.smart_albums[].name":     "相册名，即根目录下的目录名",
+	"resource.smart_albums[].query":    "查询表达式，如 tag:cat path:2024/** date>=-30d kind:image",
+	"resource.smart_albums[].sort":     "排序：path（默认）、name、date、width、height、duration、rating，前加 - 表示倒序",
+	"resource.smart_albums[].limit":    "最多列出的数量，0 表示不限",
+	"resource.tag_blacklist":           "不在标签列表中展示的标签",
+	"thumbnail_processor":              "缩略图处理器，默认 AUTO",
+	"cache":                            "缓存目录，默认 .cache",
+	"transcode":                        "HLS 实时转码设置，0 表示使用默认值",
+	"transcode.max_concurrent":         "同时运行的转码任务数",
+	"transcode.idle_timeout":           "转码会话空闲多少秒后停止",
+	"transcode.segment_seconds":        "HLS 分片时长（秒）",
+	"poster":                           "视频封面设置",
+	"poster.strategy":                  "封面帧选取方式：thumbnail（默认）、scene 或 offset",
+	"poster.scene_threshold":           "scene 策略的场景变化阈值（0~1），0 表示默认 0.3",
+	"libraries":                        "多个媒体库，设置后不再使用 resource；第一个库同时提供不带库名的路由",
+	"libraries[].name":                 "库名，用于 /api/{name}/ 与 /file/{name}/ 等路由",
+	"libraries[].base":                 "媒体库目录",
+	"libraries[].cache":                "缓存目录，默认 cache 下与库同名的子目录",
+	"libraries[].exclude":              "扫描时排除的 gitignore 风格模式，! 开头表示重新包含，re: 开头为正则表达式",
+	"libraries[].include":              "只列出匹配这些模式的文件，目录仍会遍历",
+	"libraries[].max_file_size":        "跳过超过此大小的文件，如 2GB、500MB，空表示不限",
+	"libraries[].force_thumbnail":      "总是输出缩略图而非原图的相对路径前缀",
+	"libraries[].virtual_path":         "虚拟目录：名称到若干相对路径的映射",
+	"libraries[].smart_albums":         "智能相册：按查询条件筛选媒体，扫描后重新计算并作为根目录下的目录展示",
+	"libraries[].smart_albums[].name":  "相册名，即根目录下的目录名",
+	"libraries[].smart_albums[].query": "查询表达式，如 tag:cat path:2024/** date>=-30d kind:image",
+	"libraries[].smart_albums[].sort":  "排序：path（默认）、name、date、width、height、duration、rating，前加 - 表示倒序",
+	"libraries[].smart_albums[].limit": "最多列出的数量，0 表示不限",
+	"libraries[].tag_blacklist":        "不在标签列表中展示的标签",
+	"auth":                             "认证与访问控制，默认关闭",
+	"auth.mode":                        "none（默认，不认证）、local（本地用户登录或 API 令牌）或 proxy（另外信任反向代理传入的用户名）",
+	"auth.proxy_header":                "proxy 模式下携带用户名的请求头，默认 Remote-User",
+	"auth.trusted_proxies":             "proxy 模式下信任的反向代理地址或网段，默认仅本机",
+	"auth.session_timeout":             "登录会话有效期（秒），默认 7 天",
+	"auth.users":                       "用户列表",
+	"auth.users[].name":                "用户名",
+	"auth.users[].password":            "bcrypt 密码哈希，由 hash-password 命令生成",
+	"auth.users[].tokens":              "API 令牌的 SHA-256 哈希（十六进制），由 new-token 命令生成",
+	"auth.users[].admin":               "管理员：不受路径规则限制，可访问调试接口与 pprof",
+	"auth.users[].write":               "允许修改：收藏、评分、智能相册、收藏集与封面等",
+	"auth.users[].libraries":           "可访问的媒体库，空表示全部",
+	"auth.users[].allow":               "只允许访问匹配的路径（gitignore 风格），空表示全部",
+	"auth.users[].deny":                "禁止访问匹配的路径（gitignore 风格），优先于 allow",
+	"files":                            "上传与文件管理设置",
+	"files.allow_anonymous_write":      "未开启认证时也允许上传、重命名、移动与删除文件，默认 false",
+}
+
+// keyRequired lists the keys an object must have.
+var keyRequired = map[string][]string{
+	"libraries[]":                {"name", "base"},
+	"auth.users[]":               {"name"},
+	"resource.smart_albums[]":    {"name", "query"},
+	"libraries[].smart_albums[]": {"name", "query"},
+}
+
+// keyConstraints add the range and enum checks of Validate to the schema.
+var keyConstraints = map[string]map[string]interface{}{
+	"port":                             {"minimum": 0, "maximum": 65535},
+	"transcode.max_concurrent":         {"minimum": 0},
+	"transcode.idle_timeout":           {"minimum": 0},
+	"transcode.segment_seconds":        {"minimum": 0},
+	"poster.strategy":                  {"enum": PosterStrategies},
+	"poster.scene_threshold":           {"minimum": 0, "maximum": 1},
+	"auth.mode":                        {"enum": AuthModes},
+	"auth.session_timeout":             {"minimum": 0},
+	"resource.smart_albums[].limit":    {"minimum": 0},
+	"libraries[].smart_albums[].limit": {"minimum": 0},
+	"libraries[].name":                 {"pattern": libraryName.String(), "not": map[string]interface{}{"enum": ReservedLibraryNames}},
+}
+
+// Schema returns the JSON Schema of gallery.yaml, generated from GalleryConfig.
+// Point an editor at it with a "# yaml-language-server: $schema=<SchemaID>" comment.
+func Schema() []byte {
+	schema := typeSchema(reflect.TypeOf(GalleryConfig{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaID
+	schema["title"] = "gallery.yaml"
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(data, '\n')
+}
+
+func typeSchema(t reflect.Type, key string) map[string]interface{} {
+	schema := make(map[string]interface{})
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name := yamlName(f); name != "" {
+				properties[name] = typeSchema(f.Type, joinKey(key, name))
+			}
+		}
+		if required := keyRequired[key]; required != nil {
+			schema["required"] = required
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = typeSchema(t.Elem(), "")
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = typeSchema(t.Elem(), key+"[]")
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Int:
+		schema["type"] = "integer"
+	case reflect.Float64:
+		schema["type"] = "number"
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	}
+	if doc, ok := keyDocs[key]; ok {
+		schema["description"] = doc
+	}
+	for k, v := range keyConstraints[key] {
+		schema[k] = v
+	}
+	return schema
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,19 @@
+//go:build ignore
+
+// schema_gen writes the JSON Schema of gallery.yaml; run it with go generate ./config.
+package main
+
+import (
+	"gallery/config"
+	"log"
+	"os"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: go run schema_gen.go <output>")
+	}
+	if err := os.WriteFile(os.Args[1], config.Schema(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"gallery/common/query"
+	"gallery/common/storage"
+)
+
+// SmartAlbum is a saved query whose matches are listed as a directory at the root of the
+// tree. Query uses the syntax of package query; Sort is one of query.Sorts, optionally
+// prefixed with "-", and a positive Limit keeps only the first matches.
+type SmartAlbum struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Sort  string `json:"sort,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// FavoritesAlbum is the built-in smart album listing every favorite. A virtual path, smart
+// album or real directory of the same name at the root takes precedence.
+const FavoritesAlbum = "Favorites"
+
+var favoritesAlbum, _ = SmartAlbum{Name: FavoritesAlbum, Query: "favorite:true", Sort: "-rating"}.compile()
+
+type compiledAlbum struct {
+	SmartAlbum
+	query   *query.Query
+	compare func(a, b query.Item) int
+}
+
+// Validate checks the name, query and sort of the album.
+func (a SmartAlbum) Validate() error {
+	_, err := a.compile()
+	return err
+}
+
+func (a SmartAlbum) compile() (compiledAlbum, error) {
+	if a.Name == "" || strings.Contains(a.Name, "/") || !storage.IsNormalFile(a.Name) || a.Name == ".." {
+		return compiledAlbum{}, fmt.Errorf("invalid album name %q", a.Name)
+	}
+	q, err := query.Parse(a.Query)
+	if err != nil {
+		return compiledAlbum{}, fmt.Errorf("album %s: query %w", a.Name, err)
+	}
+	compare, err := query.Compare(a.Sort)
+	if err != nil {
+		return compiledAlbum{}, fmt.Errorf("album %s: %w", a.Name, err)
+	}
+	if a.Limit < 0 {
+		return compiledAlbum{}, fmt.Errorf("album %s: limit must not be negative", a.Name)
+	}
+	return compiledAlbum{SmartAlbum: a, query: q, compare: compare}, nil
+}
+
+// SetSmartAlbums replaces the smart albums; they are evaluated by the next ApplyVirtualPaths.
+// Invalid albums are reported and left out.
+func (s *Scanner) SetSmartAlbums(albums []SmartAlbum) error {
+	compiled := make([]compiledAlbum, 0, len(albums))
+	var errs []error
+	for _, album := range albums {
+		c, err := album.compile()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+	s.rulesMu.Lock()
+	s.smartAlbums = compiled
+	s.rulesMu.Unlock()
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("Ignoring invalid smart albums: %v", err)
+		return err
+	}
+	return nil
+}
+
+type albumMatch struct {
+	item  query.Item
+	image *ImageNode
+	video *VideoNode
+}
+
+// evaluateAlbums runs every album query over the real directories of root in one walk.
+// The caller holds rulesMu.
+func (s *Scanner) evaluateAlbums(root *TraverseNode) map[string]*TraverseNode {
+	albums := s.smartAlbums
+	if s.showFavorites(root) {
+		albums = append(slices.Clip(albums), favoritesAlbum)
+	}
+	now := time.Now()
+	matches := make([][]albumMatch, len(albums))
+	var walk func(node *TraverseNode)
+	walk = func(node *TraverseNode) {
+		node.mu.RLock()
+		for i := range node.Images {
+			img := node.Images[i]
+			item := imageItem(img)
+			for a, album := range albums {
+				if album.query.Match(item, now) {
+					matches[a] = append(matches[a], albumMatch{item: item, image: &img})
+				}
+			}
+		}
+		for i := range node.Videos {
+			vid := node.Videos[i]
+			item := videoItem(vid)
+			for a, album := range albums {
+				if album.query.Match(item, now) {
+					matches[a] = append(matches[a], albumMatch{item: item, video: &vid})
+				}
+			}
+		}
+		children := make([]*TraverseNode, 0, len(node.Directories))
+		for _, child := range node.Directories {
+			if !child.IsVirtual() {
+				children = append(children, child)
+			}
+		}
+		node.mu.RUnlock()
+		for _, child := range children {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	result := make(map[string]*TraverseNode, len(albums))
+	for a, album := range albums {
+		found := matches[a]
+		slices.SortFunc(found, func(x, y albumMatch) int { return album.compare(x.item, y.item) })
+		if album.Limit > 0 && len(found) > album.Limit {
+			found = found[:album.Limit]
+		}
+		node := &TraverseNode{
+			Node:        Node{Name: album.Name, Path: album.Name, LastScanID: virtualScanID},
+			Images:      make([]ImageNode, 0),
+			Videos:      make([]VideoNode, 0),
+			Directories: make(map[string]*TraverseNode),
+		}
+		for _, m := range found {
+			if m.image != nil {
+				node.Images = append(node.Images, *m.image)
+			} else {
+				node.Videos = append(node.Videos, *m.video)
+			}
+		}
+		result[album.Name] = node
+	}
+	return result
+}
+
+// showFavorites reports whether nothing else takes the name of FavoritesAlbum.
+func (s *Scanner) showFavorites(root *TraverseNode) bool {
+	if _, ok := s.virtualPaths[FavoritesAlbum]; ok {
+		return false
+	}
+	for _, album := range s.smartAlbums {
+		if album.Name == FavoritesAlbum {
+			return false
+		}
+	}
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+	node, ok := root.Directories[FavoritesAlbum]
+	return !ok || node.IsVirtual()
+}
+
+// SelectMedia keeps the images and videos matching q and, unless compare is nil, orders each
+// list by it. Either may be nil.
+func SelectMedia(images []ImageNode, videos []VideoNode, q *query.Query, compare func(a, b query.Item) int) ([]ImageNode, []VideoNode) {
+	now := time.Now()
+	selectedImages := make([]ImageNode, 0, len(images))
+	for _, img := range images {
+		if q == nil || q.Match(imageItem(img), now) {
+			selectedImages = append(selectedImages, img)
+		}
+	}
+	selectedVideos := make([]VideoNode, 0, len(videos))
+	for _, vid := range videos {
+		if q == nil || q.Match(videoItem(vid), now) {
+			selectedVideos = append(selectedVideos, vid)
+		}
+	}
+	if compare != nil {
+		slices.SortStableFunc(selectedImages, func(a, b ImageNode) int { return compare(imageItem(a), imageItem(b)) })
+		slices.SortStableFunc(selectedVideos, func(a, b VideoNode) int { return compare(videoItem(a), videoItem(b)) })
+	}
+	return selectedImages, selectedVideos
+}
+
+func imageItem(img ImageNode) query.Item {
+	return query.Item{
+		Kind:     query.KindImage,
+		Path:     img.Path,
+		Width:    img.Width,
+		Height:   img.Height,
+		Tags:     tagNames(img.Tags),
+		Caption:  img.Caption,
+		ModTime:  unixTime(img.ModTime),
+		Favorite: img.Favorite,
+		Rating:   img.Rating,
+	}
+}
+
+func videoItem(vid VideoNode) query.Item {
+	return query.Item{
+		Kind:        query.KindVideo,
+		Path:        vid.Path,
+		Width:       vid.Width,
+		Height:      vid.Height,
+		DurationSec: vid.DurationSec,
+		Tags:        tagNames(vid.Tags),
+		Caption:     vid.Caption,
+		ModTime:     unixTime(vid.ModTime),
+		Favorite:    vid.Favorite,
+		Rating:      vid.Rating,
+	}
+}
+
+func tagNames(tags []TagInfo) []string {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Tag)
+	}
+	return names
+}
+
+func unixTime(sec int64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyVirtualPaths_EvaluatesSmartAlbums(t *testing.T) {
+	now := time.Now().Unix()
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	trip := root.Locate("2024/trip")
+	trip.Images = []ImageNode{
+		{Node: Node{Name: "old.jpg", Path: "2024/trip/old.jpg"}, Size: Size{Width: 4, Height: 3}, Tags: []TagInfo{{Tag: "cat", Value: 90}}, ModTime: now - 90*86400},
+		{Node: Node{Name: "new.jpg", Path: "2024/trip/new.jpg"}, Size: Size{Width: 4, Height: 3}, Tags: []TagInfo{{Tag: "cat", Value: 90}}, ModTime: now - 86400},
+	}
+	trip.Videos = []VideoNode{{Node: Node{Name: "clip.mp4", Path: "2024/trip/clip.mp4"}, Tags: []TagInfo{{Tag: "cat", Value: 90}}, ModTime: now}}
+	root.Locate("misc").Images = []ImageNode{{Node: Node{Name: "cat.png", Path: "misc/cat.png"}, Size: Size{Width: 1, Height: 1}}}
+
+	scanner := NewScanner(newFakeStorage(nil), nil, NewCacheManager(newFakeStorage(nil), nil), map[string][]string{"merged": {"2024/trip"}}, nil)
+	err := scanner.SetSmartAlbums([]SmartAlbum{
+		{Name: "cats", Query: "tag:cat path:2024/**", Sort: "-date", Limit: 2},
+		{Name: "recent", Query: "date>=-30d kind:image"},
+		{Name: "bad", Query: "(oops"},
+	})
+	if err == nil {
+		t.Fatal("expected the invalid album reported")
+	}
+	// The second pass sees the virtual folders of the first and must skip them.
+	scanner.ApplyVirtualPaths(root)
+	scanner.ApplyVirtualPaths(root)
+
+	cats := root.Directories["cats"]
+	if cats == nil || !cats.IsVirtual() || len(cats.Videos) != 1 || len(cats.Images) != 1 || cats.Images[0].Name != "new.jpg" {
+		t.Fatalf("expected newest two cat items, got %+v", cats)
+	}
+	recent := root.Directories["recent"]
+	if recent == nil || len(recent.Images) != 1 || recent.Images[0].Path != "2024/trip/new.jpg" {
+		t.Fatalf("expected the merged virtual path not to count twice, got %+v", recent)
+	}
+	if merged := root.Directories["merged"]; merged == nil || len(merged.Videos) != 1 {
+		t.Fatalf("expected virtual path to keep videos, got %+v", merged)
+	}
+	if _, ok := root.Directories["bad"]; ok {
+		t.Fatal("expected the invalid album left out")
+	}
+	for _, item := range root.Flatten() {
+		if item.Path == "cats" || item.Path == "merged" {
+			t.Fatalf("expected virtual folders not to be persisted, got %+v", item)
+		}
+	}
+
+	scanner.SetSmartAlbums(nil)
+	scanner.ApplyVirtualPaths(root)
+	if _, ok := root.Directories["cats"]; ok {
+		t.Fatal("expected removed album dropped")
+	}
+}
@@ -3,18 +3,48 @@ package core
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"reflect"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	utils "github.com/XGFan/go-utils"
+	bolt "go.etcd.io/bbolt"
 
 	"gallery/common/storage"
 )
 
-// Cache file names
+// TrashDir is the folder of a library deleted files are moved to. Scans skip it like any
+// hidden folder, but Save keeps the cache entries below it, so a restored file comes back
+// with its tags and caption.
+const TrashDir = ".gallery-trash"
+
+// IsTrashed reports whether p is inside TrashDir.
+func IsTrashed(p string) bool {
+	return strings.HasPrefix(p, TrashDir+"/")
+}
+
+// CacheDBFile is the embedded database holding every cache bucket, inside the cache directory.
+const CacheDBFile = ".gallery.db"
+
+// CacheDBBackup is the last-good copy of CacheDBFile, refreshed after every Save that changed something.
+// A database that fails verification on open is moved aside with corruptSuffix and replaced by it.
+const CacheDBBackup = CacheDBFile + ".bak"
+
+const corruptSuffix = ".corrupt"
+
+// CacheSchemaVersion is the layout version of CacheDBFile, kept in the meta bucket.
+// A database written by a newer version is left untouched and not used.
+const CacheSchemaVersion = 1
+
+// Legacy JSON cache file names. They are imported into CacheDBFile on load and renamed
+// with migratedSuffix; tag and caption files written later by external taggers are imported again.
 const ImgSizeCache = ".img-size.json"
 const ImgTagCache = ".img-tag.json"
 const ImgCaptionCache = ".img-caption.json"
@@ -22,6 +52,12 @@ const ImgStructureCache = ".img.json"
 const VideoMetaCache = ".video-meta.json"
 const TagMinValue = 60
 
+const migratedSuffix = ".migrated"
+
+// VideoMetaSchemaVersion is bumped whenever parseProbeOutput starts extracting new fields.
+// Entries written by an older schema are re-probed on the next scan.
+const VideoMetaSchemaVersion = 2
+
 // VideoMeta represents metadata for video files
 type VideoMeta struct {
 	Path            string  `json:"path,omitempty"`
@@ -30,119 +66,442 @@ type VideoMeta struct {
 	Height          int     `json:"height"`
 	SizeBytes       int64   `json:"size_bytes"`
 	ModTimeUnixNano int64   `json:"mod_time_unix_nano"`
+
+	Schema         int          `json:"schema,omitempty"`
+	Format         string       `json:"format,omitempty"`
+	VideoCodec     string       `json:"video_codec,omitempty"`
+	AudioCodec     string       `json:"audio_codec,omitempty"`
+	BitRate        int64        `json:"bit_rate,omitempty"`
+	FrameRate      float64      `json:"frame_rate,omitempty"`
+	Rotation       int          `json:"rotation,omitempty"`
+	HDR            bool         `json:"hdr,omitempty"`
+	AudioTracks    []MediaTrack `json:"audio_tracks,omitempty"`
+	SubtitleTracks []MediaTrack `json:"subtitle_tracks,omitempty"`
+}
+
+// MediaTrack describes an audio or subtitle stream inside a video container
+type MediaTrack struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
 }
 
-// CacheManager handles persistence with smart diffing
+// videoMetaFile is the on-disk layout of VideoMetaCache.
+// Version 1 files were a bare path -> VideoMeta map.
+type videoMetaFile struct {
+	Version int                  `json:"version"`
+	Items   map[string]VideoMeta `json:"items"`
+}
+
+// Buckets of CacheDBFile, one per former JSON cache. Every bucket maps a media path to a JSON value.
+var (
+	bucketStructure = []byte("structure")
+	bucketSizes     = []byte("sizes")
+	bucketTags      = []byte("tags")
+	bucketCaptions  = []byte("captions")
+	bucketVideoMeta = []byte("video_meta")
+	bucketHashes    = []byte("hashes")
+)
+
+var cacheBuckets = [][]byte{bucketStructure, bucketSizes, bucketTags, bucketCaptions, bucketVideoMeta, bucketHashes}
+
+// bucketMeta holds bookkeeping such as the schema version; it is not part of Save.
+var (
+	bucketMeta = []byte("meta")
+	schemaKey  = []byte("schema")
+)
+
+var (
+	errCacheUnavailable  = errors.New("cache db unavailable")
+	errCacheCorrupt      = errors.New("cache db corrupt")
+	errCacheSchemaTooNew = errors.New("cache db written by a newer version")
+)
+
+// restoreBatchSize is how many structure entries one read transaction hands to Restore.
+const restoreBatchSize = 512
+
+// CacheManager persists scan results in an embedded key-value database.
+// Save writes only the entries that changed and deletes the ones whose files are gone,
+// all in one transaction. Video metadata and image hashes are also kept in memory, because
+// the scanner and the handlers consult them for every video and image.
 type CacheManager struct {
-	Fs           storage.Storage
-	TagBlacklist utils.Set[string]
-
-	// Internal state mirroring disk content
-	currentSizes     map[string]Size
-	currentTags      map[string][]TagInfo
-	currentCaptions  map[string]string
-	currentVideoMeta map[string]VideoMeta
+	Fs storage.Storage
+
+	tagBlacklist     utils.Set[string]
+	tagBlacklistMu   sync.RWMutex
+	db               *bolt.DB
 	workingVideoMeta map[string]VideoMeta
 	videoMetaMu      sync.RWMutex
+	workingHashes    map[string]ImageHash
+	hashesVersion    uint64 // counts changes to workingHashes
+	hashesMu         sync.RWMutex
+	marks            map[string]Mark
+	marksMu          sync.RWMutex
 }
 
-// NewCacheManager creates a new CacheManager
+// NewCacheManager creates a new CacheManager backed by CacheDBFile in cacheFs.
+// If the database cannot be opened the manager still works, but nothing is persisted.
 func NewCacheManager(cacheFs storage.Storage, tagBlacklist []string) *CacheManager {
-	return &CacheManager{
+	c := &CacheManager{
 		Fs:               cacheFs,
-		TagBlacklist:     utils.NewSetWithSlice(tagBlacklist),
-		currentSizes:     make(map[string]Size),
-		currentTags:      make(map[string][]TagInfo),
-		currentCaptions:  make(map[string]string),
-		currentVideoMeta: make(map[string]VideoMeta),
+		tagBlacklist:     utils.NewSetWithSlice(tagBlacklist),
+		db:               openCacheDB(cacheFs),
 		workingVideoMeta: make(map[string]VideoMeta),
+		workingHashes:    make(map[string]ImageHash),
 	}
+	c.loadMarks()
+	return c
 }
 
-// LoadScanItems loads the structure snapshot (Event Stream) and auxiliary caches
-func (c *CacheManager) LoadScanItems() ([]ScanItem, error) {
-	// 1. Load Auxiliary Caches (Knowledge Base)
-	// We load these first so Scanner can use them even if Structure Cache is partial or missing.
-	c.loadJSON(ImgSizeCache, &c.currentSizes)
-	c.loadJSON(ImgTagCache, &c.currentTags)
-	c.loadJSON(ImgCaptionCache, &c.currentCaptions)
-	c.loadJSON(VideoMetaCache, &c.currentVideoMeta)
+func openCacheDB(cacheFs storage.Storage) *bolt.DB {
+	if cacheFs == nil {
+		return nil
+	}
+	dbPath := cacheFs.Join(cacheFs.GetPath(), CacheDBFile)
+	db, err := openVerifiedDB(dbPath)
+	if err == nil {
+		return db
+	}
+	if !errors.Is(err, errCacheCorrupt) {
+		log.Printf("cache db unavailable, scan results will not be persisted: %s, err: %v", dbPath, err)
+		return nil
+	}
 
-	c.videoMetaMu.Lock()
-	for k, v := range c.currentVideoMeta {
-		c.workingVideoMeta[k] = v
+	log.Printf("%v, moving it to %s", err, dbPath+corruptSuffix)
+	if err := os.Rename(dbPath, dbPath+corruptSuffix); err != nil {
+		log.Printf("cache db unavailable, scan results will not be persisted: %s, err: %v", dbPath, err)
+		return nil
 	}
-	c.videoMetaMu.Unlock()
+	backupPath := cacheFs.Join(cacheFs.GetPath(), CacheDBBackup)
+	if err := restoreCacheBackup(backupPath, dbPath); err == nil {
+		if db, err = openVerifiedDB(dbPath); err == nil {
+			log.Printf("cache db restored from %s", backupPath)
+			return db
+		}
+		log.Printf("cache db backup unusable: %s, err: %v", backupPath, err)
+		_ = os.Remove(dbPath)
+	}
+	if db, err = openVerifiedDB(dbPath); err != nil {
+		log.Printf("cache db unavailable, scan results will not be persisted: %s, err: %v", dbPath, err)
+		return nil
+	}
+	log.Printf("cache db recreated empty: %s", dbPath)
+	return db
+}
 
-	log.Printf("Knowledge Base loaded: %d sizes, %d tags, %d video metas", len(c.currentSizes), len(c.currentTags), len(c.currentVideoMeta))
+// openVerifiedDB opens dbPath, checks every page and the schema version, and creates missing buckets.
+// Damage is reported as errCacheCorrupt; a lock held by another process is not.
+func openVerifiedDB(dbPath string) (db *bolt.DB, err error) {
+	defer func() {
+		// bbolt panics on some kinds of page damage instead of returning an error.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errCacheCorrupt, r)
+		}
+		if err != nil && db != nil {
+			_ = db.Close()
+			db = nil
+		}
+	}()
+	db, err = bolt.Open(dbPath, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+			err = fmt.Errorf("%w: %v", errCacheCorrupt, err)
+		}
+		return nil, err
+	}
 
-	// 2. Load Structure Snapshot (Event Stream)
-	var items []ScanItem
-	if f, err := c.Fs.Open(ImgStructureCache); err == nil {
-		defer f.Close()
-		if err := json.NewDecoder(f).Decode(&items); err != nil {
-			log.Printf("Failed to decode structure cache: %v", err)
-			return nil, err
+	err = db.View(func(tx *bolt.Tx) error {
+		var first error
+		// Check reports through an unbuffered channel, so it must be drained completely.
+		for checkErr := range tx.Check() {
+			if first == nil {
+				first = fmt.Errorf("%w: %v", errCacheCorrupt, checkErr)
+			}
 		}
-	} else {
-		return nil, nil // No cache exists
+		return first
+	})
+	if err != nil {
+		return db, err
 	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		version := 0
+		if meta := tx.Bucket(bucketMeta); meta != nil {
+			version, _ = strconv.Atoi(string(meta.Get(schemaKey)))
+		}
+		if version > CacheSchemaVersion {
+			return fmt.Errorf("%w: schema %d, supported %d", errCacheSchemaTooNew, version, CacheSchemaVersion)
+		}
+		for _, name := range append([][]byte{bucketMeta}, cacheBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketMeta).Put(schemaKey, []byte(strconv.Itoa(CacheSchemaVersion)))
+	})
+	return db, err
+}
 
-	log.Printf("Structure Snapshot loaded: %d events", len(items))
-	return items, nil
+// restoreCacheBackup copies the backup over dbPath.
+func restoreCacheBackup(backupPath, dbPath string) error {
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return storage.WriteFileAtomic(dbPath, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
 }
 
-// Save persists changes to disk if needed
-func (c *CacheManager) Save(root *TraverseNode) error {
-	// 1. Save Structure (Flatten Tree to Event Stream)
-	// We always save structure to ensure it matches current runtime state.
-	items := root.Flatten()
-	c.saveJSON(ImgStructureCache, items)
+// writeBackup snapshots the database into CacheDBBackup from a consistent read transaction.
+func (c *CacheManager) writeBackup() {
+	backupPath := c.Fs.Join(c.Fs.GetPath(), CacheDBBackup)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return storage.WriteFileAtomic(backupPath, func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to back up cache db: %v", err)
+	}
+}
 
-	// 2. Diff and Save Sizes
-	newSizes := root.Dump()
-	if !reflect.DeepEqual(c.currentSizes, newSizes) {
-		if c.saveJSON(ImgSizeCache, newSizes) == nil {
-			c.currentSizes = newSizes
-			log.Printf("Updated size cache: %d entries", len(newSizes))
-		}
+// SetTagBlacklist replaces the tags hidden from tag listings.
+func (c *CacheManager) SetTagBlacklist(tags []string) {
+	c.tagBlacklistMu.Lock()
+	defer c.tagBlacklistMu.Unlock()
+	c.tagBlacklist = utils.NewSetWithSlice(tags)
+}
+
+// IsTagBlacklisted reports whether tag is hidden from tag listings.
+func (c *CacheManager) IsTagBlacklisted(tag string) bool {
+	c.tagBlacklistMu.RLock()
+	defer c.tagBlacklistMu.RUnlock()
+	return c.tagBlacklist.Contains(tag)
+}
+
+// Close releases the database file.
+func (c *CacheManager) Close() error {
+	if c.db == nil {
+		return nil
 	}
+	return c.db.Close()
+}
 
-	// 3. Diff and Save Meta
-	newTags, newCaptions := root.DumpMeta()
+// Load imports legacy JSON caches, reads video metadata and image hashes into memory and returns
+// the number of structure entries StreamScanItems will emit.
+func (c *CacheManager) Load() (int, error) {
+	if c.db == nil {
+		return 0, nil
+	}
+	c.importLegacyCaches()
 
-	if !reflect.DeepEqual(c.currentTags, newTags) {
-		if c.saveJSON(ImgTagCache, newTags) == nil {
-			c.currentTags = newTags
-			log.Printf("Updated tag cache: %d entries", len(newTags))
+	metas := make(map[string]VideoMeta)
+	hashes := make(map[string]ImageHash)
+	count := 0
+	err := c.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucketStructure).Stats().KeyN
+		err := tx.Bucket(bucketVideoMeta).ForEach(func(k, v []byte) error {
+			var meta VideoMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				log.Printf("Failed to decode video meta of %s: %v", k, err)
+				return nil
+			}
+			metas[string(k)] = meta
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+		return tx.Bucket(bucketHashes).ForEach(func(k, v []byte) error {
+			var hash ImageHash
+			if err := json.Unmarshal(v, &hash); err != nil {
+				log.Printf("Failed to decode image hash of %s: %v", k, err)
+				return nil
+			}
+			hashes[string(k)] = hash
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	if !reflect.DeepEqual(c.currentCaptions, newCaptions) {
-		if c.saveJSON(ImgCaptionCache, newCaptions) == nil {
-			c.currentCaptions = newCaptions
-			log.Printf("Updated caption cache: %d entries", len(newCaptions))
+	// Entries probed since startup are newer than what the database holds.
+	c.videoMetaMu.Lock()
+	for k, v := range metas {
+		if _, ok := c.workingVideoMeta[k]; !ok {
+			c.workingVideoMeta[k] = v
 		}
 	}
+	c.videoMetaMu.Unlock()
+	c.hashesMu.Lock()
+	for k, v := range hashes {
+		if _, ok := c.workingHashes[k]; !ok {
+			c.workingHashes[k] = v
+		}
+	}
+	c.hashesVersion++
+	c.hashesMu.Unlock()
 
-	// 4. Diff and Save Video Meta
-	visibleVideos := collectVideoPaths(root)
-	c.videoMetaMu.Lock()
-	pruneVideoMeta(c.workingVideoMeta, visibleVideos)
-	if !reflect.DeepEqual(c.currentVideoMeta, c.workingVideoMeta) {
-		if c.saveJSON(VideoMetaCache, c.workingVideoMeta) == nil {
-			c.currentVideoMeta = make(map[string]VideoMeta)
-			for k, v := range c.workingVideoMeta {
-				c.currentVideoMeta[k] = v
+	log.Printf("Cache loaded: %d structure entries, %d video metas, %d image hashes", count, len(metas), len(hashes))
+	return count, nil
+}
+
+// StreamScanItems emits the structure snapshot in path order. It reads restoreBatchSize
+// entries per transaction, so the snapshot is never held in memory as a whole.
+func (c *CacheManager) StreamScanItems() <-chan ScanItem {
+	out := make(chan ScanItem, 100)
+	go func() {
+		defer close(out)
+		if c.db == nil {
+			return
+		}
+		var after []byte
+		for {
+			batch := make([]ScanItem, 0, restoreBatchSize)
+			read := 0
+			err := c.db.View(func(tx *bolt.Tx) error {
+				cursor := tx.Bucket(bucketStructure).Cursor()
+				k, v := cursor.First()
+				if after != nil {
+					k, v = cursor.Seek(after)
+					if k != nil && bytes.Equal(k, after) {
+						k, v = cursor.Next()
+					}
+				}
+				for ; k != nil && read < restoreBatchSize; k, v = cursor.Next() {
+					read++
+					after = append(after[:0], k...)
+					var item ScanItem
+					if err := json.Unmarshal(v, &item); err != nil {
+						log.Printf("Failed to decode structure entry %s: %v", k, err)
+						continue
+					}
+					batch = append(batch, item)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("Failed to read structure cache: %v", err)
+				return
+			}
+			for _, item := range batch {
+				out <- item
 			}
-			log.Printf("Updated video meta cache: %d entries", len(c.currentVideoMeta))
+			if read < restoreBatchSize {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Save persists the tree. Each bucket is synchronized against the current state:
+// unchanged entries are left alone, changed ones are rewritten and missing ones deleted.
+func (c *CacheManager) Save(root *TraverseNode) error {
+	structure := make(map[string][]byte)
+	for _, item := range root.Flatten() {
+		if data, err := json.Marshal(item); err == nil {
+			structure[item.Path] = data
 		}
 	}
+	tags, captions := root.DumpMeta()
+
+	visibleVideos := collectVideoPaths(root)
+	c.videoMetaMu.Lock()
+	pruneMissing(c.workingVideoMeta, visibleVideos)
+	videoMeta := encodeEntries(c.workingVideoMeta)
 	c.videoMetaMu.Unlock()
 
+	c.hashesMu.Lock()
+	pruneMissing(c.workingHashes, collectImagePaths(root))
+	hashes := encodeEntries(c.workingHashes)
+	c.hashesMu.Unlock()
+
+	if c.db == nil {
+		return nil
+	}
+
+	entries := map[string]map[string][]byte{
+		string(bucketStructure): structure,
+		string(bucketSizes):     encodeEntries(root.Dump()),
+		string(bucketTags):      encodeEntries(tags),
+		string(bucketCaptions):  encodeEntries(captions),
+		string(bucketVideoMeta): videoMeta,
+		string(bucketHashes):    hashes,
+	}
+	changed := false
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range cacheBuckets {
+			upserts, deletes, err := syncBucket(tx.Bucket(name), entries[string(name)])
+			if err != nil {
+				return err
+			}
+			if upserts > 0 || deletes > 0 {
+				changed = true
+				log.Printf("Updated %s cache: %d upserts, %d deletes", name, upserts, deletes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if changed || !c.Fs.Exist(CacheDBBackup) {
+		c.writeBackup()
+	}
 	return nil
 }
 
+// syncBucket makes the bucket hold exactly entries, touching only what differs. Entries of
+// trashed files are kept.
+func syncBucket(bucket *bolt.Bucket, entries map[string][]byte) (int, int, error) {
+	var stale [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		if _, ok := entries[string(k)]; !ok && !IsTrashed(string(k)) {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, k := range stale {
+		if err := bucket.Delete(k); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	upserts := 0
+	for k, v := range entries {
+		if k == "" || bytes.Equal(bucket.Get([]byte(k)), v) {
+			continue
+		}
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return 0, 0, err
+		}
+		upserts++
+	}
+	return upserts, len(stale), nil
+}
+
+func encodeEntries[V any](m map[string]V) map[string][]byte {
+	result := make(map[string][]byte, len(m))
+	for k, v := range m {
+		if data, err := json.Marshal(v); err == nil {
+			result[k] = data
+		}
+	}
+	return result
+}
+
 func collectVideoPaths(root *TraverseNode) map[string]struct{} {
 	visible := make(map[string]struct{})
 	if root == nil {
@@ -157,12 +516,26 @@ func collectVideoPaths(root *TraverseNode) map[string]struct{} {
 	return visible
 }
 
-func pruneVideoMeta(meta map[string]VideoMeta, visible map[string]struct{}) {
+func collectImagePaths(root *TraverseNode) map[string]struct{} {
+	visible := make(map[string]struct{})
+	if root == nil {
+		return visible
+	}
+	for _, img := range root.Image() {
+		if img.Path != "" {
+			visible[img.Path] = struct{}{}
+		}
+	}
+	return visible
+}
+
+// pruneMissing drops the entries of files no longer in the tree, keeping trashed ones.
+func pruneMissing[V any](meta map[string]V, visible map[string]struct{}) {
 	if len(meta) == 0 {
 		return
 	}
 	for path := range meta {
-		if _, ok := visible[path]; !ok {
+		if _, ok := visible[path]; !ok && !IsTrashed(path) {
 			delete(meta, path)
 		}
 	}
@@ -170,18 +543,37 @@ func pruneVideoMeta(meta map[string]VideoMeta, visible map[string]struct{}) {
 
 // GetSize provides size lookup for Scanner (optimization)
 func (c *CacheManager) GetSize(path string) (Size, bool) {
-	s, ok := c.currentSizes[path]
-	return s, ok
+	var size Size
+	ok := c.get(bucketSizes, path, &size)
+	return size, ok
 }
 
 // GetTags provides tag lookup (optimization)
 func (c *CacheManager) GetTags(path string) []TagInfo {
-	return c.currentTags[path]
+	var tags []TagInfo
+	c.get(bucketTags, path, &tags)
+	return tags
 }
 
 // GetCaption provides caption lookup (optimization)
 func (c *CacheManager) GetCaption(path string) string {
-	return c.currentCaptions[path]
+	var caption string
+	c.get(bucketCaptions, path, &caption)
+	return caption
+}
+
+// get decodes the entry of path in bucket into v, reporting whether it exists.
+func (c *CacheManager) get(bucket []byte, path string, v interface{}) bool {
+	if c.db == nil || path == "" {
+		return false
+	}
+	found := false
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(path))
+		found = data != nil && json.Unmarshal(data, v) == nil
+		return nil
+	})
+	return found
 }
 
 // GetVideoMeta provides video metadata lookup
@@ -207,24 +599,224 @@ func (c *CacheManager) NeedsVideoMetaRefresh(path string, modTime time.Time, siz
 	if !ok {
 		return true
 	}
+	if meta.Schema < VideoMetaSchemaVersion {
+		return true
+	}
 	return meta.ModTimeUnixNano != modTime.UnixNano() || meta.SizeBytes != size
 }
 
-// Helpers
+// GetImageHash returns the cached hash of an image.
+func (c *CacheManager) GetImageHash(path string) (ImageHash, bool) {
+	c.hashesMu.RLock()
+	defer c.hashesMu.RUnlock()
+	h, ok := c.workingHashes[path]
+	return h, ok
+}
+
+// UpsertImageHash updates the hash of an image.
+func (c *CacheManager) UpsertImageHash(path string, hash ImageHash) {
+	c.hashesMu.Lock()
+	defer c.hashesMu.Unlock()
+	c.workingHashes[path] = hash
+	c.hashesVersion++
+}
+
+// ImageHashesVersion changes whenever an image hash is added, changed or removed.
+func (c *CacheManager) ImageHashesVersion() uint64 {
+	c.hashesMu.RLock()
+	defer c.hashesMu.RUnlock()
+	return c.hashesVersion
+}
+
+// EachImageHash calls fn for every cached image hash and returns the version it saw. fn runs
+// under a read lock and must not call back into the hash methods.
+func (c *CacheManager) EachImageHash(fn func(path string, hash ImageHash)) uint64 {
+	c.hashesMu.RLock()
+	defer c.hashesMu.RUnlock()
+	for p, hash := range c.workingHashes {
+		fn(p, hash)
+	}
+	return c.hashesVersion
+}
+
+// Move rekeys what is cached about from, and about everything below it when from is a
+// directory, to to: sizes, tags, captions, video metadata, image hashes and marks. The
+// structure snapshot, the stored video metadata and the stored hashes follow with the next Save.
+func (c *CacheManager) Move(from, to string) error {
+	if from == "" || to == "" {
+		return errors.New("cannot move the library root")
+	}
+	return c.rekey(from, to)
+}
+
+// Forget drops what is cached about p and everything below it.
+func (c *CacheManager) Forget(p string) error {
+	if p == "" {
+		return errors.New("cannot forget the library root")
+	}
+	return c.rekey(p, "")
+}
+
+// rekey moves the entries of from and below to to, or drops them when to is empty.
+func (c *CacheManager) rekey(from, to string) error {
+	rename := func(p string) (string, bool) {
+		if p == from {
+			return to, true
+		}
+		if rest, ok := strings.CutPrefix(p, from+"/"); ok {
+			return path.Join(to, rest), true
+		}
+		return "", false
+	}
 
-func (c *CacheManager) loadJSON(name string, v interface{}) {
-	f, err := c.Fs.Open(name)
+	c.videoMetaMu.Lock()
+	for p, meta := range c.workingVideoMeta {
+		if target, ok := rename(p); ok {
+			delete(c.workingVideoMeta, p)
+			if to != "" {
+				meta.Path = target
+				c.workingVideoMeta[target] = meta
+			}
+		}
+	}
+	c.videoMetaMu.Unlock()
+
+	c.hashesMu.Lock()
+	for p, hash := range c.workingHashes {
+		if target, ok := rename(p); ok {
+			delete(c.workingHashes, p)
+			if to != "" {
+				c.workingHashes[target] = hash
+			}
+			c.hashesVersion++
+		}
+	}
+	c.hashesMu.Unlock()
+
+	err := c.updateMarks(func(marks map[string]Mark) {
+		for p, mark := range marks {
+			if target, ok := rename(p); ok {
+				delete(marks, p)
+				if to != "" {
+					marks[target] = mark
+				}
+			}
+		}
+	})
+	if err != nil || c.db == nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		// Entries of these buckets do not repeat their path in the value.
+		for _, name := range [][]byte{bucketSizes, bucketTags, bucketCaptions} {
+			bucket := tx.Bucket(name)
+			moved := make(map[string][]byte)
+			cursor := bucket.Cursor()
+			for k, v := cursor.Seek([]byte(from)); k != nil && bytes.HasPrefix(k, []byte(from)); k, v = cursor.Next() {
+				if _, ok := rename(string(k)); ok {
+					moved[string(k)] = append([]byte(nil), v...)
+				}
+			}
+			for k := range moved {
+				if err := bucket.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+			for k, v := range moved {
+				if to == "" {
+					break
+				}
+				target, _ := rename(k)
+				if err := bucket.Put([]byte(target), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Legacy JSON migration
+
+// importLegacyCaches moves every legacy JSON cache found in Fs into its bucket.
+func (c *CacheManager) importLegacyCaches() {
+	c.importLegacy(ImgStructureCache, bucketStructure, decodeLegacyStructure)
+	c.importLegacy(ImgSizeCache, bucketSizes, decodeLegacyMap)
+	c.importLegacy(ImgTagCache, bucketTags, decodeLegacyMap)
+	c.importLegacy(ImgCaptionCache, bucketCaptions, decodeLegacyMap)
+	c.importLegacy(VideoMetaCache, bucketVideoMeta, decodeLegacyVideoMeta)
+}
+
+// importLegacy upserts the entries of a legacy file into bucket and renames the file,
+// so it is imported once but kept around for a downgrade.
+func (c *CacheManager) importLegacy(name string, bucket []byte, decode func([]byte) (map[string][]byte, error)) {
+	data, err := c.Fs.Read(name)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	json.NewDecoder(f).Decode(v)
+	entries, err := decode(data)
+	if err != nil {
+		log.Printf("Failed to decode legacy cache %s: %v", name, err)
+		return
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for k, v := range entries {
+			if k == "" {
+				continue
+			}
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to import legacy cache %s: %v", name, err)
+		return
+	}
+	if err := c.Fs.Rename(name, name+migratedSuffix); err != nil {
+		log.Printf("Failed to rename legacy cache %s: %v", name, err)
+	}
+	log.Printf("Imported legacy cache %s: %d entries", name, len(entries))
 }
 
-func (c *CacheManager) saveJSON(name string, v interface{}) error {
-	data, err := json.Marshal(v)
-	if err != nil {
-		return err
+func decodeLegacyStructure(data []byte) (map[string][]byte, error) {
+	var items []ScanItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte, len(items))
+	for _, item := range items {
+		if encoded, err := json.Marshal(item); err == nil {
+			entries[item.Path] = encoded
+		}
+	}
+	return entries, nil
+}
+
+func decodeLegacyMap(data []byte) (map[string][]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte, len(raw))
+	for k, v := range raw {
+		entries[k] = v
+	}
+	return entries, nil
+}
+
+// decodeLegacyVideoMeta reads VideoMetaCache in either the versioned or the bare-map (v1) layout.
+// v1 entries keep their dimensions for display but carry Schema 0, so the next scan re-probes them.
+func decodeLegacyVideoMeta(data []byte) (map[string][]byte, error) {
+	var file videoMetaFile
+	if err := json.Unmarshal(data, &file); err == nil && file.Version > 0 {
+		return encodeEntries(file.Items), nil
+	}
+	legacy := make(map[string]VideoMeta)
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
 	}
-	return c.Fs.Save(name, io.NopCloser(bytes.NewReader(data)))
+	return encodeEntries(legacy), nil
 }
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gallery/common/storage"
+)
+
+// A cache archive is a gzip-compressed tar holding, in this order:
+//
+//	manifest.json  archiveManifest
+//	index.jsonl    one archiveEntry per line, every cache bucket keyed by relative media path
+//	files/<path>   renditions from the cache directory (thumbnails, posters, previews, subtitles)
+//
+// Nothing in it depends on the absolute location of the library or the cache, so an archive
+// built on one machine can be imported on another that mounts the same library elsewhere.
+const (
+	archiveFormat       = "gallery-cache"
+	archiveVersion      = 1
+	archiveManifestName = "manifest.json"
+	archiveIndexName    = "index.jsonl"
+	archiveFilesPrefix  = "files/"
+)
+
+type archiveManifest struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Schema  int       `json:"schema"`
+	Created time.Time `json:"created"`
+}
+
+type archiveEntry struct {
+	Bucket string          `json:"bucket"`
+	Path   string          `json:"path"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// ArchiveStats counts what Export wrote or Import applied.
+type ArchiveStats struct {
+	Entries int `json:"entries"`
+	Files   int `json:"files"`
+}
+
+// Persistent reports whether the cache database is open, i.e. whether Save, Export and Import can work.
+func (c *CacheManager) Persistent() bool {
+	return c.db != nil
+}
+
+// Export writes every bucket and every rendition in the cache directory to w as a cache archive.
+// HLS segments are left out: they are produced on demand during playback and are cheap to redo.
+func (c *CacheManager) Export(w io.Writer) (ArchiveStats, error) {
+	var stats ArchiveStats
+	if c.db == nil {
+		return stats, errCacheUnavailable
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, _ := json.Marshal(archiveManifest{Format: archiveFormat, Version: archiveVersion, Schema: CacheSchemaVersion, Created: time.Now()})
+	if err := writeArchiveFile(tw, archiveManifestName, manifest); err != nil {
+		return stats, err
+	}
+
+	// The index goes through a temporary file: tar needs its size up front and the buckets may be large.
+	index, err := os.CreateTemp("", "gallery-index-*.jsonl")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(index.Name())
+	defer index.Close()
+	buffered := bufio.NewWriter(index)
+	encoder := json.NewEncoder(buffered)
+	err = c.db.View(func(tx *bolt.Tx) error {
+		for _, name := range cacheBuckets {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				stats.Entries++
+				return encoder.Encode(archiveEntry{Bucket: string(name), Path: string(k), Value: v})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = copyArchiveFile(tw, archiveIndexName, index.Name())
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	root := c.Fs.GetPath()
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if strings.HasSuffix(rel, ".hls") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !isArchivedRendition(rel) {
+			return nil
+		}
+		if err := copyArchiveFile(tw, archiveFilesPrefix+rel, p); err != nil {
+			return err
+		}
+		stats.Files++
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// isArchivedRendition reports whether a file of the cache directory belongs in an archive.
+// The database and its backups travel as index.jsonl; legacy caches and temporary outputs are skipped.
+func isArchivedRendition(rel string) bool {
+	name := path.Base(rel)
+	if strings.HasPrefix(name, CacheDBFile) || strings.Contains(name, ".tmp") {
+		return false
+	}
+	return !isLegacyCacheFile(name)
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func copyArchiveFile(tw *tar.Writer, name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: info.Size(), ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Import merges a cache archive into this cache: entries overwrite those with the same
+// bucket and path, renditions overwrite files with the same relative path.
+// It must not run while a server is using the same cache directory.
+func (c *CacheManager) Import(r io.Reader) (ArchiveStats, error) {
+	var stats ArchiveStats
+	if c.db == nil {
+		return stats, errCacheUnavailable
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("not a cache archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	manifestSeen := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch {
+		case header.Name == archiveManifestName:
+			if err := checkArchiveManifest(tr); err != nil {
+				return stats, err
+			}
+			manifestSeen = true
+		case !manifestSeen:
+			return stats, fmt.Errorf("not a cache archive: %s before %s", header.Name, archiveManifestName)
+		case header.Name == archiveIndexName:
+			n, err := c.importIndex(tr)
+			stats.Entries += n
+			if err != nil {
+				return stats, err
+			}
+		case strings.HasPrefix(header.Name, archiveFilesPrefix):
+			rel, ok := archiveRelPath(strings.TrimPrefix(header.Name, archiveFilesPrefix))
+			if !ok || !isArchivedRendition(rel) {
+				return stats, fmt.Errorf("refusing archive entry %q", header.Name)
+			}
+			target := c.Fs.Join(c.Fs.GetPath(), rel)
+			if err := os.MkdirAll(path.Dir(target), 0o755); err != nil {
+				return stats, err
+			}
+			err := storage.WriteFileAtomic(target, func(w io.Writer) error {
+				_, err := io.Copy(w, tr)
+				return err
+			})
+			if err != nil {
+				return stats, err
+			}
+			stats.Files++
+		}
+	}
+	if !manifestSeen {
+		return stats, fmt.Errorf("not a cache archive: missing %s", archiveManifestName)
+	}
+	c.writeBackup()
+	return stats, nil
+}
+
+func checkArchiveManifest(r io.Reader) error {
+	var manifest archiveManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return fmt.Errorf("not a cache archive: %w", err)
+	}
+	if manifest.Format != archiveFormat {
+		return fmt.Errorf("not a cache archive: format %q", manifest.Format)
+	}
+	if manifest.Version > archiveVersion || manifest.Schema > CacheSchemaVersion {
+		return fmt.Errorf("cache archive written by a newer version (archive %d, schema %d)", manifest.Version, manifest.Schema)
+	}
+	return nil
+}
+
+// importIndex applies index.jsonl in transactions of restoreBatchSize entries.
+func (c *CacheManager) importIndex(r io.Reader) (int, error) {
+	known := make(map[string]bool, len(cacheBuckets))
+	for _, name := range cacheBuckets {
+		known[string(name)] = true
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	imported := 0
+	batch := make([]archiveEntry, 0, restoreBatchSize)
+	flush := func() error {
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			for _, entry := range batch {
+				if err := tx.Bucket([]byte(entry.Bucket)).Put([]byte(entry.Path), entry.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			imported += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+	for scanner.Scan() {
+		var entry archiveEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return imported, fmt.Errorf("bad index entry: %w", err)
+		}
+		if !known[entry.Bucket] || entry.Path == "" || len(entry.Value) == 0 {
+			continue
+		}
+		batch = append(batch, entry)
+		if len(batch) == restoreBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+// archiveRelPath cleans a path taken from an archive, rejecting anything that would land outside the cache directory.
+func archiveRelPath(name string) (string, bool) {
+	cleaned := path.Clean(name)
+	if cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return cleaned, true
+}
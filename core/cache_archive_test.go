@@ -0,0 +1,94 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gallery/common/storage"
+)
+
+func TestCacheArchive_RoundTrip(t *testing.T) {
+	src := t.TempDir()
+	cache := newTestCache(t, src)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	album := root.Locate("album")
+	album.Images = []ImageNode{{Node: Node{Name: "a.jpg", Path: "album/a.jpg"}, Size: Size{Width: 10, Height: 20}}}
+	album.Videos = []VideoNode{{Node: Node{Name: "v.mp4", Path: "album/v.mp4"}}}
+	cache.UpsertVideoMeta("album/v.mp4", VideoMeta{Width: 1920, Height: 1080, DurationSec: 12, Schema: VideoMetaSchemaVersion})
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	files := map[string]string{
+		"album/a.jpg":                "thumb",
+		"album/v.mp4.poster.jpg":     "poster",
+		"album/v.mp4.hls/seg-0.ts":   "segment",
+		"album/v.mp4.poster.tmp.jpg": "partial",
+	}
+	for name, content := range files {
+		target := filepath.Join(src, name)
+		_ = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err := os.WriteFile(target, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	stats, err := cache.Export(&archive)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if stats.Files != 2 {
+		t.Fatalf("expect thumbnail and poster exported only, got %+v", stats)
+	}
+
+	dst := t.TempDir()
+	imported := newTestCache(t, dst)
+	stats, err = imported.Import(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if stats.Files != 2 || stats.Entries == 0 {
+		t.Fatalf("unexpected import stats %+v", stats)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "album/v.mp4.poster.jpg")); err != nil || string(data) != "poster" {
+		t.Fatalf("expect poster imported, got %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "album/v.mp4.hls")); !os.IsNotExist(err) {
+		t.Fatalf("expect hls segments left out, got %v", err)
+	}
+	if size, ok := imported.GetSize("album/a.jpg"); !ok || size.Height != 20 {
+		t.Fatalf("expect size imported, got %+v %v", size, ok)
+	}
+	if _, err := imported.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, ok := imported.GetVideoMeta("album/v.mp4"); !ok || meta.Width != 1920 {
+		t.Fatalf("expect video meta imported, got %+v %v", meta, ok)
+	}
+}
+
+func TestCacheArchive_RejectsEscapingPaths(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	_ = writeArchiveFile(tw, archiveManifestName, []byte(`{"format":"gallery-cache","version":1,"schema":1}`))
+	_ = writeArchiveFile(tw, archiveFilesPrefix+"../escape.jpg", []byte("x"))
+	_ = tw.Close()
+	_ = gz.Close()
+
+	dir := t.TempDir()
+	cache := NewCacheManager(storage.NewFs(filepath.Join(dir, "cache")), nil)
+	defer cache.Close()
+	_, err := cache.Import(&archive)
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("expect escaping entry refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("expect nothing written outside the cache, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gallery/common/storage"
+)
+
+func newTestCache(t *testing.T, dir string) *CacheManager {
+	t.Helper()
+	cache := NewCacheManager(storage.NewFs(dir), nil)
+	if cache.db == nil {
+		t.Fatalf("expect cache db opened in %s", dir)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+func TestCacheSave_UpsertsAndDeletes(t *testing.T) {
+	cache := newTestCache(t, t.TempDir())
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	album := root.Locate("album")
+	album.Images = []ImageNode{
+		{Node: Node{Name: "a.jpg", Path: "album/a.jpg"}, Size: Size{Width: 10, Height: 20}, Tags: []TagInfo{{Tag: "cat", Value: 90}}},
+		{Node: Node{Name: "b.jpg", Path: "album/b.jpg"}, Size: Size{Width: 30, Height: 40}},
+	}
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if size, ok := cache.GetSize("album/b.jpg"); !ok || size.Width != 30 {
+		t.Fatalf("expect size of b.jpg, got %+v %v", size, ok)
+	}
+	if tags := cache.GetTags("album/a.jpg"); len(tags) != 1 || tags[0].Tag != "cat" {
+		t.Fatalf("expect tags of a.jpg, got %+v", tags)
+	}
+
+	album.Images = album.Images[:1]
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, ok := cache.GetSize("album/b.jpg"); ok {
+		t.Fatalf("expect deleted image removed from the size bucket")
+	}
+	var paths []string
+	for item := range cache.StreamScanItems() {
+		paths = append(paths, item.Path)
+	}
+	if len(paths) != 2 || paths[0] != "album" || paths[1] != "album/a.jpg" {
+		t.Fatalf("unexpected structure after delete: %v", paths)
+	}
+}
+
+func TestCacheStreamScanItems_CrossesBatches(t *testing.T) {
+	dir := t.TempDir()
+	cache := newTestCache(t, dir)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	total := restoreBatchSize*2 + 7
+	for i := 0; i < total; i++ {
+		root.Images = append(root.Images, ImageNode{Node: Node{Name: fmt.Sprintf("%05d.jpg", i), Path: fmt.Sprintf("%05d.jpg", i)}})
+	}
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	count, err := cache.Load()
+	if err != nil || count != total {
+		t.Fatalf("expect %d entries, got %d %v", total, count, err)
+	}
+
+	seen := make(map[string]bool)
+	for item := range cache.StreamScanItems() {
+		if seen[item.Path] {
+			t.Fatalf("duplicate item %s", item.Path)
+		}
+		seen[item.Path] = true
+	}
+	if len(seen) != total {
+		t.Fatalf("expect %d streamed items, got %d", total, len(seen))
+	}
+}
+
+func TestCacheLoad_ImportsLegacyJSON(t *testing.T) {
+	dir := t.TempDir()
+	legacy := map[string]interface{}{
+		ImgStructureCache: []ScanItem{{Type: ItemDir, Path: "album", Name: "album"}, {Type: ItemImage, Path: "album/a.jpg", Name: "a.jpg", Width: 10, Height: 20}},
+		ImgSizeCache:      map[string]Size{"album/a.jpg": {Width: 10, Height: 20}},
+		ImgCaptionCache:   map[string]string{"album/a.jpg": "a cat"},
+	}
+	for name, v := range legacy {
+		data, _ := json.Marshal(v)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	cache := newTestCache(t, dir)
+	count, err := cache.Load()
+	if err != nil || count != 2 {
+		t.Fatalf("expect 2 structure entries, got %d %v", count, err)
+	}
+	if size, ok := cache.GetSize("album/a.jpg"); !ok || size.Height != 20 {
+		t.Fatalf("expect imported size, got %+v %v", size, ok)
+	}
+	if caption := cache.GetCaption("album/a.jpg"); caption != "a cat" {
+		t.Fatalf("expect imported caption, got %q", caption)
+	}
+	for name := range legacy {
+		if _, err := os.Stat(filepath.Join(dir, name+migratedSuffix)); err != nil {
+			t.Fatalf("expect %s renamed after import: %v", name, err)
+		}
+	}
+
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	scanner := NewScanner(newFakeStorage(nil), nil, cache, nil, nil)
+	scanner.Toolchain = NewFakeToolchain()
+	if restored, err := scanner.Restore(root); err != nil || restored != 2 {
+		t.Fatalf("expect 2 restored items, got %d %v", restored, err)
+	}
+	if images := root.Locate("album").Images; len(images) != 1 || images[0].Caption != "a cat" {
+		t.Fatalf("expect restored image with caption, got %+v", images)
+	}
+}
+
+func TestCacheOpen_RestoresBackupWhenCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewCacheManager(storage.NewFs(dir), nil)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	root.Images = []ImageNode{{Node: Node{Name: "a.jpg", Path: "a.jpg"}, Size: Size{Width: 10, Height: 20}}}
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	cache.Close()
+	if _, err := os.Stat(filepath.Join(dir, CacheDBBackup)); err != nil {
+		t.Fatalf("expect backup written after save: %v", err)
+	}
+
+	garbage := make([]byte, 64*1024)
+	for i := range garbage {
+		garbage[i] = 0xAB
+	}
+	if err := os.WriteFile(filepath.Join(dir, CacheDBFile), garbage, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestCache(t, dir)
+	if size, ok := restored.GetSize("a.jpg"); !ok || size.Width != 10 {
+		t.Fatalf("expect size restored from backup, got %+v %v", size, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, CacheDBFile+corruptSuffix)); err != nil {
+		t.Fatalf("expect corrupt db kept aside: %v", err)
+	}
+}
+
+func TestCacheOpen_RecreatesWithoutBackup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, CacheDBFile), []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := newTestCache(t, dir)
+	if count, err := cache.Load(); err != nil || count != 0 {
+		t.Fatalf("expect empty cache, got %d %v", count, err)
+	}
+}
+
+func TestCacheOpen_LeavesNewerSchemaUntouched(t *testing.T) {
+	dir := t.TempDir()
+	cache := newTestCache(t, dir)
+	err := cache.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(schemaKey, []byte(strconv.Itoa(CacheSchemaVersion+1)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	newer := NewCacheManager(storage.NewFs(dir), nil)
+	if newer.db != nil {
+		newer.Close()
+		t.Fatalf("expect a newer schema not to be opened")
+	}
+	if _, err := os.Stat(filepath.Join(dir, CacheDBFile+corruptSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("expect newer db not treated as corrupt, got %v", err)
+	}
+}
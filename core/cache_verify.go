@@ -0,0 +1,217 @@
+package core
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CacheReport is the outcome of Verify or Prune.
+// Stale entries and orphan renditions belong to media that no longer exists in the library;
+// Prune removes them, Verify only counts them.
+type CacheReport struct {
+	Entries          int `json:"entries"`
+	Undecodable      int `json:"undecodable"`
+	Stale            int `json:"stale"`
+	Renditions       int `json:"renditions"`
+	OrphanRenditions int `json:"orphan_renditions"`
+}
+
+// Clean reports whether the check found nothing to fix.
+func (r CacheReport) Clean() bool {
+	return r.Undecodable == 0 && r.Stale == 0 && r.OrphanRenditions == 0
+}
+
+// renditionSuffixes map a rendition in the cache directory back to its source media.
+// Thumbnails have no suffix: they use the path of the image itself.
+var renditionSuffixes = []string{".poster.jpg", ".preview.mp4"}
+var renditionDirSuffixes = []string{".hls/", ".subs/"}
+
+// RenditionSource returns the media path a cache file was generated from.
+func RenditionSource(rel string) string {
+	for _, suffix := range renditionDirSuffixes {
+		if i := strings.Index(rel, suffix); i >= 0 {
+			return rel[:i]
+		}
+	}
+	for _, suffix := range renditionSuffixes {
+		if strings.HasSuffix(rel, suffix) {
+			return strings.TrimSuffix(rel, suffix)
+		}
+	}
+	return rel
+}
+
+// Renditions returns the cache paths that may hold renditions of the media at p: its
+// thumbnail, poster and preview, and its HLS and subtitle directories.
+func Renditions(p string) []string {
+	result := []string{p}
+	for _, suffix := range renditionSuffixes {
+		result = append(result, p+suffix)
+	}
+	for _, suffix := range renditionDirSuffixes {
+		result = append(result, p+strings.TrimSuffix(suffix, "/"))
+	}
+	return result
+}
+
+// Verify checks every media entry and rendition against exists, which reports whether
+// a path is still in the library. The structure snapshot is only decoded, since it also
+// holds virtual paths that have no file behind them.
+func (c *CacheManager) Verify(exists func(path string) bool) (CacheReport, error) {
+	return c.check(exists, false)
+}
+
+// Prune removes what Verify reports: undecodable and stale entries, orphan renditions
+// and temporary files left behind by interrupted generators.
+// It must not run while a server is using the same cache directory.
+func (c *CacheManager) Prune(exists func(path string) bool) (CacheReport, error) {
+	return c.check(exists, true)
+}
+
+func (c *CacheManager) check(exists func(path string) bool, prune bool) (CacheReport, error) {
+	var report CacheReport
+	if c.db == nil {
+		return report, errCacheUnavailable
+	}
+	decoders := map[string]func([]byte) error{
+		string(bucketStructure): func(v []byte) error { return json.Unmarshal(v, new(ScanItem)) },
+		string(bucketSizes):     func(v []byte) error { return json.Unmarshal(v, new(Size)) },
+		string(bucketTags):      func(v []byte) error { return json.Unmarshal(v, new([]TagInfo)) },
+		string(bucketCaptions):  func(v []byte) error { return json.Unmarshal(v, new(string)) },
+		string(bucketVideoMeta): func(v []byte) error { return json.Unmarshal(v, new(VideoMeta)) },
+		string(bucketHashes):    func(v []byte) error { return json.Unmarshal(v, new(ImageHash)) },
+	}
+	update := c.db.View
+	if prune {
+		update = c.db.Update
+	}
+	err := update(func(tx *bolt.Tx) error {
+		for _, name := range cacheBuckets {
+			bucket := tx.Bucket(name)
+			var remove [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				report.Entries++
+				switch {
+				case decoders[string(name)](v) != nil:
+					report.Undecodable++
+				case string(name) != string(bucketStructure) && !exists(string(k)):
+					report.Stale++
+				default:
+					return nil
+				}
+				remove = append(remove, append([]byte(nil), k...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !prune {
+				continue
+			}
+			for _, k := range remove {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	root := c.Fs.GetPath()
+	var dirs []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, CacheDBFile) || isLegacyCacheFile(name) || isStateFile(rel) {
+			return nil
+		}
+		report.Renditions++
+		if !strings.Contains(name, ".tmp") && exists(RenditionSource(rel)) {
+			return nil
+		}
+		report.OrphanRenditions++
+		if prune {
+			if err := os.Remove(p); err != nil {
+				log.Printf("Failed to remove %s: %v", rel, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if prune {
+		// Deepest first, so directories emptied by the removals above go too; non-empty ones stay.
+		sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+		for _, dir := range dirs {
+			_ = os.Remove(dir)
+		}
+		c.writeBackup()
+	}
+	return report, nil
+}
+
+// isStateFile reports whether rel is user data the server keeps at the top of the cache
+// directory, such as smart albums and collections. Renditions are never JSON.
+func isStateFile(rel string) bool {
+	return !strings.Contains(rel, "/") && path.Ext(rel) == ".json"
+}
+
+func isLegacyCacheFile(name string) bool {
+	for _, legacy := range []string{ImgStructureCache, ImgSizeCache, ImgTagCache, ImgCaptionCache, VideoMetaCache} {
+		if strings.HasPrefix(name, legacy) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportTags replaces the tags of every path in data, which has the layout of ImgTagCache:
+// a JSON object mapping media paths to tag lists.
+func (c *CacheManager) ImportTags(data []byte) (int, error) {
+	if c.db == nil {
+		return 0, errCacheUnavailable
+	}
+	var tags map[string][]TagInfo
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return 0, err
+	}
+	entries := encodeEntries(tags)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTags)
+		for k, v := range entries {
+			if k == "" {
+				continue
+			}
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachePrune_DropsStaleEntries(t *testing.T) {
+	cache := newTestCache(t, t.TempDir())
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	root.Images = []ImageNode{
+		{Node: Node{Name: "a.jpg", Path: "a.jpg"}, Size: Size{Width: 1, Height: 1}},
+		{Node: Node{Name: "b.jpg", Path: "b.jpg"}, Size: Size{Width: 1, Height: 1}},
+	}
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := cache.ImportTags([]byte(`{"b.jpg":[{"tag":"dog","value":80}]}`)); err != nil {
+		t.Fatalf("import tags: %v", err)
+	}
+	exists := func(path string) bool { return path == "a.jpg" }
+
+	report, err := cache.Verify(exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Stale != 2 || report.Clean() {
+		t.Fatalf("expect size and tags of b.jpg stale, got %+v", report)
+	}
+	if _, ok := cache.GetSize("b.jpg"); !ok {
+		t.Fatalf("expect verify to leave entries alone")
+	}
+
+	if _, err := cache.Prune(exists); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.GetSize("b.jpg"); ok {
+		t.Fatalf("expect stale size pruned")
+	}
+	if report, _ := cache.Verify(exists); !report.Clean() {
+		t.Fatalf("expect clean cache after prune, got %+v", report)
+	}
+}
+
+func TestCachePrune_KeepsStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	cache := newTestCache(t, dir)
+	for _, name := range []string{"collections.json", "gone.jpg.poster.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := cache.Prune(func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Renditions != 1 || report.OrphanRenditions != 1 {
+		t.Fatalf("expect only the poster counted, got %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "collections.json")); err != nil {
+		t.Fatalf("expect state file kept: %v", err)
+	}
+}
+
+func TestRenditionSource(t *testing.T) {
+	cases := map[string]string{
+		"album/a.jpg":                  "album/a.jpg",
+		"album/v.mp4.poster.jpg":       "album/v.mp4",
+		"album/v.mp4.preview.mp4":      "album/v.mp4",
+		"album/v.mp4.hls/seg-00001.ts": "album/v.mp4",
+		"album/v.mkv.subs/s_0.vtt":     "album/v.mkv",
+	}
+	for rel, want := range cases {
+		if got := RenditionSource(rel); got != want {
+			t.Fatalf("RenditionSource(%q) = %q, want %q", rel, got, want)
+		}
+	}
+}
@@ -3,80 +3,176 @@ package core
 import (
 	"encoding/json"
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
 )
 
+type ffprobeStream struct {
+	Index          int    `json:"index"`
+	CodecType      string `json:"codec_type"`
+	CodecName      string `json:"codec_name"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Duration       string `json:"duration"`
+	BitRate        string `json:"bit_rate"`
+	AvgFrameRate   string `json:"avg_frame_rate"`
+	RFrameRate     string `json:"r_frame_rate"`
+	Channels       int    `json:"channels"`
+	ColorTransfer  string `json:"color_transfer"`
+	ColorPrimaries string `json:"color_primaries"`
+	Tags           struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+		Rotate   string `json:"rotate"`
+	} `json:"tags"`
+	Disposition struct {
+		Default     int `json:"default"`
+		Forced      int `json:"forced"`
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	SideDataList []struct {
+		Rotation *float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
 type ffprobeOutput struct {
-	Streams []struct {
-		Width    int    `json:"width"`
-		Height   int    `json:"height"`
-		Duration string `json:"duration"`
-	} `json:"streams"`
-	Format struct {
-		Duration string `json:"duration"`
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
 	} `json:"format"`
 }
 
-// ProbeVideoMeta runs ffprobe and extracts width/height/duration.
-func ProbeVideoMeta(absPath string) (int, int, float64, error) {
-	cmd := exec.Command(
-		"ffprobe",
-		"-v",
-		"error",
-		"-select_streams",
-		"v:0",
-		"-show_entries",
-		"stream=width,height,duration",
-		"-show_entries",
-		"format=duration,format_name",
-		"-of",
-		"json",
-		absPath,
-	)
-	output, err := cmd.CombinedOutput()
+// parseProbeOutput extracts VideoMeta from `ffprobe -show_streams -show_format -of json`.
+// Width and height are corrected for rotation.
+func parseProbeOutput(output []byte) (VideoMeta, error) {
 	trimmedOutput := strings.TrimSpace(string(output))
-	if err != nil {
-		if trimmedOutput == "" {
-			return 0, 0, 0, err
-		}
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
-	}
 
 	var probe ffprobeOutput
 	if err := json.Unmarshal(output, &probe); err != nil {
 		if trimmedOutput == "" {
-			return 0, 0, 0, err
+			return VideoMeta{}, err
+		}
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
+	}
+
+	var video *ffprobeStream
+	meta := VideoMeta{Schema: VideoMetaSchemaVersion, Format: probe.Format.FormatName}
+	for i := range probe.Streams {
+		stream := &probe.Streams[i]
+		switch stream.CodecType {
+		case "video":
+			// Cover art in mp4/mkv is reported as a video stream too.
+			if video == nil && stream.Disposition.AttachedPic == 0 {
+				video = stream
+			}
+		case "audio":
+			meta.AudioTracks = append(meta.AudioTracks, newMediaTrack(stream))
+		case "subtitle":
+			meta.SubtitleTracks = append(meta.SubtitleTracks, newMediaTrack(stream))
 		}
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
 	}
 
-	if len(probe.Streams) == 0 {
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
+	if video == nil {
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
 	}
 
-	width := probe.Streams[0].Width
-	height := probe.Streams[0].Height
+	width := video.Width
+	height := video.Height
 	if width <= 0 || height <= 0 {
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
 	}
 
 	durationText := strings.TrimSpace(probe.Format.Duration)
 	if durationText == "" || durationText == "N/A" {
-		durationText = strings.TrimSpace(probe.Streams[0].Duration)
+		durationText = strings.TrimSpace(video.Duration)
 	}
 	if durationText == "" || durationText == "N/A" {
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
 	}
 
 	durationSec, err := strconv.ParseFloat(durationText, 64)
 	if err != nil {
 		if trimmedOutput == "" {
-			return 0, 0, 0, err
+			return VideoMeta{}, err
 		}
-		return 0, 0, 0, fmt.Errorf("%s", trimmedOutput)
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
+	}
+
+	meta.Rotation = streamRotation(video)
+	if meta.Rotation == 90 || meta.Rotation == 270 {
+		width, height = height, width
+	}
+	meta.Width = width
+	meta.Height = height
+	meta.DurationSec = durationSec
+	meta.VideoCodec = video.CodecName
+	if len(meta.AudioTracks) > 0 {
+		meta.AudioCodec = meta.AudioTracks[0].Codec
 	}
+	meta.BitRate = parseInt64(probe.Format.BitRate)
+	if meta.BitRate == 0 {
+		meta.BitRate = parseInt64(video.BitRate)
+	}
+	meta.FrameRate = parseFrameRate(video.AvgFrameRate)
+	if meta.FrameRate == 0 {
+		meta.FrameRate = parseFrameRate(video.RFrameRate)
+	}
+	meta.HDR = video.ColorTransfer == "smpte2084" || video.ColorTransfer == "arib-std-b67"
+
+	return meta, nil
+}
+
+func newMediaTrack(stream *ffprobeStream) MediaTrack {
+	return MediaTrack{
+		Index:    stream.Index,
+		Codec:    stream.CodecName,
+		Language: stream.Tags.Language,
+		Title:    stream.Tags.Title,
+		Channels: stream.Channels,
+		Default:  stream.Disposition.Default == 1,
+		Forced:   stream.Disposition.Forced == 1,
+	}
+}
+
+// streamRotation normalizes the display rotation to one of 0, 90, 180, 270.
+// Newer ffmpeg reports it in the display matrix side data, older ones in the rotate tag.
+func streamRotation(stream *ffprobeStream) int {
+	rotation := 0
+	if stream.Tags.Rotate != "" {
+		if v, err := strconv.Atoi(stream.Tags.Rotate); err == nil {
+			rotation = v
+		}
+	}
+	for _, sideData := range stream.SideDataList {
+		if sideData.Rotation != nil {
+			rotation = int(*sideData.Rotation)
+			break
+		}
+	}
+	rotation = ((rotation % 360) + 360) % 360
+	return (rotation + 45) / 90 * 90 % 360
+}
+
+func parseFrameRate(text string) float64 {
+	num, den, ok := strings.Cut(text, "/")
+	if !ok {
+		v, _ := strconv.ParseFloat(text, 64)
+		return v
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
 
-	return width, height, durationSec, nil
+func parseInt64(text string) int64 {
+	v, _ := strconv.ParseInt(text, 10, 64)
+	return v
 }
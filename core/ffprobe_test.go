@@ -0,0 +1,140 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gallery/common/storage"
+)
+
+const portraitPhoneProbe = `{
+  "streams": [
+    {"index": 0, "codec_type": "video", "codec_name": "hevc", "width": 1920, "height": 1080,
+     "avg_frame_rate": "30000/1001", "color_transfer": "arib-std-b67",
+     "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]},
+    {"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2,
+     "tags": {"language": "eng"}, "disposition": {"default": 1}},
+    {"index": 2, "codec_type": "subtitle", "codec_name": "mov_text",
+     "tags": {"language": "chi", "title": "Chinese"}},
+    {"index": 3, "codec_type": "video", "codec_name": "mjpeg", "width": 320, "height": 240,
+     "disposition": {"attached_pic": 1}}
+  ],
+  "format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "12.500000", "bit_rate": "8000000"}
+}`
+
+func TestParseProbeOutput_PortraitPhoneVideo(t *testing.T) {
+	meta, err := parseProbeOutput([]byte(portraitPhoneProbe))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if meta.Width != 1080 || meta.Height != 1920 {
+		t.Fatalf("expect rotation-corrected 1080x1920, got %dx%d", meta.Width, meta.Height)
+	}
+	if meta.Rotation != 270 {
+		t.Fatalf("expect rotation 270, got %d", meta.Rotation)
+	}
+	if meta.DurationSec != 12.5 || meta.BitRate != 8000000 {
+		t.Fatalf("unexpected duration/bitrate: %v %d", meta.DurationSec, meta.BitRate)
+	}
+	if meta.VideoCodec != "hevc" || meta.AudioCodec != "aac" || meta.Format != "mov,mp4,m4a,3gp,3g2,mj2" {
+		t.Fatalf("unexpected codecs: %+v", meta)
+	}
+	if meta.FrameRate < 29.96 || meta.FrameRate > 29.98 {
+		t.Fatalf("expect ~29.97 fps, got %v", meta.FrameRate)
+	}
+	if !meta.HDR {
+		t.Fatalf("expect HDR for HLG transfer")
+	}
+	if len(meta.AudioTracks) != 1 || !meta.AudioTracks[0].Default || meta.AudioTracks[0].Language != "eng" {
+		t.Fatalf("unexpected audio tracks: %+v", meta.AudioTracks)
+	}
+	if len(meta.SubtitleTracks) != 1 || meta.SubtitleTracks[0].Index != 2 || meta.SubtitleTracks[0].Title != "Chinese" {
+		t.Fatalf("unexpected subtitle tracks: %+v", meta.SubtitleTracks)
+	}
+	if meta.Schema != VideoMetaSchemaVersion {
+		t.Fatalf("expect schema %d, got %d", VideoMetaSchemaVersion, meta.Schema)
+	}
+}
+
+func TestParseProbeOutput_RotateTag(t *testing.T) {
+	probe := `{"streams": [{"codec_type": "video", "codec_name": "h264", "width": 640, "height": 480,
+		"duration": "3.0", "tags": {"rotate": "90"}}], "format": {"duration": "N/A"}}`
+	meta, err := parseProbeOutput([]byte(probe))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if meta.Width != 480 || meta.Height != 640 || meta.DurationSec != 3 {
+		t.Fatalf("unexpected meta: %+v", meta)
+	}
+}
+
+func TestParseProbeOutput_NoVideoStream(t *testing.T) {
+	probe := `{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {"duration": "3.0"}}`
+	if _, err := parseProbeOutput([]byte(probe)); err == nil {
+		t.Fatalf("expect error for audio-only file")
+	}
+}
+
+func TestVideoMetaCache_LegacyUpgrade(t *testing.T) {
+	modTime := time.Now()
+	legacy, _ := json.Marshal(map[string]VideoMeta{
+		"video.mp4": {Path: "video.mp4", DurationSec: 5, Width: 1920, Height: 1080, SizeBytes: 10, ModTimeUnixNano: modTime.UnixNano()},
+	})
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, VideoMetaCache), legacy, 0o644); err != nil {
+		t.Fatalf("write legacy cache: %v", err)
+	}
+	fs := storage.NewFs(dir)
+	cache := NewCacheManager(fs, nil)
+	if _, err := cache.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	meta, ok := cache.GetVideoMeta("video.mp4")
+	if !ok || meta.Width != 1920 {
+		t.Fatalf("expect legacy entry kept for display, got %+v %v", meta, ok)
+	}
+	if !cache.NeedsVideoMetaRefresh("video.mp4", modTime, 10) {
+		t.Fatalf("expect legacy entry to need refresh")
+	}
+	if fs.Exist(VideoMetaCache) || !fs.Exist(VideoMetaCache+migratedSuffix) {
+		t.Fatalf("expect legacy file renamed after import")
+	}
+
+	meta.Schema = VideoMetaSchemaVersion
+	cache.UpsertVideoMeta("video.mp4", meta)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	root.Videos = []VideoNode{{Node: Node{Name: "video.mp4", Path: "video.mp4"}}}
+	if err := cache.Save(root); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reloaded := NewCacheManager(fs, nil)
+	defer reloaded.Close()
+	if _, err := reloaded.Load(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if reloaded.NeedsVideoMetaRefresh("video.mp4", modTime, 10) {
+		t.Fatalf("expect upgraded entry to be fresh")
+	}
+}
+
+func TestUpdateVideoMeta_GoneVideo(t *testing.T) {
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	root.Locate("a").Videos = []VideoNode{{Node: Node{Name: "v.mp4", Path: "a/v.mp4"}}}
+	if video, ok := root.UpdateVideoMeta("a/v.mp4", VideoMeta{Width: 640, Height: 480}); !ok || video.Width != 640 {
+		t.Fatalf("expected the video updated, got %+v %v", video, ok)
+	}
+	if _, ok := root.UpdateVideoMeta("gone/v.mp4", VideoMeta{Width: 640}); ok {
+		t.Fatalf("expected no update for a video out of the tree")
+	}
+	if root.Lookup("gone") != nil {
+		t.Fatalf("expected no directory created for a video out of the tree")
+	}
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"gallery/common/ignore"
+	"gallery/common/storage"
+)
+
+// ScanFilter decides which entries of the library a scan lists.
+type ScanFilter struct {
+	Exclude     []string // gitignore-style patterns, see package ignore
+	Include     []string // when set, only files matching one of these patterns are listed
+	MaxFileSize int64    // files larger than this many bytes are skipped, 0 for no limit
+}
+
+// Exclusion reasons reported by Explain.
+const (
+	ExcludedByPattern = "pattern"
+	ExcludedHidden    = "hidden"
+	ExcludedByInclude = "include"
+	ExcludedBySize    = "size"
+)
+
+// Exclusion explains whether and why a scan skips a path.
+type Exclusion struct {
+	Path     string `json:"path"`
+	Excluded bool   `json:"excluded"`
+	Reason   string `json:"reason,omitempty"`
+	// Rule and Source name the deciding pattern: the one that excluded the path, or the
+	// negation that re-included it.
+	Rule   string `json:"rule,omitempty"`
+	Source string `json:"source,omitempty"`
+	// Dir is set when an ancestor directory was excluded, which hides everything below it.
+	Dir string `json:"dir,omitempty"`
+}
+
+// compiledFilter is a ScanFilter ready for matching.
+type compiledFilter struct {
+	exclude     ignore.Rules
+	include     ignore.Rules
+	maxFileSize int64
+}
+
+func compileFilter(f ScanFilter) compiledFilter {
+	exclude, err := ignore.CompileAll(f.Exclude, "exclude")
+	if err != nil {
+		log.Printf("Ignoring invalid exclude patterns: %v", err)
+	}
+	include, err := ignore.CompileAll(f.Include, "include")
+	if err != nil {
+		log.Printf("Ignoring invalid include patterns: %v", err)
+	}
+	return compiledFilter{exclude: exclude, include: include, maxFileSize: f.MaxFileSize}
+}
+
+// check decides on one directory entry. rules are the configured exclusions followed by the
+// .galleryignore rules in effect for its directory.
+func (f compiledFilter) check(rules ignore.Rules, rel string, isDir bool, size int64) Exclusion {
+	result := Exclusion{Path: rel}
+	if !storage.IsNormalFile(path.Base(rel)) {
+		result.Excluded, result.Reason = true, ExcludedHidden
+		return result
+	}
+	if rule, ok := rules.Match(rel, isDir); ok {
+		result.Rule, result.Source = rule.Pattern, rule.Source
+		if !rule.Negate {
+			result.Excluded, result.Reason = true, ExcludedByPattern
+			return result
+		}
+	}
+	if isDir {
+		return result
+	}
+	if f.maxFileSize > 0 && size > f.maxFileSize {
+		result.Excluded, result.Reason = true, ExcludedBySize
+		return result
+	}
+	if len(f.include) > 0 && !f.included(rel) {
+		result.Excluded, result.Reason = true, ExcludedByInclude
+	}
+	return result
+}
+
+// included reports whether a file, or one of its directories, matches an include pattern.
+func (f compiledFilter) included(rel string) bool {
+	rule, ok := f.include.MatchWithParents(rel)
+	return ok && !rule.Negate
+}
+
+// dirRules holds, for each directory discovered during one scan, the .galleryignore rules
+// of the directory and its ancestors. Parents are always registered before their children.
+type dirRules struct {
+	mu    sync.Mutex
+	rules map[string]ignore.Rules
+}
+
+func newDirRules() *dirRules {
+	return &dirRules{rules: make(map[string]ignore.Rules)}
+}
+
+// enter reads the .galleryignore of dir and returns the rules in effect inside it.
+func (d *dirRules) enter(originFs storage.Storage, dir string) ignore.Rules {
+	d.mu.Lock()
+	inherited := d.rules[parentDir(dir)]
+	d.mu.Unlock()
+	rules := withIgnoreFile(originFs, dir, inherited)
+	d.mu.Lock()
+	d.rules[dir] = rules
+	d.mu.Unlock()
+	return rules
+}
+
+// withIgnoreFile appends the rules of the .galleryignore in dir, if any, without touching
+// the backing array of inherited, which sibling directories share.
+func withIgnoreFile(originFs storage.Storage, dir string, inherited ignore.Rules) ignore.Rules {
+	data, err := originFs.Read(path.Join(dir, ignore.FileName))
+	if err != nil {
+		return inherited
+	}
+	own, err := ignore.ParseFile(data, dir)
+	if err != nil {
+		log.Printf("Invalid lines in %s: %v", path.Join(dir, ignore.FileName), err)
+	}
+	return append(inherited[:len(inherited):len(inherited)], own...)
+}
+
+func parentDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	if parent := path.Dir(dir); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// Explain reports whether a scan skips rel and which rule or limit decided it. It reads the
+// .galleryignore files on disk, so it reflects edits not yet picked up by a scan.
+func (s *Scanner) Explain(rel string) Exclusion {
+	return s.explain(rel, s.statEntry)
+}
+
+// MaxFileSize returns the size in bytes above which files are excluded, 0 for no limit.
+func (s *Scanner) MaxFileSize() int64 {
+	return s.currentFilter().maxFileSize
+}
+
+// ExplainNew is Explain for a file of size bytes or a directory that need not exist yet, such
+// as an upload or the target of a move.
+func (s *Scanner) ExplainNew(rel string, isDir bool, size int64) Exclusion {
+	return s.explain(rel, func(string) (bool, int64) { return isDir, size })
+}
+
+func (s *Scanner) explain(rel string, stat func(rel string) (bool, int64)) Exclusion {
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	filter := s.currentFilter()
+	rules := filter.exclude
+	var result Exclusion
+	segments := strings.Split(rel, "/")
+	dir := ""
+	for i := range segments {
+		rules = withIgnoreFile(s.OriginFs, dir, rules)
+		current := path.Join(dir, segments[i])
+		isDir, size := true, int64(0)
+		if i == len(segments)-1 {
+			isDir, size = stat(current)
+		}
+		result = filter.check(rules, current, isDir, size)
+		if result.Excluded {
+			if current != rel {
+				result.Dir = current
+				result.Path = rel
+			}
+			return result
+		}
+		dir = current
+	}
+	result.Path = rel
+	return result
+}
+
+func (s *Scanner) statEntry(rel string) (bool, int64) {
+	f, err := s.OriginFs.Open(rel)
+	if err != nil {
+		return false, 0
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, 0
+	}
+	return info.IsDir(), info.Size()
+}
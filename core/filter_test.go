@@ -0,0 +1,95 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"gallery/common/storage"
+)
+
+func writeFilterTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", name, err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func discovered(scanner *Scanner) []string {
+	var paths []string
+	for item := range scanner.StartDiscovery(2) {
+		if item.Type != ItemDir {
+			paths = append(paths, item.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestDiscovery_HonoursGalleryIgnore(t *testing.T) {
+	dir := writeFilterTree(t, map[string]string{
+		"a/x.jpg":               "x",
+		"a/y.psd.jpg":           "x",
+		"a/.galleryignore":      "*.psd.jpg\nraw/\n",
+		"a/raw/z.jpg":           "x",
+		"a/keep/.galleryignore": "!*.psd.jpg\n",
+		"a/keep/k.psd.jpg":      "x",
+		"b/big.jpg":             "0123456789",
+		"tmp/t.jpg":             "x",
+	})
+	scanner := NewScanner(storage.NewFs(dir), nil, NewCacheManager(newFakeStorage(nil), nil), nil, nil)
+	scanner.SetFilter(ScanFilter{Exclude: []string{"/tmp"}, MaxFileSize: 5})
+
+	got := discovered(scanner)
+	want := []string{"a/keep/k.psd.jpg", "a/x.jpg"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	cases := []struct {
+		path   string
+		reason string
+		source string
+		dir    string
+	}{
+		{"a/y.psd.jpg", ExcludedByPattern, "a/.galleryignore:1", ""},
+		{"a/raw/z.jpg", ExcludedByPattern, "a/.galleryignore:2", "a/raw"},
+		{"a/keep/k.psd.jpg", "", "a/keep/.galleryignore:1", ""},
+		{"b/big.jpg", ExcludedBySize, "", ""},
+		{"tmp/t.jpg", ExcludedByPattern, "exclude[0]", "tmp"},
+	}
+	for _, c := range cases {
+		result := scanner.Explain(c.path)
+		if result.Excluded != (c.reason != "") || result.Reason != c.reason || result.Source != c.source || result.Dir != c.dir {
+			t.Errorf("%s: unexpected explanation %+v", c.path, result)
+		}
+	}
+}
+
+func TestDiscovery_IncludeOnly(t *testing.T) {
+	dir := writeFilterTree(t, map[string]string{
+		"2024/trip/a.jpg": "x",
+		"2024/trip/b.mp4": "x",
+		"2024/misc/c.jpg": "x",
+		"d.jpg":           "x",
+	})
+	scanner := NewScanner(storage.NewFs(dir), nil, NewCacheManager(newFakeStorage(nil), nil), nil, nil)
+	scanner.SetFilter(ScanFilter{Include: []string{"trip/", "d.jpg"}})
+
+	got := discovered(scanner)
+	if len(got) != 3 || got[0] != "2024/trip/a.jpg" || got[1] != "2024/trip/b.mp4" || got[2] != "d.jpg" {
+		t.Fatalf("expected trip and d.jpg only, got %v", got)
+	}
+	if result := scanner.Explain("2024/misc/c.jpg"); !result.Excluded || result.Reason != ExcludedByInclude {
+		t.Fatalf("expected include exclusion, got %+v", result)
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"strconv"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageHashSchemaVersion is bumped whenever ComputeImageHash starts filling new fields.
+// Entries written by an older schema are hashed again on the next scan.
+const ImageHashSchemaVersion = 1
+
+// ImageHash identifies the content of an image. Content is the SHA-256 of the file, equal
+// for byte-identical copies; DHash is a 64-bit difference hash in hex, close in Hamming
+// distance for re-encoded and resized copies; Colors is the ColorSignature in hex. Both are
+// empty when the image cannot be decoded. ModTime (Unix seconds) and SizeBytes tell whether
+// the entry still matches the file.
+type ImageHash struct {
+	Content   string `json:"content"`
+	DHash     string `json:"dhash,omitempty"`
+	Colors    string `json:"colors,omitempty"`
+	SizeBytes int64  `json:"size_bytes"`
+	ModTime   int64  `json:"mtime"`
+	Schema    int    `json:"schema,omitempty"`
+}
+
+// Perceptual returns the difference hash as a number.
+func (h ImageHash) Perceptual() (uint64, bool) {
+	if h.DHash == "" {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(h.DHash, 16, 64)
+	return value, err == nil
+}
+
+// ColorSignature returns the colour signature.
+func (h ImageHash) ColorSignature() (ColorSignature, bool) {
+	var sig ColorSignature
+	if n, err := hex.Decode(sig[:], []byte(h.Colors)); err != nil || n != len(sig) {
+		return sig, false
+	}
+	return sig, true
+}
+
+// ComputeImageHash reads an image once, hashing its bytes while decoding it. It returns the
+// decoded bounds too, zero when the image cannot be decoded.
+func ComputeImageHash(r io.Reader) (ImageHash, image.Rectangle, error) {
+	sum := sha256.New()
+	counted := &countingWriter{w: sum}
+	tee := io.TeeReader(r, counted)
+	hash := ImageHash{Schema: ImageHashSchemaVersion}
+	var bounds image.Rectangle
+	if img, _, err := image.Decode(tee); err == nil {
+		hash.DHash = formatDHash(DifferenceHash(img))
+		sig := NewColorSignature(img)
+		hash.Colors = hex.EncodeToString(sig[:])
+		bounds = img.Bounds()
+	}
+	// Decoders may stop before the end of the file.
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return ImageHash{}, image.Rectangle{}, err
+	}
+	hash.Content = hex.EncodeToString(sum.Sum(nil))
+	hash.SizeBytes = counted.n
+	return hash, bounds, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func formatDHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// DifferenceHash shrinks img to 9x8 grey pixels and sets one bit per pixel that is brighter
+// than its right neighbour. Scaling and re-encoding move few bits; cropping moves many.
+func DifferenceHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			h <<= 1
+			if left > right {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// ColorSignature is the mean RGB colour of each quarter of an image, top left to bottom
+// right: where the colours sit, in 12 bytes.
+type ColorSignature [12]byte
+
+// NewColorSignature averages img down to 2x2 pixels.
+func NewColorSignature(img image.Image) ColorSignature {
+	small := imaging.Resize(img, 2, 2, imaging.Box)
+	var sig ColorSignature
+	for i := 0; i < 4; i++ {
+		offset := small.PixOffset(i%2, i/2)
+		copy(sig[i*3:i*3+3], small.Pix[offset:offset+3])
+	}
+	return sig
+}
+
+// Distance returns how far apart two signatures are, from 0 (same colours) to 1 (black
+// against white).
+func (a ColorSignature) Distance(b ColorSignature) float64 {
+	total := 0
+	for i := range a {
+		total += abs(int(a[i]) - int(b[i]))
+	}
+	return float64(total) / float64(len(a)*255)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// HammingDistance returns the number of bits in which a and b differ.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// HashTree is a BK-tree over 64-bit hashes under the Hamming distance. Each node keeps the
+// IDs added with its hash, so equal hashes share a node. It is not safe for concurrent
+// writes; searches may run concurrently once it is built.
+type HashTree struct {
+	root *hashTreeNode
+	size int
+}
+
+type hashTreeNode struct {
+	hash     uint64
+	ids      []int
+	children [65]*hashTreeNode // indexed by distance to hash
+}
+
+// Add inserts id under hash.
+func (t *HashTree) Add(hash uint64, id int) {
+	t.size++
+	if t.root == nil {
+		t.root = &hashTreeNode{hash: hash, ids: []int{id}}
+		return
+	}
+	node := t.root
+	for {
+		d := HammingDistance(hash, node.hash)
+		if d == 0 {
+			node.ids = append(node.ids, id)
+			return
+		}
+		next := node.children[d]
+		if next == nil {
+			node.children[d] = &hashTreeNode{hash: hash, ids: []int{id}}
+			return
+		}
+		node = next
+	}
+}
+
+// Len returns the number of IDs in the tree.
+func (t *HashTree) Len() int {
+	return t.size
+}
+
+// Search calls fn for every ID whose hash is within radius of hash, with its distance.
+func (t *HashTree) Search(hash uint64, radius int, fn func(id, distance int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*hashTreeNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := HammingDistance(hash, node.hash)
+		if d <= radius {
+			for _, id := range node.ids {
+				fn(id, d)
+			}
+		}
+		// By the triangle inequality, only children at distance d-radius..d+radius can match.
+		for i := max(d-radius, 1); i <= min(d+radius, 64); i++ {
+			if child := node.children[i]; child != nil {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// hashImages computes the ImageHash of images whose cached entry is missing, older than the
+// file or of an older schema, and fills in the dimensions of the images it decodes. Other items pass through.
+func (s *Scanner) hashImages(in <-chan ScanItem, workerSize int) <-chan ScanItem {
+	out := make(chan ScanItem, 100)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workerSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				if item.Type == ItemImage {
+					if cached, ok := s.Cache.GetImageHash(item.Path); !ok || cached.ModTime != item.ModTime || cached.Schema < ImageHashSchemaVersion {
+						s.hashImage(&item)
+					}
+				}
+				out <- item
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+func (s *Scanner) hashImage(item *ScanItem) {
+	f, err := s.OriginFs.Open(item.Path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	hash, bounds, err := ComputeImageHash(f)
+	if err != nil {
+		return
+	}
+	hash.ModTime = info.ModTime().Unix()
+	s.Cache.UpsertImageHash(item.Path, hash)
+	if item.Width == 0 && item.Height == 0 {
+		item.Width, item.Height = bounds.Dx(), bounds.Dy()
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/disintegration/imaging"
+
+	"gallery/common/storage"
+)
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestComputeImageHash_NearForResizedCopies(t *testing.T) {
+	original := PatternImage(180, 120)
+	data := encodeJPEG(t, original)
+	hash, bounds, err := ComputeImageHash(bytes.NewReader(data))
+	if err != nil || hash.SizeBytes != int64(len(data)) || bounds.Dx() != 180 || len(hash.DHash) != 16 {
+		t.Fatalf("unexpected hash %+v %v %v", hash, bounds, err)
+	}
+	again, _, _ := ComputeImageHash(bytes.NewReader(data))
+	if again.Content != hash.Content {
+		t.Fatalf("expected equal bytes to share the content hash")
+	}
+
+	resized, _, _ := ComputeImageHash(bytes.NewReader(encodeJPEG(t, imaging.Resize(original, 90, 60, imaging.Lanczos))))
+	flipped, _, _ := ComputeImageHash(bytes.NewReader(encodeJPEG(t, imaging.FlipH(original))))
+	a, _ := hash.Perceptual()
+	b, _ := resized.Perceptual()
+	c, _ := flipped.Perceptual()
+	if resized.Content == hash.Content || HammingDistance(a, b) > 4 {
+		t.Fatalf("expected a resized copy within 4 bits, got %d", HammingDistance(a, b))
+	}
+	if HammingDistance(a, c) < 16 {
+		t.Fatalf("expected a flipped image far away, got %d", HammingDistance(a, c))
+	}
+	sa, _ := hash.ColorSignature()
+	sb, _ := resized.ColorSignature()
+	inverted, _, _ := ComputeImageHash(bytes.NewReader(encodeJPEG(t, imaging.Invert(original))))
+	si, _ := inverted.ColorSignature()
+	if sa.Distance(sb) > 0.02 || sa.Distance(si) < 0.1 {
+		t.Fatalf("expected close colours for the resized copy and far ones for the inverted image, got %.3f and %.3f", sa.Distance(sb), sa.Distance(si))
+	}
+
+	undecodable, _, err := ComputeImageHash(bytes.NewReader([]byte("not an image")))
+	if err != nil || undecodable.Content == "" || undecodable.DHash != "" || undecodable.Colors != "" {
+		t.Fatalf("expected only a content hash, got %+v %v", undecodable, err)
+	}
+}
+
+func TestHashTree_MatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hashes := make([]uint64, 2000)
+	var tree HashTree
+	for i := range hashes {
+		hashes[i] = rng.Uint64()
+		if i%10 == 0 && i > 0 {
+			hashes[i] = hashes[i-1] ^ 1<<uint(rng.Intn(64)) // a near neighbour
+		}
+		tree.Add(hashes[i], i)
+	}
+	for q := 0; q < 50; q++ {
+		query := hashes[rng.Intn(len(hashes))] ^ 1<<uint(rng.Intn(64))
+		var want, got []int
+		for i, h := range hashes {
+			if HammingDistance(query, h) <= 12 {
+				want = append(want, i)
+			}
+		}
+		tree.Search(query, 12, func(id, _ int) { got = append(got, id) })
+		sort.Ints(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("query %x: got %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestScan_CachesImageHashes(t *testing.T) {
+	dir := t.TempDir()
+	data := encodeJPEG(t, PatternImage(40, 30))
+	for _, name := range []string{"a/x.jpg", "b/y.jpg"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheDir := t.TempDir()
+	cache := newTestCache(t, cacheDir)
+	scanner := NewScanner(storage.NewFs(dir), nil, cache, nil, nil)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	scanner.Scan(root)
+
+	x, ok := cache.GetImageHash("a/x.jpg")
+	y, _ := cache.GetImageHash("b/y.jpg")
+	if !ok || x.Content != y.Content || x.SizeBytes != int64(len(data)) {
+		t.Fatalf("expected equal hashes for copies, got %+v and %+v", x, y)
+	}
+	if err := cache.Move("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.GetImageHash("c/x.jpg"); !ok {
+		t.Fatalf("expected the hash moved with its folder")
+	}
+
+	cache.Close()
+	cache = newTestCache(t, cacheDir)
+	if _, err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cache.GetImageHash("b/y.jpg"); !ok || got != y {
+		t.Fatalf("expected the hash persisted, got %+v", got)
+	}
+}
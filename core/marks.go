@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// MarksFile holds the favorites and ratings, inside the cache directory. Unlike the cache
+// database it is user data: Save never prunes it, so the marks of a file that is missing for
+// a while come back with it.
+const MarksFile = "marks.json"
+
+// MaxRating is the highest star rating.
+const MaxRating = 5
+
+// Mark is what the user recorded about an image or video.
+type Mark struct {
+	Favorite bool `json:"favorite,omitempty"`
+	Rating   int  `json:"rating,omitempty"` // 0 (unrated) to MaxRating
+}
+
+// IsZero reports whether nothing is marked.
+func (m Mark) IsZero() bool {
+	return m == Mark{}
+}
+
+// Validate checks the rating.
+func (m Mark) Validate() error {
+	if m.Rating < 0 || m.Rating > MaxRating {
+		return fmt.Errorf("rating must be between 0 and %d", MaxRating)
+	}
+	return nil
+}
+
+func (c *CacheManager) loadMarks() {
+	c.marks = make(map[string]Mark)
+	if c.Fs == nil {
+		return
+	}
+	data, err := c.Fs.Read(MarksFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &c.marks)
+	}
+	if err != nil {
+		log.Printf("Failed to read %s: %v", MarksFile, err)
+	}
+}
+
+// GetMark returns the mark of path; unmarked paths return the zero Mark.
+func (c *CacheManager) GetMark(path string) Mark {
+	c.marksMu.RLock()
+	defer c.marksMu.RUnlock()
+	return c.marks[path]
+}
+
+// SetMark records the mark of path and writes MarksFile. A zero mark removes the entry.
+func (c *CacheManager) SetMark(path string, mark Mark) error {
+	if err := mark.Validate(); err != nil {
+		return err
+	}
+	return c.updateMarks(func(marks map[string]Mark) {
+		if mark.IsZero() {
+			delete(marks, path)
+		} else {
+			marks[path] = mark
+		}
+	})
+}
+
+// updateMarks applies change to a copy of the marks and writes MarksFile.
+func (c *CacheManager) updateMarks(change func(marks map[string]Mark)) error {
+	c.marksMu.Lock()
+	defer c.marksMu.Unlock()
+	marks := make(map[string]Mark, len(c.marks)+1)
+	for p, m := range c.marks {
+		marks[p] = m
+	}
+	change(marks)
+	if c.Fs != nil {
+		data, err := json.MarshalIndent(marks, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := c.Fs.Save(MarksFile, io.NopCloser(bytes.NewReader(data))); err != nil {
+			return err
+		}
+	}
+	c.marks = marks
+	return nil
+}
+
+// SetMark applies mark to the image or video at p. It returns false if p is not in the tree.
+// Copies in virtual folders and smart albums follow with the next ApplyVirtualPaths.
+func (dn *TraverseNode) SetMark(p string, mark Mark) bool {
+	node := dn.Lookup(path.Dir(p))
+	if node == nil {
+		return false
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for i := range node.Images {
+		if node.Images[i].Path == p {
+			node.Images[i].Mark = mark
+			return true
+		}
+	}
+	for i := range node.Videos {
+		if node.Videos[i].Path == p {
+			node.Videos[i].Mark = mark
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestMarks_SurviveCleanupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	cache := newTestCache(t, dir)
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	root.Locate("trip").Images = []ImageNode{
+		{Node: Node{Name: "a.jpg", Path: "trip/a.jpg"}, Size: Size{Width: 4, Height: 3}},
+		{Node: Node{Name: "b.jpg", Path: "trip/b.jpg"}, Size: Size{Width: 4, Height: 3}},
+	}
+	if err := cache.SetMark("trip/a.jpg", Mark{Favorite: true, Rating: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetMark("trip/b.jpg", Mark{Rating: 6}); err == nil {
+		t.Fatal("expected a rating above the maximum rejected")
+	}
+	if err := cache.Save(root); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file goes away for a while: the structure forgets it, the mark does not.
+	root.Locate("trip").Images = root.Locate("trip").Images[1:]
+	if err := cache.Save(root); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+	cache = newTestCache(t, dir)
+	if mark := cache.GetMark("trip/a.jpg"); !mark.Favorite || mark.Rating != 5 {
+		t.Fatalf("expected the mark kept, got %+v", mark)
+	}
+
+	root.Locate("trip").Images = append(root.Locate("trip").Images, ImageNode{Node: Node{Name: "a.jpg", Path: "trip/a.jpg"}, Size: Size{Width: 4, Height: 3}})
+	if err := cache.Save(root); err != nil {
+		t.Fatal(err)
+	}
+	restored := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	scanner := NewScanner(newFakeStorage(nil), nil, cache, nil, nil)
+	if _, err := scanner.Restore(restored); err != nil {
+		t.Fatal(err)
+	}
+	img, ok := restored.FindImage("trip/a.jpg")
+	if !ok || !img.Favorite || img.Rating != 5 {
+		t.Fatalf("expected the mark restored, got %+v", img)
+	}
+	favorites := restored.Directories[FavoritesAlbum]
+	if favorites == nil || !favorites.IsVirtual() || len(favorites.Images) != 1 || favorites.Images[0].Path != "trip/a.jpg" {
+		t.Fatalf("expected the favorite listed in %s, got %+v", FavoritesAlbum, favorites)
+	}
+
+	if err := cache.SetMark("trip/a.jpg", Mark{}); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.SetMark("trip/a.jpg", Mark{}) {
+		t.Fatal("expected the image found")
+	}
+	scanner.ApplyVirtualPaths(restored)
+	if favorites := restored.Directories[FavoritesAlbum]; len(favorites.Images) != 0 {
+		t.Fatalf("expected the unmarked image dropped, got %+v", favorites.Images)
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"path"
+	"strings"
 
 	"gallery/common/storage"
 )
@@ -16,10 +17,31 @@ func posterCachePath(videoPath string) string {
 	return videoPath + ".poster.jpg"
 }
 
+// PosterSidecarPath is the per-video poster override next to the video in the origin folder.
+func PosterSidecarPath(videoPath string) string {
+	return videoPath + ".poster.jpg"
+}
+
+// isPosterSidecar reports whether name is the poster sidecar of one of videos.
+func isPosterSidecar(name string, videos []string) bool {
+	if !strings.HasSuffix(name, ".poster.jpg") {
+		return false
+	}
+	for _, video := range videos {
+		if PosterSidecarPath(video) == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Scanner) enqueuePosterIfNeeded(videoPath string, needsRefresh bool) {
 	if s == nil || s.PosterQueue == nil || videoPath == "" {
 		return
 	}
+	if s.Toolchain != nil && !s.Toolchain.Capabilities().ExtractFrame {
+		return
+	}
 	if needsRefresh || !s.posterExists(videoPath) {
 		s.PosterQueue.Enqueue(videoPath)
 	}
@@ -30,6 +52,10 @@ func (s *Scanner) posterExists(videoPath string) bool {
 		return false
 	}
 
+	if s.OriginFs != nil && s.OriginFs.Exist(PosterSidecarPath(videoPath)) {
+		return true
+	}
+
 	parentDir := path.Dir(videoPath)
 	for _, candidate := range posterCoverCandidates {
 		coverPath := path.Join(parentDir, candidate)
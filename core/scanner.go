@@ -1,67 +1,143 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"image"
 	"log"
+	"os"
 	"path"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	utils "github.com/XGFan/go-utils"
-
+	"gallery/common/ignore"
 	"gallery/common/misc"
 	"gallery/common/storage"
 )
 
 // Scanner handles filesystem scanning and pipeline
 type Scanner struct {
-	OriginFs     storage.Storage
-	Exclude      utils.Set[string]
-	Cache        *CacheManager // Dependency Injection
-	VirtualPaths map[string][]string
-	PosterQueue  PosterEnqueuer
+	OriginFs    storage.Storage
+	Cache       *CacheManager // Dependency Injection
+	PosterQueue PosterEnqueuer
+	Toolchain   MediaToolchain
+
+	// Filter, virtual paths and smart albums can be swapped while the server runs.
+	rulesMu        sync.RWMutex
+	filter         compiledFilter
+	virtualPaths   map[string][]string
+	smartAlbums    []compiledAlbum
+	appliedVirtual []string
+
+	// Changes to the tree made outside a scan wait for the running one; see Apply.
+	pendingMu sync.Mutex
+	scanning  int
+	pending   []func()
 }
 
 // NewScanner creates a new Scanner
 func NewScanner(originFs storage.Storage, exclude []string, cache *CacheManager, virtualPaths map[string][]string, posterQueue PosterEnqueuer) *Scanner {
 	return &Scanner{
 		OriginFs:     originFs,
-		Exclude:      utils.NewSetWithSlice(exclude),
+		filter:       compileFilter(ScanFilter{Exclude: exclude}),
 		Cache:        cache,
-		VirtualPaths: virtualPaths,
+		virtualPaths: virtualPaths,
 		PosterQueue:  posterQueue,
+		Toolchain:    DefaultToolchain(),
 	}
 }
 
-// Scan orchestrates the full scanning process: FS Discovery -> Pipeline -> Virtual Paths -> Persist
+// SetRules replaces the scan filter and the virtual paths. The filter applies from the next
+// scan on; virtual paths from the next ApplyVirtualPaths.
+func (s *Scanner) SetRules(filter ScanFilter, virtualPaths map[string][]string) {
+	compiled := compileFilter(filter)
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	s.filter = compiled
+	s.virtualPaths = virtualPaths
+}
+
+// SetFilter replaces the scan filter only.
+func (s *Scanner) SetFilter(filter ScanFilter) {
+	compiled := compileFilter(filter)
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	s.filter = compiled
+}
+
+func (s *Scanner) currentFilter() compiledFilter {
+	s.rulesMu.RLock()
+	defer s.rulesMu.RUnlock()
+	return s.filter
+}
+
+// Scan orchestrates the full scanning process: FS Discovery -> Hashing -> Pipeline -> Virtual Paths -> Persist
 func (s *Scanner) Scan(data *TraverseNode) {
 	start := time.Now()
 	log.Println("Scan started")
 
-	source := s.StartDiscovery(8)
+	s.beginScan()
+	source := s.hashImages(s.StartDiscovery(8), 4)
 	s.RunPipeline(data, source)
 	s.ApplyVirtualPaths(data)
 	s.Persist(data)
+	s.endScan()
 
 	log.Printf("Scan finished: %s", time.Now().Sub(start).Truncate(time.Millisecond))
 }
 
-// Restore loads state from cache and reconstructs the tree via pipeline
+// Restore streams the cached structure through the pipeline to rebuild the tree
 // Returns number of items restored or error
 func (s *Scanner) Restore(data *TraverseNode) (int, error) {
-	items, err := s.Cache.LoadScanItems()
+	count, err := s.Cache.Load()
 	if err != nil {
 		return 0, err
 	}
-	if len(items) == 0 {
+	if count == 0 {
 		return 0, nil
 	}
 
-	source := s.StartCacheStream(items)
-	s.RunPipeline(data, source)
+	s.beginScan()
+	s.RunPipeline(data, s.Cache.StreamScanItems())
 	s.ApplyVirtualPaths(data)
+	s.endScan()
+
+	return count, nil
+}
 
-	return len(items), nil
+// Apply runs change on the tree now or, when a scan is running, once the scan is done. A
+// scan rebuilds each directory from what it found on disk, so a change made meanwhile could
+// be lost or duplicated.
+func (s *Scanner) Apply(change func()) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.scanning > 0 {
+		s.pending = append(s.pending, change)
+		return
+	}
+	change()
+}
+
+func (s *Scanner) beginScan() {
+	s.pendingMu.Lock()
+	s.scanning++
+	s.pendingMu.Unlock()
+}
+
+// endScan applies the changes that waited for the scans to finish.
+func (s *Scanner) endScan() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.scanning--
+	if s.scanning > 0 {
+		return
+	}
+	for _, change := range s.pending {
+		change()
+	}
+	s.pending = nil
 }
 
 // Persist saves the current tree state to cache
@@ -69,24 +145,45 @@ func (s *Scanner) Persist(data *TraverseNode) error {
 	return s.Cache.Save(data)
 }
 
-// ApplyVirtualPaths merges virtual folders into the root
+// ApplyVirtualPaths merges virtual folders into the root and re-evaluates the smart albums
 func (s *Scanner) ApplyVirtualPaths(root *TraverseNode) {
-	if s.VirtualPaths == nil {
-		return
-	}
-	for name, paths := range s.VirtualPaths {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	albums := s.evaluateAlbums(root)
+	virtual := make(map[string]*TraverseNode, len(s.virtualPaths)+len(albums))
+	for name, paths := range s.virtualPaths {
 		nodes := make([]*TraverseNode, 0, len(paths))
 		for _, p := range paths {
 			nodes = append(nodes, root.Locate(p))
 		}
-		virtualPath := s.mergeVirtualPath(name, nodes)
-		root.Directories[name] = virtualPath
+		virtual[name] = s.mergeVirtualPath(name, nodes)
+	}
+	for name, album := range albums {
+		if _, ok := virtual[name]; !ok {
+			virtual[name] = album
+		}
+	}
+
+	// Requests look up the root while it changes.
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	// Virtual folders and albums removed since the last call go away; a real directory of the
+	// same name comes back with the next scan.
+	for _, name := range s.appliedVirtual {
+		if _, ok := virtual[name]; !ok {
+			delete(root.Directories, name)
+		}
+	}
+	s.appliedVirtual = s.appliedVirtual[:0]
+	for name, node := range virtual {
+		root.Directories[name] = node
+		s.appliedVirtual = append(s.appliedVirtual, name)
 	}
 }
 
 func (s *Scanner) mergeVirtualPath(name string, nodes []*TraverseNode) *TraverseNode {
 	result := &TraverseNode{
-		Node:        Node{Name: name, Path: name, LastScanID: 1<<63 - 1}, // MaxInt64: never cleanup
+		Node:        Node{Name: name, Path: name, LastScanID: virtualScanID},
 		Directories: make(map[string]*TraverseNode),
 	}
 
@@ -95,6 +192,7 @@ func (s *Scanner) mergeVirtualPath(name string, nodes []*TraverseNode) *Traverse
 			result.Directories[k] = v // Shallow copy
 		}
 		result.Images = append(result.Images, node.Images...)
+		result.Videos = append(result.Videos, node.Videos...)
 		result.Others = append(result.Others, node.Others...)
 	}
 	return result
@@ -121,12 +219,130 @@ func (s *Scanner) RunPipeline(data *TraverseNode, source <-chan ScanItem) {
 	<-s.runMutator(metaOut, 4, data, currentScanID)
 }
 
+// Insert adds one file to the tree without waiting for the next scan. The item is hashed and
+// goes through the size probe and the meta enricher like a scanned one, then joins its
+// directory through Apply, after the running scan if there is one: siblings are kept,
+// nothing is cleaned up, and an entry at the same path is replaced. Videos pick up their sidecar subtitles. It
+// returns false when the probe drops the item, such as an image that cannot be decoded.
+func (s *Scanner) Insert(data *TraverseNode, item ScanItem) (ScanItem, bool) {
+	if item.Type == ItemVideo {
+		item.Subtitles = s.sidecarSubtitles(item.Path)
+	}
+	source := make(chan ScanItem, 1)
+	source <- item
+	close(source)
+	item, ok := <-s.runMetaEnricher(s.runSizeProbe(s.hashImages(source, 1), 1), 1)
+	if ok {
+		s.Apply(func() { put(data, item) })
+	}
+	return item, ok
+}
+
+// InsertDir adds the directory dir and everything below it to the tree, as Insert does for
+// a file. Discovery starts at dir with the exclusion rules of its parents.
+func (s *Scanner) InsertDir(data *TraverseNode, dir string) int {
+	filter := s.currentFilter()
+	ignored := newDirRules()
+	ignored.rules[parentDir(dir)] = s.ignoreRulesAbove(dir)
+	source := s.discover(4, Node{Name: path.Base(dir), Path: dir}, filter, ignored)
+	var items []ScanItem
+	count := 0
+	for item := range s.runMetaEnricher(s.runSizeProbe(s.hashImages(source, 4), 4), 4) {
+		items = append(items, item)
+		if item.Type != ItemDir {
+			count++
+		}
+	}
+	s.Apply(func() {
+		for _, item := range items {
+			put(data, item)
+		}
+	})
+	return count
+}
+
+// ignoreRulesAbove returns the rules of the .galleryignore files of the parents of dir.
+func (s *Scanner) ignoreRulesAbove(dir string) ignore.Rules {
+	rules := withIgnoreFile(s.OriginFs, "", nil)
+	parent := parentDir(dir)
+	if parent == "" {
+		return rules
+	}
+	current := ""
+	for _, segment := range strings.Split(parent, "/") {
+		current = path.Join(current, segment)
+		rules = withIgnoreFile(s.OriginFs, current, rules)
+	}
+	return rules
+}
+
+// put adds an item to its directory outside of a scan. The item takes the ID of the directory,
+// so it stays for as long as the directory does; an entry at the same path is replaced.
+func put(data *TraverseNode, item ScanItem) {
+	if item.Type == ItemDir {
+		data.Locate(item.Path)
+		return
+	}
+	node := data.Locate(parentDir(item.Path))
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	scanID := node.LastScanID
+	node.Images = slices.DeleteFunc(node.Images, func(img ImageNode) bool { return img.Path == item.Path })
+	node.Videos = slices.DeleteFunc(node.Videos, func(vid VideoNode) bool { return vid.Path == item.Path })
+	node.Others = slices.DeleteFunc(node.Others, func(other Node) bool { return other.Path == item.Path })
+	// Entries stay sorted by path, as a scan leaves them.
+	switch item.Type {
+	case ItemImage:
+		i, _ := slices.BinarySearchFunc(node.Images, item.Path, func(img ImageNode, p string) int { return strings.Compare(img.Path, p) })
+		node.Images = slices.Insert(node.Images, i, ImageNode{
+			Node:    Node{Name: item.Name, Path: item.Path, LastScanID: scanID},
+			Size:    Size{Width: item.Width, Height: item.Height},
+			Tags:    item.Tags,
+			Caption: item.Caption,
+			ModTime: item.ModTime,
+			Mark:    item.Mark,
+		})
+	case ItemVideo:
+		i, _ := slices.BinarySearchFunc(node.Videos, item.Path, func(vid VideoNode, p string) int { return strings.Compare(vid.Path, p) })
+		node.Videos = slices.Insert(node.Videos, i, VideoNode{
+			Node:        Node{Name: item.Name, Path: item.Path, LastScanID: scanID},
+			Size:        Size{Width: item.Width, Height: item.Height},
+			DurationSec: item.DurationSec,
+			Tags:        item.Tags,
+			Caption:     item.Caption,
+			Subtitles:   item.Subtitles,
+			ModTime:     item.ModTime,
+			Mark:        item.Mark,
+		})
+	default:
+		node.Others = append(node.Others, Node{Name: item.Name, Path: item.Path})
+	}
+}
+
+// sidecarSubtitles returns the subtitle files next to a video that belong to it.
+func (s *Scanner) sidecarSubtitles(videoPath string) []SubtitleTrack {
+	entries, _ := s.OriginFs.ReadDir(parentDir(videoPath))
+	var subtitles []string
+	for _, info := range entries {
+		if !info.IsDir() && storage.IsSubtitle(info.Name()) {
+			subtitles = append(subtitles, info.Name())
+		}
+	}
+	name := path.Base(videoPath)
+	return matchSidecarSubtitles([]string{name}, subtitles)[name]
+}
+
 // StartDiscovery scans the filesystem and emits initial items
 func (s *Scanner) StartDiscovery(workerSize int) <-chan ScanItem {
+	return s.discover(workerSize, Node{}, s.currentFilter(), newDirRules())
+}
+
+// discover emits the items of start and everything below it.
+func (s *Scanner) discover(workerSize int, start Node, filter compiledFilter, ignored *dirRules) <-chan ScanItem {
 	out := make(chan ScanItem, 2000)
 
 	task := misc.NewUnboundedChan[Node](1)
-	task.In <- Node{} // Start from root
+	task.In <- start
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -142,54 +358,66 @@ func (s *Scanner) StartDiscovery(workerSize int) <-chan ScanItem {
 	for i := 0; i < workerSize; i++ {
 		go func() {
 			for node := range task.Out {
-				s.scanDir(node, out, wg, task)
+				s.scanDir(node, out, wg, task, filter, ignored)
 			}
 		}()
 	}
 	return out
 }
 
-// StartCacheStream emits items from a cached list
-func (s *Scanner) StartCacheStream(items []ScanItem) <-chan ScanItem {
-	out := make(chan ScanItem, 2000)
-	go func() {
-		for _, item := range items {
-			out <- item
-		}
-		close(out)
-	}()
-	return out
-}
-
-func (s *Scanner) scanDir(node Node, out chan<- ScanItem, wg *sync.WaitGroup, task misc.UnboundedChan[Node]) {
+func (s *Scanner) scanDir(node Node, out chan<- ScanItem, wg *sync.WaitGroup, task misc.UnboundedChan[Node], filter compiledFilter, ignored *dirRules) {
 	defer wg.Done()
 
 	readDir, _ := s.OriginFs.ReadDir(node.Path)
+	rules := append(filter.exclude[:len(filter.exclude):len(filter.exclude)], ignored.enter(s.OriginFs, node.Path)...)
 
 	// Emit Dir Item
 	out <- ScanItem{Type: ItemDir, Path: node.Path, Name: node.Name}
 
+	entries := make([]os.FileInfo, 0, len(readDir))
+	var videos, subtitles []string
 	for _, info := range readDir {
 		targetPath := s.OriginFs.Join(node.Path, info.Name())
-		if s.Exclude.Contains(targetPath) {
+		if filter.check(rules, targetPath, info.IsDir(), info.Size()).Excluded {
 			continue
 		}
-
-		target := Node{Name: info.Name(), Path: targetPath}
-
-		if !storage.IsNormalFile(info.Name()) {
+		entries = append(entries, info)
+		if info.IsDir() {
 			continue
 		}
+		if storage.IsValidVideo(info.Name()) {
+			videos = append(videos, info.Name())
+		} else if storage.IsSubtitle(info.Name()) {
+			subtitles = append(subtitles, info.Name())
+		}
+	}
+
+	// Sidecar subtitles travel with their video instead of being listed as other files,
+	// and poster sidecars are not listed at all
+	sidecars := matchSidecarSubtitles(videos, subtitles)
+	attached := make(map[string]bool)
+	for _, tracks := range sidecars {
+		for _, track := range tracks {
+			attached[track.ID] = true
+		}
+	}
+
+	for _, info := range entries {
+		targetPath := s.OriginFs.Join(node.Path, info.Name())
+		target := Node{Name: info.Name(), Path: targetPath}
 
 		if info.IsDir() {
 			wg.Add(1)
 			task.In <- target
 		} else {
+			if isPosterSidecar(info.Name(), videos) {
+				continue
+			}
 			if storage.IsValidPic(info.Name()) {
-				out <- ScanItem{Type: ItemImage, Path: targetPath, Name: info.Name()}
+				out <- ScanItem{Type: ItemImage, Path: targetPath, Name: info.Name(), ModTime: info.ModTime().Unix()}
 			} else if storage.IsValidVideo(info.Name()) {
-				out <- ScanItem{Type: ItemVideo, Path: targetPath, Name: info.Name()}
-			} else {
+				out <- ScanItem{Type: ItemVideo, Path: targetPath, Name: info.Name(), Subtitles: sidecars[info.Name()], ModTime: info.ModTime().Unix()}
+			} else if !attached[info.Name()] {
 				out <- ScanItem{Type: ItemFile, Path: targetPath, Name: info.Name()}
 			}
 		}
@@ -253,34 +481,29 @@ func (s *Scanner) runSizeProbe(in <-chan ScanItem, workerSize int) (out chan Sca
 				needsRefresh := s.Cache.NeedsVideoMetaRefresh(item.Path, info.ModTime(), info.Size())
 				s.enqueuePosterIfNeeded(item.Path, needsRefresh)
 
+				// A fresh entry without dimensions records an earlier failed probe; it is kept as is
+				// so an unreadable file is not probed again on every scan.
 				meta, ok := s.Cache.GetVideoMeta(item.Path)
-				if ok && !needsRefresh && meta.Width > 0 && meta.Height > 0 {
+				if ok && !needsRefresh {
 					item.Width = meta.Width
 					item.Height = meta.Height
 					item.DurationSec = meta.DurationSec
+					item.Subtitles = withEmbeddedSubtitles(item.Subtitles, meta)
 					out <- item
 					continue
 				}
 
-				absPath := s.OriginFs.Join(s.OriginFs.GetPath(), item.Path)
-				width, height, durationSec, err := ProbeVideoMeta(absPath)
-				if err != nil {
-					log.Printf("ffprobe failed for %s: %s", item.Path, err.Error())
+				// Videos that cannot be probed are still listed, with unknown dimensions.
+				probed, err := s.probeVideoMeta(item.Path, info)
+				if errors.Is(err, ErrToolUnavailable) {
+					out <- item
 					continue
 				}
 
-				item.Width = width
-				item.Height = height
-				item.DurationSec = durationSec
-
-				s.Cache.UpsertVideoMeta(item.Path, VideoMeta{
-					Path:            item.Path,
-					DurationSec:     durationSec,
-					Width:           width,
-					Height:          height,
-					SizeBytes:       info.Size(),
-					ModTimeUnixNano: info.ModTime().UnixNano(),
-				})
+				item.Width = probed.Width
+				item.Height = probed.Height
+				item.DurationSec = probed.DurationSec
+				item.Subtitles = withEmbeddedSubtitles(item.Subtitles, probed)
 
 				out <- item
 			}
@@ -295,7 +518,45 @@ func (s *Scanner) runSizeProbe(in <-chan ScanItem, workerSize int) (out chan Sca
 	return out
 }
 
-// runMetaEnricher: Enrich images with tags/captions. Pass-through others.
+// ResolveVideoMeta returns the metadata of a video, probing it only when the cache has no fresh entry.
+// A fresh entry without dimensions records an earlier failed probe and is returned as is.
+func (s *Scanner) ResolveVideoMeta(videoPath string) (VideoMeta, error) {
+	f, err := s.OriginFs.Open(videoPath)
+	if err != nil {
+		return VideoMeta{}, err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return VideoMeta{}, err
+	}
+
+	if meta, ok := s.Cache.GetVideoMeta(videoPath); ok && !s.Cache.NeedsVideoMetaRefresh(videoPath, info.ModTime(), info.Size()) {
+		return meta, nil
+	}
+	return s.probeVideoMeta(videoPath, info)
+}
+
+// probeVideoMeta probes a video and caches the result. A failed probe is cached without dimensions,
+// so an unreadable file is not probed again until it changes; a missing ffprobe is not cached at all.
+func (s *Scanner) probeVideoMeta(videoPath string, info os.FileInfo) (VideoMeta, error) {
+	absPath := s.OriginFs.Join(s.OriginFs.GetPath(), videoPath)
+	meta, err := s.Toolchain.Probe(context.Background(), absPath)
+	if errors.Is(err, ErrToolUnavailable) {
+		return VideoMeta{}, err
+	}
+	if err != nil {
+		log.Printf("ffprobe failed for %s: %s", videoPath, err.Error())
+		meta = VideoMeta{Schema: VideoMetaSchemaVersion}
+	}
+	meta.Path = videoPath
+	meta.SizeBytes = info.Size()
+	meta.ModTimeUnixNano = info.ModTime().UnixNano()
+	s.Cache.UpsertVideoMeta(videoPath, meta)
+	return meta, err
+}
+
+// runMetaEnricher: Enrich images with tags/captions and media with marks. Pass-through others.
 func (s *Scanner) runMetaEnricher(in <-chan ScanItem, workerSize int) (out chan ScanItem) {
 	out = make(chan ScanItem, 100)
 	var wg sync.WaitGroup
@@ -313,6 +574,9 @@ func (s *Scanner) runMetaEnricher(in <-chan ScanItem, workerSize int) (out chan
 						item.Caption = s.Cache.GetCaption(item.Path)
 					}
 				}
+				if item.Type == ItemImage || item.Type == ItemVideo {
+					item.Mark = s.Cache.GetMark(item.Path)
+				}
 				out <- item
 			}
 		}()
@@ -379,6 +643,8 @@ func (s *Scanner) runMutator(in <-chan ScanItem, workerSize int, data *TraverseN
 						Size:    Size{Width: item.Width, Height: item.Height},
 						Tags:    item.Tags,
 						Caption: item.Caption,
+						ModTime: item.ModTime,
+						Mark:    item.Mark,
 					}
 
 					node.mu.Lock()
@@ -405,6 +671,9 @@ func (s *Scanner) runMutator(in <-chan ScanItem, workerSize int, data *TraverseN
 						DurationSec: item.DurationSec,
 						Tags:        item.Tags,
 						Caption:     item.Caption,
+						Subtitles:   item.Subtitles,
+						ModTime:     item.ModTime,
+						Mark:        item.Mark,
 					}
 
 					node.mu.Lock()
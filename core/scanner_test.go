@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -56,6 +57,7 @@ func (fs *fakeStorage) Save(name string, reader io.ReadCloser) error {
 	return nil
 }
 func (fs *fakeStorage) Rename(oldName, newName string) error { return nil }
+func (fs *fakeStorage) Remove(name string) error             { return nil }
 func (fs *fakeStorage) Exist(name string) bool {
 	_, ok := fs.files[name]
 	return ok
@@ -112,6 +114,7 @@ func TestScanEnqueuePoster_MissingPoster(t *testing.T) {
 
 	queue := &mockPosterQueue{}
 	scanner := NewScanner(originFs, nil, cache, nil, queue)
+	scanner.Toolchain = NewFakeToolchain()
 	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
 
 	source := make(chan ScanItem, 1)
@@ -141,10 +144,12 @@ func TestScanEnqueuePoster_NoChange_NoEnqueue(t *testing.T) {
 		Height:          720,
 		SizeBytes:       2048,
 		ModTimeUnixNano: modTime.UnixNano(),
+		Schema:          VideoMetaSchemaVersion,
 	})
 
 	queue := &mockPosterQueue{}
 	scanner := NewScanner(originFs, nil, cache, nil, queue)
+	scanner.Toolchain = NewFakeToolchain()
 	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
 
 	source := make(chan ScanItem, 1)
@@ -157,3 +162,146 @@ func TestScanEnqueuePoster_NoChange_NoEnqueue(t *testing.T) {
 		t.Fatalf("expected no enqueue when poster exists and unchanged, got %d", queue.Count())
 	}
 }
+
+func TestScanProbe_DegradesWithoutTools(t *testing.T) {
+	modTime := time.Now()
+	originFs := newFakeStorage(map[string]*fakeFileInfo{
+		"video.mp4": {name: "video.mp4", size: 1024, modTime: modTime},
+	})
+	cache := NewCacheManager(newFakeStorage(nil), nil)
+	queue := &mockPosterQueue{}
+	scanner := NewScanner(originFs, nil, cache, nil, queue)
+	scanner.Toolchain = &FakeToolchain{}
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+
+	source := make(chan ScanItem, 1)
+	source <- ScanItem{Type: ItemVideo, Path: "video.mp4", Name: "video.mp4"}
+	close(source)
+	scanner.RunPipeline(root, source)
+
+	videos := root.Video()
+	if len(videos) != 1 || videos[0].Width != 0 || videos[0].Height != 0 {
+		t.Fatalf("expected video listed with unknown dimensions, got %+v", videos)
+	}
+	if queue.Count() != 0 {
+		t.Fatalf("expected no poster enqueue without ffmpeg, got %d", queue.Count())
+	}
+	if _, ok := cache.GetVideoMeta("video.mp4"); ok {
+		t.Fatalf("expected no meta cached while tools are missing")
+	}
+}
+
+func TestScanProbe_UsesToolchain(t *testing.T) {
+	modTime := time.Now()
+	originFs := newFakeStorage(map[string]*fakeFileInfo{
+		"video.mp4": {name: "video.mp4", size: 1024, modTime: modTime},
+	})
+	cache := NewCacheManager(newFakeStorage(nil), nil)
+	scanner := NewScanner(originFs, nil, cache, nil, nil)
+	toolchain := NewFakeToolchain()
+	toolchain.Metas["video.mp4"] = VideoMeta{Schema: VideoMetaSchemaVersion, Width: 720, Height: 1280, DurationSec: 3}
+	scanner.Toolchain = toolchain
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+
+	source := make(chan ScanItem, 1)
+	source <- ScanItem{Type: ItemVideo, Path: "video.mp4", Name: "video.mp4"}
+	close(source)
+	scanner.RunPipeline(root, source)
+
+	videos := root.Video()
+	if len(videos) != 1 || videos[0].Width != 720 || videos[0].Height != 1280 {
+		t.Fatalf("expected probed dimensions, got %+v", videos)
+	}
+	meta, ok := cache.GetVideoMeta("video.mp4")
+	if !ok || meta.SizeBytes != 1024 || meta.Path != "video.mp4" {
+		t.Fatalf("expected probed meta cached, got %+v %v", meta, ok)
+	}
+	if len(toolchain.Calls()) != 1 {
+		t.Fatalf("expected one probe, got %v", toolchain.Calls())
+	}
+}
+
+func TestScannerInsert_KeepsSiblings(t *testing.T) {
+	dir := writeFilterTree(t, map[string]string{"a/old.mp4": "x"})
+	scanner := NewScanner(storage.NewFs(dir), nil, NewCacheManager(newFakeStorage(nil), nil), nil, nil)
+	scanner.Toolchain = NewFakeToolchain()
+	scanner.SetFilter(ScanFilter{MaxFileSize: 5})
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	scanner.Scan(root)
+
+	for name, content := range map[string]string{"a/new.mp4": "x", "a/new.en.srt": "1", "a/bad.jpg": "x"} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := scanner.Insert(root, ScanItem{Type: ItemImage, Path: "a/bad.jpg", Name: "bad.jpg"}); ok {
+		t.Fatalf("expected an undecodable image dropped")
+	}
+	item, ok := scanner.Insert(root, ScanItem{Type: ItemVideo, Path: "a/new.mp4", Name: "new.mp4"})
+	if !ok || len(item.Subtitles) != 1 {
+		t.Fatalf("expected the video inserted with its subtitle, got %+v", item)
+	}
+	scanner.Insert(root, ScanItem{Type: ItemVideo, Path: "a/new.mp4", Name: "new.mp4"})
+	if videos := root.Lookup("a").Videos; len(videos) != 2 {
+		t.Fatalf("expected the sibling kept and no duplicate, got %+v", videos)
+	}
+
+	if got := scanner.ExplainNew("a/big.mp4", false, 10); got.Reason != ExcludedBySize {
+		t.Fatalf("expected an upload over max_file_size excluded, got %+v", got)
+	}
+}
+
+func TestScannerInsert_DuringScan(t *testing.T) {
+	dir := writeFilterTree(t, map[string]string{"a/old.mp4": "x"})
+	scanner := NewScanner(storage.NewFs(dir), nil, NewCacheManager(newFakeStorage(nil), nil), nil, nil)
+	scanner.Toolchain = NewFakeToolchain()
+	root := &TraverseNode{Directories: make(map[string]*TraverseNode)}
+	scanner.Scan(root)
+
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(name string) int {
+		n := 0
+		for _, video := range root.Lookup("a").Videos {
+			if video.Path == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	scanner.beginScan()
+	write("a/held.mp4")
+	scanner.Insert(root, ScanItem{Type: ItemVideo, Path: "a/held.mp4", Name: "held.mp4"})
+	if count("a/held.mp4") != 0 {
+		t.Fatalf("expected the insert held back while a scan runs")
+	}
+	scanner.endScan()
+	if count("a/held.mp4") != 1 {
+		t.Fatalf("expected the insert applied once the scan ends")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			scanner.Scan(root)
+		}
+	}()
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := "a/up" + string(rune('a'+i)) + ".mp4"
+		write(name)
+		scanner.Insert(root, ScanItem{Type: ItemVideo, Path: name, Name: path.Base(name)})
+		names = append(names, name)
+	}
+	<-done
+	for _, name := range append(names, "a/old.mp4", "a/held.mp4") {
+		if n := count(name); n != 1 {
+			t.Fatalf("expected %s in the tree once, found %d times", name, n)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+
+	"gallery/common/storage"
+)
+
+const embeddedSubtitlePrefix = "stream:"
+
+// SubtitleTrack is a subtitle available for a video, either a sidecar file or an embedded stream
+type SubtitleTrack struct {
+	ID       string `json:"id"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Format   string `json:"format"`
+	Embedded bool   `json:"embedded,omitempty"`
+}
+
+// textSubtitleCodecs are embedded codecs ffmpeg can convert to WebVTT; bitmap ones (pgs, dvdsub) are skipped.
+var textSubtitleCodecs = map[string]bool{"subrip": true, "ass": true, "ssa": true, "webvtt": true, "mov_text": true, "text": true}
+
+// EmbeddedSubtitleID is the track id of the subtitle stream at index inside its container.
+func EmbeddedSubtitleID(index int) string {
+	return embeddedSubtitlePrefix + strconv.Itoa(index)
+}
+
+// ParseEmbeddedSubtitleID is the inverse of EmbeddedSubtitleID.
+func ParseEmbeddedSubtitleID(id string) (int, bool) {
+	if !strings.HasPrefix(id, embeddedSubtitlePrefix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(id, embeddedSubtitlePrefix))
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// EmbeddedSubtitles lists the text subtitle streams of a probed video.
+func EmbeddedSubtitles(meta VideoMeta) []SubtitleTrack {
+	var tracks []SubtitleTrack
+	for _, stream := range meta.SubtitleTracks {
+		if !textSubtitleCodecs[stream.Codec] {
+			continue
+		}
+		tracks = append(tracks, SubtitleTrack{
+			ID:       EmbeddedSubtitleID(stream.Index),
+			Language: stream.Language,
+			Label:    stream.Title,
+			Format:   stream.Codec,
+			Embedded: true,
+		})
+	}
+	return tracks
+}
+
+// withEmbeddedSubtitles replaces the embedded tracks of a subtitle list with those of meta, keeping sidecars.
+// Items restored from cache already carry embedded tracks, so they must not be appended twice.
+func withEmbeddedSubtitles(tracks []SubtitleTrack, meta VideoMeta) []SubtitleTrack {
+	result := make([]SubtitleTrack, 0, len(tracks)+len(meta.SubtitleTracks))
+	for _, track := range tracks {
+		if !track.Embedded {
+			result = append(result, track)
+		}
+	}
+	result = append(result, EmbeddedSubtitles(meta)...)
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// videoStem is the file name of a video without its extension.
+func videoStem(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// matchSidecarSubtitles associates subtitle files of a directory with its videos by file name stem.
+// "movie.srt" and "movie.en.srt" both belong to "movie.mp4"; the part between the stem and
+// the extension is taken as the language. When stems overlap ("movie" and "movie.part2")
+// the longest one wins. Subtitles without a matching video are not returned.
+func matchSidecarSubtitles(videos []string, subtitles []string) map[string][]SubtitleTrack {
+	result := make(map[string][]SubtitleTrack)
+	for _, subtitle := range subtitles {
+		best := ""
+		for _, video := range videos {
+			stem := videoStem(video)
+			if strings.HasPrefix(subtitle, stem+".") && len(stem) > len(videoStem(best)) {
+				best = video
+			}
+		}
+		if best == "" {
+			continue
+		}
+		ext := path.Ext(subtitle)
+		language := strings.TrimPrefix(strings.TrimSuffix(subtitle, ext), videoStem(best))
+		language = strings.TrimPrefix(language, ".")
+		result[best] = append(result[best], SubtitleTrack{
+			ID:       subtitle,
+			Language: language,
+			Label:    language,
+			Format:   storage.GetExt(subtitle),
+		})
+	}
+	return result
+}
+
+// SidecarSubtitlePath resolves a sidecar track id of a video to its path.
+// It returns false for ids that do not name a subtitle next to the video.
+func SidecarSubtitlePath(videoPath string, id string) (string, bool) {
+	if id == "" || strings.ContainsAny(id, "/\\") || !storage.IsSubtitle(id) {
+		return "", false
+	}
+	if !strings.HasPrefix(id, videoStem(path.Base(videoPath))+".") {
+		return "", false
+	}
+	return path.Join(path.Dir(videoPath), id), true
+}
+
+// SrtToVtt converts SubRip text to WebVTT: it adds the header and switches the
+// millisecond separator of cue timings from ',' to '.'.
+func SrtToVtt(srt []byte) []byte {
+	srt = bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))
+	srt = bytes.ReplaceAll(srt, []byte("\r\n"), []byte("\n"))
+	out := bytes.NewBufferString("WEBVTT\n\n")
+	for _, line := range bytes.Split(srt, []byte("\n")) {
+		if bytes.Contains(line, []byte("-->")) {
+			line = bytes.ReplaceAll(line, []byte(","), []byte("."))
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// SubtitleCachePath is where a converted track of a video is kept in the cache.
+func SubtitleCachePath(videoPath string, id string) string {
+	return videoPath + ".subs/" + strings.ReplaceAll(id, ":", "_") + ".vtt"
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gallery/common/storage"
+)
+
+func TestMatchSidecarSubtitles(t *testing.T) {
+	matched := matchSidecarSubtitles(
+		[]string{"movie.mkv", "movie.part2.mp4"},
+		[]string{"movie.srt", "movie.en.srt", "movie.part2.srt", "orphan.ass"},
+	)
+	if got := matched["movie.mkv"]; len(got) != 2 || got[0].Language != "" || got[1].Language != "en" {
+		t.Fatalf("unexpected tracks for movie.mkv: %+v", got)
+	}
+	if got := matched["movie.part2.mp4"]; len(got) != 1 || got[0].ID != "movie.part2.srt" || got[0].Language != "" {
+		t.Fatalf("expect longest stem to win, got %+v", got)
+	}
+	for _, tracks := range matched {
+		for _, track := range tracks {
+			if track.ID == "orphan.ass" {
+				t.Fatalf("orphan subtitle should not be attached")
+			}
+		}
+	}
+}
+
+func TestSidecarSubtitlePath(t *testing.T) {
+	if got, ok := SidecarSubtitlePath("shows/movie.mkv", "movie.en.srt"); !ok || got != "shows/movie.en.srt" {
+		t.Fatalf("unexpected path %q %v", got, ok)
+	}
+	for _, id := range []string{"../movie.srt", "other.srt", "movie.en.txt", ""} {
+		if _, ok := SidecarSubtitlePath("shows/movie.mkv", id); ok {
+			t.Fatalf("expect %q rejected", id)
+		}
+	}
+}
+
+func TestSrtToVtt(t *testing.T) {
+	srt := "\xef\xbb\xbf1\r\n00:00:01,500 --> 00:00:03,000\r\nHello, world\r\n"
+	vtt := string(SrtToVtt([]byte(srt)))
+	if !strings.HasPrefix(vtt, "WEBVTT\n\n1\n") {
+		t.Fatalf("missing header: %q", vtt)
+	}
+	if !strings.Contains(vtt, "00:00:01.500 --> 00:00:03.000\n") {
+		t.Fatalf("timing not converted: %q", vtt)
+	}
+	if !strings.Contains(vtt, "Hello, world\n") {
+		t.Fatalf("cue text should keep commas: %q", vtt)
+	}
+}
+
+func TestWithEmbeddedSubtitles(t *testing.T) {
+	meta := VideoMeta{SubtitleTracks: []MediaTrack{
+		{Index: 2, Codec: "subrip", Language: "eng"},
+		{Index: 3, Codec: "hdmv_pgs_subtitle"},
+	}}
+	tracks := withEmbeddedSubtitles([]SubtitleTrack{{ID: "movie.srt", Format: "srt"}}, meta)
+	tracks = withEmbeddedSubtitles(tracks, meta)
+	if len(tracks) != 2 || tracks[1].ID != EmbeddedSubtitleID(2) || !tracks[1].Embedded {
+		t.Fatalf("unexpected tracks: %+v", tracks)
+	}
+}
+
+func TestDiscoveryAttachesSidecarSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"movie.mkv", "movie.zh.ass", "notes.srt", "readme.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	scanner := NewScanner(storage.NewFs(dir), nil, NewCacheManager(newFakeStorage(nil), nil), nil, nil)
+
+	var video ScanItem
+	others := map[string]bool{}
+	for item := range scanner.StartDiscovery(2) {
+		switch item.Type {
+		case ItemVideo:
+			video = item
+		case ItemFile:
+			others[item.Name] = true
+		}
+	}
+	if len(video.Subtitles) != 1 || video.Subtitles[0].ID != "movie.zh.ass" || video.Subtitles[0].Language != "zh" {
+		t.Fatalf("unexpected video subtitles: %+v", video.Subtitles)
+	}
+	if others["movie.zh.ass"] {
+		t.Fatalf("attached subtitle should not be listed as other file")
+	}
+	if !others["notes.srt"] || !others["readme.txt"] {
+		t.Fatalf("unattached files should stay in others: %v", others)
+	}
+}
@@ -0,0 +1,19 @@
+package core
+
+import (
+	"image"
+	"image/color"
+)
+
+// PatternImage returns a w x h image with enough structure for its difference hash and
+// colour signature to survive resizing and re-encoding, for tests of near duplicates.
+func PatternImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*7 + y*3 + (x/9)*(y/7)*40) % 256)
+			img.Set(x, y, color.RGBA{R: v, G: 255 - v, B: uint8(x * 255 / w), A: 255})
+		}
+	}
+	return img
+}
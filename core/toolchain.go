@@ -0,0 +1,129 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ErrToolUnavailable is returned by a MediaToolchain for operations whose tool is not installed.
+var ErrToolUnavailable = errors.New("media tool unavailable")
+
+// ToolchainCapabilities reports which operations a MediaToolchain can perform on this host.
+type ToolchainCapabilities struct {
+	Probe        bool `json:"probe"`
+	ExtractFrame bool `json:"extractFrame"`
+	Transcode    bool `json:"transcode"`
+}
+
+// MediaToolchain is every external media operation the gallery depends on.
+// ExtractFrame and Transcode take ffmpeg-style arguments whose last element is the output path,
+// so generators keep building their own filter graphs while the toolchain decides how to run them.
+type MediaToolchain interface {
+	Capabilities() ToolchainCapabilities
+	Probe(ctx context.Context, absPath string) (VideoMeta, error)
+	ExtractFrame(ctx context.Context, args []string) error
+	Transcode(ctx context.Context, args []string) error
+}
+
+// FFmpegToolchain runs the ffprobe and ffmpeg binaries. An empty path means the tool is missing.
+type FFmpegToolchain struct {
+	FFprobePath string
+	FFmpegPath  string
+}
+
+// NewFFmpegToolchain looks both binaries up in PATH.
+func NewFFmpegToolchain() *FFmpegToolchain {
+	tc := &FFmpegToolchain{}
+	if p, err := exec.LookPath("ffprobe"); err == nil {
+		tc.FFprobePath = p
+	}
+	if p, err := exec.LookPath("ffmpeg"); err == nil {
+		tc.FFmpegPath = p
+	}
+	return tc
+}
+
+var (
+	defaultToolchain     MediaToolchain
+	defaultToolchainOnce sync.Once
+)
+
+// DefaultToolchain is the ffmpeg toolchain of this host, detected once and logged at first use.
+func DefaultToolchain() MediaToolchain {
+	defaultToolchainOnce.Do(func() {
+		tc := NewFFmpegToolchain()
+		LogCapabilities(tc)
+		defaultToolchain = tc
+	})
+	return defaultToolchain
+}
+
+// LogCapabilities reports missing tools once, instead of an error per video later on.
+func LogCapabilities(tc MediaToolchain) {
+	caps := tc.Capabilities()
+	if caps.Probe && caps.ExtractFrame && caps.Transcode {
+		log.Printf("media toolchain ready: %+v", caps)
+		return
+	}
+	log.Printf("media toolchain degraded: %+v; videos are listed without dimensions, posters, previews or transcoding", caps)
+}
+
+func (tc *FFmpegToolchain) Capabilities() ToolchainCapabilities {
+	return ToolchainCapabilities{
+		Probe:        tc.FFprobePath != "",
+		ExtractFrame: tc.FFmpegPath != "",
+		Transcode:    tc.FFmpegPath != "",
+	}
+}
+
+// Probe runs ffprobe and extracts the full VideoMeta of a file.
+// SizeBytes and ModTimeUnixNano are left for the caller to fill in.
+func (tc *FFmpegToolchain) Probe(ctx context.Context, absPath string) (VideoMeta, error) {
+	if tc.FFprobePath == "" {
+		return VideoMeta{}, fmt.Errorf("ffprobe: %w", ErrToolUnavailable)
+	}
+	cmd := exec.CommandContext(
+		ctx,
+		tc.FFprobePath,
+		"-v",
+		"error",
+		"-show_streams",
+		"-show_format",
+		"-of",
+		"json",
+		absPath,
+	)
+	output, err := cmd.CombinedOutput()
+	trimmedOutput := strings.TrimSpace(string(output))
+	if err != nil {
+		if trimmedOutput == "" {
+			return VideoMeta{}, err
+		}
+		return VideoMeta{}, fmt.Errorf("%s", trimmedOutput)
+	}
+	return parseProbeOutput(output)
+}
+
+func (tc *FFmpegToolchain) ExtractFrame(ctx context.Context, args []string) error {
+	return tc.runFFmpeg(ctx, args)
+}
+
+func (tc *FFmpegToolchain) Transcode(ctx context.Context, args []string) error {
+	return tc.runFFmpeg(ctx, args)
+}
+
+func (tc *FFmpegToolchain) runFFmpeg(ctx context.Context, args []string) error {
+	if tc.FFmpegPath == "" {
+		return fmt.Errorf("ffmpeg: %w", ErrToolUnavailable)
+	}
+	cmd := exec.CommandContext(ctx, tc.FFmpegPath, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FakeToolchain is a deterministic MediaToolchain for tests and hosts without ffmpeg.
+// Probe answers from Metas (keyed by file base name) or a fixed 1920x1080 10s h264 video;
+// ExtractFrame and Transcode write a marker derived from their arguments to the output path.
+// Operations disabled in Caps fail with ErrToolUnavailable.
+type FakeToolchain struct {
+	Caps  ToolchainCapabilities
+	Metas map[string]VideoMeta
+
+	mu    sync.Mutex
+	calls []string
+}
+
+// NewFakeToolchain returns a fake with every capability enabled.
+func NewFakeToolchain() *FakeToolchain {
+	return &FakeToolchain{
+		Caps:  ToolchainCapabilities{Probe: true, ExtractFrame: true, Transcode: true},
+		Metas: make(map[string]VideoMeta),
+	}
+}
+
+// Calls lists the operations run so far, as "op:target".
+func (ft *FakeToolchain) Calls() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append([]string(nil), ft.calls...)
+}
+
+func (ft *FakeToolchain) record(op string, target string) {
+	ft.mu.Lock()
+	ft.calls = append(ft.calls, op+":"+target)
+	ft.mu.Unlock()
+}
+
+func (ft *FakeToolchain) Capabilities() ToolchainCapabilities {
+	return ft.Caps
+}
+
+func (ft *FakeToolchain) Probe(ctx context.Context, absPath string) (VideoMeta, error) {
+	if !ft.Caps.Probe {
+		return VideoMeta{}, fmt.Errorf("fake probe: %w", ErrToolUnavailable)
+	}
+	ft.record("probe", absPath)
+	if meta, ok := ft.Metas[filepath.Base(absPath)]; ok {
+		return meta, nil
+	}
+	return VideoMeta{
+		Schema:      VideoMetaSchemaVersion,
+		Width:       1920,
+		Height:      1080,
+		DurationSec: 10,
+		VideoCodec:  "h264",
+		AudioCodec:  "aac",
+	}, nil
+}
+
+func (ft *FakeToolchain) ExtractFrame(ctx context.Context, args []string) error {
+	if !ft.Caps.ExtractFrame {
+		return fmt.Errorf("fake frame: %w", ErrToolUnavailable)
+	}
+	return ft.writeOutput(ctx, "frame", args)
+}
+
+func (ft *FakeToolchain) Transcode(ctx context.Context, args []string) error {
+	if !ft.Caps.Transcode {
+		return fmt.Errorf("fake transcode: %w", ErrToolUnavailable)
+	}
+	return ft.writeOutput(ctx, "transcode", args)
+}
+
+func (ft *FakeToolchain) writeOutput(ctx context.Context, op string, args []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("fake %s: no output path", op)
+	}
+	output := args[len(args)-1]
+	ft.record(op, output)
+	return os.WriteFile(output, []byte(op+" "+strings.Join(args[:len(args)-1], " ")), 0o644)
+}
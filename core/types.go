@@ -3,6 +3,9 @@ package core
 import (
 	"errors"
 	"math/rand"
+	"path"
+	"slices"
+	"strings"
 	"sync"
 
 	utils "github.com/XGFan/go-utils"
@@ -32,11 +35,14 @@ type ScanItem struct {
 	Name string       `json:"name"`
 
 	// Payload (populated by stages)
-	Width       int       `json:"width,omitempty"`
-	Height      int       `json:"height,omitempty"`
-	DurationSec float64   `json:"duration_sec,omitempty"`
-	Tags        []TagInfo `json:"tags,omitempty"`
-	Caption     string    `json:"caption,omitempty"`
+	Width       int             `json:"width,omitempty"`
+	Height      int             `json:"height,omitempty"`
+	DurationSec float64         `json:"duration_sec,omitempty"`
+	Tags        []TagInfo       `json:"tags,omitempty"`
+	Caption     string          `json:"caption,omitempty"`
+	Subtitles   []SubtitleTrack `json:"subtitles,omitempty"`
+	ModTime     int64           `json:"mtime,omitempty"`
+	Mark        Mark            `json:"-"` // from MarksFile, not stored with the structure
 }
 
 // EmptySize represents an uninitialized size
@@ -76,17 +82,30 @@ type ImageNode struct {
 	Size
 	Tags    []TagInfo `json:"tags,omitempty"`
 	Caption string    `json:"caption,omitempty"`
+	ModTime int64     `json:"mtime,omitempty"` // Unix seconds
+	Mark
 }
 
 // VideoNode represents a video file
 type VideoNode struct {
 	Node
 	Size
-	DurationSec float64   `json:"duration_sec,omitempty"`
-	Tags        []TagInfo `json:"tags,omitempty"`
-	Caption     string    `json:"caption,omitempty"`
+	DurationSec float64         `json:"duration_sec,omitempty"`
+	Tags        []TagInfo       `json:"tags,omitempty"`
+	Caption     string          `json:"caption,omitempty"`
+	Subtitles   []SubtitleTrack `json:"subtitles,omitempty"`
+	MetaStatus  string          `json:"meta_status,omitempty"`
+	ModTime     int64           `json:"mtime,omitempty"` // Unix seconds
+	Mark
 }
 
+// MetaStatus values of a VideoNode whose dimensions are not known yet; empty means resolved.
+const (
+	MetaStatusPending     = "pending"
+	MetaStatusFailed      = "failed"
+	MetaStatusUnavailable = "unavailable"
+)
+
 // DirNode represents a directory for API response
 type DirNode struct {
 	Node
@@ -111,6 +130,15 @@ type TraverseNode struct {
 	mu          sync.RWMutex // Protects concurrent access
 }
 
+// virtualScanID marks virtual folders and smart albums, which no scan cleans up.
+const virtualScanID = 1<<63 - 1 // MaxInt64
+
+// IsVirtual reports whether the node is a virtual folder or a smart album rather than a
+// directory on disk.
+func (dn *TraverseNode) IsVirtual() bool {
+	return dn.LastScanID == virtualScanID
+}
+
 // Locate finds or creates a node at the given path
 func (dn *TraverseNode) Locate(path string) *TraverseNode {
 	if path == "" || path == "/" {
@@ -144,6 +172,162 @@ func (dn *TraverseNode) Locate(path string) *TraverseNode {
 	return current
 }
 
+// Lookup returns the directory at path, or nil when there is none. Unlike Locate it never
+// creates nodes.
+func (dn *TraverseNode) Lookup(path string) *TraverseNode {
+	if path == "." {
+		path = ""
+	}
+	current := dn
+	for _, part := range splitPath(path) {
+		current.mu.RLock()
+		next := current.Directories[part]
+		current.mu.RUnlock()
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+// FindImage returns the image at imagePath.
+func (dn *TraverseNode) FindImage(imagePath string) (ImageNode, bool) {
+	node := dn.Lookup(path.Dir(imagePath))
+	if node == nil {
+		return ImageNode{}, false
+	}
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	for _, img := range node.Images {
+		if img.Path == imagePath {
+			return img, true
+		}
+	}
+	return ImageNode{}, false
+}
+
+// FindVideo returns the video at videoPath.
+func (dn *TraverseNode) FindVideo(videoPath string) (VideoNode, bool) {
+	node := dn.Lookup(path.Dir(videoPath))
+	if node == nil {
+		return VideoNode{}, false
+	}
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	for _, vid := range node.Videos {
+		if vid.Path == videoPath {
+			return vid, true
+		}
+	}
+	return VideoNode{}, false
+}
+
+// Remove takes the file or directory at p out of the tree. It returns false if p is not in
+// the tree. Copies in virtual folders and smart albums follow with the next ApplyVirtualPaths.
+func (dn *TraverseNode) Remove(p string) bool {
+	parent := dn.Lookup(path.Dir(p))
+	if parent == nil || p == "" {
+		return false
+	}
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	if child, ok := parent.Directories[path.Base(p)]; ok && child.Path == p {
+		delete(parent.Directories, path.Base(p))
+		return true
+	}
+	removed := false
+	drop := func(itemPath string) bool {
+		if itemPath == p {
+			removed = true
+		}
+		return itemPath == p
+	}
+	parent.Images = slices.DeleteFunc(parent.Images, func(img ImageNode) bool { return drop(img.Path) })
+	parent.Videos = slices.DeleteFunc(parent.Videos, func(vid VideoNode) bool { return drop(vid.Path) })
+	parent.Others = slices.DeleteFunc(parent.Others, func(other Node) bool { return drop(other.Path) })
+	if removed && parent.CoverIndex >= len(parent.Images) {
+		parent.CoverIndex = 0
+	}
+	return removed
+}
+
+// Prune returns a copy of the tree holding only the files for which keep reports true.
+// A directory stays when keep accepts it or when something below it stays, so the way to
+// a visible file is never cut off. Virtual folders are pruned like real ones.
+func (dn *TraverseNode) Prune(keep func(path string) bool) *TraverseNode {
+	pruned, _ := dn.prune(keep)
+	return pruned
+}
+
+func (dn *TraverseNode) prune(keep func(path string) bool) (*TraverseNode, bool) {
+	dn.mu.RLock()
+	result := &TraverseNode{
+		Node:        dn.Node,
+		Images:      make([]ImageNode, 0, len(dn.Images)),
+		Videos:      make([]VideoNode, 0, len(dn.Videos)),
+		Others:      make([]Node, 0, len(dn.Others)),
+		Directories: make(map[string]*TraverseNode, len(dn.Directories)),
+	}
+	for i, img := range dn.Images {
+		if keep(img.Path) {
+			if i == dn.CoverIndex {
+				result.CoverIndex = len(result.Images)
+			}
+			result.Images = append(result.Images, img)
+		}
+	}
+	for _, vid := range dn.Videos {
+		if keep(vid.Path) {
+			result.Videos = append(result.Videos, vid)
+		}
+	}
+	for _, other := range dn.Others {
+		if keep(other.Path) {
+			result.Others = append(result.Others, other)
+		}
+	}
+	children := make(map[string]*TraverseNode, len(dn.Directories))
+	for name, child := range dn.Directories {
+		children[name] = child
+	}
+	dn.mu.RUnlock()
+
+	for name, child := range children {
+		if pruned, ok := child.prune(keep); ok {
+			result.Directories[name] = pruned
+		}
+	}
+	visible := len(result.Images) > 0 || len(result.Videos) > 0 || len(result.Others) > 0 ||
+		len(result.Directories) > 0 || (dn.Path != "" && keep(dn.Path))
+	return result, visible
+}
+
+// UpdateVideoMeta applies probed metadata to the video at videoPath.
+// It returns the updated node, or false if the video is not in the tree.
+func (dn *TraverseNode) UpdateVideoMeta(videoPath string, meta VideoMeta) (VideoNode, bool) {
+	// The video may have been moved or deleted while it was probed; Locate would bring its
+	// directory back empty.
+	node := dn.Lookup(path.Dir(videoPath))
+	if node == nil {
+		return VideoNode{}, false
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for i := range node.Videos {
+		video := &node.Videos[i]
+		if video.Path != videoPath {
+			continue
+		}
+		video.Width = meta.Width
+		video.Height = meta.Height
+		video.DurationSec = meta.DurationSec
+		video.Subtitles = withEmbeddedSubtitles(video.Subtitles, meta)
+		return *video, true
+	}
+	return VideoNode{}, false
+}
+
 // Load applies size cache to all images
 func (dn *TraverseNode) Load(sizeCache map[string]Size) {
 	for i := range dn.Images {
@@ -253,6 +437,9 @@ func (dn *TraverseNode) dumpMetaRecursive(tags map[string][]TagInfo, captions ma
 
 // CleanupRecursively removes nodes that weren't updated in current scan and images with no size
 func (dn *TraverseNode) CleanupRecursively(currentScanID int64) int {
+	// Requests keep reading the tree while a scan finishes.
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
 	deletedCount := 0
 
 	// Cleanup directories
@@ -273,6 +460,8 @@ func (dn *TraverseNode) CleanupRecursively(currentScanID int64) int {
 			deletedCount++
 		}
 	}
+	// Scan workers append in any order; sorting keeps listings and the cover stable.
+	slices.SortFunc(validImages, func(a, b ImageNode) int { return strings.Compare(a.Path, b.Path) })
 	dn.Images = validImages
 
 	// Cleanup videos (filter out those not scanned)
@@ -284,6 +473,7 @@ func (dn *TraverseNode) CleanupRecursively(currentScanID int64) int {
 			deletedCount++
 		}
 	}
+	slices.SortFunc(validVideos, func(a, b VideoNode) int { return strings.Compare(a.Path, b.Path) })
 	dn.Videos = validVideos
 
 	return deletedCount
@@ -302,8 +492,9 @@ func (dn *TraverseNode) ToStructureOnly() *TraverseNode {
 	videos := make([]VideoNode, len(dn.Videos))
 	for i, vid := range dn.Videos {
 		videos[i] = VideoNode{
-			Node: Node{Name: vid.Name, Path: vid.Path},
-			Size: EmptySize,
+			Node:      Node{Name: vid.Name, Path: vid.Path},
+			Size:      EmptySize,
+			Subtitles: vid.Subtitles,
 		}
 	}
 
@@ -342,17 +533,19 @@ func (n *TraverseNode) flattenRecursive(items *[]ScanItem) {
 
 	// Add Images
 	for _, img := range n.Images {
-		*items = append(*items, ScanItem{Type: ItemImage, Path: img.Path, Name: img.Name, Width: img.Size.Width, Height: img.Size.Height, Tags: img.Tags, Caption: img.Caption})
+		*items = append(*items, ScanItem{Type: ItemImage, Path: img.Path, Name: img.Name, Width: img.Size.Width, Height: img.Size.Height, Tags: img.Tags, Caption: img.Caption, ModTime: img.ModTime})
 	}
 
 	// Add Videos
 	for _, vid := range n.Videos {
-		*items = append(*items, ScanItem{Type: ItemVideo, Path: vid.Path, Name: vid.Name, Width: vid.Size.Width, Height: vid.Size.Height, DurationSec: vid.DurationSec, Tags: vid.Tags, Caption: vid.Caption})
+		*items = append(*items, ScanItem{Type: ItemVideo, Path: vid.Path, Name: vid.Name, Width: vid.Size.Width, Height: vid.Size.Height, DurationSec: vid.DurationSec, Tags: vid.Tags, Caption: vid.Caption, Subtitles: vid.Subtitles, ModTime: vid.ModTime})
 	}
 
-	// Recurse
+	// Recurse; virtual folders are rebuilt from the real ones and not stored
 	for _, child := range n.Directories {
-		child.flattenRecursive(items)
+		if !child.IsVirtual() {
+			child.flattenRecursive(items)
+		}
 	}
 }
 
@@ -564,6 +757,13 @@ func (dn *TraverseNode) Cover() ImageNode {
 	return EmptyNode
 }
 
+// MediaCount returns the number of images and videos directly in the directory.
+func (dn *TraverseNode) MediaCount() int {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	return len(dn.Images) + len(dn.Videos)
+}
+
 // HasImages checks if directory has images
 func (dn *TraverseNode) HasImages() bool {
 	return dn.Images != nil && len(dn.Images) > 0
@@ -0,0 +1,275 @@
+package gallery
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// Renditions of a download.
+const (
+	RenditionOriginal  = "original"
+	RenditionThumbnail = "thumbnail"
+)
+
+// DownloadRequest selects files and folders for one ZIP download.
+type DownloadRequest struct {
+	Paths     []string `json:"paths" binding:"required"`
+	Rendition string   `json:"rendition"`
+	Name      string   `json:"name"`
+}
+
+// downloadEntry is a file of a ZIP download.
+type downloadEntry struct {
+	name    string // inside the archive
+	source  string // library path
+	video   bool
+	modTime int64
+}
+
+// downloadSet collects the entries of a download; a file selected twice is stored once and
+// names taken by another file get a numbered suffix.
+type downloadSet struct {
+	entries []downloadEntry
+	sources map[string]bool
+	names   map[string]bool
+}
+
+func (ds *downloadSet) add(name, source string, video bool, modTime int64) {
+	if ds.sources == nil {
+		ds.sources, ds.names = make(map[string]bool), make(map[string]bool)
+	}
+	if ds.sources[source] {
+		return
+	}
+	ds.sources[source] = true
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; ds.names[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	ds.names[unique] = true
+	ds.entries = append(ds.entries, downloadEntry{name: unique, source: source, video: video, modTime: modTime})
+}
+
+// addFolder adds the images and videos under node, named relative to the folder dir of the
+// library; items of virtual folders keep their library path.
+func (ds *downloadSet) addFolder(node *core.TraverseNode, dir, prefix string) {
+	name := func(p string) string {
+		if dir == "" {
+			return path.Join(prefix, p)
+		}
+		if rel, ok := strings.CutPrefix(p, dir+"/"); ok {
+			return path.Join(prefix, rel)
+		}
+		return path.Join(prefix, p)
+	}
+	for _, img := range node.Image() {
+		ds.add(name(img.Path), img.Path, false, img.ModTime)
+	}
+	for _, vid := range node.Video() {
+		ds.add(name(vid.Path), vid.Path, true, vid.ModTime)
+	}
+}
+
+// addPath adds a file or folder of root, named after its last element.
+func (ds *downloadSet) addPath(root *core.TraverseNode, p string) bool {
+	if img, ok := root.FindImage(p); ok {
+		ds.add(img.Name, img.Path, false, img.ModTime)
+		return true
+	}
+	if vid, ok := root.FindVideo(p); ok {
+		ds.add(vid.Name, vid.Path, true, vid.ModTime)
+		return true
+	}
+	node := root.Lookup(p)
+	if node == nil {
+		return false
+	}
+	ds.addFolder(node, p, path.Base("/"+p))
+	return true
+}
+
+// openRendition returns the file to store for an entry in the given rendition. Thumbnails
+// come from the cache only: images whose thumbnail is not generated yet are queued and left
+// out, like videos without a poster.
+func (l *library) openRendition(e downloadEntry, rendition string) (http.File, string, error) {
+	sir := l.resolver
+	switch {
+	case rendition == RenditionThumbnail && e.video:
+		f, err := sir.openPosterFile(e.source)
+		return f, e.name + ".jpg", err
+	case rendition == RenditionThumbnail:
+		f, err := sir.CachedThumbs.Open(e.source)
+		return f, e.name, err
+	default:
+		f, err := sir.OriginFs.Open(e.source)
+		return f, e.name, err
+	}
+}
+
+func validRendition(c *gin.Context, rendition string) (string, bool) {
+	switch rendition {
+	case "", RenditionOriginal:
+		return RenditionOriginal, true
+	case RenditionThumbnail:
+		return rendition, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("rendition must be %s or %s", RenditionOriginal, RenditionThumbnail)})
+	return "", false
+}
+
+// streamZip writes the entries as a ZIP straight to the response. Media is already
+// compressed, so entries are stored; nothing is buffered beyond the copy buffer.
+func (l *library) streamZip(c *gin.Context, name string, entries []downloadEntry, rendition string) {
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	zw := zip.NewWriter(c.Writer)
+	for _, e := range entries {
+		if c.Request.Context().Err() != nil {
+			return
+		}
+		f, entryName, err := l.openRendition(e, rendition)
+		if err != nil {
+			log.Printf("download: skip %s: %v", e.source, err)
+			continue
+		}
+		header := &zip.FileHeader{Name: entryName, Method: zip.Store}
+		if info, err := f.Stat(); err == nil {
+			header.Modified = info.ModTime()
+		} else if e.modTime > 0 {
+			header.Modified = time.Unix(e.modTime, 0)
+		}
+		w, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(w, f)
+		}
+		f.Close()
+		if err != nil {
+			// The status is sent already; a cut archive is all the client can be told.
+			log.Printf("download: %s: %v", e.source, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("download: %v", err)
+	}
+}
+
+// serveDownload sends a single file as an attachment, with Range support for resuming.
+func (l *library) serveDownload(c *gin.Context, e downloadEntry, rendition string) {
+	f, name, err := l.openRendition(e, rendition)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not available"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
+}
+
+// HandleDownload godoc
+// @Summary Download a file or folder
+// @Description Downloads an image or video as an attachment with Range support, or streams every image and video under a folder as a ZIP. Excluded files and files the user may not see are left out
+// @Tags media
+// @Produce application/zip
+// @Param name path string true "File or directory path"
+// @Param rendition query string false "original (default) or thumbnail; videos become their poster in thumbnail downloads, images without a generated thumbnail are left out"
+// @Success 200 {file} file
+// @Success 206 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/download/{name} [get]
+func (l *library) HandleDownload(c *gin.Context) {
+	rendition, ok := validRendition(c, c.Query("rendition"))
+	if !ok {
+		return
+	}
+	name := CleanUrlPath(c.Param("name"))
+	root := l.gallery.view(c)
+	var ds downloadSet
+	if storage.IsValidPic(name) || storage.IsValidVideo(name) {
+		if ds.addPath(root, name); len(ds.entries) == 1 {
+			l.serveDownload(c, ds.entries[0], rendition)
+			return
+		}
+	}
+	if node := root.Lookup(name); node != nil {
+		ds.addFolder(node, name, "")
+	}
+	if len(ds.entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "nothing to download"})
+		return
+	}
+	archive := path.Base("/" + name)
+	if name == "" {
+		archive = l.name
+	}
+	l.streamZip(c, archive, ds.entries, rendition)
+}
+
+// HandleDownloadSelection godoc
+// @Summary Download a selection
+// @Description Streams the selected images, videos and folders as one ZIP. Files are named after the selected item: a selected folder becomes a folder of the archive. Paths that do not exist or the user may not see fail the request
+// @Tags media
+// @Accept json
+// @Produce application/zip
+// @Param selection body DownloadRequest true "Paths, rendition (original or thumbnail) and archive name"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/download [post]
+func (l *library) HandleDownloadSelection(c *gin.Context) {
+	var req DownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rendition, ok := validRendition(c, req.Rendition)
+	if !ok {
+		return
+	}
+	root := l.gallery.view(c)
+	var ds downloadSet
+	for _, p := range req.Paths {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if !ds.addPath(root, p) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": p + " does not exist"})
+			return
+		}
+	}
+	if len(ds.entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "nothing to download"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		name = l.name
+	}
+	l.streamZip(c, strings.TrimSuffix(name, ".zip"), ds.entries, rendition)
+}
+
+// downloadRoutes are POST routes that only read, so read-only users may call them.
+var downloadRoutes = []string{"/api/download", "/api/:lib/download"}
+
+func isReadOnlyRoute(fullPath string) bool {
+	return slices.Contains(downloadRoutes, fullPath)
+}
@@ -0,0 +1,113 @@
+package gallery
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/config"
+)
+
+func TestDownload_ZipSelectionAndRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	base := l.gallery.scanner.OriginFs.GetPath()
+	writeTestJPEG(t, filepath.Join(base, "x", "sub", "c.jpg"))
+	writeTestJPEG(t, filepath.Join(base, "y", "a.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	sum := sha256.Sum256([]byte("guest-token"))
+	libs := &libraries{auth: newAuthenticator(config.AuthConfig{
+		Mode: config.AuthLocal,
+		Users: []config.UserConfig{
+			{Name: "guest", Tokens: []string{hex.EncodeToString(sum[:])}, Deny: []string{"sub/"}},
+		},
+	})}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer guest-token")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	entries := func(w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("expected a zip, got %d %s", w.Code, w.Body)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// The denied folder is left out of the guest's archive.
+	if got := entries(do(http.MethodGet, "/api/download/x", "")); !reflect.DeepEqual(got, []string{"a.jpg"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	// A read-only user may still post a selection; equal names get a suffix.
+	w := do(http.MethodPost, "/api/download", `{"paths":["x/a.jpg","y","y/a.jpg"],"name":"pick"}`)
+	if got := entries(w); !reflect.DeepEqual(got, []string{"a.jpg", "y/a.jpg"}) {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), `filename=pick.zip`) {
+		t.Fatalf("unexpected disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if got := entries(do(http.MethodPost, "/api/download", `{"paths":["x/a.jpg","y/a.jpg"]}`)); !reflect.DeepEqual(got, []string{"a (2).jpg", "a.jpg"}) {
+		t.Fatalf("expected a renamed duplicate, got %v", got)
+	}
+	if w := do(http.MethodPost, "/api/download", `{"paths":["x/sub/c.jpg"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a denied path rejected, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/download/x?rendition=raw", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown rendition rejected, got %d", w.Code)
+	}
+
+	// Thumbnail archives hold generated thumbnails only, never originals in their place.
+	thumbPath := filepath.Join(l.resolver.CacheFs.GetPath(), "y", "a.jpg")
+	if err := os.MkdirAll(filepath.Dir(thumbPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(thumbPath, []byte("thumb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w = do(http.MethodPost, "/api/download", `{"paths":["x/a.jpg","y/a.jpg"],"rendition":"thumbnail"}`)
+	if got := entries(w); !reflect.DeepEqual(got, []string{"a (2).jpg"}) {
+		t.Fatalf("expected the image without a thumbnail left out, got %v", got)
+	}
+	zr, _ := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if f, err := zr.File[0].Open(); err != nil {
+		t.Fatal(err)
+	} else if data, _ := io.ReadAll(f); string(data) != "thumb" {
+		t.Fatalf("expected the cached thumbnail, got %d bytes", len(data))
+	}
+
+	w = do(http.MethodGet, "/api/download/x/a.jpg", "", "Range", "bytes=0-9")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 10 || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatalf("expected a ranged attachment, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,181 @@
+package gallery
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+// Hamming distances between difference hashes up to which images count as near duplicates.
+const (
+	DefaultDuplicateDistance = 4
+	MaxDuplicateDistance     = 16
+)
+
+// Kinds of DuplicateCluster.
+const (
+	DuplicateExact = "exact"
+	DuplicateNear  = "near"
+)
+
+// DuplicateItem is an image of a DuplicateCluster. Distance is the Hamming distance of its
+// difference hash to the one of the first item; items with the same content are byte-identical.
+type DuplicateItem struct {
+	Path     string `json:"path"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime,omitempty"`
+	Content  string `json:"content"`
+	Distance int    `json:"distance"`
+}
+
+// DuplicateCluster groups copies of one picture, largest first. An exact cluster holds
+// byte-identical files only; a near cluster also holds re-encoded or resized copies.
+type DuplicateCluster struct {
+	Kind  string          `json:"kind"`
+	Items []DuplicateItem `json:"items"`
+}
+
+// DuplicatesResponse lists the clusters, most copies first. Unhashed counts the images the
+// scan has not hashed yet, which are left out.
+type DuplicatesResponse struct {
+	Clusters []DuplicateCluster `json:"clusters"`
+	Unhashed int                `json:"unhashed"`
+}
+
+// HandleDuplicates godoc
+// @Summary Find duplicate images
+// @Description Clusters byte-identical images (same SHA-256) and near duplicates whose difference hashes are within distance bits of each other. Near duplicates are linked transitively. Hashes are computed by the scan and cached; images not hashed yet are counted as unhashed
+// @Tags images
+// @Produce json
+// @Param distance query int false "Hamming distance for near duplicates, 0-16 (default 4)"
+// @Success 200 {object} DuplicatesResponse
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/duplicates [get]
+func (g *Gallery) HandleDuplicates(c *gin.Context) {
+	distance := DefaultDuplicateDistance
+	if value := c.Query("distance"); value != "" {
+		d, err := strconv.Atoi(value)
+		if err != nil || d < 0 || d > MaxDuplicateDistance {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "distance must be between 0 and " + strconv.Itoa(MaxDuplicateDistance)})
+			return
+		}
+		distance = d
+	}
+	clusters, unhashed := findDuplicates(g.view(c).Image(), g.scanner.Cache.GetImageHash, distance)
+	c.JSON(200, DuplicatesResponse{Clusters: clusters, Unhashed: unhashed})
+}
+
+// contentGroup holds the images sharing one content hash.
+type contentGroup struct {
+	items      []DuplicateItem
+	hash       uint64
+	perceptual bool
+}
+
+// findDuplicates groups images by content hash, then links groups whose difference hashes
+// are within distance through a BK-tree. Virtual folders repeat images, so paths count once.
+func findDuplicates(images []core.ImageNode, hashOf func(string) (core.ImageHash, bool), distance int) ([]DuplicateCluster, int) {
+	seen := make(map[string]bool, len(images))
+	byContent := make(map[string]int)
+	var groups []*contentGroup
+	unhashed := 0
+	for _, img := range images {
+		if seen[img.Path] {
+			continue
+		}
+		seen[img.Path] = true
+		hash, ok := hashOf(img.Path)
+		if !ok {
+			unhashed++
+			continue
+		}
+		i, ok := byContent[hash.Content]
+		if !ok {
+			i = len(groups)
+			byContent[hash.Content] = i
+			group := &contentGroup{}
+			group.hash, group.perceptual = hash.Perceptual()
+			groups = append(groups, group)
+		}
+		groups[i].items = append(groups[i].items, DuplicateItem{
+			Path:    img.Path,
+			Width:   img.Width,
+			Height:  img.Height,
+			Size:    hash.SizeBytes,
+			ModTime: img.ModTime,
+			Content: hash.Content,
+		})
+	}
+
+	parent := make([]int, len(groups))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	var tree core.HashTree
+	for i, group := range groups {
+		if group.perceptual {
+			tree.Add(group.hash, i)
+		}
+	}
+	for i, group := range groups {
+		if !group.perceptual {
+			continue
+		}
+		tree.Search(group.hash, distance, func(j, _ int) {
+			if a, b := find(i), find(j); a != b {
+				parent[a] = b
+			}
+		})
+	}
+
+	members := make(map[int][]int)
+	for i := range groups {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	clusters := make([]DuplicateCluster, 0)
+	for _, ids := range members {
+		cluster := DuplicateCluster{Kind: DuplicateExact}
+		if len(ids) > 1 {
+			cluster.Kind = DuplicateNear
+		}
+		for _, id := range ids {
+			cluster.Items = append(cluster.Items, groups[id].items...)
+		}
+		if len(cluster.Items) < 2 {
+			continue
+		}
+		slices.SortFunc(cluster.Items, func(a, b DuplicateItem) int {
+			return cmp.Or(
+				cmp.Compare(b.Width*b.Height, a.Width*a.Height),
+				cmp.Compare(b.Size, a.Size),
+				cmp.Compare(a.Path, b.Path),
+			)
+		})
+		first := groups[byContent[cluster.Items[0].Content]]
+		for i, item := range cluster.Items {
+			if group := groups[byContent[item.Content]]; group.perceptual && first.perceptual {
+				cluster.Items[i].Distance = core.HammingDistance(group.hash, first.hash)
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	slices.SortFunc(clusters, func(a, b DuplicateCluster) int {
+		return cmp.Or(cmp.Compare(len(b.Items), len(a.Items)), cmp.Compare(a.Items[0].Path, b.Items[0].Path))
+	})
+	return clusters, unhashed
+}
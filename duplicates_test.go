@@ -0,0 +1,77 @@
+package gallery
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+func TestDuplicates_ExactAndNearClusters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	base := l.gallery.scanner.OriginFs.GetPath()
+	data, err := os.ReadFile(filepath.Join(base, "x", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(base, "y"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "y", "a.jpg"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pattern := core.PatternImage(180, 120)
+	for name, img := range map[string]image.Image{
+		"p/big.jpg":   pattern,
+		"p/small.jpg": imaging.Resize(pattern, 90, 60, imaging.Lanczos),
+		"q/other.jpg": imaging.FlipH(pattern),
+	} {
+		if err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := imaging.Save(img, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.gallery.scanner.Scan(l.gallery.Root)
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	var resp DuplicatesResponse
+	w := get("/api/duplicates")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("duplicates: status %d %s", w.Code, w.Body)
+	}
+	if len(resp.Clusters) != 2 || resp.Unhashed != 0 {
+		t.Fatalf("expected two clusters, got %+v", resp)
+	}
+	near, exact := resp.Clusters[0], resp.Clusters[1]
+	if near.Kind != DuplicateNear || len(near.Items) != 2 || near.Items[0].Path != "p/big.jpg" || near.Items[1].Path != "p/small.jpg" {
+		t.Fatalf("unexpected near cluster %+v", near)
+	}
+	if near.Items[0].Width != 180 || near.Items[0].Size == 0 || near.Items[1].Distance > DefaultDuplicateDistance {
+		t.Fatalf("expected dimensions, size and distance, got %+v", near.Items)
+	}
+	if exact.Kind != DuplicateExact || len(exact.Items) != 2 || exact.Items[0].Content != exact.Items[1].Content || exact.Items[1].Path != "y/a.jpg" {
+		t.Fatalf("unexpected exact cluster %+v", exact)
+	}
+	if w := get("/api/duplicates?distance=17"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a distance over the maximum rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package gallery
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventVideoMeta is published when background probing resolves a video's metadata.
+const EventVideoMeta = "video_meta"
+
+const (
+	eventBufferSize = 64
+	eventKeepAlive  = 30 * time.Second
+)
+
+// Event is a change pushed to clients over /api/events.
+type Event struct {
+	Type string      `json:"type"`
+	Path string      `json:"path"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// visibleTo reports whether u may receive the event. A move tells both paths, so the
+// user must be able to read where the file was as well as where it went.
+func (e Event) visibleTo(u *user) bool {
+	if change, ok := e.Data.(FileChange); ok && e.Type == EventMoved {
+		return u.canRead(change.From) && u.canRead(change.To)
+	}
+	return u.canRead(e.Path)
+}
+
+// eventHub fans events out to SSE subscribers. A subscriber that cannot keep up
+// loses events rather than blocking publishers; clients re-fetch on reconnect anyway.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// HandleEvents godoc
+// @Summary Subscribe to server events
+// @Description Server-sent event stream. A "video_meta" event carries the updated video node once background probing finishes.
+// @Tags browse
+// @Produce text/event-stream
+// @Success 200 {object} Event
+// @Router /api/events [get]
+func (g *Gallery) HandleEvents(c *gin.Context) {
+	u := currentUser(c)
+	events, unsubscribe := g.events.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			if event.visibleTo(u) {
+				c.SSEvent(event.Type, event)
+			}
+		case <-ticker.C:
+			c.SSEvent("ping", "")
+		}
+		return true
+	})
+}
@@ -0,0 +1,586 @@
+package gallery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// TrashFile lists the deleted files of a library, inside the cache directory. The files
+// themselves are in core.TrashDir of the library.
+const TrashFile = "trash.json"
+
+// Events of file management.
+const (
+	EventMoved    = "moved"
+	EventTrashed  = "trashed"
+	EventRestored = "restored"
+)
+
+var (
+	errNotFound  = errors.New("no such file or folder")
+	errNoFolder  = errors.New("target folder does not exist")
+	errNameTaken = errors.New("a file of that name exists")
+	errBadName   = errors.New("invalid name")
+	errNotMedia  = errors.New("not a supported image or video")
+	errExcluded  = errors.New("excluded by the scan rules")
+	errHidden    = errors.New("folder holds items hidden from the user")
+)
+
+// fileStatus maps an error of an upload or file operation to its HTTP status.
+func fileStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, errNoFolder):
+		return http.StatusNotFound
+	case errors.Is(err, errNameTaken):
+		return http.StatusConflict
+	case errors.Is(err, errBadName):
+		return http.StatusBadRequest
+	case errors.Is(err, errNotMedia):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errExcluded):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errHidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// targetFolder returns the folder of the library files go to. It must be a directory on disk
+// the user can see; virtual folders and smart albums take no files.
+func (g *Gallery) targetFolder(c *gin.Context, dir string) (string, error) {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	node := g.view(c).Lookup(dir)
+	if node == nil || node.IsVirtual() || node.Path != dir {
+		return "", fmt.Errorf("%w: %q", errNoFolder, dir)
+	}
+	return dir, nil
+}
+
+// TrashEntry is a deleted file or folder.
+type TrashEntry struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"` // where it was
+	Dir       bool   `json:"dir"`
+	Deleted   int64  `json:"deleted"` // Unix seconds
+	DeletedBy string `json:"deleted_by,omitempty"`
+}
+
+// location returns where the entry is kept inside the library.
+func (e TrashEntry) location() string {
+	return path.Join(core.TrashDir, e.ID, path.Base(e.Path))
+}
+
+// trashStore keeps the list of deleted files of a library.
+type trashStore struct {
+	mu      sync.Mutex
+	cacheFs storage.Storage
+	entries []TrashEntry
+}
+
+func newTrashStore(cacheFs storage.Storage) *trashStore {
+	store := &trashStore{cacheFs: cacheFs}
+	if err := readJSONFile(cacheFs, TrashFile, &store.entries); err != nil {
+		log.Printf("Failed to read %s: %v", TrashFile, err)
+	}
+	return store
+}
+
+func (st *trashStore) list() []TrashEntry {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.entries)
+}
+
+func (st *trashStore) get(id string) (TrashEntry, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.entries, func(e TrashEntry) bool { return e.ID == id })
+	if i < 0 {
+		return TrashEntry{}, false
+	}
+	return st.entries[i], true
+}
+
+func (st *trashStore) add(e TrashEntry) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.persist(append(slices.Clone(st.entries), e))
+}
+
+func (st *trashStore) remove(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.persist(slices.DeleteFunc(slices.Clone(st.entries), func(e TrashEntry) bool { return e.ID == id }))
+}
+
+func (st *trashStore) persist(entries []TrashEntry) error {
+	if err := writeJSONFile(st.cacheFs, TrashFile, entries); err != nil {
+		return err
+	}
+	st.entries = entries
+	return nil
+}
+
+// FileChange is a file or folder that moved.
+type FileChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RenameRequest gives a file or folder a new name in the same folder.
+type RenameRequest struct {
+	Path string `json:"path" binding:"required"`
+	Name string `json:"name" binding:"required"`
+}
+
+// MoveRequest moves files and folders into a folder.
+type MoveRequest struct {
+	Paths []string `json:"paths" binding:"required"`
+	To    string   `json:"to"`
+}
+
+// DeleteRequest moves files and folders to the trash.
+type DeleteRequest struct {
+	Paths []string `json:"paths" binding:"required"`
+}
+
+// source checks a file or folder a user wants to change and reports whether it is a folder.
+// Only images, videos and folders on disk can be changed; virtual folders and the library
+// root cannot. A folder moves as a whole, so a restricted user may only change one whose
+// every item they can see: otherwise they would delete hidden files, or move them out from
+// under the rules that hide them.
+func (g *Gallery) source(c *gin.Context, p string) (string, bool, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" || core.IsTrashed(p+"/") {
+		return "", false, fmt.Errorf("%w: %q", errBadName, p)
+	}
+	root := g.view(c)
+	if _, ok := root.FindImage(p); ok {
+		return p, false, nil
+	}
+	if _, ok := root.FindVideo(p); ok {
+		return p, false, nil
+	}
+	if node := root.Lookup(p); node != nil && !node.IsVirtual() && node.Path == p {
+		if u := currentUser(c); u.restricted() {
+			for _, item := range g.Root.Lookup(p).Flatten() {
+				if !u.canRead(item.Path) {
+					return "", false, fmt.Errorf("%w: %q", errHidden, p)
+				}
+			}
+		}
+		return p, true, nil
+	}
+	return "", false, fmt.Errorf("%w: %q", errNotFound, p)
+}
+
+// checkTarget validates the new path of a file or folder: a visible, free, plain name that
+// scans do not skip. Images stay images and videos stay videos.
+func (g *Gallery) checkTarget(c *gin.Context, from, to string, dir bool) error {
+	name := path.Base(to)
+	if name == "" || strings.ContainsAny(name, `/\`) || !storage.IsNormalFile(name) {
+		return fmt.Errorf("%w: %q", errBadName, name)
+	}
+	if !dir && (storage.IsValidPic(from) != storage.IsValidPic(to) || storage.IsValidVideo(from) != storage.IsValidVideo(to)) {
+		return fmt.Errorf("%w: %q changes the file type", errBadName, name)
+	}
+	if dir && (to == from || strings.HasPrefix(to, from+"/")) {
+		return fmt.Errorf("%w: cannot move %q into itself", errBadName, from)
+	}
+	if !currentUser(c).canRead(to) {
+		return fmt.Errorf("%w: %q", errNoFolder, path.Dir(to))
+	}
+	if g.scanner.OriginFs.Exist(to) {
+		return fmt.Errorf("%w: %q", errNameTaken, to)
+	}
+	var size int64
+	if info, err := statFile(g.scanner.OriginFs, from); err == nil && !dir {
+		size = info.Size()
+	}
+	if exclusion := g.scanner.ExplainNew(to, dir, size); exclusion.Excluded {
+		return fmt.Errorf("%w: %s", errExcluded, exclusion.Reason)
+	}
+	return nil
+}
+
+// relocate moves a file or folder on disk together with its sidecar poster and subtitles,
+// its renditions in the cache directory and its cached sizes, tags, captions, video metadata
+// and marks. Unless it goes to or comes from the trash, collections follow it. The tree
+// loses the old path; a target inside the library is added to it right away, or after a
+// running scan. Callers hold filesMu and checked the target.
+func (g *Gallery) relocate(from, to string, dir bool) error {
+	originFs, cacheFs := g.scanner.OriginFs, g.scanner.Cache.Fs
+	sidecars := g.sidecars(from, to)
+	if err := originFs.Rename(from, to); err != nil {
+		return err
+	}
+	for _, sidecar := range sidecars {
+		if originFs.Exist(sidecar.To) {
+			log.Printf("Keeping %s in place, %s exists", sidecar.From, sidecar.To)
+			continue
+		}
+		if err := originFs.Rename(sidecar.From, sidecar.To); err != nil {
+			log.Printf("Failed to move %s: %v", sidecar.From, err)
+		}
+	}
+
+	// The renditions of a folder are below the folder of the same path in the cache directory.
+	renditions := []FileChange{{From: from, To: to}}
+	if !dir {
+		renditions = nil
+		targets := core.Renditions(to)
+		for i, rendition := range core.Renditions(from) {
+			renditions = append(renditions, FileChange{From: rendition, To: targets[i]})
+		}
+	}
+	for _, rendition := range renditions {
+		if !cacheFs.Exist(rendition.From) {
+			continue
+		}
+		if err := cacheFs.Rename(rendition.From, rendition.To); err != nil {
+			log.Printf("Failed to move %s in the cache: %v", rendition.From, err)
+		}
+	}
+	if err := g.scanner.Cache.Move(from, to); err != nil {
+		log.Printf("Failed to move the cache entries of %s: %v", from, err)
+	}
+
+	g.scanner.Apply(func() { g.Root.Remove(from) })
+	trashed := core.IsTrashed(from) || core.IsTrashed(to)
+	if !core.IsTrashed(to) {
+		if dir {
+			g.scanner.InsertDir(g.Root, to)
+		} else {
+			item := core.ScanItem{Type: core.ItemImage, Path: to, Name: path.Base(to)}
+			if storage.IsValidVideo(to) {
+				item.Type = core.ItemVideo
+			}
+			if info, err := statFile(originFs, to); err == nil {
+				item.ModTime = info.ModTime().Unix()
+			}
+			g.scanner.Insert(g.Root, item)
+		}
+	}
+	if !trashed && g.collections != nil {
+		g.collections.move(from, to)
+	}
+	select {
+	case g.albumsChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sidecars returns the poster and subtitle files of the video at from with their paths for a
+// move to to. Subtitles keep the part of their name after the stem of the video. A file
+// restored from the trash takes along everything deleted with it.
+func (g *Gallery) sidecars(from, to string) []FileChange {
+	var result []FileChange
+	if core.IsTrashed(from) {
+		entries, _ := g.scanner.OriginFs.ReadDir(path.Dir(from))
+		for _, info := range entries {
+			if info.Name() != path.Base(from) {
+				result = append(result, FileChange{From: path.Join(path.Dir(from), info.Name()), To: path.Join(path.Dir(to), info.Name())})
+			}
+		}
+		return result
+	}
+	video, ok := g.Root.FindVideo(from)
+	if !ok {
+		return nil
+	}
+	if poster := core.PosterSidecarPath(from); g.scanner.OriginFs.Exist(poster) {
+		result = append(result, FileChange{From: poster, To: core.PosterSidecarPath(to)})
+	}
+	stem := func(p string) string { return strings.TrimSuffix(path.Base(p), path.Ext(p)) }
+	for _, track := range video.Subtitles {
+		if track.Embedded {
+			continue
+		}
+		result = append(result, FileChange{
+			From: path.Join(path.Dir(from), track.ID),
+			To:   path.Join(path.Dir(to), stem(to)+strings.TrimPrefix(track.ID, stem(from))),
+		})
+	}
+	return result
+}
+
+// move relocates a checked source to to and notifies subscribers.
+func (g *Gallery) move(c *gin.Context, from, to string, dir bool) (FileChange, error) {
+	g.filesMu.Lock()
+	defer g.filesMu.Unlock()
+	if err := g.checkTarget(c, from, to, dir); err != nil {
+		return FileChange{}, err
+	}
+	if err := g.relocate(from, to, dir); err != nil {
+		return FileChange{}, err
+	}
+	change := FileChange{From: from, To: to}
+	g.events.Publish(Event{Type: EventMoved, Path: to, Data: change})
+	return change, nil
+}
+
+// HandleRename godoc
+// @Summary Rename a file or folder
+// @Description Renames an image, video or folder in place. Sidecar posters and subtitles, thumbnails and other renditions, cached tags, captions, marks and collection items follow, and the tree is updated right away. Images keep being images and videos keep being videos
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param rename body RenameRequest true "Path and new name"
+// @Success 200 {object} FileChange
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/files/rename [post]
+func (g *Gallery) HandleRename(c *gin.Context) {
+	var req RenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, dir, err := g.source(c, req.Path)
+	if err == nil && (req.Name == "." || req.Name == ".." || strings.ContainsAny(req.Name, `/\`)) {
+		err = fmt.Errorf("%w: %q", errBadName, req.Name)
+	}
+	var change FileChange
+	if err == nil {
+		change, err = g.move(c, from, path.Join(path.Dir(from), req.Name), dir)
+	}
+	if err != nil {
+		c.JSON(fileStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, change)
+}
+
+// HandleMove godoc
+// @Summary Move files and folders
+// @Description Moves images, videos and folders into a folder, keeping their names, with everything that belongs to them as for a rename. Paths are moved in order and the request stops at the first failure, reporting the moves done before it
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param move body MoveRequest true "Paths and target folder"
+// @Success 200 {array} FileChange
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/files/move [post]
+func (g *Gallery) HandleMove(c *gin.Context) {
+	var req MoveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dir, err := g.targetFolder(c, req.To)
+	if err != nil {
+		c.JSON(fileStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	moved := make([]FileChange, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		from, isDir, err := g.source(c, p)
+		var change FileChange
+		if err == nil {
+			change, err = g.move(c, from, path.Join(dir, path.Base(from)), isDir)
+		}
+		if err != nil {
+			c.JSON(fileStatus(err), gin.H{"error": err.Error(), "moved": moved})
+			return
+		}
+		moved = append(moved, change)
+	}
+	c.JSON(http.StatusOK, moved)
+}
+
+// HandleDelete godoc
+// @Summary Delete files and folders
+// @Description Moves images, videos and folders to the trash of the library, with their renditions and cached metadata, so they can be restored. Paths are deleted in order and the request stops at the first failure, reporting the entries created before it
+// @Tags files
+// @Accept json
+// @Produce json
+// @Param delete body DeleteRequest true "Paths"
+// @Success 200 {array} TrashEntry
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/files/delete [post]
+func (g *Gallery) HandleDelete(c *gin.Context) {
+	var req DeleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deleted := make([]TrashEntry, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		entry, err := g.trashPath(c, p)
+		if err != nil {
+			c.JSON(fileStatus(err), gin.H{"error": err.Error(), "deleted": deleted})
+			return
+		}
+		deleted = append(deleted, entry)
+	}
+	c.JSON(http.StatusOK, deleted)
+}
+
+func (g *Gallery) trashPath(c *gin.Context, p string) (TrashEntry, error) {
+	from, dir, err := g.source(c, p)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return TrashEntry{}, err
+	}
+	entry := TrashEntry{
+		ID:        hex.EncodeToString(id),
+		Path:      from,
+		Dir:       dir,
+		Deleted:   time.Now().Unix(),
+		DeletedBy: userName(currentUser(c)),
+	}
+	g.filesMu.Lock()
+	defer g.filesMu.Unlock()
+	if err := g.relocate(from, entry.location(), dir); err != nil {
+		return TrashEntry{}, err
+	}
+	if err := g.trash.add(entry); err != nil {
+		return TrashEntry{}, err
+	}
+	g.events.Publish(Event{Type: EventTrashed, Path: from, Data: entry})
+	return entry, nil
+}
+
+// visibleTrash returns the trash entries the user of the request may see.
+func (g *Gallery) visibleTrash(c *gin.Context) []TrashEntry {
+	u := currentUser(c)
+	return slices.DeleteFunc(g.trash.list(), func(e TrashEntry) bool { return !u.canRead(e.Path) })
+}
+
+func (g *Gallery) trashEntry(c *gin.Context) (TrashEntry, bool) {
+	entry, ok := g.trash.get(c.Param("id"))
+	if !ok || !currentUser(c).canRead(entry.Path) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown trash entry"})
+		return TrashEntry{}, false
+	}
+	return entry, true
+}
+
+// HandleTrash godoc
+// @Summary List the trash
+// @Description Lists the deleted files and folders of the library, oldest first
+// @Tags files
+// @Produce json
+// @Success 200 {array} TrashEntry
+// @Router /api/trash [get]
+func (g *Gallery) HandleTrash(c *gin.Context) {
+	c.JSON(http.StatusOK, g.visibleTrash(c))
+}
+
+// HandleRestore godoc
+// @Summary Restore from the trash
+// @Description Moves a deleted file or folder back to where it was, with its renditions and cached metadata. Missing parent folders are created; a file now taken the name fails the request
+// @Tags files
+// @Produce json
+// @Param id path string true "Trash entry ID"
+// @Success 200 {object} FileChange
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /api/trash/{id}/restore [post]
+func (g *Gallery) HandleRestore(c *gin.Context) {
+	entry, ok := g.trashEntry(c)
+	if !ok {
+		return
+	}
+	g.filesMu.Lock()
+	defer g.filesMu.Unlock()
+	if g.scanner.OriginFs.Exist(entry.Path) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s: %q", errNameTaken, entry.Path)})
+		return
+	}
+	if err := g.relocate(entry.location(), entry.Path, entry.Dir); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Sidecars that could not go back because their name was taken stay in the trash.
+	if left, _ := g.scanner.OriginFs.ReadDir(path.Join(core.TrashDir, entry.ID)); len(left) == 0 {
+		_ = g.scanner.OriginFs.Remove(path.Join(core.TrashDir, entry.ID))
+	}
+	_ = g.scanner.Cache.Fs.Remove(path.Join(core.TrashDir, entry.ID))
+	if err := g.trash.remove(entry.ID); err != nil {
+		log.Printf("Failed to save %s: %v", TrashFile, err)
+	}
+	change := FileChange{From: entry.location(), To: entry.Path}
+	g.events.Publish(Event{Type: EventRestored, Path: entry.Path, Data: change})
+	c.JSON(http.StatusOK, change)
+}
+
+// purge deletes an entry of the trash for good, with its renditions and cache entries.
+func (g *Gallery) purge(entry TrashEntry) error {
+	dir := path.Join(core.TrashDir, entry.ID)
+	if err := g.scanner.OriginFs.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := g.scanner.Cache.Fs.Remove(dir); err != nil {
+		log.Printf("Failed to remove the renditions of %s: %v", entry.Path, err)
+	}
+	if err := g.scanner.Cache.Forget(dir); err != nil {
+		log.Printf("Failed to remove the cache entries of %s: %v", entry.Path, err)
+	}
+	return g.trash.remove(entry.ID)
+}
+
+// HandlePurge godoc
+// @Summary Delete from the trash for good
+// @Description Removes a deleted file or folder from disk, with its renditions and cached metadata
+// @Tags files
+// @Param id path string true "Trash entry ID"
+// @Success 204
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/trash/{id} [delete]
+func (g *Gallery) HandlePurge(c *gin.Context) {
+	entry, ok := g.trashEntry(c)
+	if !ok {
+		return
+	}
+	g.filesMu.Lock()
+	defer g.filesMu.Unlock()
+	if err := g.purge(entry); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// HandleEmptyTrash godoc
+// @Summary Empty the trash
+// @Description Deletes every entry of the trash the user can see for good
+// @Tags files
+// @Success 204
+// @Router /api/trash [delete]
+func (g *Gallery) HandleEmptyTrash(c *gin.Context) {
+	g.filesMu.Lock()
+	defer g.filesMu.Unlock()
+	for _, entry := range g.visibleTrash(c) {
+		if err := g.purge(entry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
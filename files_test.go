@@ -0,0 +1,292 @@
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/config"
+	"gallery/core"
+)
+
+func TestFiles_RenameMoveAndTrash(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	g := l.gallery
+	base := g.scanner.OriginFs.GetPath()
+	writeTestJPEG(t, filepath.Join(base, "x", "sub", "c.jpg"))
+	writeTestJPEG(t, filepath.Join(base, "y", "d.jpg"))
+	for _, name := range []string{"v.mp4", "v.en.srt"} {
+		if err := os.WriteFile(filepath.Join(base, "x", name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.scanner.Scan(g.Root)
+	g.trash = newTrashStore(g.scanner.Cache.Fs)
+	cacheDir := g.scanner.Cache.Fs.GetPath()
+	writeTestJPEG(t, filepath.Join(cacheDir, "x", "a.jpg"))
+	if err := g.scanner.Cache.SetMark("x/a.jpg", core.Mark{Favorite: true}); err != nil {
+		t.Fatal(err)
+	}
+	libs := &libraries{anonymousWrite: true}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(base, filepath.FromSlash(p)))
+		return err == nil
+	}
+
+	if w := do(http.MethodPost, "/api/files/rename", `{"path":"x/a.jpg","name":"b.jpg"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: status %d %s", w.Code, w.Body)
+	}
+	if _, ok := g.Root.FindImage("x/b.jpg"); !ok || exists("x/a.jpg") {
+		t.Fatalf("expected x/a.jpg renamed in the tree and on disk")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "x", "b.jpg")); err != nil {
+		t.Fatalf("expected the thumbnail renamed: %v", err)
+	}
+	if !g.scanner.Cache.GetMark("x/b.jpg").Favorite {
+		t.Fatalf("expected the mark to follow the file")
+	}
+	for body, status := range map[string]int{
+		`{"path":"x/b.jpg","name":"b.mp4"}`:    http.StatusBadRequest,
+		`{"path":"x/b.jpg","name":"../b.jpg"}`: http.StatusBadRequest,
+		`{"path":"x/b.jpg","name":"v.mp4"}`:    http.StatusBadRequest,
+		`{"path":"x/sub","name":"v.mp4"}`:      http.StatusConflict,
+		`{"path":"x/nope.jpg","name":"e.jpg"}`: http.StatusNotFound,
+	} {
+		if w := do(http.MethodPost, "/api/files/rename", body); w.Code != status {
+			t.Fatalf("rename %s: expected %d, got %d", body, status, w.Code)
+		}
+	}
+
+	if w := do(http.MethodPost, "/api/files/move", `{"paths":["x/v.mp4","x/sub"],"to":"y"}`); w.Code != http.StatusOK {
+		t.Fatalf("move: status %d %s", w.Code, w.Body)
+	}
+	if video, ok := g.Root.FindVideo("y/v.mp4"); !ok || len(video.Subtitles) != 1 || !exists("y/v.en.srt") {
+		t.Fatalf("expected the video moved with its subtitle, got %+v", video)
+	}
+	if _, ok := g.Root.FindImage("y/sub/c.jpg"); !ok || g.Root.Lookup("x/sub") != nil {
+		t.Fatalf("expected the folder moved in the tree")
+	}
+	if w := do(http.MethodPost, "/api/files/move", `{"paths":["y"],"to":"y/sub"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a move into itself rejected, got %d", w.Code)
+	}
+
+	var deleted []TrashEntry
+	w := do(http.MethodPost, "/api/files/delete", `{"paths":["x/b.jpg"]}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &deleted); err != nil || len(deleted) != 1 {
+		t.Fatalf("delete: status %d %s", w.Code, w.Body)
+	}
+	entry := deleted[0]
+	if _, ok := g.Root.FindImage("x/b.jpg"); ok || !exists(entry.location()) {
+		t.Fatalf("expected x/b.jpg in the trash")
+	}
+	g.scanner.Scan(g.Root)
+	if g.Root.Lookup(core.TrashDir) != nil {
+		t.Fatalf("expected scans to skip the trash")
+	}
+	var trash []TrashEntry
+	if err := json.Unmarshal(do(http.MethodGet, "/api/trash", "").Body.Bytes(), &trash); err != nil || len(trash) != 1 || trash[0].Path != "x/b.jpg" {
+		t.Fatalf("unexpected trash %+v", trash)
+	}
+	if w := do(http.MethodPost, "/api/trash/"+entry.ID+"/restore", ""); w.Code != http.StatusOK {
+		t.Fatalf("restore: status %d %s", w.Code, w.Body)
+	}
+	if _, ok := g.Root.FindImage("x/b.jpg"); !ok || !g.scanner.Cache.GetMark("x/b.jpg").Favorite {
+		t.Fatalf("expected x/b.jpg restored with its mark")
+	}
+
+	w = do(http.MethodPost, "/api/files/delete", `{"paths":["y/sub"]}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &deleted); err != nil || len(deleted) != 1 || !deleted[0].Dir {
+		t.Fatalf("delete folder: status %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/api/trash/"+deleted[0].ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("purge: status %d", w.Code)
+	}
+	if exists(core.TrashDir+"/"+deleted[0].ID) || len(g.trash.list()) != 0 {
+		t.Fatalf("expected the folder gone for good")
+	}
+}
+
+func TestFiles_NeedAuthOrOptIn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	l.gallery.trash = newTrashStore(l.gallery.scanner.Cache.Fs)
+	writer := sha256.Sum256([]byte("writer-token"))
+	reader := sha256.Sum256([]byte("reader-token"))
+	engines := map[string]*gin.Engine{}
+	for name, libs := range map[string]*libraries{
+		"off": {},
+		"local": {auth: newAuthenticator(config.AuthConfig{
+			Mode: config.AuthLocal,
+			Users: []config.UserConfig{
+				{Name: "writer", Tokens: []string{hex.EncodeToString(writer[:])}, Write: true},
+				{Name: "reader", Tokens: []string{hex.EncodeToString(reader[:])}},
+			},
+		})},
+	} {
+		libs.add(l)
+		engines[name] = gin.New()
+		libs.register(engines[name])
+	}
+	do := func(engine, method, target, token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"paths":["x/nope.jpg"]}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		engines[engine].ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, route := range [][2]string{
+		{http.MethodPost, "/api/upload/x"},
+		{http.MethodPost, "/api/uploads"},
+		{http.MethodPost, "/api/files/delete"},
+		{http.MethodGet, "/api/trash"},
+		{http.MethodDelete, "/api/trash"},
+	} {
+		if code := do("off", route[0], route[1], ""); code != http.StatusForbidden {
+			t.Fatalf("%s %s with auth off: expected 403, got %d", route[0], route[1], code)
+		}
+		if code := do("local", route[0], route[1], "reader-token"); code != http.StatusForbidden {
+			t.Fatalf("%s %s as a read-only user: expected 403, got %d", route[0], route[1], code)
+		}
+	}
+	if code := do("local", http.MethodPost, "/api/files/delete", "writer-token"); code != http.StatusNotFound {
+		t.Fatalf("expected a writer to reach the handler, got %d", code)
+	}
+	if code := do("local", http.MethodGet, "/api/trash", "writer-token"); code != http.StatusOK {
+		t.Fatalf("expected a writer to list the trash, got %d", code)
+	}
+}
+
+func TestFiles_RestrictedWriterKeepsOffHiddenContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	g := l.gallery
+	base := g.scanner.OriginFs.GetPath()
+	writeTestJPEG(t, filepath.Join(base, "x", "private", "p.jpg"))
+	writeTestJPEG(t, filepath.Join(base, "y", "b.jpg"))
+	g.scanner.Scan(g.Root)
+	g.trash = newTrashStore(g.scanner.Cache.Fs)
+	sum := sha256.Sum256([]byte("limited-token"))
+	libs := &libraries{auth: newAuthenticator(config.AuthConfig{
+		Mode: config.AuthLocal,
+		Users: []config.UserConfig{
+			{Name: "limited", Tokens: []string{hex.EncodeToString(sum[:])}, Write: true, Deny: []string{"/x/private"}},
+		},
+	})}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+	do := func(target, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer limited-token")
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for target, body := range map[string]string{
+		"/api/files/delete": `{"paths":["x"]}`,
+		"/api/files/rename": `{"path":"x","name":"z"}`,
+		"/api/files/move":   `{"paths":["x"],"to":"y"}`,
+	} {
+		if code := do(target, body); code != http.StatusForbidden {
+			t.Fatalf("%s %s: expected 403, got %d", target, body, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, "x", "private", "p.jpg")); err != nil {
+		t.Fatalf("expected the hidden file untouched: %v", err)
+	}
+	if code := do("/api/files/move", `{"paths":["x/a.jpg"],"to":"y"}`); code != http.StatusOK {
+		t.Fatalf("expected a visible file moved, got %d", code)
+	}
+	if code := do("/api/files/delete", `{"paths":["y"]}`); code != http.StatusOK {
+		t.Fatalf("expected a fully visible folder deleted, got %d", code)
+	}
+}
+
+func TestFiles_MoveDuringScan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	g := l.gallery
+	base := g.scanner.OriginFs.GetPath()
+	for i := 0; i < 10; i++ {
+		writeTestJPEG(t, filepath.Join(base, "x", fmt.Sprintf("f%d.jpg", i)))
+	}
+	g.scanner.Scan(g.Root)
+	g.trash = newTrashStore(g.scanner.Cache.Fs)
+	libs := &libraries{anonymousWrite: true}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			g.scanner.Scan(g.Root)
+		}
+	}()
+	want := []string{"x/a.jpg"}
+	for i := 0; i < 10; i++ {
+		body := fmt.Sprintf(`{"path":"x/f%d.jpg","name":"g%d.jpg"}`, i, i)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/files/rename", strings.NewReader(body)))
+		switch w.Code {
+		case http.StatusOK:
+			want = append(want, fmt.Sprintf("x/g%d.jpg", i))
+		case http.StatusNotFound:
+			// The scan was rebuilding x/ and had not seen the file again yet.
+			want = append(want, fmt.Sprintf("x/f%d.jpg", i))
+		default:
+			t.Fatalf("rename %s: status %d %s", body, w.Code, w.Body)
+		}
+	}
+	<-done
+	var got []string
+	for _, img := range g.Root.Lookup("x").Images {
+		got = append(got, img.Path)
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected the renamed files in the tree once, got %v", got)
+	}
+}
+
+func TestEvents_MovedNeedsBothPaths(t *testing.T) {
+	guest := newUser(config.UserConfig{Name: "guest", Allow: []string{"y/**"}})
+	for change, visible := range map[FileChange]bool{
+		{From: "x/a.jpg", To: "y/a.jpg"}: false,
+		{From: "y/a.jpg", To: "x/a.jpg"}: false,
+		{From: "y/a.jpg", To: "y/b.jpg"}: true,
+	} {
+		event := Event{Type: EventMoved, Path: change.To, Data: change}
+		if got := event.visibleTo(guest); got != visible {
+			t.Fatalf("move %+v: expected visible %v, got %v", change, visible, got)
+		}
+		if !event.visibleTo(nil) {
+			t.Fatalf("expected every event visible with auth off")
+		}
+	}
+}
@@ -3,12 +3,14 @@ package gallery
 import (
 	"context"
 	"embed"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	utils "github.com/XGFan/go-utils"
@@ -17,11 +19,11 @@ import (
 	ginSwagger "github.com/swaggo/gin-swagger"
 
 	"gallery/common/misc"
+	"gallery/common/query"
 	"gallery/common/storage"
 	"gallery/config"
 	"gallery/core"
 	_ "gallery/swagger"
-	"gallery/thumbnail"
 )
 
 // @title Gallery API
@@ -39,6 +41,25 @@ type Gallery struct {
 	scanner       *core.Scanner
 	originFs      storage.Storage
 	rescanTrigger chan struct{}
+	metaQueue     core.PosterEnqueuer
+	events        *eventHub
+
+	rulesMu      sync.Mutex
+	pendingRules *scanRules
+	rulesChanged chan struct{}
+
+	albums        *albumStore
+	albumsChanged chan struct{}
+
+	collections *collectionStore
+	shares      *shareStore
+	uploads     *uploadStore
+	trash       *trashStore
+
+	similarIndex similarIndex
+
+	// filesMu serializes changes to the files of the library.
+	filesMu sync.Mutex
 }
 
 // NewGallery creates a new Gallery
@@ -49,6 +70,14 @@ func NewGallery(originFs storage.Storage, cacheFs storage.Storage,
 		Root:          &core.TraverseNode{Directories: make(map[string]*core.TraverseNode)},
 		scanner:       core.NewScanner(originFs, exclude, cache, virtualPath, nil),
 		rescanTrigger: make(chan struct{}),
+		events:        newEventHub(),
+		rulesChanged:  make(chan struct{}, 1),
+		albums:        newAlbumStore(cacheFs),
+		albumsChanged: make(chan struct{}, 1),
+		collections:   newCollectionStore(cacheFs),
+		shares:        newShareStore(cacheFs),
+		uploads:       newUploadStore(cacheFs),
+		trash:         newTrashStore(cacheFs),
 	}
 	go g.scanWorker(ctx)
 	return g
@@ -74,12 +103,24 @@ func (g *Gallery) scanWorker(ctx context.Context) {
 			log.Println("Scan exit")
 			return
 		case <-g.rescanTrigger:
-			g.scanner.Scan(g.Root)
-			g.lastScan = time.Now().Unix()
+			g.rescan()
+		case <-g.rulesChanged:
+			g.applyPendingRules()
+		case <-g.albumsChanged:
+			g.scanner.ApplyVirtualPaths(g.Root)
 		}
 	}
 }
 
+// rescan runs a full scan, then points collections at the files renamed or moved since.
+func (g *Gallery) rescan() {
+	g.scanner.Scan(g.Root)
+	g.lastScan = time.Now().Unix()
+	if g.collections != nil {
+		g.collections.reconcile(g.Root, g.scanner.OriginFs)
+	}
+}
+
 func (g *Gallery) warmUp() {
 	if count, err := g.scanner.Restore(g.Root); err == nil && count > 0 {
 		log.Printf("Warm up complete, service ready (restored %d items)", count)
@@ -89,17 +130,17 @@ func (g *Gallery) warmUp() {
 	g.rescanTrigger <- struct{}{}
 }
 
-// GetAllTags returns all tags with statistics
-func (g *Gallery) GetAllTags() []core.TagStat {
+// GetAllTags returns all tags of the images under root with statistics
+func (g *Gallery) GetAllTags(root *core.TraverseNode) []core.TagStat {
 	tagStats := make(map[string]*core.TagStat)
 
-	allImages := g.Root.Image()
+	allImages := root.Image()
 	for _, img := range allImages {
 		for _, tag := range img.Tags {
 			if tag.Value < core.TagMinValue {
 				continue
 			}
-			if g.scanner.Cache.TagBlacklist.Contains(tag.Tag) {
+			if g.scanner.Cache.IsTagBlacklisted(tag.Tag) {
 				continue
 			}
 			if stat, exists := tagStats[tag.Tag]; exists {
@@ -138,7 +179,7 @@ func (g *Gallery) GetAllTags() []core.TagStat {
 // @Success 200 {object} map[string]interface{}
 // @Router /api/tree [get]
 func (g *Gallery) HandleTree(c *gin.Context) {
-	tree := g.Root.ToTree()
+	tree := g.view(c).ToTree()
 	withLeaf := misc.BoolVar(c.Query("leaf"), true)
 	if !withLeaf {
 		filterEmpty(tree)
@@ -152,13 +193,20 @@ func (g *Gallery) HandleTree(c *gin.Context) {
 // @Tags browse
 // @Produce json
 // @Param name path string true "Directory path"
+// @Param q query string false "Only images and videos matching this query, in the smart album syntax"
+// @Param sort query string false "Order images and videos by path, name, date, width, height, duration or rating; prefix - to reverse"
 // @Success 200 {object} core.SimpleDirectory
+// @Failure 400 {object} map[string]interface{}
 // @Router /api/explore/{name} [get]
 func (g *Gallery) HandleExplore(c *gin.Context) {
 	g.Trigger()
 	name := strings.TrimPrefix(c.Param("name"), "/")
-	node := g.Root.Locate(name)
+	node := g.view(c).Locate(name)
 	result := node.Explore()
+	var ok bool
+	if result.Images, result.Videos, ok = selectMedia(c, result.Images, result.Videos); !ok {
+		return
+	}
 	result.Videos = g.fillVideoMetas(result.Videos)
 	for i := range result.Directories {
 		g.fillCoverVideoMeta(&result.Directories[i].Cover)
@@ -189,13 +237,20 @@ func (g *Gallery) HandleExplore(c *gin.Context) {
 // @Tags images
 // @Produce json
 // @Param name path string true "Directory path"
+// @Param q query string false "Only images matching this query, in the smart album syntax"
+// @Param sort query string false "Order by path, name, date, width, height or rating; prefix - to reverse"
 // @Success 200 {array} core.ImageNode
+// @Failure 400 {object} map[string]interface{}
 // @Router /api/image/{name} [get]
 func (g *Gallery) HandleImage(c *gin.Context) {
 	g.Trigger()
 	name := c.Param("name")[1:]
-	node := g.Root.Locate(name)
-	c.JSON(200, node.Image())
+	node := g.view(c).Locate(name)
+	images, _, ok := selectMedia(c, node.Image(), nil)
+	if !ok {
+		return
+	}
+	c.JSON(200, images)
 }
 
 // HandleMedia godoc
@@ -205,12 +260,15 @@ func (g *Gallery) HandleImage(c *gin.Context) {
 // @Produce json
 // @Param name path string true "Directory path"
 // @Param flat query bool false "Flatten search into subdirectories (default: true)"
+// @Param q query string false "Only images and videos matching this query, in the smart album syntax"
+// @Param sort query string false "Order by path, name, date, width, height, duration or rating; prefix - to reverse"
 // @Success 200 {object} core.MediaResponse
+// @Failure 400 {object} map[string]interface{}
 // @Router /api/media/{name} [get]
 func (g *Gallery) HandleMedia(c *gin.Context) {
 	g.Trigger()
 	name := strings.TrimPrefix(c.Param("name"), "/")
-	node := g.Root.Locate(name)
+	node := g.view(c).Locate(name)
 	flat := utils.DefaultToTrue(c.Query("flat"))
 
 	var images []core.ImageNode
@@ -223,6 +281,10 @@ func (g *Gallery) HandleMedia(c *gin.Context) {
 		images = node.Images
 		videos = node.Videos
 	}
+	images, videos, ok := selectMedia(c, images, videos)
+	if !ok {
+		return
+	}
 
 	videos = g.fillVideoMetas(videos)
 	if images == nil {
@@ -249,7 +311,7 @@ func (g *Gallery) HandleMedia(c *gin.Context) {
 func (g *Gallery) HandleAlbum(c *gin.Context) {
 	g.Trigger()
 	name := c.Param("name")[1:]
-	node := g.Root.Locate(name)
+	node := g.view(c).Locate(name)
 	c.JSON(200, node.Album())
 }
 
@@ -265,12 +327,44 @@ func (g *Gallery) HandleAlbum(c *gin.Context) {
 func (g *Gallery) HandleRandom(c *gin.Context) {
 	name := c.Param("name")[1:]
 	flatten := utils.DefaultToTrue(c.Query("flat"))
+	root := g.view(c)
 	random, _ := utils.Retry(5, func() (core.NodeWithParent, error) {
-		return g.Root.Locate(name).Random(flatten)
+		return root.Locate(name).Random(flatten)
 	})
 	c.JSON(200, random)
 }
 
+// HandleVideoMeta godoc
+// @Summary Get video metadata
+// @Description Returns probed metadata of a video: codecs, bitrate, frame rate, rotation-corrected size, HDR flag, audio and subtitle tracks
+// @Tags media
+// @Produce json
+// @Param name path string true "Video path"
+// @Success 200 {object} core.VideoMeta
+// @Success 202 {object} map[string]interface{} "Not probed yet; a video_meta event follows"
+// @Router /api/meta/{name} [get]
+func (g *Gallery) HandleVideoMeta(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	if !storage.IsValidVideo(name) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !g.scanner.OriginFs.Exist(name) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	meta, status := g.cachedVideoMeta(name)
+	switch status {
+	case core.MetaStatusPending, core.MetaStatusUnavailable:
+		c.JSON(http.StatusAccepted, gin.H{"path": name, "meta_status": status})
+		return
+	case core.MetaStatusFailed:
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(200, meta)
+}
+
 // HandleTag godoc
 // @Summary Get all tags
 // @Description Returns tag statistics across all images
@@ -279,42 +373,38 @@ func (g *Gallery) HandleRandom(c *gin.Context) {
 // @Success 200 {array} core.TagStat
 // @Router /api/tag [get]
 func (g *Gallery) HandleTag(c *gin.Context) {
-	c.JSON(200, g.GetAllTags())
+	c.JSON(200, g.GetAllTags(g.view(c)))
+}
+
+// HandleExplainExclude godoc
+// @Summary Explain an exclusion
+// @Description Reports whether scans skip a path and which exclude/include pattern, .galleryignore line or size limit decided it
+// @Tags debug
+// @Produce json
+// @Param name path string true "Path relative to the library"
+// @Success 200 {object} core.Exclusion
+// @Router /api/debug/exclude/{name} [get]
+func (g *Gallery) HandleExplainExclude(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	c.JSON(200, g.scanner.Explain(name))
 }
 
 // Init initializes the gallery routes
-func Init(s *gin.Engine, conf config.GalleryConfig) {
-	ctx, _ := context.WithCancel(context.Background())
-	originFs := storage.NewFs(conf.Resource.Base)
-	cacheFs := storage.NewFs(conf.Cache)
-	gallery := NewGallery(originFs, cacheFs, conf.Resource.Exclude, conf.Resource.VirtualPath, conf.Resource.TagBlacklist, ctx)
-	imageResolver := NewStaticImageResolver(originFs, cacheFs, conf.Resource.ForceThumbnail, ctx)
-	posterQueue := thumbnail.NewPosterQueue(newPosterGenerator(originFs, cacheFs, gallery.scanner.Cache.GetVideoMeta), thumbnail.PosterQueueOptions{})
-	posterQueue.Run(ctx)
-	imageResolver.PosterQueue = posterQueue
-	gallery.scanner.PosterQueue = posterQueue
-
-	// warmup
-	go gallery.warmUp()
-
-	// image OriginFs
-	s.StaticFS("/file/", imageResolver.OriginAdapter)
-	s.StaticFS("/thumbnail/", imageResolver.ThumbAdapter)
-	s.StaticFS("/video/", imageResolver.VideoAdapter)
-	s.GET("/poster/*name", imageResolver.HandlePoster)
+// Every library is served under /api/{lib}/ and /file/{lib}/ and so on; the first one also
+// serves the unprefixed routes. The returned reloader applies later changes of conf live.
+func Init(s *gin.Engine, conf config.GalleryConfig) *ConfigReloader {
+	ctx := context.Background()
+	// Detect ffmpeg/ffprobe up front so a host without them reports it once at startup.
+	core.DefaultToolchain()
+	libs := &libraries{auth: newAuthenticator(conf.Auth), anonymousWrite: conf.Files.AllowAnonymousWrite}
+	for _, lib := range conf.LibraryList() {
+		libs.add(newLibrary(ctx, lib.Name, conf.ForLibrary(lib)))
+	}
+
+	libs.register(s)
 
 	// Swagger UI
 	s.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-
-	// API routes
-	s.GET("/api/tree", gallery.HandleTree)
-	s.GET("/api/explore/*name", gallery.HandleExplore)
-	s.GET("/api/image/*name", gallery.HandleImage)
-	s.GET("/api/media/*name", gallery.HandleMedia)
-	s.GET("/api/album/*name", gallery.HandleAlbum)
-	s.GET("/api/random/*name", gallery.HandleRandom)
-	s.GET("/api/tag", gallery.HandleTag)
-
 	s.NoRoute(func(c *gin.Context) {
 		if c.Request.URL.Path == "/" || c.Request.URL.Path == "/index.html" {
 			defer func() {
@@ -334,6 +424,7 @@ func Init(s *gin.Engine, conf config.GalleryConfig) {
 			}
 		}
 	})
+	return &ConfigReloader{current: conf, libraries: libs}
 }
 
 // filterEmpty removes empty directories from tree
@@ -352,6 +443,32 @@ func filterEmpty(m map[string]interface{}) {
 	}
 }
 
+// selectMedia applies the q and sort parameters of a listing request. Without either the
+// lists are returned as they are; an invalid one is answered with 400 and ok is false.
+func selectMedia(c *gin.Context, images []core.ImageNode, videos []core.VideoNode) (_ []core.ImageNode, _ []core.VideoNode, ok bool) {
+	expr, sortBy := c.Query("q"), c.Query("sort")
+	if expr == "" && sortBy == "" {
+		return images, videos, true
+	}
+	q, err := query.Parse(expr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q " + err.Error()})
+		return nil, nil, false
+	}
+	var compare func(a, b query.Item) int
+	if sortBy != "" {
+		if compare, err = query.Compare(sortBy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, nil, false
+		}
+	}
+	images, videos = core.SelectMedia(images, videos, q, compare)
+	return images, videos, true
+}
+
+// fillVideoMetas fills videos missing dimensions from the metadata cache without touching the disk.
+// Videos not probed yet are marked pending and handed to the background queue; their update
+// arrives later as a video_meta event.
 func (g *Gallery) fillVideoMetas(videos []core.VideoNode) []core.VideoNode {
 	if len(videos) == 0 {
 		return videos
@@ -363,13 +480,13 @@ func (g *Gallery) fillVideoMetas(videos []core.VideoNode) []core.VideoNode {
 			filled = append(filled, video)
 			continue
 		}
-		meta, ok := g.getVideoMeta(video.Path)
-		if !ok {
-			continue
+		meta, status := g.cachedVideoMeta(video.Path)
+		if status == "" {
+			video.Width = meta.Width
+			video.Height = meta.Height
+			video.DurationSec = meta.DurationSec
 		}
-		video.Width = meta.Width
-		video.Height = meta.Height
-		video.DurationSec = meta.DurationSec
+		video.MetaStatus = status
 		filled = append(filled, video)
 	}
 	return filled
@@ -385,48 +502,57 @@ func (g *Gallery) fillCoverVideoMeta(cover *core.ImageNode) {
 	if !storage.IsValidVideo(cover.Path) {
 		return
 	}
-	meta, ok := g.getVideoMeta(cover.Path)
-	if !ok {
+	meta, status := g.cachedVideoMeta(cover.Path)
+	if status != "" {
 		return
 	}
 	cover.Width = meta.Width
 	cover.Height = meta.Height
 }
 
-func (g *Gallery) getVideoMeta(videoPath string) (core.VideoMeta, bool) {
-	f, err := g.scanner.OriginFs.Open(videoPath)
-	if err != nil {
-		log.Printf("ffprobe failed for %s: %s", videoPath, err.Error())
-		return core.VideoMeta{}, false
+// cachedVideoMeta looks a video up in the metadata cache only. The returned status is empty when
+// the dimensions are known, otherwise one of the core.MetaStatus values; pending videos are enqueued.
+func (g *Gallery) cachedVideoMeta(videoPath string) (core.VideoMeta, string) {
+	meta, ok := g.scanner.Cache.GetVideoMeta(videoPath)
+	switch {
+	case ok && meta.Width > 0 && meta.Height > 0:
+		return meta, ""
+	case !g.scanner.Toolchain.Capabilities().Probe:
+		return meta, core.MetaStatusUnavailable
+	case ok && meta.Schema >= core.VideoMetaSchemaVersion:
+		return meta, core.MetaStatusFailed
 	}
-	info, err := f.Stat()
-	f.Close()
-	if err != nil {
-		log.Printf("ffprobe failed for %s: %s", videoPath, err.Error())
-		return core.VideoMeta{}, false
+	if g.metaQueue != nil {
+		g.metaQueue.Enqueue(videoPath)
 	}
+	return meta, core.MetaStatusPending
+}
 
-	if meta, ok := g.scanner.Cache.GetVideoMeta(videoPath); ok {
-		if !g.scanner.Cache.NeedsVideoMetaRefresh(videoPath, info.ModTime(), info.Size()) && meta.Width > 0 && meta.Height > 0 && meta.DurationSec > 0 {
-			return meta, true
-		}
-	}
+// videoMetaProber is the generator of the background metadata queue.
+type videoMetaProber struct {
+	gallery *Gallery
+}
 
-	absPath := g.scanner.OriginFs.Join(g.scanner.OriginFs.GetPath(), videoPath)
-	width, height, durationSec, err := core.ProbeVideoMeta(absPath)
-	if err != nil {
-		log.Printf("ffprobe failed for %s: %s", videoPath, err.Error())
-		return core.VideoMeta{}, false
+// Generate resolves the metadata of one video for the background queue, applies it to the tree
+// and notifies subscribers.
+func (vp *videoMetaProber) Generate(ctx context.Context, source string) error {
+	meta, err := vp.gallery.scanner.ResolveVideoMeta(source)
+	if errors.Is(err, core.ErrToolUnavailable) {
+		return nil
 	}
-
-	meta := core.VideoMeta{
-		Path:            videoPath,
-		DurationSec:     durationSec,
-		Width:           width,
-		Height:          height,
-		SizeBytes:       info.Size(),
-		ModTimeUnixNano: info.ModTime().UnixNano(),
+	if err != nil && meta.Schema == 0 {
+		return err
+	}
+	video, ok := vp.gallery.Root.UpdateVideoMeta(source, meta)
+	if !ok {
+		video = core.VideoNode{Node: core.Node{Name: path.Base(source), Path: source}}
+		video.Width = meta.Width
+		video.Height = meta.Height
+		video.DurationSec = meta.DurationSec
+	}
+	if meta.Width <= 0 || meta.Height <= 0 {
+		video.MetaStatus = core.MetaStatusFailed
 	}
-	g.scanner.Cache.UpsertVideoMeta(videoPath, meta)
-	return meta, true
+	vp.gallery.events.Publish(Event{Type: EventVideoMeta, Path: source, Data: video})
+	return nil
 }
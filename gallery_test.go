@@ -0,0 +1,102 @@
+package gallery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func newTestGallery(t *testing.T) (*Gallery, *core.FakeToolchain, string) {
+	t.Helper()
+	originDir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	g := NewGallery(storage.NewFs(originDir), storage.NewFs(t.TempDir()), nil, nil, nil, ctx)
+	toolchain := core.NewFakeToolchain()
+	g.scanner.Toolchain = toolchain
+	return g, toolchain, originDir
+}
+
+func TestFillVideoMetas_DoesNotProbe(t *testing.T) {
+	g, toolchain, _ := newTestGallery(t)
+	queue := &mockPosterQueue{}
+	g.metaQueue = queue
+	g.scanner.Cache.UpsertVideoMeta("known.mp4", core.VideoMeta{Schema: core.VideoMetaSchemaVersion, Width: 640, Height: 360, DurationSec: 4})
+	g.scanner.Cache.UpsertVideoMeta("broken.mp4", core.VideoMeta{Schema: core.VideoMetaSchemaVersion})
+
+	videos := g.fillVideoMetas([]core.VideoNode{
+		{Node: core.Node{Path: "known.mp4"}},
+		{Node: core.Node{Path: "new.mp4"}},
+		{Node: core.Node{Path: "broken.mp4"}},
+	})
+
+	if len(videos) != 3 {
+		t.Fatalf("expect every video listed, got %d", len(videos))
+	}
+	if videos[0].Width != 640 || videos[0].MetaStatus != "" {
+		t.Fatalf("expect cached meta applied, got %+v", videos[0])
+	}
+	if videos[1].MetaStatus != core.MetaStatusPending {
+		t.Fatalf("expect pending, got %+v", videos[1])
+	}
+	if videos[2].MetaStatus != core.MetaStatusFailed {
+		t.Fatalf("expect failed, got %+v", videos[2])
+	}
+	if len(queue.items) != 1 || queue.items[0] != "new.mp4" {
+		t.Fatalf("expect only the unknown video enqueued, got %v", queue.items)
+	}
+	if calls := toolchain.Calls(); len(calls) != 0 {
+		t.Fatalf("expect no probe inside the handler path, got %v", calls)
+	}
+
+	toolchain.Caps.Probe = false
+	videos = g.fillVideoMetas([]core.VideoNode{{Node: core.Node{Path: "other.mp4"}}})
+	if videos[0].MetaStatus != core.MetaStatusUnavailable {
+		t.Fatalf("expect unavailable without ffprobe, got %+v", videos[0])
+	}
+}
+
+func TestVideoMetaProber_UpdatesTreeAndPublishes(t *testing.T) {
+	g, toolchain, originDir := newTestGallery(t)
+	if err := os.MkdirAll(filepath.Join(originDir, "videos"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(originDir, "videos", "clip.mp4"), []byte("video"), 0o644); err != nil {
+		t.Fatalf("write video: %v", err)
+	}
+	toolchain.Metas["clip.mp4"] = core.VideoMeta{Schema: core.VideoMetaSchemaVersion, Width: 1080, Height: 1920, DurationSec: 7}
+	g.Root.Locate("videos").Videos = []core.VideoNode{{Node: core.Node{Name: "clip.mp4", Path: "videos/clip.mp4"}}}
+
+	events, unsubscribe := g.events.Subscribe()
+	defer unsubscribe()
+
+	prober := &videoMetaProber{gallery: g}
+	if err := prober.Generate(context.Background(), "videos/clip.mp4"); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	if video := g.Root.Locate("videos").Videos[0]; video.Width != 1080 || video.Height != 1920 {
+		t.Fatalf("expect tree updated, got %+v", video)
+	}
+	select {
+	case event := <-events:
+		video, ok := event.Data.(core.VideoNode)
+		if event.Type != EventVideoMeta || event.Path != "videos/clip.mp4" || !ok || video.DurationSec != 7 {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect video_meta event")
+	}
+
+	if err := prober.Generate(context.Background(), "videos/clip.mp4"); err != nil {
+		t.Fatalf("generate again: %v", err)
+	}
+	if calls := toolchain.Calls(); len(calls) != 1 {
+		t.Fatalf("expect cached meta reused, got %v", calls)
+	}
+}
@@ -15,6 +15,8 @@ require (
 	github.com/XGFan/go-utils v0.0.0-20240318151539-025ddda1ce33
 	github.com/davidbyttow/govips/v2 v2.18.0
 	github.com/swaggo/swag v1.16.6
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.49.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -55,7 +57,6 @@ require (
 	go.mongodb.org/mongo-driver/v2 v2.5.0 // indirect
 	go.yaml.in/yaml/v3 v3.0.4 // indirect
 	golang.org/x/arch v0.25.0 // indirect
-	golang.org/x/crypto v0.49.0 // indirect
 	golang.org/x/image v0.38.0 // indirect
 	golang.org/x/mod v0.34.0 // indirect
 	golang.org/x/sync v0.20.0 // indirect
@@ -0,0 +1,108 @@
+package gallery
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/transcode"
+)
+
+const hlsPlaylistName = "index.m3u8"
+
+// HandleHLS serves /hls/<video>/index.m3u8 and the segments it references.
+func (sir *StaticImageResolver) HandleHLS(c *gin.Context) {
+	name := CleanUrlPath(c.Param("name"))
+	source, file := path.Dir(name), path.Base(name)
+	if sir.Transcoder == nil || !storage.IsValidVideo(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if hasParentRef(name) || !sir.knownVideo(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if file == hlsPlaylistName {
+		playlist, err := sir.Transcoder.Playlist(source)
+		if err != nil {
+			log.Printf("hls playlist failed: %s, err: %v", source, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist)
+		return
+	}
+
+	index, ok := transcode.ParseSegmentName(file)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	segmentPath, err := sir.Transcoder.Segment(c.Request.Context(), source, index)
+	if err != nil {
+		if errors.Is(err, transcode.ErrSegmentOutOfRange) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		log.Printf("hls segment failed: %s, err: %v", source, err)
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	segment, err := sir.CacheFs.Open(segmentPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.Status(http.StatusNotFound)
+		} else {
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer segment.Close()
+	info, err := segment.Stat()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Content-Type", "video/mp2t")
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), segment)
+}
+
+// HandlePlayback godoc
+// @Summary Get playback source of a video
+// @Description Returns "direct" with the raw /video URL for browser-compatible codecs, otherwise "hls" with a transcoded playlist URL
+// @Tags media
+// @Produce json
+// @Param name path string true "Video path"
+// @Success 200 {object} map[string]string
+// @Router /api/playback/{name} [get]
+func (sir *StaticImageResolver) HandlePlayback(c *gin.Context) {
+	source := CleanUrlPath(c.Param("name"))
+	if !storage.IsValidVideo(source) || !sir.knownVideo(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	mode := transcode.ModeDirect
+	if sir.Transcoder != nil {
+		mode = sir.Transcoder.Mode(source)
+	}
+	// Asked through /api/{lib}/, the media routes need the library too.
+	if lib := c.Param("lib"); lib != "" {
+		source = libraryPrefix + lib + "/" + source
+	}
+	target := "/video/" + source
+	if mode == transcode.ModeHLS {
+		target = "/hls/" + source + "/" + hlsPlaylistName
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"mode": mode,
+		"url":  (&url.URL{Path: target}).EscapedPath(),
+	})
+}
@@ -0,0 +1,70 @@
+package gallery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+	"gallery/transcode"
+)
+
+func TestHLS_OnlyVideosOfTheTree(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	base := t.TempDir()
+	for _, name := range []string{"library/movie.mkv", "outside/v.mkv"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(base, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, name), []byte("video"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	originFs, cacheFs := storage.NewFs(filepath.Join(base, "library")), storage.NewFs(t.TempDir())
+	resolver := NewStaticImageResolver(originFs, cacheFs, nil, context.Background())
+	resolver.findVideo = func(path string) (core.VideoNode, bool) {
+		return core.VideoNode{}, path == "movie.mkv"
+	}
+	resolver.Transcoder = transcode.NewManager(originFs, cacheFs, func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{DurationSec: 30, Schema: core.VideoMetaSchemaVersion}, true
+	}, transcode.Options{})
+	resolver.Transcoder.RunSegment = func(ctx context.Context, source string, args []string) error {
+		t.Fatalf("unexpected transcode of %s", source)
+		return nil
+	}
+	r := gin.New()
+	r.GET("/hls/*name", resolver.HandleHLS)
+	r.GET("/playback/*name", resolver.HandlePlayback)
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+
+	if code := get("/hls/movie.mkv/index.m3u8"); code != http.StatusOK {
+		t.Fatalf("expected the playlist of a library video, got %d", code)
+	}
+	r.GET("/api/:lib/playback/*name", resolver.HandlePlayback)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/archive/playback/movie.mkv", nil))
+	if !strings.Contains(w.Body.String(), `"/video/@archive/movie.mkv"`) {
+		t.Fatalf("expected the library in the playback URL, got %s", w.Body)
+	}
+	for _, target := range []string{
+		"/hls/../outside/v.mkv/index.m3u8",
+		"/hls/../outside/v.mkv/seg_00000.ts",
+		"/hls/x/../movie.mkv/index.m3u8",
+		"/playback/../outside/v.mkv",
+	} {
+		if code := get(target); code != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404, got %d", target, code)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+
+	"gallery/common/storage"
+)
+
+// readJSONFile decodes the file name of fs into v. A missing file leaves v untouched and
+// is not an error.
+func readJSONFile(fs storage.Storage, name string, v interface{}) error {
+	data, err := fs.Read(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces the file name of fs with v, atomically.
+func writeJSONFile(fs storage.Storage, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.Save(name, io.NopCloser(bytes.NewReader(data)))
+}
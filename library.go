@@ -0,0 +1,269 @@
+package gallery
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/config"
+	"gallery/core"
+	"gallery/thumbnail"
+	"gallery/transcode"
+)
+
+// library is one media root with its own tree, cache and generators.
+type library struct {
+	name     string
+	gallery  *Gallery
+	resolver *StaticImageResolver
+}
+
+// newLibrary wires the gallery, resolver and background queues of one library.
+// conf is the single-library view returned by config.GalleryConfig.ForLibrary.
+func newLibrary(ctx context.Context, name string, conf config.GalleryConfig) *library {
+	originFs := storage.NewFs(conf.Resource.Base)
+	cacheFs := storage.NewFs(conf.Cache)
+	gallery := NewGallery(originFs, cacheFs, conf.Resource.Exclude, conf.Resource.VirtualPath, conf.Resource.TagBlacklist, ctx)
+	gallery.scanner.SetFilter(scanFilter(conf.Resource))
+	gallery.setConfigAlbums(smartAlbums(conf.Resource.SmartAlbums))
+	imageResolver := NewStaticImageResolver(originFs, cacheFs, conf.Resource.ForceThumbnail, ctx)
+	posters := newPosterGenerator(originFs, cacheFs, gallery.scanner.Cache.GetVideoMeta)
+	posters.strategy = conf.Poster.Strategy
+	posters.sceneThreshold = conf.Poster.SceneThreshold
+	posterQueue := thumbnail.NewPosterQueue(posters, thumbnail.PosterQueueOptions{})
+	posterQueue.Run(ctx)
+	imageResolver.PosterQueue = posterQueue
+	imageResolver.posterGenerator = posters
+	imageResolver.getVideoMeta = gallery.scanner.Cache.GetVideoMeta
+	imageResolver.findVideo = gallery.Root.FindVideo
+	gallery.scanner.PosterQueue = posterQueue
+	metaQueue := thumbnail.NewPosterQueue(&videoMetaProber{gallery: gallery}, thumbnail.PosterQueueOptions{Concurrency: 2})
+	metaQueue.Run(ctx)
+	gallery.metaQueue = metaQueue
+	previewQueue := thumbnail.NewPosterQueue(newPreviewGenerator(originFs, cacheFs, gallery.scanner.Cache.GetVideoMeta), thumbnail.PosterQueueOptions{Concurrency: 2})
+	previewQueue.Run(ctx)
+	imageResolver.PreviewQueue = previewQueue
+	transcoder := transcode.NewManager(originFs, cacheFs, gallery.scanner.Cache.GetVideoMeta, transcode.Options{
+		SegmentSec:    conf.Transcode.SegmentSeconds,
+		MaxConcurrent: conf.Transcode.MaxConcurrent,
+		IdleTimeout:   time.Duration(conf.Transcode.IdleTimeout) * time.Second,
+	})
+	transcoder.Run(ctx)
+	imageResolver.Transcoder = transcoder
+
+	// warmup
+	go gallery.warmUp()
+	return &library{name: name, gallery: gallery, resolver: imageResolver}
+}
+
+// scanFilter converts the exclusion settings of a library for the scanner.
+// max_file_size was checked by config.Validate, so a parse error cannot happen here.
+func scanFilter(resource config.ResourceConfig) core.ScanFilter {
+	maxFileSize, _ := config.ParseSize(resource.MaxFileSize)
+	return core.ScanFilter{Exclude: resource.Exclude, Include: resource.Include, MaxFileSize: maxFileSize}
+}
+
+// smartAlbums converts the smart albums of a library for the scanner.
+func smartAlbums(albums []config.SmartAlbumConfig) []core.SmartAlbum {
+	result := make([]core.SmartAlbum, 0, len(albums))
+	for _, album := range albums {
+		result = append(result, core.SmartAlbum{Name: album.Name, Query: album.Query, Sort: album.Sort, Limit: album.Limit})
+	}
+	return result
+}
+
+// libraries routes requests to a library; the first one is the default that serves the
+// unprefixed routes.
+type libraries struct {
+	list   []*library
+	byName map[string]*library
+	auth   *authenticator
+	// anonymousWrite opens the file routes while auth is off.
+	anonymousWrite bool
+}
+
+const libraryContextKey = "gallery.library"
+
+func (ls *libraries) add(l *library) {
+	if ls.byName == nil {
+		ls.byName = make(map[string]*library)
+	}
+	ls.list = append(ls.list, l)
+	ls.byName[l.name] = l
+}
+
+// selectLibrary is the middleware of the /api/:lib routes.
+func (ls *libraries) selectLibrary(c *gin.Context) {
+	l, ok := ls.byName[c.Param("lib")]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	c.Set(libraryContextKey, l)
+}
+
+// current returns the library selected for the request, the default one when none was.
+func (ls *libraries) current(c *gin.Context) *library {
+	if l, ok := c.Get(libraryContextKey); ok {
+		return l.(*library)
+	}
+	return ls.list[0]
+}
+
+func (ls *libraries) gallery(handler func(g *Gallery, c *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		handler(ls.current(c).gallery, c)
+	}
+}
+
+func (ls *libraries) library(handler func(l *library, c *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		handler(ls.current(c), c)
+	}
+}
+
+func (ls *libraries) resolver(handler func(sir *StaticImageResolver, c *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		handler(ls.current(c).resolver, c)
+	}
+}
+
+// libraryPrefix marks the first segment of a media path as a library name. Scans skip
+// names starting with "@", so /file/@photos/... can never hide a folder of the default library.
+const libraryPrefix = "@"
+
+// split takes the library from the first segment of a media path when it is "@" and a
+// library name. Other paths belong to the default library, so /file/a.jpg keeps working next
+// to /file/@photos/a.jpg and adding a library changes no existing URL.
+func (ls *libraries) split(name string) (*library, string) {
+	first, rest, found := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if lib, ok := strings.CutPrefix(first, libraryPrefix); ok && found {
+		if l, ok := ls.byName[lib]; ok {
+			return l, "/" + rest
+		}
+	}
+	return ls.list[0], name
+}
+
+// media selects the library of a *name media route and strips its name from the path.
+func (ls *libraries) media(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		l, rest := ls.split(c.Param("name"))
+		c.Set(libraryContextKey, l)
+		for i := range c.Params {
+			if c.Params[i].Key == "name" {
+				c.Params[i].Value = rest
+			}
+		}
+		next(c)
+	}
+}
+
+// fs is media for the file systems behind StaticFS routes.
+func (ls *libraries) fs(pick func(l *library) http.FileSystem) http.FileSystem {
+	return FsFunc(func(name string) (http.File, error) {
+		l, rest := ls.split(name)
+		return pick(l).Open(rest)
+	})
+}
+
+// register adds the media and API routes of every library to s.
+func (ls *libraries) register(s *gin.Engine) {
+	s.Use(ls.authorize)
+	registerPprof(s)
+
+	// image OriginFs
+	s.StaticFS("/file/", ls.fs(func(l *library) http.FileSystem { return l.resolver.OriginAdapter }))
+	s.StaticFS("/thumbnail/", ls.fs(func(l *library) http.FileSystem { return l.resolver.ThumbAdapter }))
+	s.StaticFS("/video/", ls.fs(func(l *library) http.FileSystem { return l.resolver.VideoAdapter }))
+	s.GET("/poster/*name", ls.media(ls.resolver((*StaticImageResolver).HandlePoster)))
+	s.GET("/preview/*name", ls.media(ls.resolver((*StaticImageResolver).HandlePreview)))
+	s.GET("/hls/*name", ls.media(ls.resolver((*StaticImageResolver).HandleHLS)))
+	s.GET("/subtitle/*name", ls.media(ls.resolver((*StaticImageResolver).HandleSubtitle)))
+
+	// API routes, unprefixed for the default library and under /api/{lib}/ for each one
+	s.GET("/api/libraries", ls.HandleLibraries)
+	s.POST("/api/auth/login", ls.HandleLogin)
+	s.POST("/api/auth/logout", ls.HandleLogout)
+	s.GET("/api/auth/me", ls.HandleMe)
+	for _, api := range []*gin.RouterGroup{s.Group("/api"), s.Group("/api/:lib", ls.selectLibrary)} {
+		api.GET("/tree", ls.gallery((*Gallery).HandleTree))
+		api.GET("/explore/*name", ls.gallery((*Gallery).HandleExplore))
+		api.GET("/image/*name", ls.gallery((*Gallery).HandleImage))
+		api.GET("/media/*name", ls.gallery((*Gallery).HandleMedia))
+		api.GET("/album/*name", ls.gallery((*Gallery).HandleAlbum))
+		api.GET("/random/*name", ls.gallery((*Gallery).HandleRandom))
+		api.GET("/tag", ls.gallery((*Gallery).HandleTag))
+		api.GET("/duplicates", ls.gallery((*Gallery).HandleDuplicates))
+		api.GET("/similar/*name", readable(ls.gallery((*Gallery).HandleSimilar)))
+		api.GET("/playback/*name", readable(ls.resolver((*StaticImageResolver).HandlePlayback)))
+		api.GET("/meta/*name", readable(ls.gallery((*Gallery).HandleVideoMeta)))
+		api.GET("/events", ls.gallery((*Gallery).HandleEvents))
+		api.GET("/download/*name", ls.library((*library).HandleDownload))
+		api.POST("/download", ls.library((*library).HandleDownloadSelection))
+		api.POST("/upload/*name", ls.managed(ls.gallery((*Gallery).HandleUpload)))
+		api.POST("/uploads", ls.managed(ls.gallery((*Gallery).HandleCreateUpload)))
+		api.HEAD("/uploads/:id", ls.managed(ls.gallery((*Gallery).HandleUploadOffset)))
+		api.PATCH("/uploads/:id", ls.managed(ls.gallery((*Gallery).HandleUploadChunk)))
+		api.DELETE("/uploads/:id", ls.managed(ls.gallery((*Gallery).HandleCancelUpload)))
+		api.POST("/files/rename", ls.managed(ls.gallery((*Gallery).HandleRename)))
+		api.POST("/files/move", ls.managed(ls.gallery((*Gallery).HandleMove)))
+		api.POST("/files/delete", ls.managed(ls.gallery((*Gallery).HandleDelete)))
+		api.GET("/trash", ls.managed(ls.gallery((*Gallery).HandleTrash)))
+		api.DELETE("/trash", ls.managed(ls.gallery((*Gallery).HandleEmptyTrash)))
+		api.POST("/trash/:id/restore", ls.managed(ls.gallery((*Gallery).HandleRestore)))
+		api.DELETE("/trash/:id", ls.managed(ls.gallery((*Gallery).HandlePurge)))
+		api.POST("/poster/*name", readable(ls.resolver((*StaticImageResolver).HandleSetPoster)))
+		api.GET("/debug/exclude/*name", ls.gallery((*Gallery).HandleExplainExclude))
+		api.GET("/smart-albums", ls.gallery((*Gallery).HandleSmartAlbums))
+		api.PUT("/smart-albums/:name", ls.gallery((*Gallery).HandlePutSmartAlbum))
+		api.DELETE("/smart-albums/:name", ls.gallery((*Gallery).HandleDeleteSmartAlbum))
+		api.PUT("/marks/*name", readable(ls.gallery((*Gallery).HandleSetMark)))
+		api.GET("/collections", ls.gallery((*Gallery).HandleCollections))
+		api.POST("/collections", ls.gallery((*Gallery).HandleCreateCollection))
+		api.GET("/collections/:id", ls.gallery((*Gallery).HandleCollection))
+		api.PATCH("/collections/:id", ls.gallery((*Gallery).HandleUpdateCollection))
+		api.DELETE("/collections/:id", ls.gallery((*Gallery).HandleDeleteCollection))
+		api.POST("/collections/:id/items", ls.gallery((*Gallery).HandleAddCollectionItems))
+		api.GET("/collections/:id/explore", ls.gallery((*Gallery).HandleExploreCollection))
+		api.GET("/collections/:id/media", ls.gallery((*Gallery).HandleCollectionMedia))
+	}
+	ls.registerShares(s)
+}
+
+// LibraryInfo describes a library in the /api/libraries listing.
+type LibraryInfo struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	Images  int    `json:"images"`
+	Videos  int    `json:"videos"`
+}
+
+// HandleLibraries godoc
+// @Summary List libraries
+// @Description Returns the libraries the user may see, with the number of images and videos visible to them; the default one also serves the routes without a library name
+// @Tags browse
+// @Produce json
+// @Success 200 {array} LibraryInfo
+// @Router /api/libraries [get]
+func (ls *libraries) HandleLibraries(c *gin.Context) {
+	u := currentUser(c)
+	result := make([]LibraryInfo, 0, len(ls.list))
+	for i, l := range ls.list {
+		if !u.canLibrary(l.name) {
+			continue
+		}
+		root := l.gallery.view(c)
+		result = append(result, LibraryInfo{
+			Name:    l.name,
+			Default: i == 0,
+			Images:  len(root.Image()),
+			Videos:  len(root.Video()),
+		})
+	}
+	c.JSON(200, result)
+}
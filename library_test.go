@@ -0,0 +1,99 @@
+package gallery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// newTestLibrary scans a library holding one image, without a scan worker.
+func newTestLibrary(t *testing.T, name string, image string) *library {
+	t.Helper()
+	originDir := t.TempDir()
+	writeTestJPEG(t, filepath.Join(originDir, image))
+	cache := core.NewCacheManager(storage.NewFs(t.TempDir()), nil)
+	t.Cleanup(func() { cache.Close() })
+	g := &Gallery{
+		Root:    &core.TraverseNode{Directories: make(map[string]*core.TraverseNode)},
+		scanner: core.NewScanner(storage.NewFs(originDir), nil, cache, nil, nil),
+		events:  newEventHub(),
+	}
+	g.scanner.Toolchain = core.NewFakeToolchain()
+	g.scanner.Scan(g.Root)
+	g.lastScan = 1 << 62
+	sir := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(t.TempDir()), nil, context.Background())
+	return &library{name: name, gallery: g, resolver: sir}
+}
+
+func TestLibraries_RoutesByName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	libs := new(libraries)
+	photos := newTestLibrary(t, "photos", "a.jpg")
+	// A folder of the default library named like another library stays reachable.
+	writeTestJPEG(t, filepath.Join(photos.gallery.scanner.OriginFs.GetPath(), "archive", "c.jpg"))
+	photos.gallery.scanner.Scan(photos.gallery.Root)
+	libs.add(photos)
+	libs.add(newTestLibrary(t, "archive", "b.jpg"))
+	engine := gin.New()
+	libs.register(engine)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	imagePaths := func(target string) []string {
+		w := get(target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", target, w.Code)
+		}
+		var images []core.ImageNode
+		if err := json.Unmarshal(w.Body.Bytes(), &images); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, img := range images {
+			paths = append(paths, img.Path)
+		}
+		return paths
+	}
+
+	if got := imagePaths("/api/image/"); len(got) != 2 || got[0] != "a.jpg" || got[1] != "archive/c.jpg" {
+		t.Fatalf("expect default library on unprefixed route, got %v", got)
+	}
+	if got := imagePaths("/api/archive/image/"); len(got) != 1 || got[0] != "b.jpg" {
+		t.Fatalf("expect archive library, got %v", got)
+	}
+	if w := get("/api/nope/image/"); w.Code != http.StatusNotFound {
+		t.Fatalf("expect unknown library 404, got %d", w.Code)
+	}
+
+	var listed []LibraryInfo
+	if err := json.Unmarshal(get("/api/libraries").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Name != "photos" || !listed[0].Default || listed[1].Images != 1 {
+		t.Fatalf("unexpected listing %+v", listed)
+	}
+
+	for target, want := range map[string]int{
+		"/file/a.jpg":          http.StatusOK,
+		"/file/@photos/a.jpg":  http.StatusOK,
+		"/file/@archive/b.jpg": http.StatusOK,
+		"/file/b.jpg":          http.StatusNotFound,
+		"/file/archive/c.jpg":  http.StatusOK,
+		"/file/@nope/a.jpg":    http.StatusNotFound,
+	} {
+		if w := get(target); w.Code != want {
+			t.Fatalf("GET %s: expect %d, got %d", target, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package gallery
+
+import (
+	"errors"
+	"log"
+
+	"gallery/common/storage"
+	"gallery/config"
+	"gallery/core"
+)
+
+// Stats summarizes the library as recorded in the cache.
+type Stats struct {
+	Directories       int `json:"directories"`
+	Albums            int `json:"albums"`
+	Images            int `json:"images"`
+	Videos            int `json:"videos"`
+	VideosWithoutMeta int `json:"videos_without_meta"`
+	Tags              int `json:"tags"`
+}
+
+// maintenance is the headless counterpart of Init, used by the maintenance commands.
+// It holds the cache database exclusively, so it cannot run next to a server on the same cache.
+type maintenance struct {
+	originFs storage.Storage
+	cacheFs  storage.Storage
+	gallery  *Gallery
+}
+
+func openMaintenance(conf config.GalleryConfig) (*maintenance, error) {
+	originFs := storage.NewFs(conf.Resource.Base)
+	cacheFs := storage.NewFs(conf.Cache)
+	cache := core.NewCacheManager(cacheFs, conf.Resource.TagBlacklist)
+	if !cache.Persistent() {
+		cache.Close()
+		return nil, errors.New("cache db unavailable, is a server running on this cache?")
+	}
+	scanner := core.NewScanner(originFs, conf.Resource.Exclude, cache, conf.Resource.VirtualPath, nil)
+	scanner.SetFilter(scanFilter(conf.Resource))
+	return &maintenance{
+		originFs: originFs,
+		cacheFs:  cacheFs,
+		gallery: &Gallery{
+			Root:    &core.TraverseNode{Directories: make(map[string]*core.TraverseNode)},
+			scanner: scanner,
+			events:  newEventHub(),
+		},
+	}, nil
+}
+
+func (m *maintenance) Close() {
+	_ = m.gallery.scanner.Cache.Close()
+}
+
+// restore rebuilds the tree from the cache without touching the library.
+func (m *maintenance) restore() {
+	if _, err := m.gallery.scanner.Restore(m.gallery.Root); err != nil {
+		log.Printf("Cache restore failed: %v", err)
+	}
+}
+
+func (m *maintenance) stats() Stats {
+	root := m.gallery.Root
+	stats := Stats{
+		Directories: countDirectories(root),
+		Albums:      len(root.Album()),
+		Images:      len(root.Image()),
+		Tags:        len(m.gallery.GetAllTags(m.gallery.Root)),
+	}
+	for _, video := range root.Video() {
+		stats.Videos++
+		if meta, ok := m.gallery.scanner.Cache.GetVideoMeta(video.Path); !ok || meta.Width <= 0 || meta.Height <= 0 {
+			stats.VideosWithoutMeta++
+		}
+	}
+	return stats
+}
+
+func countDirectories(node *core.TraverseNode) int {
+	count := 0
+	for _, sub := range node.Directories {
+		count += 1 + countDirectories(sub)
+	}
+	return count
+}
+
+// ScanLibrary runs one full scan headless, persists it and returns the resulting stats.
+func ScanLibrary(conf config.GalleryConfig) (Stats, error) {
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer m.Close()
+	m.restore()
+	m.gallery.scanner.Scan(m.gallery.Root)
+	return m.stats(), nil
+}
+
+// LibraryStats reports the library as the cache last recorded it, without scanning.
+func LibraryStats(conf config.GalleryConfig) (Stats, error) {
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer m.Close()
+	m.restore()
+	return m.stats(), nil
+}
+
+// VerifyCache checks the cache against the library; see core.CacheManager.Verify.
+func VerifyCache(conf config.GalleryConfig) (core.CacheReport, error) {
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return core.CacheReport{}, err
+	}
+	defer m.Close()
+	return m.gallery.scanner.Cache.Verify(m.originFs.Exist)
+}
+
+// PruneCache drops cache entries and renditions of media that left the library.
+func PruneCache(conf config.GalleryConfig) (core.CacheReport, error) {
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return core.CacheReport{}, err
+	}
+	defer m.Close()
+	return m.gallery.scanner.Cache.Prune(m.originFs.Exist)
+}
+
+// ImportTags replaces the tags of the paths listed in data (the .img-tag.json layout).
+// They show up once the server restores or rescans the library.
+func ImportTags(conf config.GalleryConfig, data []byte) (int, error) {
+	m, err := openMaintenance(conf)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	return m.gallery.scanner.Cache.ImportTags(data)
+}
@@ -0,0 +1,72 @@
+package gallery
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+// MarkRequest changes the favorite flag or rating of an item; fields left out are kept.
+type MarkRequest struct {
+	Favorite *bool `json:"favorite"`
+	Rating   *int  `json:"rating"`
+}
+
+// MarkResponse is the mark of an item after a change.
+type MarkResponse struct {
+	Path string `json:"path"`
+	core.Mark
+}
+
+// HandleSetMark godoc
+// @Summary Favorite or rate an item
+// @Description Sets the favorite flag and the 0-5 star rating of an image or video. Marks are kept in the cache directory, survive rescans and show up as favorite/rating on the item; the Favorites folder at the root lists every favorite
+// @Tags media
+// @Accept json
+// @Produce json
+// @Param name path string true "Image or video path"
+// @Param mark body MarkRequest true "Fields to change"
+// @Success 200 {object} MarkResponse
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/marks/{name} [put]
+func (g *Gallery) HandleSetMark(c *gin.Context) {
+	name := CleanUrlPath(c.Param("name"))
+	var req MarkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var mark core.Mark
+	if img, ok := g.Root.FindImage(name); ok {
+		mark = img.Mark
+	} else if vid, ok := g.Root.FindVideo(name); ok {
+		mark = vid.Mark
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such image or video"})
+		return
+	}
+	if req.Favorite != nil {
+		mark.Favorite = *req.Favorite
+	}
+	if req.Rating != nil {
+		mark.Rating = *req.Rating
+	}
+	if err := mark.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := g.scanner.Cache.SetMark(name, mark); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	g.Root.SetMark(name, mark)
+	// Rebuild Favorites, smart albums and virtual folders, which hold copies of the item.
+	select {
+	case g.albumsChanged <- struct{}{}:
+	default:
+	}
+	c.JSON(200, MarkResponse{Path: name, Mark: mark})
+}
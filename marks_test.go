@@ -0,0 +1,74 @@
+package gallery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+func TestMarks_SetFilterAndSort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	writeTestJPEG(t, filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "x", "b.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	for target, body := range map[string]string{
+		"/api/marks/x/a.jpg": `{"rating":3}`,
+		"/api/marks/x/b.jpg": `{"favorite":true,"rating":5}`,
+	} {
+		if w := do(http.MethodPut, target, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status %d %s", target, w.Code, w.Body)
+		}
+	}
+	var mark MarkResponse
+	if err := json.Unmarshal(do(http.MethodPut, "/api/marks/x/a.jpg", `{"favorite":true}`).Body.Bytes(), &mark); err != nil {
+		t.Fatal(err)
+	}
+	if mark.Path != "x/a.jpg" || !mark.Favorite || mark.Rating != 3 {
+		t.Fatalf("expected the rating kept, got %+v", mark)
+	}
+	if w := do(http.MethodPut, "/api/marks/x/a.jpg", `{"rating":6}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid rating rejected, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/marks/x/none.jpg", `{"favorite":true}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown item rejected, got %d", w.Code)
+	}
+
+	// Marks are read again by the enricher, so a rescan keeps them.
+	l.gallery.scanner.Scan(l.gallery.Root)
+	var media struct {
+		Images []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/media/x?q=rating>=3&sort=-rating", "").Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Images) != 2 || media.Images[0].Path != "x/b.jpg" || media.Images[1].Rating != 3 {
+		t.Fatalf("expected both images, best first, got %+v", media.Images)
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/explore/Favorites", "").Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Images) != 2 || media.Images[0].Path != "x/b.jpg" {
+		t.Fatalf("expected the favorites folder ordered by rating, got %+v", media.Images)
+	}
+	if w := do(http.MethodGet, "/api/image/x?sort=size", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown sort rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,197 @@
+package gallery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+const (
+	previewSegmentCount = 5
+	previewSegmentSec   = 0.8
+	previewWidth        = 480
+	previewFps          = 15
+)
+
+type previewGenerator struct {
+	originFs          storage.Storage
+	cacheFs           storage.Storage
+	getVideoMeta      func(path string) (core.VideoMeta, bool)
+	toolchain         core.MediaToolchain
+	runPreviewAttempt func(ctx context.Context, source string, args []string) error
+}
+
+func newPreviewGenerator(originFs storage.Storage, cacheFs storage.Storage, getVideoMeta func(path string) (core.VideoMeta, bool)) *previewGenerator {
+	pg := &previewGenerator{originFs: originFs, cacheFs: cacheFs, getVideoMeta: getVideoMeta, toolchain: core.DefaultToolchain()}
+	pg.runPreviewAttempt = pg.defaultRunPreviewAttempt
+	return pg
+}
+
+func previewCachePath(videoPath string) string {
+	return videoPath + ".preview.mp4"
+}
+
+func (pg *previewGenerator) Generate(ctx context.Context, source string) error {
+	if pg == nil || pg.originFs == nil || pg.cacheFs == nil {
+		return fmt.Errorf("preview generator not configured")
+	}
+	if source == "" || !storage.IsValidVideo(source) {
+		return nil
+	}
+
+	cachePath := previewCachePath(source)
+	if pg.cacheFs.Exist(cachePath) {
+		return nil
+	}
+
+	durationSec, err := pg.getDurationSec(source)
+	if err != nil {
+		return err
+	}
+	offsets, segmentSec, ok := calcPreviewSegments(durationSec)
+	if !ok {
+		return fmt.Errorf("preview generate failed: %s, invalid duration: %.3f", source, durationSec)
+	}
+
+	// ffmpeg writes to a temporary name first so a half-written clip is never served as ready.
+	tmpPath := cachePath + ".tmp.mp4"
+	inputPath := pg.originFs.Join(pg.originFs.GetPath(), source)
+	outputPath := pg.cacheFs.Join(pg.cacheFs.GetPath(), tmpPath)
+	if err := storage.SafetyCreateDirectoryByFileName(outputPath); err != nil {
+		return fmt.Errorf("preview cache mkdir failed: %s, err: %w", outputPath, err)
+	}
+
+	runner := pg.runPreviewAttempt
+	if runner == nil {
+		runner = pg.defaultRunPreviewAttempt
+	}
+	if err := runner(ctx, source, buildPreviewArgs(inputPath, outputPath, offsets, segmentSec)); err != nil {
+		_ = os.Remove(outputPath)
+		return err
+	}
+	return pg.cacheFs.Rename(tmpPath, cachePath)
+}
+
+func (pg *previewGenerator) defaultRunPreviewAttempt(ctx context.Context, source string, args []string) error {
+	if err := pg.toolchain.Transcode(ctx, args); err != nil {
+		return fmt.Errorf("preview generate failed: %s, err: %w", source, err)
+	}
+	return nil
+}
+
+func (pg *previewGenerator) getDurationSec(source string) (float64, error) {
+	if pg.getVideoMeta != nil {
+		if meta, ok := pg.getVideoMeta(source); ok {
+			if meta.DurationSec > 0 {
+				return meta.DurationSec, nil
+			}
+		}
+	}
+	inputPath := pg.originFs.Join(pg.originFs.GetPath(), source)
+	meta, err := pg.toolchain.Probe(context.Background(), inputPath)
+	if err != nil {
+		return 0, fmt.Errorf("preview duration probe failed: %s, err: %w", source, err)
+	}
+	durationSec := meta.DurationSec
+	if durationSec <= 0 {
+		return 0, fmt.Errorf("preview duration probe failed: %s, invalid duration", source)
+	}
+	return durationSec, nil
+}
+
+// calcPreviewSegments spreads previewSegmentCount short segments evenly across the video.
+// Videos shorter than the whole clip are used as a single segment from the start.
+func calcPreviewSegments(durationSec float64) ([]float64, float64, bool) {
+	if durationSec <= 0 {
+		return nil, 0, false
+	}
+	clipSec := previewSegmentCount * previewSegmentSec
+	if durationSec <= clipSec {
+		return []float64{0}, durationSec, true
+	}
+	offsets := make([]float64, 0, previewSegmentCount)
+	for i := 0; i < previewSegmentCount; i++ {
+		offset := durationSec*float64(i+1)/float64(previewSegmentCount+1) - previewSegmentSec/2
+		if offset < 0 {
+			offset = 0
+		}
+		if offset > durationSec-previewSegmentSec {
+			offset = durationSec - previewSegmentSec
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets, previewSegmentSec, true
+}
+
+func buildPreviewArgs(inputPath string, outputPath string, offsets []float64, segmentSec float64) []string {
+	args := make([]string, 0, len(offsets)*6+20)
+	for _, offset := range offsets {
+		args = append(args, "-ss", formatPosterOffsetSec(offset), "-t", formatPosterOffsetSec(segmentSec), "-i", inputPath)
+	}
+	filter := strings.Builder{}
+	for i := range offsets {
+		fmt.Fprintf(&filter, "[%d:v]scale=%d:-2,setsar=1,fps=%d[v%d];", i, previewWidth, previewFps, i)
+	}
+	for i := range offsets {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	filter.WriteString("concat=n=" + strconv.Itoa(len(offsets)) + ":v=1:a=0[out]")
+	return append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[out]",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "32",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y", outputPath,
+	)
+}
+
+// HandlePreview serves the hover preview clip of a video.
+// Like HandlePoster it never blocks on ffmpeg: a missing clip is enqueued and
+// reported via X-Preview-Status: pending.
+func (sir *StaticImageResolver) HandlePreview(c *gin.Context) {
+	source := CleanUrlPath(c.Param("name"))
+	if !storage.IsValidVideo(source) || !sir.knownVideo(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if file, err := sir.CacheFs.Open(previewCachePath(source)); err == nil {
+		defer file.Close()
+		info, statErr := file.Stat()
+		if statErr == nil {
+			c.Header("X-Preview-Status", "ready")
+			c.Header("Content-Type", "video/mp4")
+			http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+			return
+		}
+		log.Printf("preview stat failed: %s, err: %v", source, statErr)
+	} else if !os.IsNotExist(err) {
+		log.Printf("preview open failed: %s, err: %v", source, err)
+	}
+
+	if !sir.Toolchain.Capabilities().Transcode {
+		c.Header("X-Preview-Status", "unavailable")
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if sir.PreviewQueue != nil {
+		sir.PreviewQueue.Enqueue(source)
+	}
+	c.Header("X-Preview-Status", "pending")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusAccepted)
+}
@@ -0,0 +1,135 @@
+package gallery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func TestCalcPreviewSegments(t *testing.T) {
+	if _, _, ok := calcPreviewSegments(0); ok {
+		t.Fatalf("expect invalid duration to fail")
+	}
+
+	offsets, segmentSec, ok := calcPreviewSegments(3)
+	if !ok || len(offsets) != 1 || offsets[0] != 0 || segmentSec != 3 {
+		t.Fatalf("expect single full segment for short video, got %v %.3f %v", offsets, segmentSec, ok)
+	}
+
+	offsets, segmentSec, ok = calcPreviewSegments(600)
+	if !ok {
+		t.Fatalf("expect ok")
+	}
+	if len(offsets) != previewSegmentCount || segmentSec != previewSegmentSec {
+		t.Fatalf("expect %d segments of %.3f, got %v %.3f", previewSegmentCount, previewSegmentSec, offsets, segmentSec)
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] <= offsets[i-1] {
+			t.Fatalf("expect increasing offsets, got %v", offsets)
+		}
+	}
+	if last := offsets[len(offsets)-1]; last+segmentSec > 600 {
+		t.Fatalf("last segment exceeds duration: %.3f", last)
+	}
+}
+
+func TestPreviewArgs(t *testing.T) {
+	offsets := []float64{10, 20}
+	args := buildPreviewArgs("/input/video.mp4", "/output/preview.mp4", offsets, previewSegmentSec)
+	assertArgPair(t, args, "-ss", formatPosterOffsetSec(10))
+	assertArgPair(t, args, "-ss", formatPosterOffsetSec(20))
+	assertArgPair(t, args, "-t", formatPosterOffsetSec(previewSegmentSec))
+	assertArgPair(t, args, "-map", "[out]")
+	if !hasArg(args, "-an") {
+		t.Fatalf("preview should be muted")
+	}
+}
+
+func TestPreviewGenerateUsesCachedDuration(t *testing.T) {
+	originFs := storage.NewFs(t.TempDir())
+	cacheFs := storage.NewFs(t.TempDir())
+
+	pg := newPreviewGenerator(originFs, cacheFs, func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{DurationSec: 120}, true
+	})
+	var gotArgs []string
+	pg.runPreviewAttempt = func(ctx context.Context, source string, args []string) error {
+		gotArgs = args
+		return os.WriteFile(args[len(args)-1], []byte("clip"), 0o644)
+	}
+
+	if err := pg.Generate(context.Background(), "video.mp4"); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !cacheFs.Exist(previewCachePath("video.mp4")) {
+		t.Fatalf("expect preview cached")
+	}
+	offsets, _, _ := calcPreviewSegments(120)
+	assertArgPair(t, gotArgs, "-ss", formatPosterOffsetSec(offsets[0]))
+}
+
+func TestPreviewHandler_PendingThenReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cacheDir := t.TempDir()
+	resolver := NewStaticImageResolver(storage.NewFs(t.TempDir()), storage.NewFs(cacheDir), nil, context.Background())
+	queue := &mockPosterQueue{}
+	resolver.PreviewQueue = queue
+	resolver.Toolchain = core.NewFakeToolchain()
+	resolver.findVideo = func(path string) (core.VideoNode, bool) {
+		return core.VideoNode{}, path == "videos/clip.mp4"
+	}
+
+	r := gin.New()
+	r.GET("/preview/*name", resolver.HandlePreview)
+
+	for _, target := range []string{"/preview/videos/other.mp4", "/preview/../outside/clip.mp4", "/preview/videos/../../clip.mp4"} {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if resp.Code != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404 for a video not in the tree, got %d", target, resp.Code)
+		}
+	}
+	if queue.Count() != 0 {
+		t.Fatalf("expected nothing queued for unknown videos, got %v", queue.items)
+	}
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/preview/videos/clip.mp4", nil))
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", resp.Code)
+	}
+	if got := resp.Header().Get("X-Preview-Status"); got != "pending" {
+		t.Fatalf("expected pending status header, got %q", got)
+	}
+	if queue.Count() != 1 || queue.items[0] != "videos/clip.mp4" {
+		t.Fatalf("expected enqueue videos/clip.mp4, got %v", queue.items)
+	}
+
+	clipPath := filepath.Join(cacheDir, "videos", "clip.mp4.preview.mp4")
+	if err := os.MkdirAll(filepath.Dir(clipPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(clipPath, []byte("clip"), 0o644); err != nil {
+		t.Fatalf("write clip: %v", err)
+	}
+
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/preview/videos/clip.mp4", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+	if got := resp.Header().Get("X-Preview-Status"); got != "ready" {
+		t.Fatalf("expected ready status header, got %q", got)
+	}
+	if resp.Body.String() != "clip" {
+		t.Fatalf("expected clip body, got %q", resp.Body.String())
+	}
+}
@@ -0,0 +1,212 @@
+package gallery
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gallery/config"
+	"gallery/core"
+)
+
+// scanRules are the scanner settings a config reload can change.
+type scanRules struct {
+	filter       core.ScanFilter
+	virtualPaths map[string][]string
+	rescan       bool
+}
+
+// setScanRules hands new rules to the scan worker, so they never change in the middle of a scan.
+// Rules not picked up yet are replaced; a pending rescan is kept.
+func (g *Gallery) setScanRules(rules scanRules) {
+	g.rulesMu.Lock()
+	if g.pendingRules != nil && g.pendingRules.rescan {
+		rules.rescan = true
+	}
+	g.pendingRules = &rules
+	g.rulesMu.Unlock()
+	select {
+	case g.rulesChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (g *Gallery) applyPendingRules() {
+	g.rulesMu.Lock()
+	rules := g.pendingRules
+	g.pendingRules = nil
+	g.rulesMu.Unlock()
+	if rules == nil {
+		return
+	}
+	g.scanner.SetRules(rules.filter, rules.virtualPaths)
+	if rules.rescan {
+		// Newly excluded paths disappear and newly included ones show up only with a full scan.
+		g.rescan()
+		return
+	}
+	g.scanner.ApplyVirtualPaths(g.Root)
+}
+
+// ConfigReloader applies a changed GalleryConfig to a running server. Only auth and the
+// exclude, include, max_file_size, virtual_path, smart_albums, tag_blacklist and
+// force_thumbnail of each library are applied live; changes to anything else, including
+// adding or removing libraries, need a restart.
+type ConfigReloader struct {
+	mu        sync.Mutex
+	current   config.GalleryConfig
+	libraries *libraries
+}
+
+// Reload validates next and applies what changed compared to the running config.
+// An invalid config is rejected as a whole and the running one stays in effect.
+func (r *ConfigReloader) Reload(next config.GalleryConfig) error {
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("config rejected: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.current
+
+	var applied []string
+	restart := restartOnlyChanges(prev, next)
+	if !reflect.DeepEqual(prev.Auth, next.Auth) && r.libraries.auth != nil {
+		r.libraries.auth.setConfig(next.Auth)
+		applied = append(applied, "auth")
+	}
+	nextLibs := next.LibraryList()
+	for i, prevLib := range prev.LibraryList() {
+		l := r.libraries.byName[prevLib.Name]
+		if i >= len(nextLibs) || nextLibs[i].Name != prevLib.Name || l == nil {
+			continue
+		}
+		key, cacheKey := "resource.", "cache"
+		if len(prev.Libraries) > 0 {
+			key = "libraries." + prevLib.Name + "."
+			cacheKey = key + "cache"
+		}
+		nextLib := nextLibs[i]
+		for _, field := range l.reload(prevLib, nextLib) {
+			applied = append(applied, key+field)
+		}
+		prevView, nextView := prev.ForLibrary(prevLib), next.ForLibrary(nextLib)
+		if prevView.Resource.Base != nextView.Resource.Base {
+			restart = append(restart, key+"base")
+		}
+		if prevView.Cache != nextView.Cache {
+			restart = append(restart, cacheKey)
+		}
+	}
+
+	if len(restart) > 0 {
+		log.Printf("Config changes need a restart and are ignored: %s", strings.Join(restart, ", "))
+	}
+	if len(applied) > 0 {
+		log.Printf("Config reloaded: %s", strings.Join(applied, ", "))
+	}
+	r.current = withLiveFields(prev, next)
+	return nil
+}
+
+// reload applies the live fields of one library and returns the names of those that changed.
+func (l *library) reload(prev, next config.LibraryConfig) []string {
+	var applied []string
+	if !reflect.DeepEqual(prev.TagBlacklist, next.TagBlacklist) {
+		l.gallery.scanner.Cache.SetTagBlacklist(next.TagBlacklist)
+		applied = append(applied, "tag_blacklist")
+	}
+	if !reflect.DeepEqual(prev.ForceThumbnail, next.ForceThumbnail) {
+		l.resolver.SetForceThumbnail(next.ForceThumbnail)
+		applied = append(applied, "force_thumbnail")
+	}
+	if !reflect.DeepEqual(prev.SmartAlbums, next.SmartAlbums) {
+		l.gallery.setConfigAlbums(smartAlbums(next.SmartAlbums))
+		applied = append(applied, "smart_albums")
+	}
+	var filterChanged []string
+	if !reflect.DeepEqual(prev.Exclude, next.Exclude) {
+		filterChanged = append(filterChanged, "exclude")
+	}
+	if !reflect.DeepEqual(prev.Include, next.Include) {
+		filterChanged = append(filterChanged, "include")
+	}
+	if prev.MaxFileSize != next.MaxFileSize {
+		filterChanged = append(filterChanged, "max_file_size")
+	}
+	virtualChanged := !reflect.DeepEqual(prev.VirtualPath, next.VirtualPath)
+	if len(filterChanged) > 0 || virtualChanged {
+		l.gallery.setScanRules(scanRules{
+			filter:       scanFilter(next.Resource()),
+			virtualPaths: next.VirtualPath,
+			rescan:       len(filterChanged) > 0,
+		})
+		applied = append(applied, filterChanged...)
+		if virtualChanged {
+			applied = append(applied, "virtual_path")
+		}
+	}
+	return applied
+}
+
+// withLiveFields is prev with the live fields of next applied. Restart-only fields keep their
+// running values, so they are reported again until the server restarts.
+func withLiveFields(prev, next config.GalleryConfig) config.GalleryConfig {
+	reloaded := prev
+	reloaded.Auth = next.Auth
+	reloaded.Resource.Exclude = next.Resource.Exclude
+	reloaded.Resource.Include = next.Resource.Include
+	reloaded.Resource.MaxFileSize = next.Resource.MaxFileSize
+	reloaded.Resource.VirtualPath = next.Resource.VirtualPath
+	reloaded.Resource.SmartAlbums = next.Resource.SmartAlbums
+	reloaded.Resource.TagBlacklist = next.Resource.TagBlacklist
+	reloaded.Resource.ForceThumbnail = next.Resource.ForceThumbnail
+	reloaded.Libraries = append([]config.LibraryConfig(nil), prev.Libraries...)
+	for i := range reloaded.Libraries {
+		if i >= len(next.Libraries) || next.Libraries[i].Name != reloaded.Libraries[i].Name {
+			continue
+		}
+		lib := &reloaded.Libraries[i]
+		lib.Exclude = next.Libraries[i].Exclude
+		lib.Include = next.Libraries[i].Include
+		lib.MaxFileSize = next.Libraries[i].MaxFileSize
+		lib.VirtualPath = next.Libraries[i].VirtualPath
+		lib.SmartAlbums = next.Libraries[i].SmartAlbums
+		lib.TagBlacklist = next.Libraries[i].TagBlacklist
+		lib.ForceThumbnail = next.Libraries[i].ForceThumbnail
+	}
+	return reloaded
+}
+
+func restartOnlyChanges(prev, next config.GalleryConfig) []string {
+	var changed []string
+	if prev.Port != next.Port {
+		changed = append(changed, "port")
+	}
+	if prev.ThumbnailProcessor != next.ThumbnailProcessor {
+		changed = append(changed, "thumbnail_processor")
+	}
+	if prev.Transcode != next.Transcode {
+		changed = append(changed, "transcode")
+	}
+	if prev.Poster != next.Poster {
+		changed = append(changed, "poster")
+	}
+	if prev.Files != next.Files {
+		changed = append(changed, "files")
+	}
+	prevNames, nextNames := libraryNames(prev), libraryNames(next)
+	if !reflect.DeepEqual(prevNames, nextNames) {
+		changed = append(changed, fmt.Sprintf("libraries (%s -> %s)", strings.Join(prevNames, ","), strings.Join(nextNames, ",")))
+	}
+	return changed
+}
+
+func libraryNames(conf config.GalleryConfig) []string {
+	var names []string
+	for _, lib := range conf.LibraryList() {
+		names = append(names, lib.Name)
+	}
+	return names
+}
@@ -0,0 +1,112 @@
+package gallery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"gallery/common/storage"
+	"gallery/config"
+	"gallery/core"
+)
+
+func TestConfigReloader_AppliesLiveFields(t *testing.T) {
+	originDir := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		writeTestJPEG(t, filepath.Join(originDir, dir, "x.jpg"))
+	}
+	// No scan worker: pending rules are applied synchronously below.
+	cache := core.NewCacheManager(storage.NewFs(t.TempDir()), nil)
+	t.Cleanup(func() { cache.Close() })
+	g := &Gallery{
+		Root:         &core.TraverseNode{Directories: make(map[string]*core.TraverseNode)},
+		scanner:      core.NewScanner(storage.NewFs(originDir), nil, cache, nil, nil),
+		rulesChanged: make(chan struct{}, 1),
+	}
+	g.scanner.Toolchain = core.NewFakeToolchain()
+	g.scanner.Scan(g.Root)
+	sir := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(t.TempDir()), nil, context.Background())
+	reloader := &ConfigReloader{libraries: singleLibrary(g, sir)}
+
+	next := config.GalleryConfig{Resource: config.ResourceConfig{
+		TagBlacklist:   []string{"nsfw"},
+		ForceThumbnail: []string{"a"},
+		VirtualPath:    map[string][]string{"both": {"a", "b"}},
+	}}
+	if err := reloader.Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !g.scanner.Cache.IsTagBlacklisted("nsfw") {
+		t.Fatalf("expect tag blacklist swapped")
+	}
+	if !sir.isForceThumbnail("a/x.jpg") || sir.isForceThumbnail("b/x.jpg") {
+		t.Fatalf("expect force_thumbnail swapped")
+	}
+	g.applyPendingRules()
+	if both := g.Root.Directories["both"]; both == nil || len(both.Images) != 2 {
+		t.Fatalf("expect virtual path merged, got %+v", both)
+	}
+
+	next.Resource.VirtualPath = nil
+	next.Resource.Exclude = []string{"b"}
+	if err := reloader.Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	g.applyPendingRules()
+	if g.Root.Directories["both"] != nil || g.Root.Directories["b"] != nil || g.Root.Directories["a"] == nil {
+		t.Fatalf("expect virtual path dropped and b excluded, got %v", g.Root.Directories)
+	}
+}
+
+func TestConfigReloader_RejectsInvalidConfig(t *testing.T) {
+	g, _, _ := newTestGallery(t)
+	sir := NewStaticImageResolver(storage.NewFs(t.TempDir()), storage.NewFs(t.TempDir()), nil, context.Background())
+	reloader := &ConfigReloader{libraries: singleLibrary(g, sir)}
+
+	next := config.GalleryConfig{Resource: config.ResourceConfig{
+		Exclude:      []string{"[unterminated"},
+		TagBlacklist: []string{"nsfw"},
+	}}
+	if err := reloader.Reload(next); err == nil {
+		t.Fatalf("expect invalid exclude pattern rejected")
+	}
+	if g.scanner.Cache.IsTagBlacklisted("nsfw") {
+		t.Fatalf("expect nothing applied from a rejected config")
+	}
+}
+
+func singleLibrary(g *Gallery, sir *StaticImageResolver) *libraries {
+	libs := new(libraries)
+	libs.add(&library{name: config.DefaultLibrary, gallery: g, resolver: sir})
+	return libs
+}
+
+func TestConfigReloader_AppliesPerLibrary(t *testing.T) {
+	photos, _, _ := newTestGallery(t)
+	videos, _, _ := newTestGallery(t)
+	libs := new(libraries)
+	for name, g := range map[string]*Gallery{"photos": photos, "videos": videos} {
+		sir := NewStaticImageResolver(storage.NewFs(t.TempDir()), storage.NewFs(t.TempDir()), nil, context.Background())
+		libs.add(&library{name: name, gallery: g, resolver: sir})
+	}
+	prev := config.GalleryConfig{Libraries: []config.LibraryConfig{
+		{Name: "photos", Base: "/p"},
+		{Name: "videos", Base: "/v"},
+	}}
+	reloader := &ConfigReloader{current: prev, libraries: libs}
+
+	next := prev
+	next.Libraries = []config.LibraryConfig{
+		{Name: "photos", Base: "/p", TagBlacklist: []string{"nsfw"}},
+		{Name: "videos", Base: "/v"},
+	}
+	if err := reloader.Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !photos.scanner.Cache.IsTagBlacklisted("nsfw") || videos.scanner.Cache.IsTagBlacklisted("nsfw") {
+		t.Fatalf("expect tag blacklist applied to photos only")
+	}
+	if got := reloader.current.Libraries[0].TagBlacklist; len(got) != 1 {
+		t.Fatalf("expect running config updated, got %v", got)
+	}
+}
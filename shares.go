@@ -0,0 +1,625 @@
+package gallery
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// SharesFile holds the share links of a library and the key signing them, inside the cache
+// directory.
+const SharesFile = "shares.json"
+
+// DefaultShareLifetime is the lifetime of a share link created without expires_in.
+const DefaultShareLifetime = 7 * 24 * time.Hour
+
+const shareUnlockCookie = "gallery_share"
+
+// Share gives people without an account access to one folder or item until it expires.
+type Share struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	Dir        bool   `json:"dir"`
+	Expires    int64  `json:"expires"` // Unix seconds
+	NoDownload bool   `json:"no_download,omitempty"`
+	Password   string `json:"password,omitempty"` // bcrypt hash
+	Created    int64  `json:"created"`
+	CreatedBy  string `json:"created_by,omitempty"`
+}
+
+func (s Share) expired(now time.Time) bool {
+	return now.Unix() >= s.Expires
+}
+
+// root is the folder share paths are relative to: the shared folder, or the folder of the
+// shared item.
+func (s Share) root() string {
+	if s.Dir {
+		return s.Path
+	}
+	return strings.Trim(path.Dir(s.Path), ".")
+}
+
+// contains reports whether p, a library path, is shared.
+func (s Share) contains(p string) bool {
+	if !s.Dir {
+		return p == s.Path
+	}
+	return s.Path == "" || strings.HasPrefix(p, s.Path+"/")
+}
+
+// sharesFile is the content of SharesFile.
+type sharesFile struct {
+	Key    string  `json:"key"`
+	Shares []Share `json:"shares"`
+}
+
+var errUnknownShare = errors.New("unknown or expired share")
+
+// shareStore keeps the share links of a library. Tokens are the share ID signed with the
+// key of the library, so they cannot be guessed from the ID and stop working when the key
+// or the share changes.
+type shareStore struct {
+	mu      sync.Mutex
+	cacheFs storage.Storage
+	key     []byte
+	shares  []Share
+}
+
+func newShareStore(cacheFs storage.Storage) *shareStore {
+	store := &shareStore{cacheFs: cacheFs}
+	var file sharesFile
+	if err := readJSONFile(cacheFs, SharesFile, &file); err != nil {
+		log.Printf("Failed to read %s: %v", SharesFile, err)
+	}
+	store.key, _ = hex.DecodeString(file.Key)
+	store.shares = file.Shares
+	return store
+}
+
+// tokenOf returns the URL token of s.
+func (st *shareStore) tokenOf(s Share) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.token(s)
+}
+
+func (st *shareStore) token(s Share) string {
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte(s.ID + "\x00" + s.Path + "\x00" + time.Unix(s.Expires, 0).UTC().Format(time.RFC3339)))
+	return s.ID + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// lookup returns the share of a valid, unexpired token.
+func (st *shareStore) lookup(token string) (Share, bool) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return Share{}, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.shares, func(s Share) bool { return s.ID == id })
+	if i < 0 || len(st.key) == 0 {
+		return Share{}, false
+	}
+	s := st.shares[i]
+	if !hmac.Equal([]byte(st.token(s)), []byte(token)) || s.expired(time.Now()) {
+		return Share{}, false
+	}
+	return s, true
+}
+
+// unlocked is the value of the cookie proving the password of s was given.
+func (st *shareStore) unlocked(s Share) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte("unlock\x00" + s.ID + "\x00" + s.Password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (st *shareStore) list() []Share {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.shares)
+}
+
+// create saves s with a new ID. Shares expired for more than a day are dropped on the way.
+func (st *shareStore) create(s Share) (Share, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := st.key
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return Share{}, err
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Share{}, err
+	}
+	s.ID = hex.EncodeToString(id)
+	s.Created = time.Now().Unix()
+	cutoff := time.Now().Add(-24 * time.Hour)
+	shares := slices.DeleteFunc(slices.Clone(st.shares), func(old Share) bool { return old.expired(cutoff) })
+	if err := st.persist(key, append(shares, s)); err != nil {
+		return Share{}, err
+	}
+	return s, nil
+}
+
+func (st *shareStore) remove(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.shares, func(s Share) bool { return s.ID == id })
+	if i < 0 {
+		return errUnknownShare
+	}
+	return st.persist(st.key, slices.Delete(slices.Clone(st.shares), i, i+1))
+}
+
+func (st *shareStore) persist(key []byte, shares []Share) error {
+	if err := writeJSONFile(st.cacheFs, SharesFile, sharesFile{Key: hex.EncodeToString(key), Shares: shares}); err != nil {
+		return err
+	}
+	st.key, st.shares = key, shares
+	return nil
+}
+
+// ShareRequest creates a share link.
+type ShareRequest struct {
+	Path       string `json:"path"`
+	ExpiresIn  int64  `json:"expires_in"` // seconds, default DefaultShareLifetime
+	NoDownload bool   `json:"no_download"`
+	Password   string `json:"password"`
+}
+
+// ShareInfo describes a share link; Token and URL are what to send out.
+type ShareInfo struct {
+	ID         string `json:"id"`
+	Library    string `json:"library"`
+	Path       string `json:"path"`
+	Dir        bool   `json:"dir"`
+	Token      string `json:"token"`
+	URL        string `json:"url"`
+	Expires    int64  `json:"expires"`
+	Expired    bool   `json:"expired"`
+	NoDownload bool   `json:"no_download"`
+	Protected  bool   `json:"protected"`
+	Created    int64  `json:"created"`
+	CreatedBy  string `json:"created_by,omitempty"`
+}
+
+func (l *library) shareInfo(s Share) ShareInfo {
+	token := l.gallery.shares.tokenOf(s)
+	return ShareInfo{
+		ID:         s.ID,
+		Library:    l.name,
+		Path:       s.Path,
+		Dir:        s.Dir,
+		Token:      token,
+		URL:        "/s/" + token + "/",
+		Expires:    s.Expires,
+		Expired:    s.expired(time.Now()),
+		NoDownload: s.NoDownload,
+		Protected:  s.Password != "",
+		Created:    s.Created,
+		CreatedBy:  s.CreatedBy,
+	}
+}
+
+// adminOnly answers 403 to users who are not admins.
+func adminOnly(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).isAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			return
+		}
+		next(c)
+	}
+}
+
+// HandleCreateShare godoc
+// @Summary Create a share link
+// @Description Creates a signed link giving people without an account access to a folder or a single image or video until it expires, optionally behind a password or without downloads of the originals
+// @Tags shares
+// @Accept json
+// @Produce json
+// @Param share body ShareRequest true "Path, lifetime in seconds, password and no_download"
+// @Success 201 {object} ShareInfo
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/shares [post]
+func (ls *libraries) HandleCreateShare(c *gin.Context) {
+	var req ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	l := ls.current(c)
+	g := l.gallery
+	p := strings.Trim(path.Clean("/"+req.Path), "/")
+	u := currentUser(c)
+	s := Share{Path: p, NoDownload: req.NoDownload}
+	if u != nil {
+		s.CreatedBy = u.name
+	}
+	if _, ok := g.Root.FindImage(p); !ok {
+		if _, ok := g.Root.FindVideo(p); !ok {
+			s.Dir = true
+		}
+	}
+	if s.Dir && p != "" {
+		if info, err := statFile(g.scanner.OriginFs, p); err != nil || !info.IsDir() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": p + " is not a folder, image or video of the library"})
+			return
+		}
+	}
+	// Users see their share through their own rules, so they may only share what they see.
+	if (!s.Dir && !u.canRead(p)) || (s.Dir && u.restricted() && len(g.view(c).Locate(p).Image())+len(g.view(c).Locate(p).Video()) == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": p + " is not a folder, image or video of the library"})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+	lifetime := DefaultShareLifetime
+	if req.ExpiresIn > 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+	}
+	s.Expires = time.Now().Add(lifetime).Unix()
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		s.Password = string(hash)
+	}
+	s, err := g.shares.create(s)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, l.shareInfo(s))
+}
+
+// HandleShares godoc
+// @Summary List share links
+// @Description Returns the share links of the library, including expired ones not cleaned up yet; admins only
+// @Tags shares
+// @Produce json
+// @Success 200 {array} ShareInfo
+// @Router /api/shares [get]
+func (ls *libraries) HandleShares(c *gin.Context) {
+	l := ls.current(c)
+	shares := l.gallery.shares.list()
+	result := make([]ShareInfo, 0, len(shares))
+	for _, s := range shares {
+		result = append(result, l.shareInfo(s))
+	}
+	c.JSON(200, result)
+}
+
+// HandleRevokeShare godoc
+// @Summary Revoke a share link
+// @Description Deletes a share link; its token stops working at once. Admins only
+// @Tags shares
+// @Param id path string true "Share ID"
+// @Success 204
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/shares/{id} [delete]
+func (ls *libraries) HandleRevokeShare(c *gin.Context) {
+	if err := ls.current(c).gallery.shares.remove(c.Param("id")); err != nil {
+		if errors.Is(err, errUnknownShare) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// sharedRequest is a request under /s/{token}/.
+type sharedRequest struct {
+	library *library
+	share   Share
+	creator *user
+}
+
+const sharedContextKey = "gallery.share"
+
+// visible reports whether p, a library path, may be seen through the share: it must be
+// shared and still readable by whoever created the share.
+func (sr *sharedRequest) visible(p string) bool {
+	return sr.share.contains(p) && sr.creator.canRead(p)
+}
+
+// resolve turns a path relative to the share into a library path.
+func (sr *sharedRequest) resolve(name string) string {
+	return strings.Trim(path.Join(sr.share.root(), path.Clean("/"+name)), "/")
+}
+
+// relative turns a library path into a path relative to the share.
+func (sr *sharedRequest) relative(p string) string {
+	if root := sr.share.root(); root != "" {
+		return strings.TrimPrefix(p, root+"/")
+	}
+	return p
+}
+
+// inLibrary reports whether p is an image or video of the library tree. Together with
+// visible, this is whether p is in view.
+func (sr *sharedRequest) inLibrary(p string) bool {
+	root := sr.library.gallery.Root
+	if _, ok := root.FindImage(p); ok {
+		return true
+	}
+	_, ok := root.FindVideo(p)
+	return ok
+}
+
+// view returns the visible part of the shared folder.
+func (sr *sharedRequest) view() *core.TraverseNode {
+	node := sr.library.gallery.Root.Lookup(sr.share.root())
+	if node == nil {
+		return &core.TraverseNode{Directories: make(map[string]*core.TraverseNode)}
+	}
+	return node.Prune(sr.visible)
+}
+
+// shared finds the share of the token and checks its password, then calls next.
+func (ls *libraries) shared(next func(sr *sharedRequest, c *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sr, ok := ls.lookupShare(c.Param("token"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errUnknownShare.Error()})
+			return
+		}
+		c.Set(sharedContextKey, sr)
+		if sr.share.Password != "" && !strings.HasSuffix(c.FullPath(), "/unlock") && c.FullPath() != "/s/:token" {
+			cookie, err := c.Cookie(shareUnlockCookie)
+			if err != nil || !hmac.Equal([]byte(cookie), []byte(sr.library.gallery.shares.unlocked(sr.share))) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "password required"})
+				return
+			}
+		}
+		next(sr, c)
+	}
+}
+
+func (ls *libraries) lookupShare(token string) (*sharedRequest, bool) {
+	for _, l := range ls.list {
+		if l.gallery.shares == nil {
+			continue
+		}
+		s, ok := l.gallery.shares.lookup(token)
+		if !ok {
+			continue
+		}
+		creator, ok := ls.auth.lookup(s.CreatedBy)
+		if !ok {
+			// Shares end with the account that created them.
+			return nil, false
+		}
+		return &sharedRequest{library: l, share: s, creator: creator}, true
+	}
+	return nil, false
+}
+
+// registerShares adds the share management API and the public /s/{token}/ routes.
+func (ls *libraries) registerShares(s *gin.Engine) {
+	for _, api := range []*gin.RouterGroup{s.Group("/api"), s.Group("/api/:lib", ls.selectLibrary)} {
+		api.POST("/shares", ls.HandleCreateShare)
+		api.GET("/shares", adminOnly(ls.HandleShares))
+		api.DELETE("/shares/:id", adminOnly(ls.HandleRevokeShare))
+	}
+	shared := s.Group("/s/:token")
+	shared.GET("", ls.shared(handleShareInfo))
+	shared.POST("/unlock", ls.shared(handleShareUnlock))
+	shared.GET("/api/explore/*name", ls.shared(handleShareExplore))
+	shared.GET("/api/media/*name", ls.shared(handleShareMedia))
+	shared.GET("/file/*name", ls.shared(handleShareFile))
+	shared.GET("/thumbnail/*name", ls.shared(handleShareThumbnail))
+	shared.GET("/video/*name", ls.shared(handleShareFile))
+	shared.GET("/poster/*name", ls.shared(handleSharePoster))
+}
+
+// SharedInfo describes a share to its visitors.
+type SharedInfo struct {
+	Name       string `json:"name"`
+	Dir        bool   `json:"dir"`
+	Expires    int64  `json:"expires"`
+	NoDownload bool   `json:"no_download"`
+	Protected  bool   `json:"protected"`
+}
+
+// handleShareInfo godoc
+// @Summary Describe a share link
+// @Description Public. Returns the name of the shared folder or item and whether a password is needed; browse it through /s/{token}/api/explore and /s/{token}/api/media with paths relative to the share
+// @Tags shares
+// @Produce json
+// @Param token path string true "Share token"
+// @Success 200 {object} SharedInfo
+// @Failure 404 {object} map[string]interface{}
+// @Router /s/{token} [get]
+func handleShareInfo(sr *sharedRequest, c *gin.Context) {
+	c.JSON(200, SharedInfo{
+		Name:       path.Base("/" + sr.share.Path),
+		Dir:        sr.share.Dir,
+		Expires:    sr.share.Expires,
+		NoDownload: sr.share.NoDownload,
+		Protected:  sr.share.Password != "",
+	})
+}
+
+// handleShareUnlock godoc
+// @Summary Unlock a share link
+// @Description Public. Checks the password of a protected share and sets a cookie valid for the share until it expires
+// @Tags shares
+// @Accept json
+// @Param token path string true "Share token"
+// @Param password body object true "{\"password\": \"...\"}"
+// @Success 204
+// @Failure 401 {object} map[string]interface{}
+// @Router /s/{token}/unlock [post]
+func handleShareUnlock(sr *sharedRequest, c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if sr.share.Password != "" && bcrypt.CompareHashAndPassword([]byte(sr.share.Password), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong password"})
+		return
+	}
+	maxAge := int(time.Until(time.Unix(sr.share.Expires, 0)).Seconds())
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(shareUnlockCookie, sr.library.gallery.shares.unlocked(sr.share), maxAge, "/s/"+c.Param("token"), "", c.Request.TLS != nil, true)
+	c.Status(http.StatusNoContent)
+}
+
+// handleShareExplore godoc
+// @Summary Explore a shared folder
+// @Description Public. /api/explore limited to the share; paths are relative to the shared folder
+// @Tags shares
+// @Produce json
+// @Param token path string true "Share token"
+// @Param name path string true "Directory path inside the share"
+// @Success 200 {object} core.SimpleDirectory
+// @Router /s/{token}/api/explore/{name} [get]
+func handleShareExplore(sr *sharedRequest, c *gin.Context) {
+	g := sr.library.gallery
+	result := sr.view().Locate(CleanUrlPath(c.Param("name"))).Explore()
+	directories := make([]core.DirNode, 0, len(result.Directories))
+	for _, dir := range result.Directories {
+		cover := dir.Cover
+		g.fillCoverVideoMeta(&cover)
+		cover.Path = sr.relative(cover.Path)
+		dir.Path = sr.relative(dir.Path)
+		dir.Cover = cover
+		directories = append(directories, dir)
+	}
+	others := make([]core.Node, 0, len(result.Others))
+	for _, other := range result.Others {
+		other.Path = sr.relative(other.Path)
+		others = append(others, other)
+	}
+	images, videos := sr.relativeMedia(result.Images, g.fillVideoMetas(result.Videos))
+	c.JSON(200, gin.H{
+		"directories": directories,
+		"images":      images,
+		"videos":      videos,
+		"others":      others,
+	})
+}
+
+// handleShareMedia godoc
+// @Summary List the media of a shared folder
+// @Description Public. /api/media limited to the share; paths are relative to the shared folder
+// @Tags shares
+// @Produce json
+// @Param token path string true "Share token"
+// @Param name path string true "Directory path inside the share"
+// @Success 200 {object} core.MediaResponse
+// @Router /s/{token}/api/media/{name} [get]
+func handleShareMedia(sr *sharedRequest, c *gin.Context) {
+	node := sr.view().Locate(CleanUrlPath(c.Param("name")))
+	images, videos := sr.relativeMedia(node.Image(), sr.library.gallery.fillVideoMetas(node.Video()))
+	c.JSON(200, gin.H{
+		"images": images,
+		"videos": videos,
+	})
+}
+
+func (sr *sharedRequest) relativeMedia(images []core.ImageNode, videos []core.VideoNode) ([]core.ImageNode, []core.VideoNode) {
+	relImages := make([]core.ImageNode, 0, len(images))
+	for _, img := range images {
+		img.Path = sr.relative(img.Path)
+		relImages = append(relImages, img)
+	}
+	relVideos := make([]core.VideoNode, 0, len(videos))
+	for _, vid := range videos {
+		vid.Path = sr.relative(vid.Path)
+		relVideos = append(relVideos, vid)
+	}
+	return relImages, relVideos
+}
+
+// sharedFile returns the library path of a file request, or answers 404. Only images and
+// videos of the library tree are served, as listed by view: excluded files and trashed
+// ones are on disk but not in the tree.
+func sharedFile(sr *sharedRequest, c *gin.Context) (string, bool) {
+	p := sr.resolve(c.Param("name"))
+	if !sr.visible(p) || !sr.inLibrary(p) {
+		c.Status(http.StatusNotFound)
+		return "", false
+	}
+	return p, true
+}
+
+// handleShareFile serves originals, or for a no-download share image thumbnails, once they
+// are generated, and no videos.
+func handleShareFile(sr *sharedRequest, c *gin.Context) {
+	p, ok := sharedFile(sr, c)
+	if !ok {
+		return
+	}
+	sir := sr.library.resolver
+	switch {
+	case storage.IsValidPic(p) && sr.share.NoDownload:
+		c.FileFromFS(p, sir.CachedThumbs)
+	case storage.IsValidPic(p):
+		c.FileFromFS(p, sir.OriginAdapter)
+	case storage.IsValidVideo(p) && !sr.share.NoDownload:
+		c.FileFromFS(p, sir.VideoAdapter)
+	default:
+		c.Status(http.StatusNotFound)
+	}
+}
+
+// handleShareThumbnail serves thumbnails. A no-download share answers 404 until the
+// thumbnail is generated rather than falling back to the original.
+func handleShareThumbnail(sr *sharedRequest, c *gin.Context) {
+	p, ok := sharedFile(sr, c)
+	if !ok {
+		return
+	}
+	if sr.share.NoDownload {
+		c.FileFromFS(p, sr.library.resolver.CachedThumbs)
+		return
+	}
+	c.FileFromFS(p, sr.library.resolver.ThumbAdapter)
+}
+
+func handleSharePoster(sr *sharedRequest, c *gin.Context) {
+	p, ok := sharedFile(sr, c)
+	if !ok {
+		return
+	}
+	for i := range c.Params {
+		if c.Params[i].Key == "name" {
+			c.Params[i].Value = "/" + p
+		}
+	}
+	sr.library.resolver.HandlePoster(c)
+}
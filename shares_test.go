@@ -0,0 +1,151 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func TestShares_FolderAndItemLinks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	writeTestJPEG(t, filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "x", "sub", "c.jpg"))
+	writeTestJPEG(t, filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "y", "b.jpg"))
+	l.gallery.scanner.Scan(l.gallery.Root)
+	// On disk but not in the tree, like excluded or trashed files.
+	writeTestJPEG(t, filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "x", "unlisted.jpg"))
+	l.gallery.shares = newShareStore(storage.NewFs(t.TempDir()))
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	do := func(method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	create := func(body string) ShareInfo {
+		t.Helper()
+		w := do(http.MethodPost, "/api/shares", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %s: status %d %s", body, w.Code, w.Body)
+		}
+		var info ShareInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	folder := create(`{"path":"x","password":"open sesame","no_download":true}`)
+	if !folder.Dir || !folder.Protected || folder.URL != "/s/"+folder.Token+"/" {
+		t.Fatalf("unexpected share %+v", folder)
+	}
+	base := "/s/" + folder.Token
+	var info SharedInfo
+	if err := json.Unmarshal(do(http.MethodGet, base, "").Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "x" || !info.Protected {
+		t.Fatalf("unexpected share info %+v", info)
+	}
+	if w := do(http.MethodGet, base+"/api/explore/", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the password required, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, base+"/unlock", `{"password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong password rejected, got %d", w.Code)
+	}
+	w := do(http.MethodPost, base+"/unlock", `{"password":"open sesame"}`)
+	if w.Code != http.StatusNoContent || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("unlock: status %d", w.Code)
+	}
+	unlocked := w.Result().Cookies()[0]
+
+	var explore struct {
+		Directories []core.DirNode   `json:"directories"`
+		Images      []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, base+"/api/explore/", "", unlocked).Body.Bytes(), &explore); err != nil {
+		t.Fatal(err)
+	}
+	if len(explore.Images) != 1 || explore.Images[0].Path != "a.jpg" || len(explore.Directories) != 1 || explore.Directories[0].Path != "sub" {
+		t.Fatalf("expected paths relative to the share, got %+v", explore)
+	}
+	// A no-download share never hands out the original, even while the thumbnail is missing.
+	for _, target := range []string{base + "/file/a.jpg", base + "/thumbnail/sub/c.jpg"} {
+		if w := do(http.MethodGet, target, "", unlocked); w.Code != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404 before the thumbnail exists, got %d", target, w.Code)
+		}
+	}
+	thumbnail := func(target, source string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			w := do(http.MethodGet, target, "", unlocked)
+			if w.Code == http.StatusOK {
+				cached, err := l.resolver.CacheFs.Read(source)
+				if err != nil || !bytes.Equal(w.Body.Bytes(), cached) {
+					t.Fatalf("GET %s: expected the cached thumbnail, got %d bytes (%v)", target, w.Body.Len(), err)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("GET %s: thumbnail not generated, last status %d", target, w.Code)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	thumbnail(base+"/file/a.jpg", "x/a.jpg")
+	thumbnail(base+"/thumbnail/sub/c.jpg", "x/sub/c.jpg")
+	for _, target := range []string{base + "/file/unlisted.jpg", base + "/thumbnail/unlisted.jpg", base + "/file/../y/b.jpg", base + "/file/%2e%2e/y/b.jpg", "/s/" + folder.ID + ".00/api/explore/"} {
+		if w := do(http.MethodGet, target, "", unlocked); w.Code != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404, got %d", target, w.Code)
+		}
+	}
+
+	item := create(`{"path":"y/b.jpg","expires_in":60}`)
+	var media struct {
+		Images []core.ImageNode `json:"images"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/s/"+item.Token+"/api/media/", "").Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if item.Dir || len(media.Images) != 1 || media.Images[0].Path != "b.jpg" {
+		t.Fatalf("expected only the shared item, got %+v", media.Images)
+	}
+	if w := do(http.MethodGet, "/s/"+item.Token+"/file/b.jpg", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected the original served, got %d", w.Code)
+	}
+
+	var shares []ShareInfo
+	if err := json.Unmarshal(do(http.MethodGet, "/api/shares", "").Body.Bytes(), &shares); err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 2 {
+		t.Fatalf("expected two shares, got %+v", shares)
+	}
+	if w := do(http.MethodDelete, "/api/shares/"+folder.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", w.Code)
+	}
+	if w := do(http.MethodGet, base+"/api/explore/", "", unlocked); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a revoked share gone, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/shares", `{"path":"nope"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown path rejected, got %d", w.Code)
+	}
+}
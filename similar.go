@@ -0,0 +1,164 @@
+package gallery
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+// Limits of /api/similar.
+const (
+	DefaultSimilarLimit = 20
+	MaxSimilarLimit     = 100
+)
+
+// similarRadii are the Hamming distances a similarity search widens through until it has
+// enough candidates; beyond the last one images have little in common.
+var similarRadii = []int{6, 10, 14, 18, 22}
+
+// similarIndexTTL is how long a built index is used while hashes keep changing, such as
+// during the first scan of a library.
+const similarIndexTTL = 30 * time.Second
+
+// SimilarImage is an image like the one asked about. Distance is the Hamming distance of the
+// difference hashes; Score mixes it with the colour distance, 0 for identical pictures.
+type SimilarImage struct {
+	core.ImageNode
+	Distance int     `json:"distance"`
+	Score    float64 `json:"score"`
+}
+
+type similarEntry struct {
+	path   string
+	hash   uint64
+	colors core.ColorSignature
+}
+
+// similarIndex keeps the difference hashes of the library in a BK-tree. It is rebuilt from
+// the hash cache on demand, at most once per similarIndexTTL while the hashes change.
+type similarIndex struct {
+	mu      sync.Mutex
+	version uint64
+	built   time.Time
+	tree    *core.HashTree
+	entries []similarEntry
+}
+
+// current returns the tree and its entries, rebuilding them first when the cache changed.
+func (x *similarIndex) current(cache *core.CacheManager) (*core.HashTree, []similarEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	stale := x.tree == nil || (cache.ImageHashesVersion() != x.version && time.Since(x.built) > similarIndexTTL)
+	if !stale {
+		return x.tree, x.entries
+	}
+	var entries []similarEntry
+	version := cache.EachImageHash(func(p string, hash core.ImageHash) {
+		h, ok := hash.Perceptual()
+		if !ok || core.IsTrashed(p) {
+			return
+		}
+		colors, _ := hash.ColorSignature()
+		entries = append(entries, similarEntry{path: p, hash: h, colors: colors})
+	})
+	tree := new(core.HashTree)
+	for i, entry := range entries {
+		tree.Add(entry.hash, i)
+	}
+	x.tree, x.entries, x.version, x.built = tree, entries, version, time.Now()
+	return tree, entries
+}
+
+// HandleSimilar godoc
+// @Summary Find visually similar images
+// @Description Returns up to limit images that look like the given one, most similar first. Candidates come from an in-memory BK-tree over the difference hashes computed by the scan, searched within a widening Hamming radius, and are ranked by hash distance and colour layout. Images added in the last 30 seconds may be missing
+// @Tags images
+// @Produce json
+// @Param name path string true "Image path"
+// @Param limit query int false "Number of images, 1-100 (default 20)"
+// @Success 200 {array} SimilarImage
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/similar/{name} [get]
+func (g *Gallery) HandleSimilar(c *gin.Context) {
+	name := CleanUrlPath(c.Param("name"))
+	limit := DefaultSimilarLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MaxSimilarLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(MaxSimilarLimit)})
+			return
+		}
+		limit = n
+	}
+	if _, ok := g.Root.FindImage(name); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such image"})
+		return
+	}
+	hash, _ := g.scanner.Cache.GetImageHash(name)
+	query, ok := hash.Perceptual()
+	if !ok {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "image not hashed yet"})
+		return
+	}
+	colors, _ := hash.ColorSignature()
+	u := currentUser(c)
+	result := g.similar(name, query, colors, limit, func(p string) (core.ImageNode, bool) {
+		if !u.canRead(p) {
+			return core.ImageNode{}, false
+		}
+		return g.Root.FindImage(p)
+	})
+	c.JSON(200, result)
+}
+
+// similar returns the limit images closest to query, looked up through find, which drops
+// images that are gone or hidden from the user.
+func (g *Gallery) similar(self string, query uint64, colors core.ColorSignature, limit int, find func(string) (core.ImageNode, bool)) []SimilarImage {
+	tree, entries := g.similarIndex.current(g.scanner.Cache)
+	type candidate struct {
+		id       int
+		distance int
+		score    float64
+	}
+	var candidates []candidate
+	for _, radius := range similarRadii {
+		candidates = candidates[:0]
+		tree.Search(query, radius, func(id, distance int) {
+			if entries[id].path == self {
+				return
+			}
+			// The shape of the picture counts most; colours tell apart images of equal shape.
+			score := 0.75*float64(distance)/64 + 0.25*colors.Distance(entries[id].colors)
+			candidates = append(candidates, candidate{id: id, distance: distance, score: score})
+		})
+		// Some candidates may be gone or hidden, so look for more than asked.
+		if len(candidates) >= 2*limit {
+			break
+		}
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.score, b.score), cmp.Compare(entries[a.id].path, entries[b.id].path))
+	})
+
+	result := make([]SimilarImage, 0, limit)
+	for _, cand := range candidates {
+		if len(result) == limit {
+			break
+		}
+		img, ok := find(entries[cand.id].path)
+		if !ok {
+			continue
+		}
+		result = append(result, SimilarImage{ImageNode: img, Distance: cand.distance, Score: cand.score})
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package gallery
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+
+	"gallery/core"
+)
+
+func TestSimilar_RanksByHashAndColour(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	base := l.gallery.scanner.OriginFs.GetPath()
+	pattern := core.PatternImage(180, 120)
+	for name, img := range map[string]image.Image{
+		"p/big.jpg":    pattern,
+		"p/small.jpg":  imaging.Resize(pattern, 90, 60, imaging.Lanczos),
+		"p/bright.jpg": imaging.AdjustBrightness(pattern, 15),
+		"q/other.jpg":  imaging.FlipH(pattern),
+	} {
+		if err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := imaging.Save(img, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.gallery.scanner.Scan(l.gallery.Root)
+	libs := new(libraries)
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	var similar []SimilarImage
+	w := get("/api/similar/p/big.jpg?limit=2")
+	if err := json.Unmarshal(w.Body.Bytes(), &similar); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("similar: status %d %s", w.Code, w.Body)
+	}
+	if len(similar) != 2 || similar[0].Path != "p/small.jpg" || similar[1].Path != "p/bright.jpg" {
+		t.Fatalf("expected the resized then the brightened copy, got %+v", similar)
+	}
+	if similar[0].Width != 90 || similar[0].Score > similar[1].Score {
+		t.Fatalf("expected image nodes ranked by score, got %+v", similar)
+	}
+
+	if err := json.Unmarshal(get("/api/similar/p/big.jpg").Body.Bytes(), &similar); err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range similar {
+		if img.Path == "p/big.jpg" {
+			t.Fatalf("expected the image itself left out, got %+v", similar)
+		}
+	}
+	for target, status := range map[string]int{
+		"/api/similar/p/nope.jpg":        http.StatusNotFound,
+		"/api/similar/p/big.jpg?limit=0": http.StatusBadRequest,
+	} {
+		if w := get(target); w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", target, status, w.Code)
+		}
+	}
+}
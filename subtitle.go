@@ -0,0 +1,136 @@
+package gallery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// HandleSubtitle godoc
+// @Summary Get a subtitle track as WebVTT
+// @Description Serves a sidecar (.srt/.ass/.ssa/.vtt) or embedded text subtitle of a video converted to WebVTT. Track ids are listed in the video's subtitles field; an embedded stream not listed there answers 404.
+// @Tags media
+// @Produce text/vtt
+// @Param name path string true "Video path"
+// @Param track query string true "Subtitle track id"
+// @Success 200 {string} string
+// @Router /subtitle/{name} [get]
+func (sir *StaticImageResolver) HandleSubtitle(c *gin.Context) {
+	source := CleanUrlPath(c.Param("name"))
+	track := c.Query("track")
+	if !storage.IsValidVideo(source) || track == "" || !sir.knownVideo(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	var vtt []byte
+	var err error
+	if index, ok := core.ParseEmbeddedSubtitleID(track); ok {
+		// Only streams the probe listed as text subtitles may be mapped.
+		if !sir.hasEmbeddedSubtitle(source, index) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		vtt, err = sir.convertSubtitle(c.Request.Context(), source, track, []string{
+			"-i", sir.OriginFs.Join(sir.OriginFs.GetPath(), source), "-map", fmt.Sprintf("0:%d", index),
+		})
+	} else if subtitlePath, ok := core.SidecarSubtitlePath(source, track); ok {
+		vtt, err = sir.sidecarSubtitle(c.Request.Context(), source, track, subtitlePath)
+	} else {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, core.ErrToolUnavailable) {
+			c.Status(http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("subtitle convert failed: %s, track: %s, err: %v", source, track, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", vtt)
+}
+
+// hasEmbeddedSubtitle reports whether stream index is one of the embedded text subtitles of source.
+func (sir *StaticImageResolver) hasEmbeddedSubtitle(source string, index int) bool {
+	if sir.getVideoMeta == nil {
+		return false
+	}
+	meta, ok := sir.getVideoMeta(source)
+	if !ok {
+		return false
+	}
+	for _, subtitle := range core.EmbeddedSubtitles(meta) {
+		if subtitle.ID == core.EmbeddedSubtitleID(index) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sir *StaticImageResolver) sidecarSubtitle(ctx context.Context, source string, track string, subtitlePath string) ([]byte, error) {
+	switch storage.GetExt(subtitlePath) {
+	case "vtt":
+		return sir.OriginFs.Read(subtitlePath)
+	case "srt":
+		srt, err := sir.OriginFs.Read(subtitlePath)
+		if err != nil {
+			return nil, err
+		}
+		return core.SrtToVtt(srt), nil
+	default:
+		if !sir.OriginFs.Exist(subtitlePath) {
+			return nil, os.ErrNotExist
+		}
+		return sir.convertSubtitle(ctx, source, track, []string{
+			"-i", sir.OriginFs.Join(sir.OriginFs.GetPath(), subtitlePath),
+		})
+	}
+}
+
+// convertSubtitle runs ffmpeg with inputArgs to produce WebVTT, caching the result per track.
+func (sir *StaticImageResolver) convertSubtitle(ctx context.Context, source string, track string, inputArgs []string) ([]byte, error) {
+	cachePath := core.SubtitleCachePath(source, track)
+	if vtt, err := sir.CacheFs.Read(cachePath); err == nil {
+		return vtt, nil
+	}
+
+	tmpPath := cachePath + ".tmp"
+	outputPath := sir.CacheFs.Join(sir.CacheFs.GetPath(), tmpPath)
+	if err := storage.SafetyCreateDirectoryByFileName(outputPath); err != nil {
+		return nil, fmt.Errorf("subtitle cache mkdir failed: %s, err: %w", outputPath, err)
+	}
+	args := append(append([]string{}, inputArgs...), "-f", "webvtt", "-y", outputPath)
+	runner := sir.runSubtitleConvert
+	if runner == nil {
+		runner = sir.defaultRunSubtitleConvert
+	}
+	if err := runner(ctx, source, args); err != nil {
+		_ = os.Remove(outputPath)
+		return nil, err
+	}
+	if err := sir.CacheFs.Rename(tmpPath, cachePath); err != nil {
+		return nil, err
+	}
+	return sir.CacheFs.Read(cachePath)
+}
+
+func (sir *StaticImageResolver) defaultRunSubtitleConvert(ctx context.Context, source string, args []string) error {
+	if err := sir.Toolchain.Transcode(ctx, args); err != nil {
+		return fmt.Errorf("subtitle convert failed: %s, err: %w", source, err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gallery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func TestSubtitleHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	base := t.TempDir()
+	originDir := filepath.Join(base, "library")
+	files := map[string]string{
+		"library/movie.mkv":    "video",
+		"library/movie.en.srt": "1\n00:00:01,000 --> 00:00:02,000\nHi\n",
+		"outside/v.mp4":        "video",
+		"outside/v.srt":        "1\n00:00:01,000 --> 00:00:02,000\nSecret\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(base, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	resolver := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(t.TempDir()), nil, context.Background())
+	resolver.findVideo = func(path string) (core.VideoNode, bool) {
+		return core.VideoNode{}, path == "movie.mkv"
+	}
+	resolver.getVideoMeta = func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{SubtitleTracks: []core.MediaTrack{
+			{Index: 2, Codec: "subrip", Language: "eng"},
+			{Index: 3, Codec: "hdmv_pgs_subtitle"},
+		}}, path == "movie.mkv"
+	}
+	var runs int
+	resolver.runSubtitleConvert = func(ctx context.Context, source string, args []string) error {
+		runs++
+		assertArgPair(t, args, "-map", "0:2")
+		return os.WriteFile(args[len(args)-1], []byte("WEBVTT\n\nembedded\n"), 0o644)
+	}
+
+	r := gin.New()
+	r.GET("/subtitle/*name", resolver.HandleSubtitle)
+	get := func(url string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, url, nil))
+		return resp
+	}
+
+	resp := get("/subtitle/movie.mkv?track=movie.en.srt")
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "00:00:01.000 --> 00:00:02.000") {
+		t.Fatalf("unexpected sidecar response %d: %q", resp.Code, resp.Body.String())
+	}
+	if got := resp.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/vtt") {
+		t.Fatalf("unexpected content type %q", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp = get("/subtitle/movie.mkv?track=stream:2")
+		if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "embedded") {
+			t.Fatalf("unexpected embedded response %d: %q", resp.Code, resp.Body.String())
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("expect embedded conversion cached, got %d runs", runs)
+	}
+
+	for _, track := range []string{"stream:0", "stream:3", "stream:9"} {
+		if resp = get("/subtitle/movie.mkv?track=" + track); resp.Code != http.StatusNotFound {
+			t.Fatalf("expect 404 for unlisted %s, got %d", track, resp.Code)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("expect no conversion for unlisted streams, got %d runs", runs)
+	}
+
+	for _, target := range []string{"/subtitle/../outside/v.mp4?track=v.srt", "/subtitle/movie.mkv/../../outside/v.mp4?track=v.srt"} {
+		if resp = get(target); resp.Code != http.StatusNotFound {
+			t.Fatalf("expect 404 for a video outside the library, got %d for %s", resp.Code, target)
+		}
+	}
+	if resp = get("/subtitle/movie.mkv?track=../secret.srt"); resp.Code != http.StatusNotFound {
+		t.Fatalf("expect 404 for foreign track, got %d", resp.Code)
+	}
+}
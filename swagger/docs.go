@@ -47,181 +47,386 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/explore/{name}": {
-            "get": {
-                "description": "Returns immediate contents of a directory (subdirectories, images, others)",
+        "/api/auth/login": {
+            "post": {
+                "description": "Checks the password of a local user and starts a session held by an HttpOnly cookie. Sessions are kept in memory and end after auth.session_timeout or a restart",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "browse"
+                    "auth"
                 ],
-                "summary": "Explore a directory",
+                "summary": "Log in",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Directory path",
-                        "name": "name",
-                        "in": "path",
-                        "required": true
+                        "description": "User name and password",
+                        "name": "login",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.LoginRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/core.SimpleDirectory"
+                            "$ref": "#/definitions/gallery.AuthInfo"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/image/{name}": {
+        "/api/auth/logout": {
+            "post": {
+                "description": "Ends the session of the cookie",
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Log out",
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/api/auth/me": {
             "get": {
-                "description": "Returns all images recursively under the specified directory",
+                "description": "Returns the auth mode and the user of the request with their permissions",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "images"
+                    "auth"
                 ],
-                "summary": "List all images under a directory",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Directory path",
-                        "name": "name",
-                        "in": "path",
-                        "required": true
+                "summary": "Current user",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.AuthInfo"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
                     }
+                }
+            }
+        },
+        "/api/collections": {
+            "get": {
+                "description": "Returns the user-curated collections with their cover and item count",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "collections"
                 ],
+                "summary": "List collections",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/core.ImageNode"
+                                "$ref": "#/definitions/gallery.CollectionInfo"
                             }
                         }
                     }
                 }
+            },
+            "post": {
+                "description": "Creates a collection of images and videos from anywhere in the library, kept in the cache directory",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "collections"
+                ],
+                "summary": "Create a collection",
+                "parameters": [
+                    {
+                        "description": "Title, description, cover and ordered item paths",
+                        "name": "collection",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.CollectionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.Collection"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
             }
         },
-        "/api/media/{name}": {
+        "/api/collections/{id}": {
             "get": {
-                "description": "Returns all images and videos under the specified directory",
+                "description": "Returns a collection with its items in order and the paths no longer found in the library",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "media"
+                    "collections"
                 ],
-                "summary": "List all media under a directory",
+                "summary": "Get a collection",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Directory path",
-                        "name": "name",
+                        "description": "Collection ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.CollectionDetail"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Deletes a collection; the media files are not touched",
+                "tags": [
+                    "collections"
+                ],
+                "summary": "Delete a collection",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Collection ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
                     },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Changes the title, description, cover or items of a collection; items replaces the whole list, which also reorders or removes items; items hidden from a restricted user keep their places",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "collections"
+                ],
+                "summary": "Change a collection",
+                "parameters": [
                     {
-                        "type": "boolean",
-                        "description": "Flatten search into subdirectories (default: true)",
-                        "name": "flat",
-                        "in": "query"
+                        "type": "string",
+                        "description": "Collection ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Fields to change",
+                        "name": "collection",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.CollectionRequest"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/core.MediaResponse"
+                            "$ref": "#/definitions/gallery.Collection"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/random/{name}": {
+        "/api/collections/{id}/explore": {
             "get": {
-                "description": "Returns a random image from the specified directory",
+                "description": "Returns the items of a collection in the response shape of /api/explore, in the collection order",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "images"
+                    "collections"
                 ],
-                "summary": "Get a random image",
+                "summary": "Explore a collection",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Directory path",
-                        "name": "name",
+                        "description": "Collection ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
-                    },
-                    {
-                        "type": "boolean",
-                        "description": "Flatten search into subdirectories (default: true)",
-                        "name": "flat",
-                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/core.NodeWithParent"
+                            "$ref": "#/definitions/core.SimpleDirectory"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/tag": {
-            "get": {
-                "description": "Returns tag statistics across all images",
+        "/api/collections/{id}/items": {
+            "post": {
+                "description": "Inserts media paths at position (default: the end); paths already in the collection are skipped",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "tags"
+                    "collections"
+                ],
+                "summary": "Add items to a collection",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Collection ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Paths and position",
+                        "name": "items",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.CollectionItemsRequest"
+                        }
+                    }
                 ],
-                "summary": "Get all tags",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/core.TagStat"
-                            }
+                            "$ref": "#/definitions/gallery.Collection"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
                         }
                     }
                 }
             }
         },
-        "/api/tree": {
+        "/api/collections/{id}/media": {
             "get": {
-                "description": "Returns the directory tree structure",
+                "description": "Returns the items of a collection in the response shape of /api/media, in the collection order",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "browse"
+                    "collections"
                 ],
-                "summary": "Get folder tree",
+                "summary": "List the media of a collection",
                 "parameters": [
                     {
-                        "type": "boolean",
-                        "description": "Include leaf nodes (default: true)",
-                        "name": "leaf",
-                        "in": "query"
+                        "type": "string",
+                        "description": "Collection ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.MediaResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "type": "object",
                             "additionalProperties": true
@@ -229,187 +434,2448 @@ const docTemplate = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "core.DirNode": {
-            "type": "object",
-            "properties": {
-                "cover": {
-                    "$ref": "#/definitions/core.ImageNode"
-                },
-                "directories": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/core.Node"
+        },
+        "/api/debug/exclude/{name}": {
+            "get": {
+                "description": "Reports whether scans skip a path and which exclude/include pattern, .galleryignore line or size limit decided it",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "debug"
+                ],
+                "summary": "Explain an exclusion",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Path relative to the library",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.Exclusion"
+                        }
                     }
-                },
-                "name": {
-                    "type": "string"
-                },
-                "path": {
-                    "type": "string"
                 }
             }
         },
-        "core.ImageNode": {
-            "type": "object",
-            "properties": {
-                "caption": {
-                    "type": "string"
+        "/api/download": {
+            "post": {
+                "description": "Streams the selected images, videos and folders as one ZIP. Files are named after the selected item: a selected folder becomes a folder of the archive. Paths that do not exist or the user may not see fail the request",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/zip"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Download a selection",
+                "parameters": [
+                    {
+                        "description": "Paths, rendition (original or thumbnail) and archive name",
+                        "name": "selection",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.DownloadRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/download/{name}": {
+            "get": {
+                "description": "Downloads an image or video as an attachment with Range support, or streams every image and video under a folder as a ZIP. Excluded files and files the user may not see are left out",
+                "produces": [
+                    "application/zip"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Download a file or folder",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "File or directory path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "original (default) or thumbnail; videos become their poster in thumbnail downloads, images without a generated thumbnail are left out",
+                        "name": "rendition",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "206": {
+                        "description": "Partial Content",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/duplicates": {
+            "get": {
+                "description": "Clusters byte-identical images (same SHA-256) and near duplicates whose difference hashes are within distance bits of each other. Near duplicates are linked transitively. Hashes are computed by the scan and cached; images not hashed yet are counted as unhashed",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "images"
+                ],
+                "summary": "Find duplicate images",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Hamming distance for near duplicates, 0-16 (default 4)",
+                        "name": "distance",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.DuplicatesResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/events": {
+            "get": {
+                "description": "Server-sent event stream. A \"video_meta\" event carries the updated video node once background probing finishes.",
+                "produces": [
+                    "text/event-stream"
+                ],
+                "tags": [
+                    "browse"
+                ],
+                "summary": "Subscribe to server events",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.Event"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/explore/{name}": {
+            "get": {
+                "description": "Returns immediate contents of a directory (subdirectories, images, others)",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "browse"
+                ],
+                "summary": "Explore a directory",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Directory path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images and videos matching this query, in the smart album syntax",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Order images and videos by path, name, date, width, height, duration or rating; prefix - to reverse",
+                        "name": "sort",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.SimpleDirectory"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/files/delete": {
+            "post": {
+                "description": "Moves images, videos and folders to the trash of the library, with their renditions and cached metadata, so they can be restored. Paths are deleted in order and the request stops at the first failure, reporting the entries created before it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Delete files and folders",
+                "parameters": [
+                    {
+                        "description": "Paths",
+                        "name": "delete",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.DeleteRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.TrashEntry"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/files/move": {
+            "post": {
+                "description": "Moves images, videos and folders into a folder, keeping their names, with everything that belongs to them as for a rename. Paths are moved in order and the request stops at the first failure, reporting the moves done before it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Move files and folders",
+                "parameters": [
+                    {
+                        "description": "Paths and target folder",
+                        "name": "move",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.MoveRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.FileChange"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/files/rename": {
+            "post": {
+                "description": "Renames an image, video or folder in place. Sidecar posters and subtitles, thumbnails and other renditions, cached tags, captions, marks and collection items follow, and the tree is updated right away. Images keep being images and videos keep being videos",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Rename a file or folder",
+                "parameters": [
+                    {
+                        "description": "Path and new name",
+                        "name": "rename",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.RenameRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.FileChange"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/image/{name}": {
+            "get": {
+                "description": "Returns all images recursively under the specified directory",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "images"
+                ],
+                "summary": "List all images under a directory",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Directory path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images matching this query, in the smart album syntax",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Order by path, name, date, width, height or rating; prefix - to reverse",
+                        "name": "sort",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/core.ImageNode"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/libraries": {
+            "get": {
+                "description": "Returns the libraries the user may see, with the number of images and videos visible to them; the default one also serves the routes without a library name",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "browse"
+                ],
+                "summary": "List libraries",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.LibraryInfo"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/marks/{name}": {
+            "put": {
+                "description": "Sets the favorite flag and the 0-5 star rating of an image or video. Marks are kept in the cache directory, survive rescans and show up as favorite/rating on the item; the Favorites folder at the root lists every favorite",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Favorite or rate an item",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Image or video path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Fields to change",
+                        "name": "mark",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.MarkRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.MarkResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/media/{name}": {
+            "get": {
+                "description": "Returns all images and videos under the specified directory",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "List all media under a directory",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Directory path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Flatten search into subdirectories (default: true)",
+                        "name": "flat",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only images and videos matching this query, in the smart album syntax",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Order by path, name, date, width, height, duration or rating; prefix - to reverse",
+                        "name": "sort",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.MediaResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/meta/{name}": {
+            "get": {
+                "description": "Returns probed metadata of a video: codecs, bitrate, frame rate, rotation-corrected size, HDR flag, audio and subtitle tracks",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Get video metadata",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Video path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.VideoMeta"
+                        }
+                    },
+                    "202": {
+                        "description": "Not probed yet; a video_meta event follows",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/playback/{name}": {
+            "get": {
+                "description": "Returns \"direct\" with the raw /video URL for browser-compatible codecs, otherwise \"hls\" with a transcoded playlist URL",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Get playback source of a video",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Video path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/poster/{name}": {
+            "post": {
+                "description": "Replaces the generated poster of a video with the frame at t seconds. A \u003cvideo\u003e.poster.jpg sidecar or folder cover still takes precedence when serving.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Regenerate a video poster at a timestamp",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Video path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "number",
+                        "description": "Timestamp in seconds",
+                        "name": "t",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/random/{name}": {
+            "get": {
+                "description": "Returns a random image from the specified directory",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "images"
+                ],
+                "summary": "Get a random image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Directory path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Flatten search into subdirectories (default: true)",
+                        "name": "flat",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.NodeWithParent"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/shares": {
+            "get": {
+                "description": "Returns the share links of the library, including expired ones not cleaned up yet; admins only",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "List share links",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.ShareInfo"
+                            }
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Creates a signed link giving people without an account access to a folder or a single image or video until it expires, optionally behind a password or without downloads of the originals",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "Create a share link",
+                "parameters": [
+                    {
+                        "description": "Path, lifetime in seconds, password and no_download",
+                        "name": "share",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.ShareRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.ShareInfo"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/shares/{id}": {
+            "delete": {
+                "description": "Deletes a share link; its token stops working at once. Admins only",
+                "tags": [
+                    "shares"
+                ],
+                "summary": "Revoke a share link",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Share ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/similar/{name}": {
+            "get": {
+                "description": "Returns up to limit images that look like the given one, most similar first. Candidates come from an in-memory BK-tree over the difference hashes computed by the scan, searched within a widening Hamming radius, and are ranked by hash distance and colour layout. Images added in the last 30 seconds may be missing",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "images"
+                ],
+                "summary": "Find visually similar images",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Image path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of images, 1-100 (default 20)",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.SimilarImage"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/smart-albums": {
+            "get": {
+                "description": "Returns the smart albums of the config file and those saved through the API, with the number of matches of the last evaluation",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "albums"
+                ],
+                "summary": "List smart albums",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.SmartAlbumInfo"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/smart-albums/{name}": {
+            "put": {
+                "description": "Saves a smart album in the cache directory and evaluates it; it is then browsable through /api/explore/{name} and /api/media/{name}",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "albums"
+                ],
+                "summary": "Create or replace a smart album",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Album name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Query, sort and limit",
+                        "name": "album",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/gallery.SmartAlbumRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.SmartAlbum"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Defined in the config file or named like a directory",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Deletes a smart album saved through the API",
+                "tags": [
+                    "albums"
+                ],
+                "summary": "Delete a smart album",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Album name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Defined in the config file",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/tag": {
+            "get": {
+                "description": "Returns tag statistics across all images",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "tags"
+                ],
+                "summary": "Get all tags",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/core.TagStat"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/trash": {
+            "get": {
+                "description": "Lists the deleted files and folders of the library, oldest first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "List the trash",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.TrashEntry"
+                            }
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Deletes every entry of the trash the user can see for good",
+                "tags": [
+                    "files"
+                ],
+                "summary": "Empty the trash",
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    }
+                }
+            }
+        },
+        "/api/trash/{id}": {
+            "delete": {
+                "description": "Removes a deleted file or folder from disk, with its renditions and cached metadata",
+                "tags": [
+                    "files"
+                ],
+                "summary": "Delete from the trash for good",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Trash entry ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/trash/{id}/restore": {
+            "post": {
+                "description": "Moves a deleted file or folder back to where it was, with its renditions and cached metadata. Missing parent folders are created; a file now taken the name fails the request",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Restore from the trash",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Trash entry ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.FileChange"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/tree": {
+            "get": {
+                "description": "Returns the directory tree structure",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "browse"
+                ],
+                "summary": "Get folder tree",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Include leaf nodes (default: true)",
+                        "name": "leaf",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/upload/{name}": {
+            "post": {
+                "description": "Stores the files of a multipart form into a folder and adds them to the tree right away. Every part named \"file\" is one upload; files are checked one by one and the request stops at the first rejected one, reporting the files stored before it",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Upload files",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Target folder",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "reject (default) answers 409 when a name is taken, rename stores the file as \\",
+                        "name": "conflict",
+                        "in": "query"
+                    },
+                    {
+                        "type": "file",
+                        "description": "Images and videos",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/gallery.UploadedFile"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/uploads": {
+            "post": {
+                "description": "Creates a tus 1.0 upload. Upload-Metadata carries filename, folder (default: the library root) and conflict (reject or rename). The name is checked now, so a taken name or a file type that is not accepted fails before any data is sent; the data follows with PATCH on the returned Location",
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Start a resumable upload",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Size of the file in bytes",
+                        "name": "Upload-Length",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "filename, folder and conflict, base64 encoded",
+                        "name": "Upload-Metadata",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/api/uploads/{id}": {
+            "delete": {
+                "description": "Drops a resumable upload and the data received so far",
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Cancel a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            },
+            "head": {
+                "description": "Reports in Upload-Offset how many bytes of a resumable upload the server has",
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Resumable upload progress",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            },
+            "patch": {
+                "description": "Appends the body at Upload-Offset, which must match the offset of the server. A connection cut midway keeps what arrived. The request completing the file places it in the folder and adds it to the tree; if the file is rejected then, the upload is gone and the error is returned",
+                "consumes": [
+                    "application/offset+octet-stream"
+                ],
+                "tags": [
+                    "upload"
+                ],
+                "summary": "Send data of a resumable upload",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Upload ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Offset the body starts at",
+                        "name": "Upload-Offset",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "423": {
+                        "description": "Locked"
+                    }
+                }
+            }
+        },
+        "/s/{token}": {
+            "get": {
+                "description": "Public. Returns the name of the shared folder or item and whether a password is needed; browse it through /s/{token}/api/explore and /s/{token}/api/media with paths relative to the share",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "Describe a share link",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Share token",
+                        "name": "token",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/gallery.SharedInfo"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/s/{token}/api/explore/{name}": {
+            "get": {
+                "description": "Public. /api/explore limited to the share; paths are relative to the shared folder",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "Explore a shared folder",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Share token",
+                        "name": "token",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Directory path inside the share",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.SimpleDirectory"
+                        }
+                    }
+                }
+            }
+        },
+        "/s/{token}/api/media/{name}": {
+            "get": {
+                "description": "Public. /api/media limited to the share; paths are relative to the shared folder",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "List the media of a shared folder",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Share token",
+                        "name": "token",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Directory path inside the share",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/core.MediaResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/s/{token}/unlock": {
+            "post": {
+                "description": "Public. Checks the password of a protected share and sets a cookie valid for the share until it expires",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "shares"
+                ],
+                "summary": "Unlock a share link",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Share token",
+                        "name": "token",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "{\\",
+                        "name": "password",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    }
+                }
+            }
+        },
+        "/subtitle/{name}": {
+            "get": {
+                "description": "Serves a sidecar (.srt/.ass/.ssa/.vtt) or embedded text subtitle of a video converted to WebVTT. Track ids are listed in the video's subtitles field; an embedded stream not listed there answers 404.",
+                "produces": [
+                    "text/vtt"
+                ],
+                "tags": [
+                    "media"
+                ],
+                "summary": "Get a subtitle track as WebVTT",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Video path",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Subtitle track id",
+                        "name": "track",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "core.DirNode": {
+            "type": "object",
+            "properties": {
+                "cover": {
+                    "$ref": "#/definitions/core.ImageNode"
+                },
+                "directories": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.Node"
+                    }
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.Exclusion": {
+            "type": "object",
+            "properties": {
+                "dir": {
+                    "description": "Dir is set when an ancestor directory was excluded, which hides everything below it.",
+                    "type": "string"
+                },
+                "excluded": {
+                    "type": "boolean"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "rule": {
+                    "description": "Rule and Source name the deciding pattern: the one that excluded the path, or the\nnegation that re-included it.",
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.ImageNode": {
+            "type": "object",
+            "properties": {
+                "caption": {
+                    "type": "string"
+                },
+                "favorite": {
+                    "type": "boolean"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "mtime": {
+                    "description": "Unix seconds",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "rating": {
+                    "description": "0 (unrated) to MaxRating",
+                    "type": "integer"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.TagInfo"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "core.MediaResponse": {
+            "type": "object",
+            "properties": {
+                "images": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.ImageNode"
+                    }
+                },
+                "videos": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.VideoNode"
+                    }
+                }
+            }
+        },
+        "core.MediaTrack": {
+            "type": "object",
+            "properties": {
+                "channels": {
+                    "type": "integer"
+                },
+                "codec": {
+                    "type": "string"
+                },
+                "default": {
+                    "type": "boolean"
+                },
+                "forced": {
+                    "type": "boolean"
+                },
+                "index": {
+                    "type": "integer"
+                },
+                "language": {
+                    "type": "string"
+                },
+                "title": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.Node": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.NodeWithParent": {
+            "type": "object",
+            "properties": {
+                "caption": {
+                    "type": "string"
+                },
+                "favorite": {
+                    "type": "boolean"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "mtime": {
+                    "description": "Unix seconds",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "parent": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "rating": {
+                    "description": "0 (unrated) to MaxRating",
+                    "type": "integer"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.TagInfo"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "core.SimpleDirectory": {
+            "type": "object",
+            "properties": {
+                "directories": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.DirNode"
+                    }
+                },
+                "images": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.ImageNode"
+                    }
+                },
+                "others": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.Node"
+                    }
+                },
+                "videos": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.VideoNode"
+                    }
+                }
+            }
+        },
+        "core.SmartAlbum": {
+            "type": "object",
+            "properties": {
+                "limit": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "query": {
+                    "type": "string"
+                },
+                "sort": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.SubtitleTrack": {
+            "type": "object",
+            "properties": {
+                "embedded": {
+                    "type": "boolean"
+                },
+                "format": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "label": {
+                    "type": "string"
+                },
+                "language": {
+                    "type": "string"
+                }
+            }
+        },
+        "core.TagInfo": {
+            "type": "object",
+            "properties": {
+                "tag": {
+                    "type": "string"
+                },
+                "value": {
+                    "type": "integer"
+                }
+            }
+        },
+        "core.TagStat": {
+            "type": "object",
+            "properties": {
+                "avgScore": {
+                    "type": "number"
+                },
+                "count": {
+                    "type": "integer"
+                },
+                "tag": {
+                    "type": "string"
+                },
+                "weight": {
+                    "type": "number"
+                }
+            }
+        },
+        "core.VideoMeta": {
+            "type": "object",
+            "properties": {
+                "audio_codec": {
+                    "type": "string"
+                },
+                "audio_tracks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.MediaTrack"
+                    }
+                },
+                "bit_rate": {
+                    "type": "integer"
+                },
+                "duration_sec": {
+                    "type": "number"
+                },
+                "format": {
+                    "type": "string"
+                },
+                "frame_rate": {
+                    "type": "number"
+                },
+                "hdr": {
+                    "type": "boolean"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "mod_time_unix_nano": {
+                    "type": "integer"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "rotation": {
+                    "type": "integer"
+                },
+                "schema": {
+                    "type": "integer"
+                },
+                "size_bytes": {
+                    "type": "integer"
+                },
+                "subtitle_tracks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.MediaTrack"
+                    }
+                },
+                "video_codec": {
+                    "type": "string"
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "core.VideoNode": {
+            "type": "object",
+            "properties": {
+                "caption": {
+                    "type": "string"
+                },
+                "duration_sec": {
+                    "type": "number"
+                },
+                "favorite": {
+                    "type": "boolean"
                 },
                 "height": {
                     "type": "integer"
                 },
-                "name": {
-                    "type": "string"
-                },
+                "meta_status": {
+                    "type": "string"
+                },
+                "mtime": {
+                    "description": "Unix seconds",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "rating": {
+                    "description": "0 (unrated) to MaxRating",
+                    "type": "integer"
+                },
+                "subtitles": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.SubtitleTrack"
+                    }
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/core.TagInfo"
+                    }
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.AuthInfo": {
+            "type": "object",
+            "properties": {
+                "admin": {
+                    "type": "boolean"
+                },
+                "libraries": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "mode": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "write": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "gallery.Collection": {
+            "type": "object",
+            "properties": {
+                "cover": {
+                    "type": "string"
+                },
+                "created": {
+                    "type": "integer"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/gallery.CollectionItem"
+                    }
+                },
+                "title": {
+                    "type": "string"
+                },
+                "updated": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.CollectionDetail": {
+            "type": "object",
+            "properties": {
+                "cover": {
+                    "type": "string"
+                },
+                "created": {
+                    "type": "integer"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/gallery.CollectionItem"
+                    }
+                },
+                "missing": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "title": {
+                    "type": "string"
+                },
+                "updated": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.CollectionInfo": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer"
+                },
+                "cover": {
+                    "$ref": "#/definitions/core.ImageNode"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "title": {
+                    "type": "string"
+                },
+                "updated": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.CollectionItem": {
+            "type": "object",
+            "properties": {
+                "mtime": {
+                    "type": "integer"
+                },
                 "path": {
                     "type": "string"
                 },
-                "tags": {
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.CollectionItemsRequest": {
+            "type": "object",
+            "required": [
+                "paths"
+            ],
+            "properties": {
+                "paths": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/core.TagInfo"
+                        "type": "string"
                     }
                 },
-                "width": {
+                "position": {
                     "type": "integer"
                 }
             }
         },
-        "core.MediaResponse": {
+        "gallery.CollectionRequest": {
             "type": "object",
             "properties": {
-                "images": {
+                "cover": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "items": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/core.ImageNode"
+                        "type": "string"
                     }
                 },
-                "videos": {
+                "title": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.DeleteRequest": {
+            "type": "object",
+            "required": [
+                "paths"
+            ],
+            "properties": {
+                "paths": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/core.VideoNode"
+                        "type": "string"
                     }
                 }
             }
         },
-        "core.Node": {
+        "gallery.DownloadRequest": {
             "type": "object",
+            "required": [
+                "paths"
+            ],
             "properties": {
                 "name": {
                     "type": "string"
                 },
-                "path": {
+                "paths": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "rendition": {
                     "type": "string"
                 }
             }
         },
-        "core.NodeWithParent": {
+        "gallery.DuplicateCluster": {
             "type": "object",
             "properties": {
-                "caption": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/gallery.DuplicateItem"
+                    }
+                },
+                "kind": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.DuplicateItem": {
+            "type": "object",
+            "properties": {
+                "content": {
                     "type": "string"
                 },
-                "height": {
+                "distance": {
                     "type": "integer"
                 },
-                "name": {
-                    "type": "string"
+                "height": {
+                    "type": "integer"
                 },
-                "parent": {
-                    "type": "string"
+                "mtime": {
+                    "type": "integer"
                 },
                 "path": {
                     "type": "string"
                 },
-                "tags": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/core.TagInfo"
-                    }
+                "size": {
+                    "type": "integer"
                 },
                 "width": {
                     "type": "integer"
                 }
             }
         },
-        "core.SimpleDirectory": {
+        "gallery.DuplicatesResponse": {
             "type": "object",
             "properties": {
-                "directories": {
+                "clusters": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/core.DirNode"
+                        "$ref": "#/definitions/gallery.DuplicateCluster"
                     }
                 },
+                "unhashed": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.Event": {
+            "type": "object",
+            "properties": {
+                "data": {},
+                "path": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.FileChange": {
+            "type": "object",
+            "properties": {
+                "from": {
+                    "type": "string"
+                },
+                "to": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.LibraryInfo": {
+            "type": "object",
+            "properties": {
+                "default": {
+                    "type": "boolean"
+                },
                 "images": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/core.ImageNode"
-                    }
+                    "type": "integer"
                 },
-                "others": {
-                    "type": "array",
-                    "items": {
-                        "$ref": "#/definitions/core.Node"
-                    }
+                "name": {
+                    "type": "string"
                 },
                 "videos": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.LoginRequest": {
+            "type": "object",
+            "required": [
+                "name",
+                "password"
+            ],
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.MarkRequest": {
+            "type": "object",
+            "properties": {
+                "favorite": {
+                    "type": "boolean"
+                },
+                "rating": {
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.MarkResponse": {
+            "type": "object",
+            "properties": {
+                "favorite": {
+                    "type": "boolean"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "rating": {
+                    "description": "0 (unrated) to MaxRating",
+                    "type": "integer"
+                }
+            }
+        },
+        "gallery.MoveRequest": {
+            "type": "object",
+            "required": [
+                "paths"
+            ],
+            "properties": {
+                "paths": {
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/core.VideoNode"
+                        "type": "string"
                     }
+                },
+                "to": {
+                    "type": "string"
                 }
             }
         },
-        "core.TagInfo": {
+        "gallery.RenameRequest": {
             "type": "object",
+            "required": [
+                "name",
+                "path"
+            ],
             "properties": {
-                "tag": {
+                "name": {
                     "type": "string"
                 },
-                "value": {
+                "path": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.ShareInfo": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "integer"
+                },
+                "created_by": {
+                    "type": "string"
+                },
+                "dir": {
+                    "type": "boolean"
+                },
+                "expired": {
+                    "type": "boolean"
+                },
+                "expires": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "library": {
+                    "type": "string"
+                },
+                "no_download": {
+                    "type": "boolean"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "protected": {
+                    "type": "boolean"
+                },
+                "token": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.ShareRequest": {
+            "type": "object",
+            "properties": {
+                "expires_in": {
+                    "description": "seconds, default DefaultShareLifetime",
                     "type": "integer"
+                },
+                "no_download": {
+                    "type": "boolean"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
                 }
             }
         },
-        "core.TagStat": {
+        "gallery.SharedInfo": {
             "type": "object",
             "properties": {
-                "avgScore": {
-                    "type": "number"
+                "dir": {
+                    "type": "boolean"
                 },
-                "count": {
+                "expires": {
                     "type": "integer"
                 },
-                "tag": {
+                "name": {
                     "type": "string"
                 },
-                "weight": {
-                    "type": "number"
+                "no_download": {
+                    "type": "boolean"
+                },
+                "protected": {
+                    "type": "boolean"
                 }
             }
         },
-        "core.VideoNode": {
+        "gallery.SimilarImage": {
             "type": "object",
             "properties": {
                 "caption": {
                     "type": "string"
                 },
-                "duration_sec": {
-                    "type": "number"
+                "distance": {
+                    "type": "integer"
+                },
+                "favorite": {
+                    "type": "boolean"
                 },
                 "height": {
                     "type": "integer"
                 },
+                "mtime": {
+                    "description": "Unix seconds",
+                    "type": "integer"
+                },
                 "name": {
                     "type": "string"
                 },
                 "path": {
                     "type": "string"
                 },
+                "rating": {
+                    "description": "0 (unrated) to MaxRating",
+                    "type": "integer"
+                },
+                "score": {
+                    "type": "number"
+                },
                 "tags": {
                     "type": "array",
                     "items": {
@@ -420,6 +2886,89 @@ const docTemplate = `{
                     "type": "integer"
                 }
             }
+        },
+        "gallery.SmartAlbumInfo": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer"
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "query": {
+                    "type": "string"
+                },
+                "sort": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.SmartAlbumRequest": {
+            "type": "object",
+            "properties": {
+                "limit": {
+                    "type": "integer"
+                },
+                "query": {
+                    "type": "string"
+                },
+                "sort": {
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.TrashEntry": {
+            "type": "object",
+            "properties": {
+                "deleted": {
+                    "description": "Unix seconds",
+                    "type": "integer"
+                },
+                "deleted_by": {
+                    "type": "string"
+                },
+                "dir": {
+                    "type": "boolean"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "path": {
+                    "description": "where it was",
+                    "type": "string"
+                }
+            }
+        },
+        "gallery.UploadedFile": {
+            "type": "object",
+            "properties": {
+                "height": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "renamed": {
+                    "description": "the requested name was taken",
+                    "type": "boolean"
+                },
+                "video": {
+                    "type": "boolean"
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
         }
     }
 }`
@@ -0,0 +1,26 @@
+package transcode
+
+import (
+	"gallery/common/storage"
+
+	"github.com/XGFan/go-utils"
+)
+
+// Containers, video and audio codecs that mainstream browsers play natively through <video>.
+// Matroska is excluded on purpose: ffprobe reports "matroska,webm" for both, so the
+// container is decided by file extension instead.
+var browserContainers = utils.NewSetWithSlice[string]([]string{"mp4", "m4v", "mov", "webm", "ogv", "ogg"})
+var browserVideoCodecs = utils.NewSetWithSlice[string]([]string{"h264", "vp8", "vp9", "av1", "theora"})
+var browserAudioCodecs = utils.NewSetWithSlice[string]([]string{"aac", "mp3", "opus", "vorbis", "flac"})
+
+// IsBrowserCompatible reports whether a video can be served as-is instead of through HLS.
+// An empty audio codec means the file has no audio stream.
+func IsBrowserCompatible(source string, videoCodec string, audioCodec string) bool {
+	if !browserContainers.Contains(storage.GetExt(source)) {
+		return false
+	}
+	if !browserVideoCodecs.Contains(videoCodec) {
+		return false
+	}
+	return audioCodec == "" || browserAudioCodecs.Contains(audioCodec)
+}
@@ -0,0 +1,348 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+const (
+	defaultSegmentSec    = 6.0
+	defaultMaxConcurrent = 2
+	defaultIdleTimeout   = 2 * time.Minute
+)
+
+const (
+	ModeDirect = "direct"
+	ModeHLS    = "hls"
+)
+
+var ErrSegmentOutOfRange = errors.New("segment out of range")
+
+type Options struct {
+	SegmentSec    float64
+	MaxConcurrent int
+	IdleTimeout   time.Duration
+}
+
+// Manager produces HLS playlists for videos and transcodes their segments on demand.
+// Segments are cached in CacheFs next to posters, so a segment is only encoded once.
+// A session per video tracks activity; sessions idle longer than IdleTimeout are
+// cancelled, which kills any ffmpeg process still running for them.
+type Manager struct {
+	OriginFs     storage.Storage
+	CacheFs      storage.Storage
+	GetVideoMeta func(path string) (core.VideoMeta, bool)
+	Toolchain    core.MediaToolchain
+	RunSegment   func(ctx context.Context, source string, args []string) error
+
+	segmentSec  float64
+	idleTimeout time.Duration
+	slots       chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	modes    map[string]string
+}
+
+type session struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lastAccess time.Time
+	inflight   map[int]chan struct{}
+}
+
+func NewManager(originFs storage.Storage, cacheFs storage.Storage, getVideoMeta func(path string) (core.VideoMeta, bool), options Options) *Manager {
+	segmentSec := options.SegmentSec
+	if segmentSec <= 0 {
+		segmentSec = defaultSegmentSec
+	}
+	maxConcurrent := options.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrent
+	}
+	idleTimeout := options.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	m := &Manager{
+		OriginFs:     originFs,
+		CacheFs:      cacheFs,
+		GetVideoMeta: getVideoMeta,
+		Toolchain:    core.DefaultToolchain(),
+		segmentSec:   segmentSec,
+		idleTimeout:  idleTimeout,
+		slots:        make(chan struct{}, maxConcurrent),
+		sessions:     make(map[string]*session),
+		modes:        make(map[string]string),
+	}
+	m.RunSegment = m.defaultRunSegment
+	return m
+}
+
+// Run starts the idle session reaper until ctx is done.
+func (m *Manager) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.idleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				m.reap(time.Time{})
+				return
+			case now := <-ticker.C:
+				m.reap(now.Add(-m.idleTimeout))
+			}
+		}
+	}()
+}
+
+// reap cancels sessions last accessed before deadline. A zero deadline cancels all sessions.
+func (m *Manager) reap(deadline time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for source, sess := range m.sessions {
+		if deadline.IsZero() || sess.lastAccess.Before(deadline) {
+			sess.cancel()
+			delete(m.sessions, source)
+			log.Printf("transcode session closed: %s", source)
+		}
+	}
+}
+
+// Mode decides whether a video is played directly or through HLS.
+func (m *Manager) Mode(source string) string {
+	m.mu.Lock()
+	mode, ok := m.modes[source]
+	m.mu.Unlock()
+	if ok {
+		return mode
+	}
+
+	// Without a transcoder HLS could never be served, so the browser gets its best shot at the original.
+	if !m.Toolchain.Capabilities().Transcode {
+		return ModeDirect
+	}
+
+	mode = ModeHLS
+	if meta, err := m.videoInfo(source); err != nil {
+		log.Printf("ffprobe codecs failed for %s: %s", source, err.Error())
+	} else if IsBrowserCompatible(source, meta.VideoCodec, meta.AudioCodec) {
+		mode = ModeDirect
+	}
+
+	m.mu.Lock()
+	m.modes[source] = mode
+	m.mu.Unlock()
+	return mode
+}
+
+// Playlist renders a VOD playlist whose segments are fetched relative to it.
+func (m *Manager) Playlist(source string) ([]byte, error) {
+	durationSec, err := m.durationSec(source)
+	if err != nil {
+		return nil, err
+	}
+	count := segmentCount(durationSec, m.segmentSec)
+
+	b := strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(m.segmentSec)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i := 0; i < count; i++ {
+		_, length := segmentRange(durationSec, m.segmentSec, i)
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", formatSec(length), SegmentName(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(b.String()), nil
+}
+
+// Segment returns the cache path of segment index, transcoding it first if needed.
+// Concurrent requests for the same segment share a single ffmpeg run.
+func (m *Manager) Segment(ctx context.Context, source string, index int) (string, error) {
+	cachePath := segmentCachePath(source, index)
+	if m.CacheFs.Exist(cachePath) {
+		m.touch(source)
+		return cachePath, nil
+	}
+
+	durationSec, err := m.durationSec(source)
+	if err != nil {
+		return "", err
+	}
+	if index < 0 || index >= segmentCount(durationSec, m.segmentSec) {
+		return "", ErrSegmentOutOfRange
+	}
+	// Sessions are opened for valid segments only, so bad requests leave none behind.
+	sess := m.session(source)
+
+	m.mu.Lock()
+	if done, ok := sess.inflight[index]; ok {
+		m.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if m.CacheFs.Exist(cachePath) {
+			return cachePath, nil
+		}
+		return "", fmt.Errorf("transcode failed: %s, segment %d", source, index)
+	}
+	done := make(chan struct{})
+	sess.inflight[index] = done
+	m.mu.Unlock()
+
+	err = m.transcode(ctx, sess, source, index, durationSec)
+
+	m.mu.Lock()
+	delete(sess.inflight, index)
+	close(done)
+	m.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+func (m *Manager) transcode(ctx context.Context, sess *session, source string, index int, durationSec float64) error {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sess.ctx.Done():
+		return sess.ctx.Err()
+	}
+	defer func() { <-m.slots }()
+
+	cachePath := segmentCachePath(source, index)
+	tmpPath := cachePath + ".tmp"
+	inputPath := m.OriginFs.Join(m.OriginFs.GetPath(), source)
+	outputPath := m.CacheFs.Join(m.CacheFs.GetPath(), tmpPath)
+	if err := storage.SafetyCreateDirectoryByFileName(outputPath); err != nil {
+		return fmt.Errorf("transcode cache mkdir failed: %s, err: %w", outputPath, err)
+	}
+
+	start, length := segmentRange(durationSec, m.segmentSec, index)
+	// The session context, not the request context, bounds ffmpeg: a client that
+	// drops a request mid-segment still gets the finished segment from cache later.
+	if err := m.RunSegment(sess.ctx, source, buildSegmentArgs(inputPath, outputPath, start, length)); err != nil {
+		_ = os.Remove(outputPath)
+		return err
+	}
+	return m.CacheFs.Rename(tmpPath, cachePath)
+}
+
+func (m *Manager) session(source string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[source]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		sess = &session{ctx: ctx, cancel: cancel, inflight: make(map[int]chan struct{})}
+		m.sessions[source] = sess
+	}
+	sess.lastAccess = time.Now()
+	return sess
+}
+
+// touch keeps the session of source, if any, from being reaped while cached segments play.
+func (m *Manager) touch(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sess, ok := m.sessions[source]; ok {
+		sess.lastAccess = time.Now()
+	}
+}
+
+// videoInfo prefers the scanner's cached metadata and only probes entries from older schemas.
+func (m *Manager) videoInfo(source string) (core.VideoMeta, error) {
+	if m.GetVideoMeta != nil {
+		if meta, ok := m.GetVideoMeta(source); ok && meta.Schema >= core.VideoMetaSchemaVersion {
+			return meta, nil
+		}
+	}
+	absPath := m.OriginFs.Join(m.OriginFs.GetPath(), source)
+	return m.Toolchain.Probe(context.Background(), absPath)
+}
+
+func (m *Manager) durationSec(source string) (float64, error) {
+	if m.GetVideoMeta != nil {
+		if meta, ok := m.GetVideoMeta(source); ok && meta.DurationSec > 0 {
+			return meta.DurationSec, nil
+		}
+	}
+	meta, err := m.videoInfo(source)
+	if err != nil {
+		return 0, fmt.Errorf("transcode duration probe failed: %s, err: %w", source, err)
+	}
+	if meta.DurationSec <= 0 {
+		return 0, fmt.Errorf("transcode duration probe failed: %s, invalid duration", source)
+	}
+	return meta.DurationSec, nil
+}
+
+func (m *Manager) defaultRunSegment(ctx context.Context, source string, args []string) error {
+	if err := m.Toolchain.Transcode(ctx, args); err != nil {
+		return fmt.Errorf("transcode failed: %s, err: %w", source, err)
+	}
+	return nil
+}
+
+func buildSegmentArgs(inputPath string, outputPath string, startSec float64, lengthSec float64) []string {
+	return []string{
+		"-ss", formatSec(startSec), "-t", formatSec(lengthSec), "-i", inputPath,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-ac", "2", "-b:a", "128k",
+		"-output_ts_offset", formatSec(startSec),
+		"-f", "mpegts", "-y", outputPath,
+	}
+}
+
+// SegmentName is the playlist entry for segment index.
+func SegmentName(index int) string {
+	return fmt.Sprintf("seg_%05d.ts", index)
+}
+
+// ParseSegmentName is the inverse of SegmentName.
+func ParseSegmentName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "seg_") || !strings.HasSuffix(name, ".ts") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg_"), ".ts"))
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+func segmentCachePath(source string, index int) string {
+	return source + ".hls/" + SegmentName(index)
+}
+
+func segmentCount(durationSec float64, segmentSec float64) int {
+	return int(math.Ceil(durationSec / segmentSec))
+}
+
+func segmentRange(durationSec float64, segmentSec float64, index int) (float64, float64) {
+	start := float64(index) * segmentSec
+	return start, math.Min(segmentSec, durationSec-start)
+}
+
+func formatSec(sec float64) string {
+	return strconv.FormatFloat(sec, 'f', 3, 64)
+}
@@ -0,0 +1,222 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func newTestManager(t *testing.T, durationSec float64, options Options) (*Manager, string) {
+	t.Helper()
+	originDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(originDir, "clip.mkv"), []byte("video"), 0o644); err != nil {
+		t.Fatalf("write video: %v", err)
+	}
+	cacheDir := t.TempDir()
+	m := NewManager(storage.NewFs(originDir), storage.NewFs(cacheDir), func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{DurationSec: durationSec}, true
+	}, options)
+	return m, cacheDir
+}
+
+func TestIsBrowserCompatible(t *testing.T) {
+	tests := []struct {
+		source string
+		video  string
+		audio  string
+		expect bool
+	}{
+		{"a.mp4", "h264", "aac", true},
+		{"a.webm", "vp9", "opus", true},
+		{"a.mp4", "h264", "", true},
+		{"a.mkv", "h264", "aac", false},
+		{"a.mp4", "hevc", "aac", false},
+		{"a.mp4", "h264", "ac3", false},
+		{"a.avi", "mpeg4", "mp3", false},
+	}
+	for _, tt := range tests {
+		if got := IsBrowserCompatible(tt.source, tt.video, tt.audio); got != tt.expect {
+			t.Fatalf("%s %s/%s: expect %v, got %v", tt.source, tt.video, tt.audio, tt.expect, got)
+		}
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	m, _ := newTestManager(t, 13, Options{SegmentSec: 6})
+	playlist, err := m.Playlist("clip.mkv")
+	if err != nil {
+		t.Fatalf("playlist: %v", err)
+	}
+	text := string(playlist)
+	for _, want := range []string{"#EXT-X-TARGETDURATION:6", "#EXTINF:6.000,\nseg_00000.ts", "#EXTINF:1.000,\nseg_00002.ts", "#EXT-X-ENDLIST"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("playlist missing %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "seg_00003.ts") {
+		t.Fatalf("unexpected extra segment:\n%s", text)
+	}
+}
+
+func TestSegmentNameRoundTrip(t *testing.T) {
+	index, ok := ParseSegmentName(SegmentName(42))
+	if !ok || index != 42 {
+		t.Fatalf("expect 42, got %d %v", index, ok)
+	}
+	if _, ok := ParseSegmentName("index.m3u8"); ok {
+		t.Fatalf("expect playlist name rejected")
+	}
+}
+
+func TestSegmentTranscodesOnceAndCaches(t *testing.T) {
+	m, cacheDir := newTestManager(t, 30, Options{SegmentSec: 6})
+	var runs int32
+	m.RunSegment = func(ctx context.Context, source string, args []string) error {
+		atomic.AddInt32(&runs, 1)
+		time.Sleep(20 * time.Millisecond)
+		return os.WriteFile(args[len(args)-1], []byte("ts"), 0o644)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Segment(context.Background(), "clip.mkv", 1); err != nil {
+				t.Errorf("segment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&runs); got != 1 {
+		t.Fatalf("expect a single transcode, got %d", got)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "clip.mkv.hls", "seg_00001.ts")); err != nil {
+		t.Fatalf("expect cached segment: %v", err)
+	}
+
+	if _, err := m.Segment(context.Background(), "clip.mkv", 1); err != nil {
+		t.Fatalf("segment: %v", err)
+	}
+	if got := atomic.LoadInt32(&runs); got != 1 {
+		t.Fatalf("expect cache hit, got %d runs", got)
+	}
+	if _, err := m.Segment(context.Background(), "clip.mkv", 5); !errors.Is(err, ErrSegmentOutOfRange) {
+		t.Fatalf("expect out of range, got %v", err)
+	}
+}
+
+func TestSegmentOutOfRangeOpensNoSession(t *testing.T) {
+	m, _ := newTestManager(t, 30, Options{SegmentSec: 6})
+	m.RunSegment = func(ctx context.Context, source string, args []string) error {
+		t.Fatalf("unexpected transcode %v", args)
+		return nil
+	}
+	for _, index := range []int{-1, 5, 1000} {
+		if _, err := m.Segment(context.Background(), "clip.mkv", index); !errors.Is(err, ErrSegmentOutOfRange) {
+			t.Fatalf("segment %d: expect out of range, got %v", index, err)
+		}
+	}
+	m.GetVideoMeta = func(path string) (core.VideoMeta, bool) { return core.VideoMeta{}, false }
+	if _, err := m.Segment(context.Background(), "missing.mkv", 0); err == nil {
+		t.Fatalf("expect an unknown duration rejected")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sessions) != 0 {
+		t.Fatalf("expect no session for rejected segments, got %d", len(m.sessions))
+	}
+}
+
+func TestSegmentConcurrencyCap(t *testing.T) {
+	m, _ := newTestManager(t, 60, Options{SegmentSec: 6, MaxConcurrent: 1})
+	var active, peak int32
+	m.RunSegment = func(ctx context.Context, source string, args []string) error {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return os.WriteFile(args[len(args)-1], []byte("ts"), 0o644)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			_, _ = m.Segment(context.Background(), "clip.mkv", index)
+		}(i)
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&peak); got != 1 {
+		t.Fatalf("expect at most 1 concurrent transcode, got %d", got)
+	}
+}
+
+func TestReapKillsIdleSession(t *testing.T) {
+	m, _ := newTestManager(t, 30, Options{SegmentSec: 6})
+	started := make(chan struct{})
+	m.RunSegment = func(ctx context.Context, source string, args []string) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := m.Segment(context.Background(), "clip.mkv", 0)
+		errCh <- err
+	}()
+	<-started
+	m.reap(time.Now().Add(time.Second))
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle session was not killed")
+	}
+}
+
+func TestModeWithoutTranscoder(t *testing.T) {
+	m, _ := newTestManager(t, 10, Options{})
+	toolchain := core.NewFakeToolchain()
+	toolchain.Caps.Transcode = false
+	m.Toolchain = toolchain
+	if mode := m.Mode("clip.mkv"); mode != ModeDirect {
+		t.Fatalf("expect direct play without a transcoder, got %s", mode)
+	}
+}
+
+func TestSegmentUsesToolchain(t *testing.T) {
+	m, cacheDir := newTestManager(t, 10, Options{SegmentSec: 6})
+	toolchain := core.NewFakeToolchain()
+	m.Toolchain = toolchain
+	if _, err := m.Segment(context.Background(), "clip.mkv", 1); err != nil {
+		t.Fatalf("segment: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(cacheDir, "clip.mkv.hls", SegmentName(1)))
+	if err != nil || !strings.HasPrefix(string(data), "transcode ") {
+		t.Fatalf("expect fake transcode output, got %q %v", data, err)
+	}
+	if calls := toolchain.Calls(); len(calls) != 1 {
+		t.Fatalf("expect one transcode call, got %v", calls)
+	}
+}
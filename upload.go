@@ -0,0 +1,601 @@
+package gallery
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+// Conflict policies of an upload whose name is taken in the target folder.
+const (
+	ConflictReject = "reject"
+	ConflictRename = "rename"
+)
+
+// EventUploaded is published when an uploaded file joins the tree.
+const EventUploaded = "uploaded"
+
+// UploadLifetime is how long an unfinished resumable upload is kept after its last write.
+const UploadLifetime = 24 * time.Hour
+
+// uploadsDir holds unfinished uploads inside the cache directory.
+const uploadsDir = "uploads"
+
+const tusVersion = "1.0.0"
+
+// UploadedFile is a file placed by an upload.
+type UploadedFile struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Video   bool   `json:"video,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Renamed bool   `json:"renamed,omitempty"` // the requested name was taken
+}
+
+// pendingUpload is a resumable upload still receiving data.
+type pendingUpload struct {
+	mu       sync.Mutex // held while a PATCH writes
+	id       string
+	dir      string
+	name     string
+	conflict string
+	owner    string
+	length   int64
+	offset   int64
+	expires  time.Time
+}
+
+// uploadStore keeps unfinished uploads as temporary files in the cache directory. Resumable
+// uploads live in memory, so a restart forgets them; their leftovers are removed by
+// prune-cache.
+type uploadStore struct {
+	mu      sync.Mutex
+	cacheFs storage.Storage
+	pending map[string]*pendingUpload
+}
+
+func newUploadStore(cacheFs storage.Storage) *uploadStore {
+	return &uploadStore{cacheFs: cacheFs, pending: make(map[string]*pendingUpload)}
+}
+
+func newUploadID() string {
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// tempName returns the cache path of the data of upload id.
+func tempName(id string) string {
+	return path.Join(uploadsDir, id+".tmp")
+}
+
+func (st *uploadStore) tempPath(id string) string {
+	return st.cacheFs.Join(st.cacheFs.GetPath(), tempName(id))
+}
+
+func (st *uploadStore) discard(id string) {
+	_ = os.Remove(st.tempPath(id))
+}
+
+// add registers a resumable upload and creates its empty temporary file. Expired uploads
+// are dropped on the way.
+func (st *uploadStore) add(up *pendingUpload) error {
+	f, err := st.cacheFs.Create(tempName(up.id))
+	if err != nil {
+		return err
+	}
+	f.Close()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for id, other := range st.pending {
+		if now.After(other.expires) {
+			delete(st.pending, id)
+			st.discard(id)
+		}
+	}
+	st.pending[up.id] = up
+	return nil
+}
+
+// get returns the unexpired upload id of owner.
+func (st *uploadStore) get(id, owner string) (*pendingUpload, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	up, ok := st.pending[id]
+	if !ok || up.owner != owner {
+		return nil, false
+	}
+	if time.Now().After(up.expires) {
+		delete(st.pending, id)
+		st.discard(id)
+		return nil, false
+	}
+	return up, true
+}
+
+func (st *uploadStore) remove(id string) {
+	st.mu.Lock()
+	delete(st.pending, id)
+	st.mu.Unlock()
+	st.discard(id)
+}
+
+// receive stores r as the data of a new single-request upload and returns its id. With a
+// limit above 0 it stops one byte past it and answers errExcluded instead.
+func (st *uploadStore) receive(r io.Reader, limit int64) (string, error) {
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	id := newUploadID()
+	f, err := st.cacheFs.Create(tempName(id))
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && n > limit {
+		err = fmt.Errorf("%w: %s", errExcluded, core.ExcludedBySize)
+	}
+	if err != nil {
+		st.discard(id)
+		return "", err
+	}
+	return id, nil
+}
+
+func userName(u *user) string {
+	if u == nil {
+		return ""
+	}
+	return u.name
+}
+
+// checkUploadName validates the name of an uploaded file: a plain file name with the
+// extension of an image or video.
+func (g *Gallery) checkUploadName(c *gin.Context, dir, name string, size int64) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w: %q", errBadName, name)
+	}
+	if !storage.IsValidPic(name) && !storage.IsValidVideo(name) {
+		return fmt.Errorf("%w: %q", errNotMedia, name)
+	}
+	target := path.Join(dir, name)
+	if !currentUser(c).canRead(target) {
+		return fmt.Errorf("%w: %q", errNoFolder, dir)
+	}
+	if exclusion := g.scanner.ExplainNew(target, false, size); exclusion.Excluded {
+		return fmt.Errorf("%w: %s", errExcluded, exclusion.Reason)
+	}
+	return nil
+}
+
+// sniffMedia checks that the content of an upload matches its extension. Images must decode;
+// videos must not look like a document, an image or an archive. It returns the dimensions of
+// an image.
+func sniffMedia(f io.ReadSeeker, name string) (int, int, error) {
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	kind := http.DetectContentType(head[:n])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	if storage.IsValidPic(name) {
+		if !strings.HasPrefix(kind, "image/") {
+			return 0, 0, fmt.Errorf("%w: %s is %s", errNotMedia, name, kind)
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+			return 0, 0, fmt.Errorf("%w: %s cannot be decoded", errNotMedia, name)
+		}
+		return cfg.Width, cfg.Height, nil
+	}
+	// Most video containers are not sniffed by net/http and come out as octet-stream.
+	switch {
+	case strings.HasPrefix(kind, "video/"), strings.HasPrefix(kind, "audio/"),
+		kind == "application/ogg", kind == "application/octet-stream":
+		return 0, 0, nil
+	}
+	return 0, 0, fmt.Errorf("%w: %s is %s", errNotMedia, name, kind)
+}
+
+// place checks the finished upload id and moves it to dir/name of the library, then adds it
+// to the tree and notifies subscribers. The temporary file is gone afterwards either way.
+func (g *Gallery) place(c *gin.Context, id, dir, name, conflict string) (UploadedFile, error) {
+	st := g.uploads
+	defer st.discard(id)
+	f, err := os.Open(st.tempPath(id))
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	if err := g.checkUploadName(c, dir, name, info.Size()); err != nil {
+		return UploadedFile{}, err
+	}
+	width, height, err := sniffMedia(f, name)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return UploadedFile{}, err
+	}
+
+	g.filesMu.Lock()
+	target, err := g.freeName(dir, name, conflict)
+	if err == nil {
+		err = g.scanner.OriginFs.Save(target, io.NopCloser(f))
+	}
+	g.filesMu.Unlock()
+	if err != nil {
+		return UploadedFile{}, err
+	}
+
+	item := core.ScanItem{Type: core.ItemImage, Path: target, Name: path.Base(target), Width: width, Height: height}
+	if storage.IsValidVideo(name) {
+		item.Type = core.ItemVideo
+	}
+	if placed, err := g.scanner.OriginFs.Open(target); err == nil {
+		if info, err := placed.Stat(); err == nil {
+			item.ModTime = info.ModTime().Unix()
+		}
+		placed.Close()
+	}
+	item, _ = g.scanner.Insert(g.Root, item)
+	select {
+	case g.albumsChanged <- struct{}{}:
+	default:
+	}
+	uploaded := UploadedFile{
+		Path:    item.Path,
+		Name:    item.Name,
+		Video:   item.Type == core.ItemVideo,
+		Width:   item.Width,
+		Height:  item.Height,
+		Renamed: item.Name != name,
+	}
+	g.events.Publish(Event{Type: EventUploaded, Path: item.Path, Data: uploaded})
+	return uploaded, nil
+}
+
+// freeName returns the path an upload of name is written to: dir/name, or with conflict
+// rename the first "name (n).ext" not taken.
+func (g *Gallery) freeName(dir, name, conflict string) (string, error) {
+	target := path.Join(dir, name)
+	if !g.scanner.OriginFs.Exist(target) {
+		return target, nil
+	}
+	if conflict != ConflictRename {
+		return "", fmt.Errorf("%w: %q", errNameTaken, target)
+	}
+	ext := path.Ext(name)
+	for i := 2; ; i++ {
+		target = path.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+		if !g.scanner.OriginFs.Exist(target) {
+			return target, nil
+		}
+	}
+}
+
+func validConflict(c *gin.Context, conflict string) (string, bool) {
+	switch conflict {
+	case "", ConflictReject:
+		return ConflictReject, true
+	case ConflictRename:
+		return conflict, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("conflict must be %s or %s", ConflictReject, ConflictRename)})
+	return "", false
+}
+
+// HandleUpload godoc
+// @Summary Upload files
+// @Description Stores the files of a multipart form into a folder and adds them to the tree right away. Every part named "file" is one upload; files are checked one by one and the request stops at the first rejected one, reporting the files stored before it
+// @Tags upload
+// @Accept multipart/form-data
+// @Produce json
+// @Param name path string true "Target folder"
+// @Param conflict query string false "reject (default) answers 409 when a name is taken, rename stores the file as \"name (2).ext\""
+// @Param file formData file true "Images and videos"
+// @Success 201 {array} UploadedFile
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 415 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/upload/{name} [post]
+func (g *Gallery) HandleUpload(c *gin.Context) {
+	conflict, ok := validConflict(c, c.Query("conflict"))
+	if !ok {
+		return
+	}
+	dir, err := g.targetFolder(c, c.Param("name"))
+	if err != nil {
+		c.JSON(fileStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uploaded := make([]UploadedFile, 0)
+	fail := func(status int, err error) {
+		c.JSON(status, gin.H{"error": err.Error(), "uploaded": uploaded})
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, err)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		name := part.FileName()
+		// Names are checked before the data is read, so a wrong file costs no transfer.
+		if err := g.checkUploadName(c, dir, name, 0); err != nil {
+			fail(fileStatus(err), err)
+			return
+		}
+		id, err := g.uploads.receive(part, g.scanner.MaxFileSize())
+		if errors.Is(err, errExcluded) {
+			fail(fileStatus(err), err)
+			return
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, err)
+			return
+		}
+		file, err := g.place(c, id, dir, name, conflict)
+		if err != nil {
+			fail(fileStatus(err), err)
+			return
+		}
+		uploaded = append(uploaded, file)
+	}
+	if len(uploaded) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `no "file" part`})
+		return
+	}
+	c.JSON(http.StatusCreated, uploaded)
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma separated keys, each
+// followed by a base64 value.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %w", key, err)
+		}
+		result[key] = string(decoded)
+	}
+	return result, nil
+}
+
+// tusHeaders announces the protocol and checks the version the client speaks.
+func tusHeaders(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+	if version := c.GetHeader("Tus-Resumable"); version != "" && version != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// HandleCreateUpload godoc
+// @Summary Start a resumable upload
+// @Description Creates a tus 1.0 upload. Upload-Metadata carries filename, folder (default: the library root) and conflict (reject or rename). The name is checked now, so a taken name or a file type that is not accepted fails before any data is sent; the data follows with PATCH on the returned Location
+// @Tags upload
+// @Param Upload-Length header int true "Size of the file in bytes"
+// @Param Upload-Metadata header string true "filename, folder and conflict, base64 encoded"
+// @Success 201
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 415 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /api/uploads [post]
+func (g *Gallery) HandleCreateUpload(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a positive size"})
+		return
+	}
+	meta, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	conflict, ok := validConflict(c, meta["conflict"])
+	if !ok {
+		return
+	}
+	dir, err := g.targetFolder(c, meta["folder"])
+	if err == nil {
+		err = g.checkUploadName(c, dir, meta["filename"], length)
+	}
+	if err == nil && conflict == ConflictReject && g.scanner.OriginFs.Exist(path.Join(dir, meta["filename"])) {
+		err = fmt.Errorf("%w: %q", errNameTaken, path.Join(dir, meta["filename"]))
+	}
+	if err != nil {
+		c.JSON(fileStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	up := &pendingUpload{
+		id:       newUploadID(),
+		dir:      dir,
+		name:     meta["filename"],
+		conflict: conflict,
+		owner:    userName(currentUser(c)),
+		length:   length,
+		expires:  time.Now().Add(UploadLifetime),
+	}
+	if err := g.uploads.add(up); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+up.id)
+	c.Header("Upload-Expires", up.expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// HandleUploadOffset godoc
+// @Summary Resumable upload progress
+// @Description Reports in Upload-Offset how many bytes of a resumable upload the server has
+// @Tags upload
+// @Param id path string true "Upload ID"
+// @Success 200
+// @Failure 404
+// @Router /api/uploads/{id} [head]
+func (g *Gallery) HandleUploadOffset(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	up, ok := g.uploads.get(c.Param("id"), userName(currentUser(c)))
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	c.Header("Upload-Offset", strconv.FormatInt(up.offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(up.length, 10))
+	c.Status(http.StatusOK)
+}
+
+// HandleUploadChunk godoc
+// @Summary Send data of a resumable upload
+// @Description Appends the body at Upload-Offset, which must match the offset of the server. A connection cut midway keeps what arrived. The request completing the file places it in the folder and adds it to the tree; if the file is rejected then, the upload is gone and the error is returned
+// @Tags upload
+// @Accept application/offset+octet-stream
+// @Param id path string true "Upload ID"
+// @Param Upload-Offset header int true "Offset the body starts at"
+// @Success 204
+// @Failure 404
+// @Failure 409 {object} map[string]interface{}
+// @Failure 415 {object} map[string]interface{}
+// @Failure 423
+// @Router /api/uploads/{id} [patch]
+func (g *Gallery) HandleUploadChunk(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	up, ok := g.uploads.get(c.Param("id"), userName(currentUser(c)))
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !up.mu.TryLock() {
+		c.AbortWithStatus(http.StatusLocked)
+		return
+	}
+	defer up.mu.Unlock()
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != up.offset {
+		c.Header("Upload-Offset", strconv.FormatInt(up.offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match"})
+		return
+	}
+	f, err := os.OpenFile(g.uploads.tempPath(up.id), os.O_WRONLY, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = f.Seek(up.offset, io.SeekStart)
+	var written int64
+	if err == nil {
+		written, err = io.Copy(f, io.LimitReader(c.Request.Body, up.length-up.offset))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	up.offset += written
+	up.expires = time.Now().Add(UploadLifetime)
+	c.Header("Upload-Offset", strconv.FormatInt(up.offset, 10))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if up.offset < up.length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	g.uploads.mu.Lock()
+	delete(g.uploads.pending, up.id)
+	g.uploads.mu.Unlock()
+	file, err := g.place(c, up.id, up.dir, up.name, up.conflict)
+	if err != nil {
+		c.JSON(fileStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Upload-Path", file.Path)
+	c.Status(http.StatusNoContent)
+}
+
+// HandleCancelUpload godoc
+// @Summary Cancel a resumable upload
+// @Description Drops a resumable upload and the data received so far
+// @Tags upload
+// @Param id path string true "Upload ID"
+// @Success 204
+// @Failure 404
+// @Router /api/uploads/{id} [delete]
+func (g *Gallery) HandleCancelUpload(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	up, ok := g.uploads.get(c.Param("id"), userName(currentUser(c)))
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !up.mu.TryLock() {
+		c.AbortWithStatus(http.StatusLocked)
+		return
+	}
+	defer up.mu.Unlock()
+	g.uploads.remove(up.id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"gallery/common/storage"
+	"gallery/core"
+)
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUpload_MultipartAndResumable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	l.gallery.uploads = newUploadStore(storage.NewFs(t.TempDir()))
+	l.gallery.albumsChanged = make(chan struct{}, 1)
+	libs := &libraries{anonymousWrite: true}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+	data := testJPEG(t)
+
+	upload := func(target string, files map[string][]byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, content := range files {
+			part, _ := mw.CreateFormFile("file", name)
+			part.Write(content)
+		}
+		mw.Close()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, target, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	w := upload("/api/upload/x", map[string][]byte{"b.jpg": data})
+	var files []UploadedFile
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("upload: status %d %s", w.Code, w.Body)
+	}
+	if len(files) != 1 || files[0].Path != "x/b.jpg" || files[0].Width != 40 {
+		t.Fatalf("unexpected result %+v", files)
+	}
+	if img, ok := l.gallery.Root.FindImage("x/b.jpg"); !ok || img.Height != 30 {
+		t.Fatalf("expected the upload in the tree without a scan, got %+v", img)
+	}
+	if _, ok := l.gallery.Root.FindImage("x/a.jpg"); !ok {
+		t.Fatalf("expected the siblings kept")
+	}
+
+	if w := upload("/api/upload/x", map[string][]byte{"a.jpg": data}); w.Code != http.StatusConflict {
+		t.Fatalf("expected a taken name rejected, got %d", w.Code)
+	}
+	w = upload("/api/upload/x?conflict=rename", map[string][]byte{"a.jpg": data})
+	if err := json.Unmarshal(w.Body.Bytes(), &files); err != nil || len(files) != 1 || files[0].Path != "x/a (2).jpg" || !files[0].Renamed {
+		t.Fatalf("expected a renamed upload, got %d %s", w.Code, w.Body)
+	}
+	for name, content := range map[string][]byte{"notes.txt": []byte("hello"), "fake.jpg": []byte("hello"), ".hidden.jpg": data} {
+		if w := upload("/api/upload/x", map[string][]byte{name: content}); w.Code == http.StatusCreated {
+			t.Fatalf("expected %s rejected, got %d", name, w.Code)
+		}
+	}
+	if w := upload("/api/upload/nope", map[string][]byte{"c.jpg": data}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a missing folder rejected, got %d", w.Code)
+	}
+
+	do := func(method, target string, body []byte, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	w = do(http.MethodPost, "/api/uploads", nil,
+		"Upload-Length", strconv.Itoa(len(data)),
+		"Upload-Metadata", "filename "+b64([]byte("c.jpg"))+",folder "+b64([]byte("x")))
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || location == "" {
+		t.Fatalf("create: status %d %s", w.Code, w.Body)
+	}
+	chunk := func(offset int, part []byte) *httptest.ResponseRecorder {
+		return do(http.MethodPatch, location, part, "Content-Type", "application/offset+octet-stream", "Upload-Offset", strconv.Itoa(offset))
+	}
+	if w := chunk(0, data[:100]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "100" {
+		t.Fatalf("first chunk: status %d offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := chunk(50, data[50:]); w.Code != http.StatusConflict {
+		t.Fatalf("expected a wrong offset rejected, got %d", w.Code)
+	}
+	if w := do(http.MethodHead, location, nil); w.Header().Get("Upload-Offset") != "100" {
+		t.Fatalf("expected offset 100, got %q", w.Header().Get("Upload-Offset"))
+	}
+	if _, ok := l.gallery.Root.FindImage("x/c.jpg"); ok {
+		t.Fatalf("expected an unfinished upload kept out of the tree")
+	}
+	if w := chunk(100, data[100:]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Path") != "x/c.jpg" {
+		t.Fatalf("last chunk: status %d %s", w.Code, w.Body)
+	}
+	if _, ok := l.gallery.Root.FindImage("x/c.jpg"); !ok {
+		t.Fatalf("expected the finished upload in the tree")
+	}
+	if w := do(http.MethodHead, location, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a finished upload gone, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/uploads", nil, "Upload-Length", "10", "Upload-Metadata", "filename "+b64([]byte("a.jpg"))+",folder "+b64([]byte("x"))); w.Code != http.StatusConflict {
+		t.Fatalf("expected a taken name rejected before any data, got %d", w.Code)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestUpload_MultipartStopsAtMaxFileSize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newTestLibrary(t, "default", "x/a.jpg")
+	uploadsDir := t.TempDir()
+	l.gallery.uploads = newUploadStore(storage.NewFs(uploadsDir))
+	l.gallery.albumsChanged = make(chan struct{}, 1)
+	l.gallery.scanner.SetFilter(core.ScanFilter{MaxFileSize: 1 << 10})
+	libs := &libraries{anonymousWrite: true}
+	libs.add(l)
+	engine := gin.New()
+	libs.register(engine)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "big.jpg")
+	part.Write(append(testJPEG(t), make([]byte, 4<<20)...))
+	mw.Close()
+	total := body.Len()
+	counted := &countingReader{r: &body}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/x", counted)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	engine.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a file over max_file_size rejected, got %d %s", w.Code, w.Body)
+	}
+	if counted.n > 1<<20 {
+		t.Fatalf("expected reading to stop at the limit, read %d of %d bytes", counted.n, total)
+	}
+	if _, err := os.Stat(filepath.Join(l.gallery.scanner.OriginFs.GetPath(), "x", "big.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing stored, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(uploadsDir, "uploads")); len(entries) != 0 {
+		t.Fatalf("expected the partial data discarded, got %v", entries)
+	}
+}
@@ -2,14 +2,15 @@ package gallery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	utils "github.com/XGFan/go-utils"
 	"github.com/gin-gonic/gin"
@@ -17,18 +18,49 @@ import (
 	"gallery/common/storage"
 	"gallery/core"
 	"gallery/thumbnail"
+	"gallery/transcode"
 )
 
 // StaticImageResolver handles image file serving and thumbnail generation
 type StaticImageResolver struct {
-	OriginFs      storage.Storage
-	CacheFs       storage.Storage
-	Tasks         chan thumbnail.Task
-	PosterQueue   core.PosterEnqueuer
-	OriginAdapter http.FileSystem
-	ThumbAdapter  http.FileSystem
-	VideoAdapter  http.FileSystem
-	PosterAdapter http.FileSystem
+	OriginFs     storage.Storage
+	CacheFs      storage.Storage
+	Tasks        chan thumbnail.Task
+	PosterQueue  core.PosterEnqueuer
+	PreviewQueue core.PosterEnqueuer
+	Transcoder   *transcode.Manager
+	Toolchain    core.MediaToolchain
+
+	posterGenerator *posterGenerator
+	getVideoMeta    func(path string) (core.VideoMeta, bool)
+	findVideo       func(path string) (core.VideoNode, bool)
+	OriginAdapter   http.FileSystem
+	ThumbAdapter    http.FileSystem
+	CachedThumbs    http.FileSystem // thumbnails only, never the original
+	VideoAdapter    http.FileSystem
+	PosterAdapter   http.FileSystem
+
+	runSubtitleConvert func(ctx context.Context, source string, args []string) error
+
+	forceThumbMu sync.RWMutex
+	forceThumb   utils.PrefixMatcher
+}
+
+// SetForceThumbnail replaces the path prefixes whose originals are served as thumbnails.
+func (sir *StaticImageResolver) SetForceThumbnail(prefixes []string) {
+	pm := make(utils.PrefixMatcher)
+	for _, p := range prefixes {
+		pm.Add(p)
+	}
+	sir.forceThumbMu.Lock()
+	sir.forceThumb = pm
+	sir.forceThumbMu.Unlock()
+}
+
+func (sir *StaticImageResolver) isForceThumbnail(source string) bool {
+	sir.forceThumbMu.RLock()
+	defer sir.forceThumbMu.RUnlock()
+	return sir.forceThumb.Match(source)
 }
 
 func (sir *StaticImageResolver) Worker(ctx context.Context) {
@@ -43,19 +75,25 @@ func (sir *StaticImageResolver) AddThumbTask(src string) {
 	}
 }
 
+// TryThumbTask queues the thumbnail of src unless the queue is full; a later miss asks again.
+func (sir *StaticImageResolver) TryThumbTask(src string) {
+	select {
+	case sir.Tasks <- thumbnail.Task{Source: src}:
+	default:
+	}
+}
+
 func NewStaticImageResolver(baseFs storage.Storage,
 	cacheFs storage.Storage,
 	forceThumb []string,
 	ctx context.Context) *StaticImageResolver {
 	sir := &StaticImageResolver{
-		OriginFs: baseFs,
-		CacheFs:  cacheFs,
-		Tasks:    make(chan thumbnail.Task, 30),
-	}
-	pm := make(utils.PrefixMatcher)
-	for _, p := range forceThumb {
-		pm.Add(p)
+		OriginFs:  baseFs,
+		CacheFs:   cacheFs,
+		Tasks:     make(chan thumbnail.Task, 30),
+		Toolchain: core.DefaultToolchain(),
 	}
+	sir.SetForceThumbnail(forceThumb)
 
 	go sir.Worker(ctx)
 	sir.ThumbAdapter = FsFunc(func(name string) (http.File, error) {
@@ -73,12 +111,26 @@ func NewStaticImageResolver(baseFs storage.Storage,
 		}
 	})
 
+	// CachedThumbs stands in for the original where it must not be handed out; a missing
+	// thumbnail is queued and reported as not existing yet.
+	sir.CachedThumbs = FsFunc(func(name string) (http.File, error) {
+		source := CleanUrlPath(name)
+		if !storage.IsValidPic(source) {
+			return nil, os.ErrNotExist
+		}
+		f, err := cacheFs.Open(source)
+		if os.IsNotExist(err) {
+			sir.TryThumbTask(source)
+		}
+		return f, err
+	})
+
 	sir.OriginAdapter = FsFunc(func(name string) (http.File, error) {
 		source := CleanUrlPath(name)
 		if !storage.IsValidPic(source) {
 			return nil, os.ErrNotExist
 		}
-		if pm.Match(source) {
+		if sir.isForceThumbnail(source) {
 			return sir.ThumbAdapter.Open(name)
 		}
 		return sir.OriginFs.Open(source)
@@ -103,16 +155,31 @@ func NewStaticImageResolver(baseFs storage.Storage,
 	return sir
 }
 
+// Poster frame selection strategies for the first generation attempt
+const (
+	PosterStrategyThumbnail = "thumbnail"
+	PosterStrategyScene     = "scene"
+	PosterStrategyOffset    = "offset"
+)
+
+const defaultPosterSceneThreshold = 0.3
+
 type posterGenerator struct {
 	originFs         storage.Storage
 	cacheFs          storage.Storage
 	getVideoMeta     func(path string) (core.VideoMeta, bool)
-	probeVideoMeta   func(absPath string) (int, int, float64, error)
+	toolchain        core.MediaToolchain
 	runPosterAttempt func(ctx context.Context, source string, args []string, label string) error
+	strategy         string
+	sceneThreshold   float64
+}
+
+func posterCachePath(videoPath string) string {
+	return videoPath + ".poster.jpg"
 }
 
 func newPosterGenerator(originFs storage.Storage, cacheFs storage.Storage, getVideoMeta func(path string) (core.VideoMeta, bool)) *posterGenerator {
-	pg := &posterGenerator{originFs: originFs, cacheFs: cacheFs, getVideoMeta: getVideoMeta, probeVideoMeta: core.ProbeVideoMeta}
+	pg := &posterGenerator{originFs: originFs, cacheFs: cacheFs, getVideoMeta: getVideoMeta, toolchain: core.DefaultToolchain()}
 	pg.runPosterAttempt = pg.defaultRunPosterAttempt
 	return pg
 }
@@ -125,7 +192,7 @@ func (pg *posterGenerator) Generate(ctx context.Context, source string) error {
 		return nil
 	}
 
-	cachePath := source + ".poster.jpg"
+	cachePath := posterCachePath(source)
 	if pg.cacheFs.Exist(cachePath) {
 		return nil
 	}
@@ -140,7 +207,12 @@ func (pg *posterGenerator) Generate(ctx context.Context, source string) error {
 	if runner == nil {
 		runner = pg.defaultRunPosterAttempt
 	}
-	if err := runner(ctx, source, buildPosterAttemptArgs(inputPath, outputPath), "generate"); err != nil {
+	err := pg.runFirstAttempt(ctx, runner, source, inputPath, outputPath)
+	// The scene filter may select no frame at all; ffmpeg then exits cleanly without output.
+	if err == nil && pg.strategy == PosterStrategyScene && !pg.cacheFs.Exist(cachePath) {
+		err = fmt.Errorf("poster scene found no frame: %s", source)
+	}
+	if err != nil {
 		durationSec, durationErr := pg.getDurationSec(source)
 		if durationErr != nil {
 			return durationErr
@@ -157,10 +229,58 @@ func (pg *posterGenerator) Generate(ctx context.Context, source string) error {
 	return nil
 }
 
+// runFirstAttempt picks the representative frame according to the configured strategy.
+// The offset strategy has no first attempt and goes straight to the duration-based fallback.
+func (pg *posterGenerator) runFirstAttempt(ctx context.Context, runner func(ctx context.Context, source string, args []string, label string) error, source string, inputPath string, outputPath string) error {
+	switch pg.strategy {
+	case PosterStrategyOffset:
+		return fmt.Errorf("poster strategy offset: %s", source)
+	case PosterStrategyScene:
+		threshold := pg.sceneThreshold
+		if threshold <= 0 {
+			threshold = defaultPosterSceneThreshold
+		}
+		return runner(ctx, source, buildScenePosterArgs(inputPath, outputPath, threshold), "scene")
+	default:
+		return runner(ctx, source, buildPosterAttemptArgs(inputPath, outputPath), "generate")
+	}
+}
+
+// GenerateAt replaces the cached poster with the frame at offsetSec.
+// The new poster is written under a temporary name and renamed over the old one.
+func (pg *posterGenerator) GenerateAt(ctx context.Context, source string, offsetSec float64) error {
+	if pg == nil || pg.originFs == nil || pg.cacheFs == nil {
+		return fmt.Errorf("poster generator not configured")
+	}
+	if offsetSec < 0 {
+		return fmt.Errorf("poster offset must not be negative: %.3f", offsetSec)
+	}
+	if durationSec, err := pg.getDurationSec(source); err == nil && offsetSec > durationSec {
+		return fmt.Errorf("poster offset %.3f exceeds duration %.3f", offsetSec, durationSec)
+	}
+
+	cachePath := posterCachePath(source)
+	tmpPath := cachePath + ".tmp.jpg"
+	inputPath := pg.originFs.Join(pg.originFs.GetPath(), source)
+	outputPath := pg.cacheFs.Join(pg.cacheFs.GetPath(), tmpPath)
+	if err := storage.SafetyCreateDirectoryByFileName(outputPath); err != nil {
+		return fmt.Errorf("poster cache mkdir failed: %s, err: %w", outputPath, err)
+	}
+
+	runner := pg.runPosterAttempt
+	if runner == nil {
+		runner = pg.defaultRunPosterAttempt
+	}
+	if err := runner(ctx, source, buildPosterAttemptWithOffsetArgs(inputPath, outputPath, offsetSec), "manual"); err != nil {
+		_ = os.Remove(outputPath)
+		return err
+	}
+	return pg.cacheFs.Rename(tmpPath, cachePath)
+}
+
 func (pg *posterGenerator) defaultRunPosterAttempt(ctx context.Context, source string, args []string, label string) error {
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("poster %s failed: %s, err: %w, output: %s", label, source, err, strings.TrimSpace(string(output)))
+	if err := pg.toolchain.ExtractFrame(ctx, args); err != nil {
+		return fmt.Errorf("poster %s failed: %s, err: %w", label, source, err)
 	}
 	return nil
 }
@@ -174,14 +294,11 @@ func (pg *posterGenerator) getDurationSec(source string) (float64, error) {
 		}
 	}
 	inputPath := pg.originFs.Join(pg.originFs.GetPath(), source)
-	probe := pg.probeVideoMeta
-	if probe == nil {
-		probe = core.ProbeVideoMeta
-	}
-	_, _, durationSec, err := probe(inputPath)
+	meta, err := pg.toolchain.Probe(context.Background(), inputPath)
 	if err != nil {
 		return 0, fmt.Errorf("poster duration probe failed: %s, err: %w", source, err)
 	}
+	durationSec := meta.DurationSec
 	if durationSec <= 0 {
 		return 0, fmt.Errorf("poster duration probe failed: %s, invalid duration", source)
 	}
@@ -194,6 +311,11 @@ func buildPosterAttemptArgs(inputPath string, outputPath string) []string {
 	return []string{"-i", inputPath, "-vf", posterFilter, "-pix_fmt", "yuvj420p", "-vframes", "1", "-q:v", "2", "-y", outputPath}
 }
 
+func buildScenePosterArgs(inputPath string, outputPath string, threshold float64) []string {
+	filter := "select='gt(scene," + strconv.FormatFloat(threshold, 'f', 2, 64) + ")',scale=1280:-1,format=yuvj420p"
+	return []string{"-i", inputPath, "-vf", filter, "-pix_fmt", "yuvj420p", "-vframes", "1", "-q:v", "2", "-y", outputPath}
+}
+
 func buildPosterAttemptWithOffsetArgs(inputPath string, outputPath string, offsetSec float64) []string {
 	return []string{"-ss", formatPosterOffsetSec(offsetSec), "-i", inputPath, "-vf", posterFilter, "-pix_fmt", "yuvj420p", "-vframes", "1", "-q:v", "2", "-y", outputPath}
 }
@@ -221,7 +343,15 @@ func calcPosterOffsetSec(durationSec float64) (float64, bool) {
 
 var posterCoverCandidates = []string{"cover.jpg", "cover.jpeg", "cover.png", "cover.webp"}
 
+// openPosterFile resolves the poster of a video: a per-video sidecar next to it wins over
+// the folder-wide cover, which wins over the generated poster in the cache.
 func (sir *StaticImageResolver) openPosterFile(source string) (http.File, error) {
+	if f, err := sir.OriginFs.Open(core.PosterSidecarPath(source)); err == nil {
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	parentDir := path.Dir(source)
 	for _, candidate := range posterCoverCandidates {
 		coverPath := path.Join(parentDir, candidate)
@@ -235,7 +365,7 @@ func (sir *StaticImageResolver) openPosterFile(source string) (http.File, error)
 		}
 	}
 
-	cachePath := source + ".poster.jpg"
+	cachePath := posterCachePath(source)
 	if f, err := sir.CacheFs.Open(cachePath); err == nil {
 		return f, nil
 	} else if !os.IsNotExist(err) {
@@ -281,14 +411,72 @@ func (sir *StaticImageResolver) HandlePoster(c *gin.Context) {
 		log.Printf("poster open failed: %s, err: %v", source, err)
 	}
 
+	// Without ffmpeg nothing will ever be generated, so the placeholder is final.
+	if !sir.Toolchain.Capabilities().ExtractFrame {
+		servePosterPlaceholder(c, "unavailable")
+		return
+	}
 	if sir.PosterQueue != nil {
 		sir.PosterQueue.Enqueue(source)
 	}
-	servePosterPlaceholder(c)
+	servePosterPlaceholder(c, "pending")
 }
 
-func servePosterPlaceholder(c *gin.Context) {
-	c.Header("X-Poster-Status", "pending")
+// HandleSetPoster godoc
+// @Summary Regenerate a video poster at a timestamp
+// @Description Replaces the generated poster of a video with the frame at t seconds. A <video>.poster.jpg sidecar or folder cover still takes precedence when serving.
+// @Tags media
+// @Produce json
+// @Param name path string true "Video path"
+// @Param t query number true "Timestamp in seconds"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/poster/{name} [post]
+func (sir *StaticImageResolver) HandleSetPoster(c *gin.Context) {
+	source := CleanUrlPath(c.Param("name"))
+	if !storage.IsValidVideo(source) || !sir.OriginFs.Exist(source) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	offsetSec, err := strconv.ParseFloat(c.Query("t"), 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid t"})
+		return
+	}
+	if sir.posterGenerator == nil {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	if err := sir.posterGenerator.GenerateAt(c.Request.Context(), source, offsetSec); err != nil {
+		if errors.Is(err, core.ErrToolUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("poster regenerate failed: %s, err: %v", source, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"path":     source,
+		"offset":   offsetSec,
+		"shadowed": sir.posterShadowed(source),
+	})
+}
+
+// posterShadowed reports whether a sidecar or folder cover hides the generated poster.
+func (sir *StaticImageResolver) posterShadowed(source string) bool {
+	if sir.OriginFs.Exist(core.PosterSidecarPath(source)) {
+		return true
+	}
+	for _, candidate := range posterCoverCandidates {
+		if sir.OriginFs.Exist(path.Join(path.Dir(source), candidate)) {
+			return true
+		}
+	}
+	return false
+}
+
+func servePosterPlaceholder(c *gin.Context, status string) {
+	c.Header("X-Poster-Status", status)
 	c.Header("Cache-Control", "no-store")
 	c.Data(http.StatusOK, "image/svg+xml; charset=utf-8", []byte(posterPlaceholderSVG))
 }
@@ -307,3 +495,25 @@ func CleanUrlPath(name string) string {
 	}
 	return name
 }
+
+// hasParentRef reports whether a URL path has a ".." segment, which could step out of the
+// folder it is checked against.
+func hasParentRef(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// knownVideo reports whether source is a video of the scanned tree. The file systems do not
+// keep paths inside the library, so handlers that run ffmpeg or read next to a video check
+// this first.
+func (sir *StaticImageResolver) knownVideo(source string) bool {
+	if sir.findVideo == nil || hasParentRef(source) {
+		return false
+	}
+	_, ok := sir.findVideo(source)
+	return ok
+}
@@ -3,6 +3,7 @@ package gallery
 import (
 	"context"
 	"errors"
+	"os"
 	"strings"
 	"testing"
 
@@ -94,9 +95,9 @@ func TestPosterGenerateDurationMissing(t *testing.T) {
 	pg := newPosterGenerator(originFs, cacheFs, func(path string) (core.VideoMeta, bool) {
 		return core.VideoMeta{}, false
 	})
-	pg.probeVideoMeta = func(absPath string) (int, int, float64, error) {
-		return 0, 0, 0, errors.New("probe failed")
-	}
+	toolchain := core.NewFakeToolchain()
+	toolchain.Caps.Probe = false
+	pg.toolchain = toolchain
 	pg.runPosterAttempt = func(ctx context.Context, source string, args []string, label string) error {
 		return errors.New("ffmpeg failed")
 	}
@@ -128,3 +129,89 @@ func assertArgPair(t *testing.T, args []string, flag string, value string) {
 	}
 	t.Fatalf("missing arg pair %s %s", flag, value)
 }
+
+func TestPosterStrategy(t *testing.T) {
+	tests := []struct {
+		strategy    string
+		expectLabel []string
+	}{
+		{strategy: PosterStrategyThumbnail, expectLabel: []string{"generate", "fallback"}},
+		{strategy: PosterStrategyScene, expectLabel: []string{"scene", "fallback"}},
+		{strategy: PosterStrategyOffset, expectLabel: []string{"fallback"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			pg := newPosterGenerator(storage.NewFs(t.TempDir()), storage.NewFs(t.TempDir()), func(path string) (core.VideoMeta, bool) {
+				return core.VideoMeta{DurationSec: 120}, true
+			})
+			pg.strategy = tt.strategy
+			var labels []string
+			pg.runPosterAttempt = func(ctx context.Context, source string, args []string, label string) error {
+				labels = append(labels, label)
+				if label == "scene" {
+					assertArgPair(t, args, "-vf", "select='gt(scene,0.30)',scale=1280:-1,format=yuvj420p")
+				}
+				if label != "fallback" {
+					return errors.New("no frame")
+				}
+				return nil
+			}
+			if err := pg.Generate(context.Background(), "video.mp4"); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			if strings.Join(labels, ",") != strings.Join(tt.expectLabel, ",") {
+				t.Fatalf("expect attempts %v, got %v", tt.expectLabel, labels)
+			}
+		})
+	}
+}
+
+func TestPosterSceneWithoutOutputFallsBack(t *testing.T) {
+	cacheFs := storage.NewFs(t.TempDir())
+	pg := newPosterGenerator(storage.NewFs(t.TempDir()), cacheFs, func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{DurationSec: 120}, true
+	})
+	pg.strategy = PosterStrategyScene
+	var labels []string
+	pg.runPosterAttempt = func(ctx context.Context, source string, args []string, label string) error {
+		labels = append(labels, label)
+		if label == "scene" {
+			return nil // ffmpeg exits cleanly when no frame passes the scene filter
+		}
+		return os.WriteFile(args[len(args)-1], []byte("fallback"), 0o644)
+	}
+
+	if err := pg.Generate(context.Background(), "video.mp4"); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if strings.Join(labels, ",") != "scene,fallback" {
+		t.Fatalf("expect the offset fallback after an empty scene attempt, got %v", labels)
+	}
+	if data, err := cacheFs.Read("video.mp4.poster.jpg"); err != nil || string(data) != "fallback" {
+		t.Fatalf("expect fallback poster cached, got %q %v", data, err)
+	}
+}
+
+func TestPosterGenerateAt(t *testing.T) {
+	cacheDir := t.TempDir()
+	cacheFs := storage.NewFs(cacheDir)
+	pg := newPosterGenerator(storage.NewFs(t.TempDir()), cacheFs, func(path string) (core.VideoMeta, bool) {
+		return core.VideoMeta{DurationSec: 60}, true
+	})
+	pg.runPosterAttempt = func(ctx context.Context, source string, args []string, label string) error {
+		assertArgPair(t, args, "-ss", formatPosterOffsetSec(12.5))
+		return os.WriteFile(args[len(args)-1], []byte("manual"), 0o644)
+	}
+
+	if err := pg.GenerateAt(context.Background(), "video.mp4", 12.5); err != nil {
+		t.Fatalf("generate at: %v", err)
+	}
+	data, err := cacheFs.Read("video.mp4.poster.jpg")
+	if err != nil || string(data) != "manual" {
+		t.Fatalf("expect manual poster cached, got %q %v", data, err)
+	}
+	if err := pg.GenerateAt(context.Background(), "video.mp4", 90); err == nil {
+		t.Fatalf("expect offset beyond duration rejected")
+	}
+}
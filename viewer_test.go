@@ -12,6 +12,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"gallery/common/storage"
+	"gallery/core"
 )
 
 type mockPosterQueue struct {
@@ -33,6 +34,7 @@ func TestPosterHandler_Pending_ReturnsPlaceholderAndHeader(t *testing.T) {
 	resolver := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(cacheDir), nil, context.Background())
 	queue := &mockPosterQueue{}
 	resolver.PosterQueue = queue
+	resolver.Toolchain = core.NewFakeToolchain()
 
 	r := gin.New()
 	r.GET("/poster/*name", resolver.HandlePoster)
@@ -80,6 +82,7 @@ func TestPosterHandler_Ready_ReturnsRealPosterAndHeader(t *testing.T) {
 	resolver := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(cacheDir), nil, context.Background())
 	queue := &mockPosterQueue{}
 	resolver.PosterQueue = queue
+	resolver.Toolchain = core.NewFakeToolchain()
 
 	r := gin.New()
 	r.GET("/poster/*name", resolver.HandlePoster)
@@ -104,3 +107,56 @@ func TestPosterHandler_Ready_ReturnsRealPosterAndHeader(t *testing.T) {
 		t.Fatalf("expected no enqueue for ready poster, got %d", queue.Count())
 	}
 }
+
+func TestPosterHandler_SidecarOverridesCover(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	originDir := t.TempDir()
+	videosDir := filepath.Join(originDir, "videos")
+	if err := os.MkdirAll(videosDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(videosDir, "cover.jpg"), []byte("cover"), 0o644); err != nil {
+		t.Fatalf("write cover: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(videosDir, "clip.mp4.poster.jpg"), []byte("sidecar"), 0o644); err != nil {
+		t.Fatalf("write sidecar: %v", err)
+	}
+
+	resolver := NewStaticImageResolver(storage.NewFs(originDir), storage.NewFs(t.TempDir()), nil, context.Background())
+	r := gin.New()
+	r.GET("/poster/*name", resolver.HandlePoster)
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/poster/videos/clip.mp4", nil))
+	if got := resp.Body.String(); got != "sidecar" {
+		t.Fatalf("expected sidecar poster, got %q", got)
+	}
+
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/poster/videos/other.mp4", nil))
+	if got := resp.Body.String(); got != "cover" {
+		t.Fatalf("expected folder cover for other video, got %q", got)
+	}
+}
+
+func TestPosterHandler_NoFFmpeg_ServesFinalPlaceholder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resolver := NewStaticImageResolver(storage.NewFs(t.TempDir()), storage.NewFs(t.TempDir()), nil, context.Background())
+	queue := &mockPosterQueue{}
+	resolver.PosterQueue = queue
+	toolchain := core.NewFakeToolchain()
+	toolchain.Caps = core.ToolchainCapabilities{}
+	resolver.Toolchain = toolchain
+
+	r := gin.New()
+	r.GET("/poster/*name", resolver.HandlePoster)
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/poster/videos/clip.mp4", nil))
+	if got := resp.Header().Get("X-Poster-Status"); got != "unavailable" {
+		t.Fatalf("expected unavailable status header, got %q", got)
+	}
+	if queue.Count() != 0 {
+		t.Fatalf("expected no enqueue without ffmpeg, got %d", queue.Count())
+	}
+}
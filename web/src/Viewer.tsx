@@ -12,9 +12,10 @@ import { Modal } from "./components/ui/Modal";
 import { Slider } from "./components/ui/Slider";
 import { GalleryItem } from "./components/GalleryItem";
 import VerticalPlayer from "./components/VerticalPlayer";
-import { buildSwipeSequence, getMixedMode } from "./utils";
+import { buildSwipeSequence, customEncodeURI, getMixedMode } from "./utils";
 import { usePinchZoom, clamp } from "./hooks/usePinchZoom";
 import { useIsMobile } from "./hooks/useIsMobile";
+import { useVideoMetaEvents } from "./hooks/useVideoMetaEvents";
 import { useScrollIntent } from "./hooks/useScrollIntent";
 import { averageAspect, calColumns, columnsToRowHeight, getColumnLimits } from "./gridLayout";
 
@@ -52,6 +53,24 @@ export default function Viewer() {
   const [album, setAlbum] = useState(fullAlbum.subAlbum(DEFAULT_PAGE_SIZE))
   const [showConfig, setShowConfig] = useState(false)
   const [showCounter, setShowCounter] = useState(true)
+  // Videos listed before their metadata was probed are patched in place: the
+  // items are shared between fullAlbum and the current page, so later pages
+  // pick the update up too; copying the page array re-lays out the grid.
+  useVideoMetaEvents(useCallback((video) => {
+    const key = customEncodeURI(video.path);
+    const item = fullAlbum.images.find(it => it.key === key);
+    if (!item) {
+      return;
+    }
+    item.metaStatus = video.meta_status;
+    if (video.width && video.height) {
+      item.width = video.width;
+      item.height = video.height;
+      item.durationSec = video.duration_sec;
+    }
+    setAlbum(prev => new Album(prev.mode, prev.path, [...prev.images]));
+  }, [fullAlbum]));
+
   const isMobile = useIsMobile();
   const scroll = useScrollIntent();
   // Mobile: the counter is mutually exclusive with the bottom nav bar — it only
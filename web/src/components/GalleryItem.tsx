@@ -1,4 +1,4 @@
-import { memo } from "react";
+import { memo, useState } from "react";
 import { FolderOpen, Play, Video } from "lucide-react";
 import { ImgData } from "../dto";
 
@@ -22,6 +22,9 @@ interface GalleryItemProps {
 export const GalleryItem = memo(function GalleryItem({ item, size, onClick }: GalleryItemProps) {
     const isVideo = item.imageType === 'video';
     const isPlayable = isVideo && item.playable !== false;
+    const [hovered, setHovered] = useState(false);
+    const [previewFailed, setPreviewFailed] = useState(false);
+    const showPreview = isVideo && hovered && !previewFailed && !!item.previewSrc;
 
     const handleClick = () => {
         onClick();
@@ -54,6 +57,8 @@ export const GalleryItem = memo(function GalleryItem({ item, size, onClick }: Ga
             data-testid={isVideo ? 'gallery-video-item' : undefined}
             aria-label={getAriaLabel()}
             onKeyDown={handleKeyDown}
+            onMouseEnter={() => setHovered(true)}
+            onMouseLeave={() => setHovered(false)}
         >
             {/* Simple container with subtle interactions */}
             <div className="rounded-lg overflow-hidden bg-white/[0.02] hover:bg-white/[0.05] transition-colors duration-200 w-full h-full relative">
@@ -63,6 +68,17 @@ export const GalleryItem = memo(function GalleryItem({ item, size, onClick }: Ga
                     className="w-full h-full object-cover"
                     loading="lazy"
                 />
+                {showPreview && (
+                    <video
+                        src={item.previewSrc}
+                        className="absolute inset-0 w-full h-full object-cover pointer-events-none"
+                        muted
+                        loop
+                        autoPlay
+                        playsInline
+                        onError={() => setPreviewFailed(true)}
+                    />
+                )}
 
             {/* Video Overlay */}
             {isVideo && (
@@ -0,0 +1,32 @@
+import { useEffect, useRef } from "react";
+import type { VideoNode } from "../types";
+
+// Subscribes to the server's `video_meta` events, which arrive when a video
+// listed as `meta_status: pending` has been probed in the background.
+// jsdom has no EventSource, so the hook is a no-op under tests.
+export function useVideoMetaEvents(onUpdate: (video: VideoNode) => void): void {
+  const handler = useRef(onUpdate);
+  handler.current = onUpdate;
+
+  useEffect(() => {
+    if (typeof window === "undefined" || typeof window.EventSource !== "function") {
+      return;
+    }
+    const source = new EventSource("/api/events");
+    const handleMeta = (e: MessageEvent) => {
+      try {
+        const event = JSON.parse(e.data) as { data?: VideoNode };
+        if (event.data) {
+          handler.current(event.data);
+        }
+      } catch (err) {
+        console.log("bad video_meta event", err);
+      }
+    };
+    source.addEventListener("video_meta", handleMeta);
+    return () => {
+      source.removeEventListener("video_meta", handleMeta);
+      source.close();
+    };
+  }, []);
+}
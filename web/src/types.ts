@@ -7,7 +7,9 @@ export interface ImgData {
   height: number
   durationSec?: number
   videoSrc?: string
+  previewSrc?: string
   playable?: boolean
+  metaStatus?: string
 }
 
 export interface Node {
@@ -24,6 +26,7 @@ export interface VideoNode extends Node {
   width: number
   height: number
   duration_sec?: number
+  meta_status?: 'pending' | 'failed' | 'unavailable'
 }
 
 export interface DirNode extends Node {
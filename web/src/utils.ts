@@ -82,26 +82,31 @@ const mapVideoNode = (it: VideoNode): ImgData => ({
   key: customEncodeURI(it.path),
   src: customEncodeURI('/poster/' + it.path),
   videoSrc: customEncodeURI('/video/' + it.path),
+  previewSrc: customEncodeURI('/preview/' + it.path),
   imageType: "video",
   name: it.name,
-  width: it.width,
-  height: it.height,
+  // Videos the server could not probe have no dimensions; lay them out as 16:9.
+  width: it.width || 16,
+  height: it.height || 9,
   durationSec: it.duration_sec,
+  metaStatus: it.meta_status,
   playable: isVideoPlayable(it.path)
 });
 
 const mapDirNode = (it: DirNode): ImgData | null => {
-  if (it.cover.height == undefined || it.cover.width == undefined) {
+  const videoCover = !!it.cover.path && isVideoPath(it.cover.path)
+  // A video cover may still be waiting for background probing; show it as 16:9 meanwhile.
+  if (!videoCover && (it.cover.height == undefined || it.cover.width == undefined)) {
     console.log("error: ", it)
     return null
   }
   return {
     key: customEncodeURI(it.path),
-    src: customEncodeURI((isVideoPath(it.cover.path) ? '/poster/' : '/thumbnail/') + it.cover.path),
+    src: customEncodeURI((videoCover ? '/poster/' : '/thumbnail/') + it.cover.path),
     imageType: "directory",
     name: it.name,
-    width: it.cover.width,
-    height: it.cover.height
+    width: it.cover.width || 16,
+    height: it.cover.height || 9
   }
 };
 